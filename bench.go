@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxBenchBytes caps one /bench/download.
+const maxBenchBytes = 10 << 30
+
+// benchBlock is what /bench/download repeats. It's random so that nothing
+// on the way (a proxy, a VPN) can compress it and flatter the numbers.
+var benchBlock = func() []byte {
+	b := make([]byte, 64<<10)
+	rand.NewChaCha8([32]byte{}).Read(b)
+	return b
+}()
+
+// benchDownloadHandler streams ?bytes= of data (suffixes K, M and G are
+// powers of 1024). With bytes=0 it's an empty round trip, which is how the
+// bench client measures latency.
+func benchDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	n, err := parseSize(r.URL.Query().Get("bytes"))
+	if err != nil || n > maxBenchBytes {
+		http.Error(w, fmt.Sprintf("bytes must be a size up to %d, e.g. 100M", maxBenchBytes), http.StatusBadRequest)
+		return
+	}
+	streaming(w)
+	hn, _ := os.Hostname()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.Header().Set("X-Hostname", hn)
+	for n > 0 {
+		chunk := benchBlock[:min(n, int64(len(benchBlock)))]
+		if _, err := w.Write(chunk); err != nil {
+			return
+		}
+		n -= int64(len(chunk))
+	}
+}
+
+// BenchUpload is the answer to a /bench/upload.
+type BenchUpload struct {
+	Hostname string  `json:"hostname"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	// BitsPerSecond is measured from the first byte of the body to the
+	// last, as the server saw them.
+	BitsPerSecond float64 `json:"bits_per_second"`
+}
+
+// benchUploadHandler reads and throws away a POSTed body of any size and
+// says how fast it arrived.
+func benchUploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	streaming(w)
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	elapsed := time.Since(start)
+	hn, _ := os.Hostname()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BenchUpload{
+		Hostname:      hn,
+		Bytes:         n,
+		Seconds:       elapsed.Seconds(),
+		BitsPerSecond: bitsPerSecond(n, elapsed),
+	})
+}
+
+// parseSize reads a byte count such as 1500, 64K, 100M or 1G.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"), strings.HasSuffix(s, "k"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"), strings.HasSuffix(s, "m"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"), strings.HasSuffix(s, "g"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("size %q is too big", s)
+	}
+	return n * mult, nil
+}
+
+func bitsPerSecond(n int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(n) * 8 / d.Seconds()
+}
+
+// formatBits renders a rate the way iperf does: 941 Mbit/s.
+func formatBits(bps float64) string {
+	for _, u := range []string{"bit/s", "Kbit/s", "Mbit/s", "Gbit/s"} {
+		if bps < 1000 || u == "Gbit/s" {
+			return fmt.Sprintf("%.3g %s", bps, u)
+		}
+		bps /= 1000
+	}
+	return ""
+}
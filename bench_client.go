@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchResult is what the bench command measured.
+type BenchResult struct {
+	Addr     string `json:"addr"`
+	Hostname string `json:"hostname"`
+
+	Pings int `json:"pings"`
+	// Round-trip times in milliseconds.
+	RTTMin    float64 `json:"rtt_min_ms"`
+	RTTAvg    float64 `json:"rtt_avg_ms"`
+	RTTMax    float64 `json:"rtt_max_ms"`
+	RTTJitter float64 `json:"rtt_jitter_ms"`
+
+	Bytes            int64   `json:"bytes"`
+	DownloadSeconds  float64 `json:"download_seconds"`
+	DownloadBits     float64 `json:"download_bits_per_second"`
+	UploadSeconds    float64 `json:"upload_seconds"`
+	UploadBits       float64 `json:"upload_bits_per_second"`
+	UploadServerBits float64 `json:"upload_server_bits_per_second"`
+}
+
+// benchCmd is iperf for a cluster that only has this image: it measures
+// round-trip time, jitter, and download and upload throughput against one
+// server. Every request rides one keep-alive connection, so behind a Service
+// all of them reach the same pod. Point it at pod IPs to compare a pod on
+// the same node with one across nodes:
+//
+//	learn-k8s bench -addr 10.244.1.7:8080 -bytes 200M
+func benchCmd(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:8080", "server address")
+	size := fs.String("bytes", "100M", "bytes to download and then upload (K, M and G suffixes)")
+	pings := fs.Int("pings", 20, "round trips for the latency measurement")
+	interval := fs.Duration("interval", 50*time.Millisecond, "pause between pings")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	n, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+	base := "http://" + *addr
+	client := &http.Client{}
+	res := BenchResult{Addr: *addr, Bytes: n, Pings: *pings}
+
+	// latency: empty downloads, after one to open the connection
+	var rtts []time.Duration
+	for i := 0; i <= *pings; i++ {
+		start := time.Now()
+		hn, err := benchGet(client, base+"/bench/download?bytes=0")
+		if err != nil {
+			return err
+		}
+		res.Hostname = hn
+		if i > 0 {
+			rtts = append(rtts, time.Since(start))
+			time.Sleep(*interval)
+		}
+	}
+	lo, avg, hi, jitter := rttStats(rtts)
+	res.RTTMin, res.RTTAvg, res.RTTMax, res.RTTJitter = ms(lo), ms(avg), ms(hi), ms(jitter)
+
+	start := time.Now()
+	if _, err := benchGet(client, fmt.Sprintf("%s/bench/download?bytes=%d", base, n)); err != nil {
+		return err
+	}
+	d := time.Since(start)
+	res.DownloadSeconds, res.DownloadBits = d.Seconds(), bitsPerSecond(n, d)
+
+	start = time.Now()
+	body := io.LimitReader(benchReader{}, n)
+	req, err := http.NewRequest(http.MethodPost, base+"/bench/upload", body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = n
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	var up BenchUpload
+	err = json.NewDecoder(resp.Body).Decode(&up)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("/bench/upload: %s: %w", resp.Status, err)
+	}
+	d = time.Since(start)
+	res.UploadSeconds, res.UploadBits, res.UploadServerBits = d.Seconds(), bitsPerSecond(n, d), up.BitsPerSecond
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "server\t%s (%s)\n", res.Addr, res.Hostname)
+	fmt.Fprintf(tw, "rtt\tmin %.3fms  avg %.3fms  max %.3fms  jitter %.3fms  (%d pings)\n",
+		res.RTTMin, res.RTTAvg, res.RTTMax, res.RTTJitter, res.Pings)
+	fmt.Fprintf(tw, "download\t%d bytes in %.2fs  %s\n", n, res.DownloadSeconds, formatBits(res.DownloadBits))
+	fmt.Fprintf(tw, "upload\t%d bytes in %.2fs  %s  (server saw %s)\n", n, res.UploadSeconds, formatBits(res.UploadBits), formatBits(res.UploadServerBits))
+	return tw.Flush()
+}
+
+// benchGet GETs url, reads the body to the end so the connection can be
+// reused, and returns the pod that answered.
+func benchGet(client *http.Client, url string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Hostname"), nil
+}
+
+// rttStats returns the minimum, mean and maximum of rtts, and the jitter:
+// the mean difference between consecutive samples.
+func rttStats(rtts []time.Duration) (lo, avg, hi, jitter time.Duration) {
+	if len(rtts) == 0 {
+		return
+	}
+	lo, hi = rtts[0], rtts[0]
+	var sum, diffs time.Duration
+	for i, d := range rtts {
+		lo, hi = min(lo, d), max(hi, d)
+		sum += d
+		if i > 0 {
+			diffs += (d - rtts[i-1]).Abs()
+		}
+	}
+	avg = sum / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		jitter = diffs / time.Duration(len(rtts)-1)
+	}
+	return
+}
+
+func ms(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+
+// benchReader is an endless supply of benchBlock.
+type benchReader struct{}
+
+func (benchReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		n += copy(p[n:], benchBlock)
+	}
+	return n, nil
+}
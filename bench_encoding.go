@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// benchEncodingCmd compares the encodings the root handler can produce:
+// how big the payload is and how long it takes to encode and decode.
+//
+//	learn-k8s bench-encoding -n 200000
+func benchEncodingCmd(args []string) error {
+	fs := flag.NewFlagSet("bench-encoding", flag.ExitOnError)
+	n := fs.Int("n", 100000, "iterations per encoding")
+	fs.Parse(args)
+
+	hn, _ := os.Hostname()
+	resp := Response{TimeStamp: time.Now(), Hostname: hn}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ENCODING\tBYTES\tENCODE/OP\tDECODE/OP")
+	for _, ct := range []string{contentTypeJSON, contentTypeProto, contentTypeMsgpack} {
+		payload, err := encodeResponse(ct, resp)
+		if err != nil {
+			return err
+		}
+
+		start := time.Now()
+		for i := 0; i < *n; i++ {
+			encodeResponse(ct, resp)
+		}
+		enc := time.Since(start) / time.Duration(*n)
+
+		start = time.Now()
+		for i := 0; i < *n; i++ {
+			if _, err := decodeResponse(ct, payload); err != nil {
+				return fmt.Errorf("%s: %w", ct, err)
+			}
+		}
+		dec := time.Since(start) / time.Duration(*n)
+
+		fmt.Fprintf(tw, "%s\t%d\t%v\t%v\n", ct, len(payload), enc, dec)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int64
+		wantErr bool
+	}{
+		{in: "1500", want: 1500},
+		{in: "64K", want: 64 << 10},
+		{in: "100m", want: 100 << 20},
+		{in: "1G", want: 1 << 30},
+		{in: "0", want: 0},
+		{in: "8589934591G", want: 8589934591 << 30},
+		// one more and n * mult wraps around
+		{in: "8589934592G", wantErr: true},
+		{in: "9223372036854775807K", wantErr: true},
+		{in: "9223372036854775808", wantErr: true},
+		{in: "-1K", wantErr: true},
+		{in: "G", wantErr: true},
+		{in: "1.5M", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseSize(tt.in)
+		switch {
+		case tt.wantErr && err == nil:
+			t.Errorf("parseSize(%q) = %d, want an error", tt.in, got)
+		case !tt.wantErr && (err != nil || got != tt.want):
+			t.Errorf("parseSize(%q) = %d, %v; want %d", tt.in, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,491 @@
+// Package bgp is a small BGP-4 speaker (RFC 4271): enough to peer with
+// Calico's BIRD as a global BGPPeer, record the IPv4 unicast routes it sends,
+// and announce a few of our own. There is no best-path selection and no
+// policy; every route is kept per peer, exactly as received.
+package bgp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+)
+
+// Message types.
+const (
+	msgOpen         = 1
+	msgUpdate       = 2
+	msgNotification = 3
+	msgKeepalive    = 4
+	msgRouteRefresh = 5
+)
+
+const (
+	headerLen  = 19
+	maxMsgLen  = 4096
+	bgpVersion = 4
+
+	// asTrans stands in for a 4-byte AS in the 2-byte OPEN field (RFC 6793).
+	asTrans = 23456
+)
+
+// Capability codes we send or understand.
+const (
+	capMultiprotocol = 1
+	capFourOctetAS   = 65
+)
+
+// Path attribute type codes.
+const (
+	attrOrigin      = 1
+	attrASPath      = 2
+	attrNextHop     = 3
+	attrMED         = 4
+	attrLocalPref   = 5
+	attrCommunities = 8
+)
+
+const (
+	flagOptional   = 0x80
+	flagTransitive = 0x40
+	flagExtended   = 0x10
+)
+
+const (
+	asSet      = 1
+	asSequence = 2
+)
+
+// NOTIFICATION error codes and the subcodes we send.
+const (
+	errHeader        = 1
+	errOpen          = 2
+	errUpdate        = 3
+	errHoldTimer     = 4
+	errFSM           = 5
+	errCease         = 6
+	subBadVersion    = 1
+	subBadPeerAS     = 2
+	subBadBGPID      = 3
+	subBadHoldTime   = 6
+	subBadLength     = 2
+	subBadType       = 3
+	subMalformedAttr = 1
+	subCollision     = 7
+	subAdminShutdown = 2
+)
+
+// Origin values.
+const (
+	OriginIGP        = 0
+	OriginEGP        = 1
+	OriginIncomplete = 2
+)
+
+// Open is an OPEN message.
+type Open struct {
+	AS       uint32
+	HoldTime uint16
+	RouterID netip.Addr
+
+	// FourOctetAS is set when the sender advertised the 4-octet AS
+	// capability; AS then comes from the capability.
+	FourOctetAS bool
+	// IPv4Unicast is set when the sender advertised multiprotocol IPv4
+	// unicast, or sent no multiprotocol capabilities at all (which implies
+	// it).
+	IPv4Unicast bool
+}
+
+// Attrs are the path attributes of an UPDATE.
+type Attrs struct {
+	Origin      uint8      `json:"origin"`
+	ASPath      []uint32   `json:"as_path"`
+	NextHop     netip.Addr `json:"next_hop"`
+	MED         *uint32    `json:"med,omitempty"`
+	LocalPref   *uint32    `json:"local_pref,omitempty"`
+	Communities []string   `json:"communities,omitempty"`
+}
+
+// Update is an UPDATE message with IPv4 unicast NLRI.
+type Update struct {
+	Withdrawn []netip.Prefix
+	Attrs     Attrs
+	NLRI      []netip.Prefix
+}
+
+// Notification is a NOTIFICATION message, which always ends the session.
+type Notification struct {
+	Code, Subcode uint8
+	Data          []byte
+
+	received bool // from the peer, rather than ours to send
+}
+
+func (n *Notification) Error() string {
+	dir := "sent"
+	if n.received {
+		dir = "received"
+	}
+	return fmt.Sprintf("%s notification %d/%d (%s)", dir, n.Code, n.Subcode, notificationText(n.Code, n.Subcode))
+}
+
+func notificationText(code, sub uint8) string {
+	switch code {
+	case errHeader:
+		return "message header error"
+	case errOpen:
+		switch sub {
+		case subBadVersion:
+			return "unsupported version"
+		case subBadPeerAS:
+			return "bad peer AS"
+		case subBadBGPID:
+			return "bad BGP identifier"
+		case subBadHoldTime:
+			return "unacceptable hold time"
+		}
+		return "OPEN message error"
+	case errUpdate:
+		return "UPDATE message error"
+	case errHoldTimer:
+		return "hold timer expired"
+	case errFSM:
+		return "finite state machine error"
+	case errCease:
+		switch sub {
+		case subAdminShutdown:
+			return "administrative shutdown"
+		case subCollision:
+			return "connection collision"
+		}
+		return "cease"
+	}
+	return "unknown"
+}
+
+// readMessage reads one message and returns its type and body.
+func readMessage(r io.Reader) (uint8, []byte, error) {
+	var hdr [headerLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	for _, b := range hdr[:16] {
+		if b != 0xff {
+			return 0, nil, &Notification{Code: errHeader, Subcode: 1}
+		}
+	}
+	n := int(binary.BigEndian.Uint16(hdr[16:]))
+	if n < headerLen || n > maxMsgLen {
+		return 0, nil, &Notification{Code: errHeader, Subcode: subBadLength, Data: hdr[16:18]}
+	}
+	body := make([]byte, n-headerLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return hdr[18], body, nil
+}
+
+func appendHeader(b []byte, typ uint8) []byte {
+	for i := 0; i < 16; i++ {
+		b = append(b, 0xff)
+	}
+	return append(b, 0, 0, typ) // length filled in by finish
+}
+
+func finish(b []byte) []byte {
+	binary.BigEndian.PutUint16(b[16:], uint16(len(b)))
+	return b
+}
+
+func (o Open) marshal() []byte {
+	b := appendHeader(nil, msgOpen)
+	as2 := uint16(asTrans)
+	if o.AS <= 0xffff {
+		as2 = uint16(o.AS)
+	}
+	id := o.RouterID.As4()
+	b = append(b, bgpVersion)
+	b = binary.BigEndian.AppendUint16(b, as2)
+	b = binary.BigEndian.AppendUint16(b, o.HoldTime)
+	b = append(b, id[:]...)
+
+	caps := []byte{
+		capMultiprotocol, 4, 0, 1, 0, 1, // AFI 1 (IPv4), SAFI 1 (unicast)
+		capFourOctetAS, 4,
+	}
+	caps = binary.BigEndian.AppendUint32(caps, o.AS)
+	b = append(b, byte(2+len(caps)), 2, byte(len(caps)))
+	b = append(b, caps...)
+	return finish(b)
+}
+
+func parseOpen(body []byte) (Open, error) {
+	if len(body) < 10 {
+		return Open{}, &Notification{Code: errHeader, Subcode: subBadLength}
+	}
+	if body[0] != bgpVersion {
+		return Open{}, &Notification{Code: errOpen, Subcode: subBadVersion, Data: []byte{0, bgpVersion}}
+	}
+	o := Open{
+		AS:       uint32(binary.BigEndian.Uint16(body[1:])),
+		HoldTime: binary.BigEndian.Uint16(body[3:]),
+		RouterID: netip.AddrFrom4([4]byte(body[5:9])),
+	}
+	if o.HoldTime == 1 || o.HoldTime == 2 {
+		return Open{}, &Notification{Code: errOpen, Subcode: subBadHoldTime}
+	}
+	if o.RouterID.As4() == [4]byte{} {
+		return Open{}, &Notification{Code: errOpen, Subcode: subBadBGPID}
+	}
+
+	params := body[10:]
+	if int(body[9]) != len(params) {
+		return Open{}, &Notification{Code: errOpen}
+	}
+	sawMP := false
+	for len(params) >= 2 {
+		typ, n := params[0], int(params[1])
+		if len(params) < 2+n {
+			return Open{}, &Notification{Code: errOpen}
+		}
+		if typ == 2 { // capabilities
+			caps := params[2 : 2+n]
+			for len(caps) >= 2 {
+				code, cn := caps[0], int(caps[1])
+				if len(caps) < 2+cn {
+					return Open{}, &Notification{Code: errOpen}
+				}
+				val := caps[2 : 2+cn]
+				switch {
+				case code == capMultiprotocol && cn == 4:
+					sawMP = true
+					if binary.BigEndian.Uint16(val) == 1 && val[3] == 1 {
+						o.IPv4Unicast = true
+					}
+				case code == capFourOctetAS && cn == 4:
+					o.FourOctetAS = true
+					o.AS = binary.BigEndian.Uint32(val)
+				}
+				caps = caps[2+cn:]
+			}
+		}
+		params = params[2+n:]
+	}
+	if !sawMP {
+		o.IPv4Unicast = true
+	}
+	return o, nil
+}
+
+func keepaliveMessage() []byte { return finish(appendHeader(nil, msgKeepalive)) }
+
+func (n *Notification) marshal() []byte {
+	b := appendHeader(nil, msgNotification)
+	b = append(b, n.Code, n.Subcode)
+	return finish(append(b, n.Data...))
+}
+
+func parseNotification(body []byte) *Notification {
+	n := &Notification{}
+	if len(body) >= 2 {
+		n.Code, n.Subcode, n.Data = body[0], body[1], body[2:]
+	}
+	return n
+}
+
+// errNotIPv4 is returned for what an IPv4 unicast UPDATE can't carry: we
+// don't speak multiprotocol extensions, so prefixes and next hops are IPv4.
+var errNotIPv4 = errors.New("not an IPv4 address")
+
+func appendPrefix(b []byte, p netip.Prefix) ([]byte, error) {
+	if !p.Addr().Is4() {
+		return nil, fmt.Errorf("prefix %v: %w", p, errNotIPv4)
+	}
+	a := p.Addr().As4()
+	return append(append(b, byte(p.Bits())), a[:(p.Bits()+7)/8]...), nil
+}
+
+func parsePrefixes(b []byte) ([]netip.Prefix, error) {
+	var out []netip.Prefix
+	for len(b) > 0 {
+		bits := int(b[0])
+		n := (bits + 7) / 8
+		if bits > 32 || len(b) < 1+n {
+			return nil, errors.New("bad prefix")
+		}
+		var a [4]byte
+		copy(a[:], b[1:1+n])
+		p, err := netip.AddrFrom4(a).Prefix(bits)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+		b = b[1+n:]
+	}
+	return out, nil
+}
+
+func appendAttr(b []byte, flags, typ uint8, val []byte) []byte {
+	if len(val) > 255 {
+		b = append(b, flags|flagExtended, typ)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(val)))
+	} else {
+		b = append(b, flags, typ, byte(len(val)))
+	}
+	return append(b, val...)
+}
+
+// marshal encodes u. fourOctet picks the AS_PATH encoding both sides agreed
+// on in their OPENs.
+func (u Update) marshal(fourOctet bool) ([]byte, error) {
+	b := appendHeader(nil, msgUpdate)
+
+	var (
+		withdrawn []byte
+		err       error
+	)
+	for _, p := range u.Withdrawn {
+		if withdrawn, err = appendPrefix(withdrawn, p); err != nil {
+			return nil, err
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(withdrawn)))
+	b = append(b, withdrawn...)
+
+	var attrs []byte
+	if len(u.NLRI) > 0 {
+		a := u.Attrs
+		attrs = appendAttr(attrs, flagTransitive, attrOrigin, []byte{a.Origin})
+		var path []byte
+		if len(a.ASPath) > 0 {
+			path = append(path, asSequence, byte(len(a.ASPath)))
+			for _, as := range a.ASPath {
+				if fourOctet {
+					path = binary.BigEndian.AppendUint32(path, as)
+				} else {
+					if as > 0xffff {
+						as = asTrans
+					}
+					path = binary.BigEndian.AppendUint16(path, uint16(as))
+				}
+			}
+		}
+		attrs = appendAttr(attrs, flagTransitive, attrASPath, path)
+		if !a.NextHop.Is4() {
+			return nil, fmt.Errorf("next hop %v: %w", a.NextHop, errNotIPv4)
+		}
+		nh := a.NextHop.As4()
+		attrs = appendAttr(attrs, flagTransitive, attrNextHop, nh[:])
+		if a.MED != nil {
+			attrs = appendAttr(attrs, flagOptional, attrMED, binary.BigEndian.AppendUint32(nil, *a.MED))
+		}
+		if a.LocalPref != nil {
+			attrs = appendAttr(attrs, flagTransitive, attrLocalPref, binary.BigEndian.AppendUint32(nil, *a.LocalPref))
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(attrs)))
+	b = append(b, attrs...)
+
+	for _, p := range u.NLRI {
+		if b, err = appendPrefix(b, p); err != nil {
+			return nil, err
+		}
+	}
+	return finish(b), nil
+}
+
+func parseUpdate(body []byte, fourOctet bool) (Update, error) {
+	malformed := &Notification{Code: errUpdate, Subcode: subMalformedAttr}
+	var u Update
+	if len(body) < 4 {
+		return u, malformed
+	}
+	wn := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+wn+2 {
+		return u, malformed
+	}
+	var err error
+	if u.Withdrawn, err = parsePrefixes(body[2 : 2+wn]); err != nil {
+		return u, &Notification{Code: errUpdate, Subcode: 10} // invalid network field
+	}
+	body = body[2+wn:]
+	an := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+an {
+		return u, malformed
+	}
+	attrs := body[2 : 2+an]
+	if u.NLRI, err = parsePrefixes(body[2+an:]); err != nil {
+		return u, &Notification{Code: errUpdate, Subcode: 10}
+	}
+
+	for len(attrs) >= 3 {
+		flags, typ := attrs[0], attrs[1]
+		var n, off int
+		if flags&flagExtended != 0 {
+			if len(attrs) < 4 {
+				return u, malformed
+			}
+			n, off = int(binary.BigEndian.Uint16(attrs[2:])), 4
+		} else {
+			n, off = int(attrs[2]), 3
+		}
+		if len(attrs) < off+n {
+			return u, malformed
+		}
+		val := attrs[off : off+n]
+		switch typ {
+		case attrOrigin:
+			if n != 1 {
+				return u, malformed
+			}
+			u.Attrs.Origin = val[0]
+		case attrASPath:
+			width := 2
+			if fourOctet {
+				width = 4
+			}
+			for len(val) >= 2 {
+				count := int(val[1])
+				if len(val) < 2+count*width {
+					return u, malformed
+				}
+				for i := 0; i < count; i++ {
+					seg := val[2+i*width:]
+					if fourOctet {
+						u.Attrs.ASPath = append(u.Attrs.ASPath, binary.BigEndian.Uint32(seg))
+					} else {
+						u.Attrs.ASPath = append(u.Attrs.ASPath, uint32(binary.BigEndian.Uint16(seg)))
+					}
+				}
+				val = val[2+count*width:]
+			}
+		case attrNextHop:
+			if n != 4 {
+				return u, malformed
+			}
+			u.Attrs.NextHop = netip.AddrFrom4([4]byte(val))
+		case attrMED:
+			if n == 4 {
+				v := binary.BigEndian.Uint32(val)
+				u.Attrs.MED = &v
+			}
+		case attrLocalPref:
+			if n == 4 {
+				v := binary.BigEndian.Uint32(val)
+				u.Attrs.LocalPref = &v
+			}
+		case attrCommunities:
+			for ; len(val) >= 4; val = val[4:] {
+				u.Attrs.Communities = append(u.Attrs.Communities,
+					fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(val), binary.BigEndian.Uint16(val[2:])))
+			}
+		}
+		attrs = attrs[off+n:]
+	}
+	if len(u.NLRI) > 0 && !u.Attrs.NextHop.IsValid() {
+		return u, &Notification{Code: errUpdate, Subcode: 3, Data: []byte{attrNextHop}} // missing well-known attribute
+	}
+	return u, nil
+}
@@ -0,0 +1,215 @@
+package bgp
+
+import (
+	"bytes"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+)
+
+// roundTrip reads back one marshalled message, checking its type.
+func roundTrip(t *testing.T, msg []byte, want uint8) []byte {
+	t.Helper()
+	typ, body, err := readMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != want {
+		t.Fatalf("type %d, want %d", typ, want)
+	}
+	return body
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	for _, o := range []Open{
+		{AS: 64512, HoldTime: 90, RouterID: netip.MustParseAddr("10.255.0.1")},
+		// too big for the 2-byte field: only the capability carries it
+		{AS: 4200000000, HoldTime: 0, RouterID: netip.MustParseAddr("192.0.2.1")},
+	} {
+		got, err := parseOpen(roundTrip(t, o.marshal(), msgOpen))
+		if err != nil {
+			t.Fatalf("AS %d: %v", o.AS, err)
+		}
+		want := o
+		want.FourOctetAS, want.IPv4Unicast = true, true
+		if got != want {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestParseOpenErrors(t *testing.T) {
+	good := Open{AS: 64512, HoldTime: 90, RouterID: netip.MustParseAddr("10.255.0.1")}.marshal()[headerLen:]
+	with := func(i int, b byte) []byte {
+		body := append([]byte{}, good...)
+		body[i] = b
+		return body
+	}
+	tests := []struct {
+		name string
+		body []byte
+		sub  uint8
+	}{
+		{"short", good[:9], subBadLength},
+		{"version 3", with(0, 3), subBadVersion},
+		{"hold time 2", with(4, 2), subBadHoldTime},
+		{"zero router ID", append(append(append([]byte{}, good[:5]...), 0, 0, 0, 0), good[9:]...), subBadBGPID},
+		{"params length", with(9, 1), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOpen(tt.body)
+			var n *Notification
+			if !errors.As(err, &n) || n.Subcode != tt.sub {
+				t.Errorf("err = %v, want subcode %d", err, tt.sub)
+			}
+		})
+	}
+}
+
+func TestUpdateRoundTrip(t *testing.T) {
+	med, pref := uint32(10), uint32(100)
+	tests := []struct {
+		name      string
+		u         Update
+		fourOctet bool
+	}{
+		{name: "withdraw only", u: Update{Withdrawn: []netip.Prefix{
+			netip.MustParsePrefix("192.168.10.0/26"),
+			netip.MustParsePrefix("0.0.0.0/0"),
+		}}},
+		{name: "ibgp", u: Update{
+			Attrs: Attrs{Origin: OriginIGP, NextHop: netip.MustParseAddr("172.19.0.2"), LocalPref: &pref},
+			NLRI: []netip.Prefix{
+				netip.MustParsePrefix("192.168.240.192/26"),
+				netip.MustParsePrefix("192.168.240.193/32"),
+				netip.MustParsePrefix("10.0.0.0/8"),
+			},
+		}},
+		{name: "ebgp two octet", u: Update{
+			Attrs: Attrs{Origin: OriginIncomplete, ASPath: []uint32{64512, 64513}, NextHop: netip.MustParseAddr("172.19.0.2"), MED: &med},
+			NLRI:  []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+		}},
+		{name: "ebgp four octet", fourOctet: true, u: Update{
+			Withdrawn: []netip.Prefix{netip.MustParsePrefix("192.168.11.0/24")},
+			Attrs:     Attrs{Origin: OriginEGP, ASPath: []uint32{4200000000}, NextHop: netip.MustParseAddr("172.19.0.2")},
+			NLRI:      []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := tt.u.marshal(tt.fourOctet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := parseUpdate(roundTrip(t, msg, msgUpdate), tt.fourOctet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.u) {
+				t.Errorf("got %+v, want %+v", got, tt.u)
+			}
+		})
+	}
+}
+
+// A 4-byte AS squeezed into a 2-byte path becomes AS_TRANS.
+func TestUpdateTwoOctetASTrans(t *testing.T) {
+	u := Update{
+		Attrs: Attrs{ASPath: []uint32{4200000000}, NextHop: netip.MustParseAddr("172.19.0.2")},
+		NLRI:  []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+	}
+	msg, err := u.marshal(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := parseUpdate(roundTrip(t, msg, msgUpdate), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{asTrans}; !reflect.DeepEqual(got.Attrs.ASPath, want) {
+		t.Errorf("AS path %v, want %v", got.Attrs.ASPath, want)
+	}
+}
+
+func TestUpdateMarshalIPv6(t *testing.T) {
+	v4 := netip.MustParsePrefix("192.168.10.0/24")
+	v6 := netip.MustParsePrefix("2001:db8::/64")
+	nh := netip.MustParseAddr("172.19.0.2")
+	tests := []struct {
+		name string
+		u    Update
+	}{
+		{"prefix", Update{Attrs: Attrs{NextHop: nh}, NLRI: []netip.Prefix{v4, v6}}},
+		{"withdrawn", Update{Withdrawn: []netip.Prefix{v6}}},
+		{"next hop", Update{Attrs: Attrs{NextHop: netip.MustParseAddr("fd00::2")}, NLRI: []netip.Prefix{v4}}},
+		{"mapped next hop", Update{Attrs: Attrs{NextHop: netip.MustParseAddr("::ffff:172.19.0.2")}, NLRI: []netip.Prefix{v4}}},
+		{"no next hop", Update{NLRI: []netip.Prefix{v4}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.u.marshal(true); !errors.Is(err, errNotIPv4) {
+				t.Errorf("err = %v, want errNotIPv4", err)
+			}
+		})
+	}
+}
+
+func TestParseUpdateErrors(t *testing.T) {
+	u := Update{
+		Attrs: Attrs{NextHop: netip.MustParseAddr("172.19.0.2")},
+		NLRI:  []netip.Prefix{netip.MustParsePrefix("192.168.10.0/24")},
+	}
+	msg, err := u.marshal(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := msg[headerLen:]
+	tests := []struct {
+		name string
+		body []byte
+		sub  uint8
+	}{
+		{"short", good[:3], subMalformedAttr},
+		// a /33 is an IPv6 length in an IPv4 NLRI field
+		{"prefix too long", append(append([]byte{}, good[:len(good)-4]...), 33, 192, 168, 10, 0, 0), 10},
+		{"truncated prefix", good[:len(good)-1], 10},
+		{"missing next hop", []byte{0, 0, 0, 0, 24, 192, 168, 10}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUpdate(tt.body, true)
+			var n *Notification
+			if !errors.As(err, &n) || n.Code != errUpdate || n.Subcode != tt.sub {
+				t.Errorf("err = %v, want UPDATE error subcode %d", err, tt.sub)
+			}
+		})
+	}
+}
+
+func TestNotificationRoundTrip(t *testing.T) {
+	for _, n := range []*Notification{
+		{Code: errCease, Subcode: subAdminShutdown},
+		{Code: errOpen, Subcode: subBadVersion, Data: []byte{0, bgpVersion}},
+	} {
+		got := parseNotification(roundTrip(t, n.marshal(), msgNotification))
+		if got.Code != n.Code || got.Subcode != n.Subcode || !bytes.Equal(got.Data, n.Data) {
+			t.Errorf("got %+v, want %+v", got, n)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	good := keepaliveMessage()
+	badMarker := append([]byte{}, good...)
+	badMarker[0] = 0
+	badLength := append([]byte{}, good...)
+	badLength[17] = 18
+	for name, msg := range map[string][]byte{"marker": badMarker, "length": badLength} {
+		var n *Notification
+		if _, _, err := readMessage(bytes.NewReader(msg)); !errors.As(err, &n) || n.Code != errHeader {
+			t.Errorf("bad %s: err = %v, want a header error", name, err)
+		}
+	}
+}
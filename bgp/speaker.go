@@ -0,0 +1,583 @@
+package bgp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is a speaker's identity.
+type Config struct {
+	AS       uint32
+	RouterID netip.Addr
+	// HoldTime is what we offer in OPEN; the session uses the smaller of
+	// ours and the peer's. RFC 4271 suggests 90s.
+	HoldTime time.Duration
+	// Logf, if set, is told about sessions coming and going.
+	Logf func(format string, args ...any)
+}
+
+// Session states, named as in RFC 4271. A passive speaker never sits in
+// Connect or Active; those are the states of the side doing the dialling.
+const (
+	StateIdle        = "Idle"
+	StateOpenSent    = "OpenSent"
+	StateOpenConfirm = "OpenConfirm"
+	StateEstablished = "Established"
+)
+
+// keepEvents is how much history Events returns.
+const keepEvents = 200
+
+// Speaker accepts (or makes) BGP sessions and keeps every route its peers
+// send.
+type Speaker struct {
+	cfg Config
+
+	mu        sync.Mutex
+	sessions  map[*session]bool
+	down      map[string]PeerStatus // last status of peers with no session
+	routes    map[routeKey]Route
+	announced map[netip.Prefix]netip.Addr
+	events    []Event
+}
+
+type routeKey struct {
+	peer   string
+	prefix netip.Prefix
+}
+
+// Route is a route one peer sent us.
+type Route struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Peer   string       `json:"peer"`
+	PeerAS uint32       `json:"peer_as"`
+	Attrs
+	Received time.Time `json:"received"`
+}
+
+// Event is one thing that happened: a session changing state, or a route
+// being announced or withdrawn.
+type Event struct {
+	Time   time.Time     `json:"time"`
+	Peer   string        `json:"peer"`
+	Kind   string        `json:"kind"`
+	Prefix *netip.Prefix `json:"prefix,omitempty"`
+	Detail string        `json:"detail,omitempty"`
+}
+
+// PeerStatus describes one peer.
+type PeerStatus struct {
+	Addr      string    `json:"addr"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	AS        uint32    `json:"as,omitempty"`
+	RouterID  string    `json:"router_id,omitempty"`
+	HoldTime  string    `json:"hold_time,omitempty"`
+	Routes    int       `json:"routes"`
+	MsgsIn    int64     `json:"messages_in"`
+	MsgsOut   int64     `json:"messages_out"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// New returns a speaker with no sessions.
+func New(cfg Config) (*Speaker, error) {
+	if !cfg.RouterID.Is4() || cfg.RouterID.IsUnspecified() {
+		return nil, fmt.Errorf("router ID must be a non-zero IPv4 address, got %v", cfg.RouterID)
+	}
+	if cfg.AS == 0 {
+		return nil, errors.New("AS number must not be 0")
+	}
+	if cfg.HoldTime == 0 {
+		cfg.HoldTime = 90 * time.Second
+	}
+	if cfg.Logf == nil {
+		cfg.Logf = func(string, ...any) {}
+	}
+	return &Speaker{
+		cfg:       cfg,
+		sessions:  map[*session]bool{},
+		down:      map[string]PeerStatus{},
+		routes:    map[routeKey]Route{},
+		announced: map[netip.Prefix]netip.Addr{},
+	}, nil
+}
+
+// Serve runs a session for every connection l accepts. It returns when l
+// does.
+func (s *Speaker) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.Run(c)
+	}
+}
+
+// Dial connects to a peer and runs the session until it ends.
+func (s *Speaker) Dial(addr string) error {
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	return s.Run(c)
+}
+
+// Announce sends p to every peer, now and as new peers come up. An invalid
+// nextHop means "our address on the session", or the router ID on sessions
+// over IPv6. Only IPv4 prefixes and next hops can be announced.
+func (s *Speaker) Announce(p netip.Prefix, nextHop netip.Addr) error {
+	if !p.Addr().Is4() {
+		return fmt.Errorf("prefix %v: %w", p, errNotIPv4)
+	}
+	if nextHop.IsValid() && !nextHop.Is4() {
+		return fmt.Errorf("next hop %v: %w", nextHop, errNotIPv4)
+	}
+	p = p.Masked()
+	s.mu.Lock()
+	s.announced[p] = nextHop
+	sessions := s.established()
+	s.mu.Unlock()
+	for _, ss := range sessions {
+		ss.announce(p, nextHop)
+	}
+	return nil
+}
+
+// Withdraw takes back a prefix passed to Announce.
+func (s *Speaker) Withdraw(p netip.Prefix) {
+	p = p.Masked()
+	s.mu.Lock()
+	_, ok := s.announced[p]
+	delete(s.announced, p)
+	sessions := s.established()
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	msg, err := Update{Withdrawn: []netip.Prefix{p}}.marshal(false)
+	if err != nil {
+		s.cfg.Logf("bgp: withdrawing %v: %v", p, err)
+		return
+	}
+	for _, ss := range sessions {
+		ss.send(msg)
+	}
+}
+
+// Close ends every session with a Cease.
+func (s *Speaker) Close() {
+	s.mu.Lock()
+	var all []*session
+	for ss := range s.sessions {
+		all = append(all, ss)
+	}
+	s.mu.Unlock()
+	for _, ss := range all {
+		ss.shutdown.Store(true)
+		ss.notify(&Notification{Code: errCease, Subcode: subAdminShutdown})
+		ss.conn.Close()
+	}
+}
+
+// Routes returns what every peer has sent us, by prefix then peer.
+func (s *Speaker) Routes() []Route {
+	s.mu.Lock()
+	out := make([]Route, 0, len(s.routes))
+	for _, r := range s.routes {
+		out = append(out, r)
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Prefix != out[j].Prefix {
+			if out[i].Prefix.Addr() != out[j].Prefix.Addr() {
+				return out[i].Prefix.Addr().Less(out[j].Prefix.Addr())
+			}
+			return out[i].Prefix.Bits() < out[j].Prefix.Bits()
+		}
+		return out[i].Peer < out[j].Peer
+	})
+	return out
+}
+
+// Peers returns the peers with a session, and the last state of those
+// without one.
+func (s *Speaker) Peers() []PeerStatus {
+	s.mu.Lock()
+	seen := map[string]bool{}
+	var out []PeerStatus
+	for ss := range s.sessions {
+		st := ss.status()
+		seen[st.Addr] = true
+		for k := range s.routes {
+			if k.peer == st.Addr {
+				st.Routes++
+			}
+		}
+		out = append(out, st)
+	}
+	for addr, st := range s.down {
+		if !seen[addr] {
+			out = append(out, st)
+		}
+	}
+	s.mu.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// Events returns recent history, oldest first.
+func (s *Speaker) Events() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event{}, s.events...)
+}
+
+// event records e; s.mu must be held.
+func (s *Speaker) event(e Event) {
+	e.Time = time.Now()
+	s.events = append(s.events, e)
+	if len(s.events) > keepEvents {
+		s.events = s.events[1:]
+	}
+}
+
+// established returns the sessions that can carry UPDATEs; s.mu must be held.
+func (s *Speaker) established() []*session {
+	var out []*session
+	for ss := range s.sessions {
+		if ss.state == StateEstablished {
+			out = append(out, ss)
+		}
+	}
+	return out
+}
+
+type session struct {
+	sp   *Speaker
+	conn net.Conn
+	peer string // remote IP, without the port
+
+	// written by the session goroutine under sp.mu, read by Peers
+	state     string
+	since     time.Time
+	open      Open
+	hold      time.Duration
+	fourOctet bool
+	msgsIn    int64
+	msgsOut   int64
+
+	wmu      sync.Mutex
+	shutdown atomic.Bool // Close ended it, not the peer
+}
+
+func (ss *session) status() PeerStatus {
+	st := PeerStatus{
+		Addr:    ss.peer,
+		State:   ss.state,
+		Since:   ss.since,
+		MsgsIn:  ss.msgsIn,
+		MsgsOut: ss.msgsOut,
+	}
+	if ss.open.RouterID.IsValid() {
+		st.AS, st.RouterID, st.HoldTime = ss.open.AS, ss.open.RouterID.String(), ss.hold.String()
+	}
+	return st
+}
+
+func (ss *session) setState(state string) {
+	ss.sp.mu.Lock()
+	defer ss.sp.mu.Unlock()
+	ss.state, ss.since = state, time.Now()
+	ss.sp.event(Event{Peer: ss.peer, Kind: "state", Detail: state})
+}
+
+func (ss *session) send(msg []byte) error {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	ss.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := ss.conn.Write(msg)
+	if err == nil {
+		ss.sp.mu.Lock()
+		ss.msgsOut++
+		ss.sp.mu.Unlock()
+	}
+	return err
+}
+
+func (ss *session) notify(n *Notification) { ss.send(n.marshal()) }
+
+// announce sends the UPDATE for one of our prefixes. Over eBGP our AS goes
+// on the path; over iBGP the path stays empty and we add LOCAL_PREF, which
+// iBGP peers expect.
+func (ss *session) announce(p netip.Prefix, nextHop netip.Addr) {
+	if !nextHop.IsValid() {
+		if ap, err := netip.ParseAddrPort(ss.conn.LocalAddr().String()); err == nil {
+			nextHop = ap.Addr().Unmap()
+		}
+		// an IPv4 UPDATE can't carry our IPv6 address; the router ID is
+		// one of ours that it can
+		if !nextHop.Is4() {
+			nextHop = ss.sp.cfg.RouterID
+		}
+	}
+	u := Update{NLRI: []netip.Prefix{p}, Attrs: Attrs{Origin: OriginIGP, NextHop: nextHop}}
+	if ss.open.AS == ss.sp.cfg.AS {
+		pref := uint32(100)
+		u.Attrs.LocalPref = &pref
+	} else {
+		u.Attrs.ASPath = []uint32{ss.sp.cfg.AS}
+	}
+	msg, err := u.marshal(ss.fourOctet)
+	if err != nil {
+		ss.sp.cfg.Logf("bgp: announcing %v to %s: %v", p, ss.peer, err)
+		return
+	}
+	ss.send(msg)
+}
+
+// Run speaks BGP on c until the session ends, and returns why it ended.
+func (s *Speaker) Run(c net.Conn) (err error) {
+	ss := &session{sp: s, conn: c, peer: c.RemoteAddr().String(), state: StateIdle, since: time.Now()}
+	if ap, perr := netip.ParseAddrPort(ss.peer); perr == nil {
+		ss.peer = ap.Addr().Unmap().String()
+	}
+	s.mu.Lock()
+	s.sessions[ss] = true
+	s.mu.Unlock()
+
+	defer func() {
+		c.Close()
+		switch {
+		case ss.shutdown.Load():
+			err = errors.New("shut down")
+		case err == nil:
+			// only a panic unwinding through here leaves it unset
+			err = errors.New("session ended")
+		case errors.Is(err, io.EOF):
+			err = errors.New("connection closed by peer")
+		}
+		s.mu.Lock()
+		delete(s.sessions, ss)
+		// routes and status are kept by peer address, so a second
+		// connection from the peer (a collision, or a port scan) that
+		// fails mustn't touch those of the session that's up
+		live := false
+		for other := range s.sessions {
+			if other.peer == ss.peer && other.state == StateEstablished {
+				live = true
+			}
+		}
+		if !live {
+			st := ss.status()
+			st.State, st.Since, st.LastError = StateIdle, time.Now(), err.Error()
+			s.down[ss.peer] = st
+		}
+		// only an Established session can have sent any
+		if !live && ss.state == StateEstablished {
+			for k := range s.routes {
+				if k.peer == ss.peer {
+					p := k.prefix
+					delete(s.routes, k)
+					s.event(Event{Peer: ss.peer, Kind: "withdraw", Prefix: &p, Detail: "session down"})
+				}
+			}
+		}
+		s.event(Event{Peer: ss.peer, Kind: "state", Detail: StateIdle + ": " + err.Error()})
+		s.mu.Unlock()
+		s.cfg.Logf("bgp: session with %s down: %v", ss.peer, err)
+	}()
+
+	err = ss.run()
+	var n *Notification
+	if errors.As(err, &n) && !n.received {
+		// we found the problem; tell the peer before hanging up
+		ss.notify(n)
+	}
+	return err
+}
+
+func (ss *session) run() error {
+	s := ss.sp
+	if err := ss.send(Open{AS: s.cfg.AS, HoldTime: uint16(s.cfg.HoldTime / time.Second), RouterID: s.cfg.RouterID}.marshal()); err != nil {
+		return err
+	}
+	ss.setState(StateOpenSent)
+
+	// RFC 4271 suggests a large hold timer until OPENs are exchanged
+	ss.conn.SetReadDeadline(time.Now().Add(4 * time.Minute))
+	typ, body, err := ss.read()
+	if err != nil {
+		return err
+	}
+	if typ != msgOpen {
+		return &Notification{Code: errFSM}
+	}
+	open, err := parseOpen(body)
+	if err != nil {
+		return err
+	}
+	if open.RouterID == s.cfg.RouterID {
+		return &Notification{Code: errOpen, Subcode: subBadBGPID}
+	}
+	if !open.IPv4Unicast {
+		return &Notification{Code: errOpen, Subcode: 7} // unsupported capability
+	}
+	s.mu.Lock()
+	for other := range s.sessions {
+		if other != ss && other.state == StateEstablished && other.open.RouterID == open.RouterID {
+			s.mu.Unlock()
+			return &Notification{Code: errCease, Subcode: subCollision}
+		}
+	}
+	ss.open, ss.fourOctet = open, open.FourOctetAS
+	ss.hold = min(s.cfg.HoldTime, time.Duration(open.HoldTime)*time.Second)
+	s.mu.Unlock()
+
+	if err := ss.send(keepaliveMessage()); err != nil {
+		return err
+	}
+	ss.setState(StateOpenConfirm)
+
+	ss.extendHold()
+	if typ, _, err = ss.read(); err != nil {
+		return err
+	}
+	if typ != msgKeepalive {
+		return &Notification{Code: errFSM}
+	}
+	ss.setState(StateEstablished)
+	s.cfg.Logf("bgp: session with %s (AS %d, router ID %s) established", ss.peer, open.AS, open.RouterID)
+
+	done := make(chan struct{})
+	defer close(done)
+	if ss.hold > 0 {
+		go ss.keepalives(done)
+	}
+	ss.sendAnnounced()
+
+	for {
+		ss.extendHold()
+		typ, body, err := ss.read()
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case msgKeepalive:
+		case msgUpdate:
+			u, err := parseUpdate(body, ss.fourOctet)
+			if err != nil {
+				return err
+			}
+			ss.apply(u)
+		case msgRouteRefresh:
+			ss.sendAnnounced()
+		default:
+			return &Notification{Code: errFSM}
+		}
+	}
+}
+
+// read reads the next message. A NOTIFICATION comes back as an error, and
+// a read timeout as an expired hold timer.
+func (ss *session) read() (uint8, []byte, error) {
+	typ, body, err := readMessage(ss.conn)
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return 0, nil, &Notification{Code: errHoldTimer}
+		}
+		return 0, nil, err
+	}
+	ss.sp.mu.Lock()
+	ss.msgsIn++
+	ss.sp.mu.Unlock()
+	if typ < msgOpen || typ > msgRouteRefresh {
+		return 0, nil, &Notification{Code: errHeader, Subcode: subBadType, Data: []byte{typ}}
+	}
+	if typ == msgNotification {
+		n := parseNotification(body)
+		n.received = true
+		return 0, nil, n
+	}
+	return typ, body, nil
+}
+
+func (ss *session) extendHold() {
+	if ss.hold > 0 {
+		ss.conn.SetReadDeadline(time.Now().Add(ss.hold))
+	} else {
+		ss.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func (ss *session) keepalives(done chan struct{}) {
+	t := time.NewTicker(ss.hold / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			if ss.send(keepaliveMessage()) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ss *session) sendAnnounced() {
+	ss.sp.mu.Lock()
+	announced := make(map[netip.Prefix]netip.Addr, len(ss.sp.announced))
+	for p, nh := range ss.sp.announced {
+		announced[p] = nh
+	}
+	ss.sp.mu.Unlock()
+	for p, nh := range announced {
+		ss.announce(p, nh)
+	}
+}
+
+func (ss *session) apply(u Update) {
+	s := ss.sp
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range u.Withdrawn {
+		k := routeKey{ss.peer, p}
+		if _, ok := s.routes[k]; ok {
+			delete(s.routes, k)
+			s.event(Event{Peer: ss.peer, Kind: "withdraw", Prefix: &p})
+		}
+	}
+	for _, p := range u.NLRI {
+		s.routes[routeKey{ss.peer, p}] = Route{Prefix: p, Peer: ss.peer, PeerAS: ss.open.AS, Attrs: u.Attrs, Received: now}
+		s.event(Event{Peer: ss.peer, Kind: "announce", Prefix: &p, Detail: "next hop " + u.Attrs.NextHop.String()})
+	}
+}
+
+// DefaultRouterID picks the first non-loopback IPv4 address on the host,
+// which is what BIRD does too.
+func DefaultRouterID() (netip.Addr, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			if ip, ok := netip.AddrFromSlice(ipn.IP); ok && ip.Unmap().Is4() && !ip.IsLoopback() {
+				return ip.Unmap(), nil
+			}
+		}
+	}
+	hn, _ := os.Hostname()
+	return netip.Addr{}, fmt.Errorf("no IPv4 address on %s to use as router ID", hn)
+}
@@ -0,0 +1,189 @@
+package bgp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newSpeaker(t *testing.T, as uint32, id string) *Speaker {
+	t.Helper()
+	sp, err := New(Config{AS: as, RouterID: netip.MustParseAddr(id), HoldTime: 9 * time.Second, Logf: t.Logf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sp.Close)
+	return sp
+}
+
+// peer has a dial b on a listener at addr, and returns the address b
+// listens on.
+func peer(t *testing.T, a, b *Speaker, addr string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("listen %s: %v", addr, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go b.Serve(ln)
+	go a.Dial(ln.Addr().String())
+	return ln.Addr().String()
+}
+
+func waitFor(t *testing.T, what string, ok func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !ok() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func established(sp *Speaker) bool {
+	peers := sp.Peers()
+	return len(peers) == 1 && peers[0].State == StateEstablished
+}
+
+func TestSpeakers(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		asA, asB  uint32
+		wantPath  []uint32
+		localPref bool
+	}{
+		{name: "ibgp", asA: 64512, asB: 64512, localPref: true},
+		{name: "ebgp", asA: 4200000000, asB: 64512, wantPath: []uint32{4200000000}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newSpeaker(t, tt.asA, "10.255.0.1")
+			b := newSpeaker(t, tt.asB, "10.255.0.2")
+			early := netip.MustParsePrefix("192.168.10.0/26")
+			late := netip.MustParsePrefix("192.168.10.64/26")
+			if err := a.Announce(early, netip.Addr{}); err != nil {
+				t.Fatal(err)
+			}
+			peer(t, a, b, "127.0.0.1:0")
+			waitFor(t, "Established", func() bool { return established(a) && established(b) })
+			if st := b.Peers()[0]; st.AS != tt.asA || st.RouterID != "10.255.0.1" {
+				t.Errorf("B sees AS %d, router ID %s", st.AS, st.RouterID)
+			}
+
+			// announced before the session came up, and after
+			if err := a.Announce(late, netip.Addr{}); err != nil {
+				t.Fatal(err)
+			}
+			waitFor(t, "routes", func() bool { return len(b.Routes()) == 2 })
+			for _, r := range b.Routes() {
+				if r.Peer != "127.0.0.1" || r.PeerAS != tt.asA || r.NextHop != netip.MustParseAddr("127.0.0.1") {
+					t.Errorf("route %+v: want one from 127.0.0.1, AS %d, via itself", r, tt.asA)
+				}
+				if len(r.ASPath) != len(tt.wantPath) || (len(r.ASPath) > 0 && r.ASPath[0] != tt.wantPath[0]) {
+					t.Errorf("%v: AS path %v, want %v", r.Prefix, r.ASPath, tt.wantPath)
+				}
+				if (r.LocalPref != nil) != tt.localPref {
+					t.Errorf("%v: LOCAL_PREF %v, want one: %v", r.Prefix, r.LocalPref, tt.localPref)
+				}
+			}
+
+			a.Withdraw(early)
+			waitFor(t, "the withdrawal", func() bool {
+				routes := b.Routes()
+				return len(routes) == 1 && routes[0].Prefix == late
+			})
+
+			// the session going down takes the rest with it
+			a.Close()
+			waitFor(t, "the session to end", func() bool { return len(b.Routes()) == 0 && b.Peers()[0].State == StateIdle })
+		})
+	}
+}
+
+// A second connection from the peer's address that never gets past OPEN
+// leaves the established session, and its routes, alone.
+func TestStrayConnectionFromPeer(t *testing.T) {
+	a := newSpeaker(t, 64512, "10.255.0.1")
+	b := newSpeaker(t, 64512, "10.255.0.2")
+	if err := a.Announce(netip.MustParsePrefix("192.168.10.0/26"), netip.Addr{}); err != nil {
+		t.Fatal(err)
+	}
+	addr := peer(t, a, b, "127.0.0.1:0")
+	waitFor(t, "the route", func() bool { return established(b) && len(b.Routes()) == 1 })
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// a header with no marker: B answers with OPEN, then a NOTIFICATION,
+	// then hangs up
+	if _, err := c.Write(make([]byte, headerLen)); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, c); err != nil {
+		t.Fatalf("waiting for B to hang up: %v", err)
+	}
+	waitFor(t, "the stray session to go", func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.sessions) == 1
+	})
+
+	if got := b.Routes(); len(got) != 1 {
+		t.Errorf("routes %+v, want the one from A", got)
+	}
+	if !established(b) {
+		t.Errorf("B: %+v, want the session with A up", b.Peers())
+	}
+}
+
+// An IPv4 UPDATE can't name our IPv6 address as the next hop; the router
+// ID goes instead.
+func TestSpeakersOverIPv6(t *testing.T) {
+	a := newSpeaker(t, 64512, "10.255.0.1")
+	b := newSpeaker(t, 64512, "10.255.0.2")
+	p := netip.MustParsePrefix("192.168.10.0/26")
+	if err := a.Announce(p, netip.Addr{}); err != nil {
+		t.Fatal(err)
+	}
+	peer(t, a, b, "[::1]:0")
+	waitFor(t, "the route", func() bool { return len(b.Routes()) == 1 })
+	r := b.Routes()[0]
+	if r.Peer != "::1" || r.NextHop != netip.MustParseAddr("10.255.0.1") {
+		t.Errorf("route %+v: want one from ::1 via the router ID", r)
+	}
+	if !established(a) {
+		t.Errorf("A: %+v, want the session up", a.Peers())
+	}
+}
+
+func TestAnnounceIPv6(t *testing.T) {
+	sp := newSpeaker(t, 64512, "10.255.0.1")
+	if err := sp.Announce(netip.MustParsePrefix("2001:db8::/64"), netip.Addr{}); !errors.Is(err, errNotIPv4) {
+		t.Errorf("IPv6 prefix: err = %v, want errNotIPv4", err)
+	}
+	if err := sp.Announce(netip.MustParsePrefix("192.168.10.0/24"), netip.MustParseAddr("fd00::1")); !errors.Is(err, errNotIPv4) {
+		t.Errorf("IPv6 next hop: err = %v, want errNotIPv4", err)
+	}
+	if len(sp.announced) != 0 {
+		t.Errorf("announced %v after refusing both", sp.announced)
+	}
+}
+
+func TestNewConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{AS: 64512},
+		{AS: 64512, RouterID: netip.MustParseAddr("0.0.0.0")},
+		{AS: 64512, RouterID: netip.MustParseAddr("fd00::1")},
+		{RouterID: netip.MustParseAddr("10.255.0.1")},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("%+v: want an error", cfg)
+		}
+	}
+}
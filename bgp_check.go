@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/montybeatnik/learn-k8s/bird"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// bgpCheckCmd looks over one calico-node's BGP state, saved from birdcl, and
+// reports anything that would leave pods unreachable:
+//
+//	learn-k8s bgp check -nodes nodes.txt -protocols protocols.txt -routes routes.txt
+//
+// Calico's default is a full node-to-node mesh, so every other node should
+// have an Established Mesh_<ip> session, and each node's IPAM blocks (/26 by
+// default) should be learned with that node as the next hop.
+func bgpCheckCmd(args []string) error {
+	fs := flag.NewFlagSet("bgp check", flag.ExitOnError)
+	nodesFile := fs.String("nodes", "", "`kubectl get nodes -o wide` or -o json output")
+	protocolsFile := fs.String("protocols", "", "`birdcl show protocols` output")
+	routesFiles := fs.String("routes", "", "comma-separated `birdcl show route` outputs; empty skips the route checks")
+	localNode := fs.String("node", "", "name or IP of the node birdcl ran on; worked out from the mesh when empty")
+	fs.Parse(args)
+
+	if *nodesFile == "" || *protocolsFile == "" {
+		return fmt.Errorf("-nodes and -protocols are required")
+	}
+	in, err := readInput(*nodesFile)
+	if err != nil {
+		return err
+	}
+	nodes, err := kube.ParseNodes(bytes.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("%s: %w", *nodesFile, err)
+	}
+	if in, err = readInput(*protocolsFile); err != nil {
+		return err
+	}
+	protocols, err := bird.ParseProtocols(bytes.NewReader(in))
+	if err != nil {
+		return fmt.Errorf("%s: %w", *protocolsFile, err)
+	}
+	var routes []bird.Route
+	if *routesFiles != "" {
+		for _, name := range strings.Split(*routesFiles, ",") {
+			if in, err = readInput(strings.TrimSpace(name)); err != nil {
+				return err
+			}
+			rs, err := bird.ParseRoutes(bytes.NewReader(in))
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			routes = append(routes, rs...)
+		}
+	}
+
+	findings := checkMesh(nodes, *localNode, protocols, routes)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	failed := 0
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.level, f.subject, f.detail)
+		if f.level == levelFail {
+			failed++
+		}
+	}
+	tw.Flush()
+	if failed > 0 {
+		return fmt.Errorf("%d problem(s) found", failed)
+	}
+	return nil
+}
+
+const (
+	levelOK   = "ok"
+	levelWarn = "WARN"
+	levelFail = "FAIL"
+)
+
+type finding struct {
+	level   string
+	subject string
+	detail  string
+}
+
+// meshPeer turns a protocol name like Mesh_172_19_0_4 back into its peer's
+// address. Calico swaps the dots (or colons) for underscores.
+func meshPeer(name string) (netip.Addr, bool) {
+	rest, ok := strings.CutPrefix(name, "Mesh_")
+	if !ok {
+		return netip.Addr{}, false
+	}
+	if a, err := netip.ParseAddr(strings.ReplaceAll(rest, "_", ".")); err == nil {
+		return a, true
+	}
+	a, err := netip.ParseAddr(strings.ReplaceAll(rest, "_", ":"))
+	return a, err == nil
+}
+
+func checkMesh(nodes []kube.Node, local string, protocols []bird.Protocol, routes []bird.Route) []finding {
+	var out []finding
+	add := func(level, subject, format string, args ...any) {
+		out = append(out, finding{level, subject, fmt.Sprintf(format, args...)})
+	}
+
+	nodeByIP := map[netip.Addr]kube.Node{}
+	for _, n := range nodes {
+		if a, err := netip.ParseAddr(n.InternalIP); err == nil {
+			nodeByIP[a] = n
+		}
+	}
+	mesh := map[netip.Addr]bird.Protocol{}
+	for _, p := range protocols {
+		if a, ok := meshPeer(p.Name); ok && p.IsBGP() {
+			mesh[a] = p
+		}
+	}
+
+	// Which node is this? The one with no session to itself.
+	var self *kube.Node
+	if local != "" {
+		for i, n := range nodes {
+			if n.Name == local || n.InternalIP == local {
+				self = &nodes[i]
+			}
+		}
+		if self == nil {
+			add(levelFail, local, "-node isn't in the node list")
+			return out
+		}
+	} else {
+		var candidates []int
+		for i, n := range nodes {
+			if a, err := netip.ParseAddr(n.InternalIP); err == nil {
+				if _, ok := mesh[a]; !ok {
+					candidates = append(candidates, i)
+				}
+			}
+		}
+		if len(candidates) != 1 {
+			add(levelFail, "mesh", "%d nodes have no Mesh_ session, so can't tell which node this is; pass -node", len(candidates))
+			return out
+		}
+		self = &nodes[candidates[0]]
+	}
+
+	// Every other node needs an Established mesh session.
+	for _, n := range nodes {
+		if n.Name == self.Name {
+			continue
+		}
+		a, err := netip.ParseAddr(n.InternalIP)
+		if err != nil {
+			add(levelFail, n.Name, "no usable INTERNAL-IP (%q)", n.InternalIP)
+			continue
+		}
+		p, ok := mesh[a]
+		switch {
+		case !ok:
+			add(levelFail, n.Name, "no Mesh_%s session: the mesh isn't full", strings.NewReplacer(".", "_", ":", "_").Replace(a.String()))
+		case !p.Established():
+			add(levelFail, p.Name, "%s is %s %s", n.Name, p.State, p.Info)
+		default:
+			add(levelOK, p.Name, "%s Established since %s", n.Name, p.Since)
+		}
+	}
+	for _, p := range protocols {
+		a, ok := meshPeer(p.Name)
+		if !ok {
+			continue
+		}
+		if _, ok := nodeByIP[a]; !ok {
+			add(levelWarn, p.Name, "peer %s isn't a node in the list (removed node?)", a)
+		}
+	}
+
+	// Peers outside the mesh: route reflectors, top-of-rack routers, ...
+	for _, p := range protocols {
+		if !p.IsBGP() || strings.HasPrefix(p.Name, "Mesh_") {
+			continue
+		}
+		if p.Established() {
+			add(levelOK, p.Name, "Established since %s", p.Since)
+			continue
+		}
+		state := strings.Fields(p.Info + " ?")[0]
+		add(levelFail, p.Name, "stuck in %s since %s (state %s): %s", state, p.Since, p.State, stuckHint(state))
+	}
+
+	if routes != nil {
+		out = append(out, checkBlocks(nodes, nodeByIP, self, routes)...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return levelRank(out[i].level) < levelRank(out[j].level) })
+	return out
+}
+
+func stuckHint(state string) string {
+	switch state {
+	case "Connect":
+		return "TCP to port 179 isn't getting through; check the peer address, firewall and that the peer has us configured"
+	case "Active":
+		return "connection attempts keep failing; the peer may be refusing us or the AS numbers don't match"
+	case "OpenSent", "OpenConfirm":
+		return "TCP is up but OPEN was rejected; compare AS numbers and router IDs"
+	case "Idle":
+		return "the session is disabled or backing off after an error"
+	}
+	return "not Established"
+}
+
+func levelRank(l string) int {
+	switch l {
+	case levelFail:
+		return 0
+	case levelWarn:
+		return 1
+	}
+	return 2
+}
+
+// checkBlocks makes sure every pod block is reached via the node that owns
+// it. A block learned straight from a peer (no "from") belongs to that
+// peer; everything else, including copies relayed by other mesh members,
+// has to agree.
+func checkBlocks(nodes []kube.Node, nodeByIP map[netip.Addr]kube.Node, self *kube.Node, routes []bird.Route) []finding {
+	var out []finding
+	add := func(level, subject, format string, args ...any) {
+		out = append(out, finding{level, subject, fmt.Sprintf(format, args...)})
+	}
+
+	owner := map[netip.Prefix]netip.Addr{}
+	via := map[netip.Prefix]map[netip.Addr]bool{}
+	for _, r := range routes {
+		if !strings.HasPrefix(r.Protocol, "Mesh_") || r.Prefix.IsSingleIP() {
+			continue
+		}
+		gw := r.BGPNextHop
+		if gw == "" && len(r.NextHops) > 0 {
+			gw = r.NextHops[0].Gateway
+		}
+		a, err := netip.ParseAddr(gw)
+		if err != nil {
+			add(levelFail, r.Prefix.String(), "no next hop in route from %s", r.Protocol)
+			continue
+		}
+		if via[r.Prefix] == nil {
+			via[r.Prefix] = map[netip.Addr]bool{}
+		}
+		via[r.Prefix][a] = true
+		if peer, ok := meshPeer(r.Protocol); ok && r.From == "" {
+			owner[r.Prefix] = peer
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(via))
+	for p := range via {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].Addr().Less(prefixes[j].Addr()) })
+
+	hasBlock := map[netip.Addr]bool{}
+	for _, p := range prefixes {
+		hops := make([]string, 0, len(via[p]))
+		for a := range via[p] {
+			hops = append(hops, a.String())
+		}
+		sort.Strings(hops)
+
+		own, known := owner[p]
+		switch {
+		case len(hops) > 1:
+			add(levelFail, p.String(), "learned via more than one next hop: %s", strings.Join(hops, ", "))
+		case known && hops[0] != own.String():
+			add(levelFail, p.String(), "announced by %s but next hop is %s", own, hops[0])
+		default:
+			a, _ := netip.ParseAddr(hops[0])
+			n, ok := nodeByIP[a]
+			if !ok {
+				add(levelFail, p.String(), "next hop %s isn't a node", a)
+				continue
+			}
+			if n.Name == self.Name {
+				add(levelFail, p.String(), "routed back to ourselves (%s)", n.Name)
+				continue
+			}
+			hasBlock[a] = true
+			add(levelOK, p.String(), "via %s (%s)", a, n.Name)
+		}
+	}
+
+	for _, n := range nodes {
+		if a, err := netip.ParseAddr(n.InternalIP); err == nil && n.Name != self.Name && !hasBlock[a] {
+			add(levelWarn, n.Name, "no pod block learned from it (no pods scheduled yet, or routes missing from the capture)")
+		}
+	}
+	return out
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/montybeatnik/learn-k8s/bird"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// The kind cluster in examples/: worker's calico-node, 172.19.0.3, meshes
+// with the other two.
+var checkNodes = []kube.Node{
+	{Name: "calico-cluster-control-plane", InternalIP: "172.19.0.4"},
+	{Name: "calico-cluster-worker", InternalIP: "172.19.0.3"},
+	{Name: "calico-cluster-worker2", InternalIP: "172.19.0.2"},
+}
+
+const protocolsHeader = "name     proto    table    state  since       info\n"
+
+// meshUp is both mesh sessions Established, as in the fixture.
+const meshUp = protocolsHeader +
+	"Mesh_172_19_0_4 BGP      master   up     16:01:02    Established\n" +
+	"Mesh_172_19_0_2 BGP      master   up     16:01:03    Established\n"
+
+// route is one `show route` line: prefix via gw, learned over the mesh
+// session with peer, relayed by from unless that's empty.
+func route(prefix, gw, peer, from string) string {
+	if from != "" {
+		from = " from " + from
+	}
+	return fmt.Sprintf("%s via %s on eth0 [Mesh_%s 16:01:02%s] * (100/0) [i]\n", prefix, gw, strings.ReplaceAll(peer, ".", "_"), from)
+}
+
+func parseProtocols(t *testing.T, in string) []bird.Protocol {
+	t.Helper()
+	ps, err := bird.ParseProtocols(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ps
+}
+
+func parseRoutes(t *testing.T, in string) []bird.Route {
+	t.Helper()
+	rs, err := bird.ParseRoutes(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rs
+}
+
+// flagged is the findings that aren't ok, as "LEVEL subject".
+func flagged(findings []finding) []string {
+	var out []string
+	for _, f := range findings {
+		if f.level != levelOK {
+			out = append(out, f.level+" "+f.subject)
+		}
+	}
+	return out
+}
+
+func TestCheckMeshFixtures(t *testing.T) {
+	var protocols []bird.Protocol
+	var routes []bird.Route
+	for _, name := range []string{"show-protocols.txt", "show-route-protocol-mesh.txt", "show-route-bgp-next-hop.txt"} {
+		f, err := os.Open("examples/bird/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "show-protocols.txt" {
+			protocols, err = bird.ParseProtocols(f)
+		} else {
+			var rs []bird.Route
+			rs, err = bird.ParseRoutes(f)
+			routes = append(routes, rs...)
+		}
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	var got []string
+	for _, f := range checkMesh(checkNodes, "", protocols, routes) {
+		got = append(got, f.level+" "+f.subject)
+	}
+	want := []string{
+		// the session to a router that was never set up
+		"FAIL Global_192_20_30_40",
+		"ok Mesh_172_19_0_4",
+		"ok Mesh_172_19_0_2",
+		"ok 192.168.156.64/26",
+		"ok 192.168.240.192/26",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("findings\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestCheckMesh(t *testing.T) {
+	blocks := route("192.168.156.64/26", "172.19.0.4", "172.19.0.4", "") +
+		route("192.168.240.192/26", "172.19.0.2", "172.19.0.2", "")
+	tests := []struct {
+		name      string
+		local     string
+		protocols string
+		routes    string // "" skips the block checks
+		want      []string
+		// detail has a word each FAIL's explanation must contain
+		detail []string
+	}{
+		{
+			name:      "healthy",
+			protocols: meshUp,
+			routes:    blocks,
+		},
+		{
+			name:      "session down",
+			protocols: protocolsHeader + "Mesh_172_19_0_4 BGP master up 16:01:02 Established\nMesh_172_19_0_2 BGP master start 16:20:00 Active Socket: Connection refused\n",
+			local:     "calico-cluster-worker",
+			want:      []string{"FAIL Mesh_172_19_0_2"},
+			detail:    []string{"Active"},
+		},
+		{
+			name:      "mesh not full",
+			protocols: protocolsHeader + "Mesh_172_19_0_4 BGP master up 16:01:02 Established\n",
+			local:     "172.19.0.3",
+			want:      []string{"FAIL calico-cluster-worker2"},
+			detail:    []string{"Mesh_172_19_0_2"},
+		},
+		{
+			// two nodes without a session: either could be us
+			name:      "which node",
+			protocols: protocolsHeader + "Mesh_172_19_0_4 BGP master up 16:01:02 Established\n",
+			want:      []string{"FAIL mesh"},
+			detail:    []string{"-node"},
+		},
+		{
+			name:      "unknown -node",
+			protocols: meshUp,
+			local:     "calico-cluster-worker9",
+			want:      []string{"FAIL calico-cluster-worker9"},
+			detail:    []string{"node list"},
+		},
+		{
+			name:      "removed node",
+			protocols: meshUp + "Mesh_172_19_0_9 BGP master start 16:20:00 Connect\n",
+			local:     "calico-cluster-worker",
+			want:      []string{"WARN Mesh_172_19_0_9"},
+		},
+		{
+			name:      "stuck peer",
+			protocols: meshUp + "rr1 BGP master start 16:20:00 OpenSent\n",
+			want:      []string{"FAIL rr1"},
+			detail:    []string{"OPEN was rejected"},
+		},
+		{
+			name:      "two next hops",
+			protocols: meshUp,
+			routes:    blocks + route("192.168.156.64/26", "172.19.0.2", "172.19.0.2", "172.19.0.4"),
+			want:      []string{"FAIL 192.168.156.64/26", "WARN calico-cluster-control-plane"},
+			detail:    []string{"more than one next hop"},
+		},
+		{
+			name:      "wrong next hop",
+			protocols: meshUp,
+			routes:    route("192.168.156.64/26", "172.19.0.2", "172.19.0.4", "") + route("192.168.240.192/26", "172.19.0.2", "172.19.0.2", ""),
+			want:      []string{"FAIL 192.168.156.64/26", "WARN calico-cluster-control-plane"},
+			detail:    []string{"announced by 172.19.0.4"},
+		},
+		{
+			name:      "routed to ourselves",
+			protocols: meshUp,
+			routes:    blocks + route("192.168.10.0/26", "172.19.0.3", "172.19.0.4", "172.19.0.3"),
+			want:      []string{"FAIL 192.168.10.0/26"},
+			detail:    []string{"ourselves"},
+		},
+		{
+			name:      "not a node",
+			protocols: meshUp,
+			routes:    blocks + route("192.168.20.0/26", "172.19.0.99", "172.19.0.4", "172.19.0.99"),
+			want:      []string{"FAIL 192.168.20.0/26"},
+			detail:    []string{"isn't a node"},
+		},
+		{
+			// /32s are the tunnel addresses, not blocks
+			name:      "no blocks",
+			protocols: meshUp,
+			routes:    route("192.168.240.192/32", "172.19.0.2", "172.19.0.4", "172.19.0.4"),
+			want:      []string{"WARN calico-cluster-control-plane", "WARN calico-cluster-worker2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var routes []bird.Route
+			if tt.routes != "" {
+				routes = parseRoutes(t, tt.routes)
+			}
+			findings := checkMesh(checkNodes, tt.local, parseProtocols(t, tt.protocols), routes)
+			got := flagged(findings)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("flagged\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			fails := 0
+			for _, f := range findings {
+				if f.level != levelFail {
+					continue
+				}
+				if fails < len(tt.detail) && !strings.Contains(f.detail, tt.detail[fails]) {
+					t.Errorf("%s: %q doesn't mention %q", f.subject, f.detail, tt.detail[fails])
+				}
+				fails++
+			}
+		})
+	}
+}
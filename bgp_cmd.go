@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/bgp"
+	"github.com/montybeatnik/learn-k8s/bird"
+)
+
+// bgpSubcommands are the tools for poking at Calico's BGP from outside the
+// cluster:
+//
+//	learn-k8s bgp parse [-type protocols|routes] [file]
+//	learn-k8s bgp check -nodes FILE -protocols FILE [-routes FILE,...]
+//	learn-k8s bgp lab [-announce PREFIX,...]
+var bgpSubcommands = map[string]func(args []string) error{
+	"check": bgpCheckCmd,
+	"lab":   bgpLabCmd,
+	"parse": bgpParseCmd,
+}
+
+func bgpCmd(args []string) error {
+	if len(args) == 0 || bgpSubcommands[args[0]] == nil {
+		return fmt.Errorf("usage: bgp %s ...", strings.Join(sortedKeys(bgpSubcommands), "|"))
+	}
+	return bgpSubcommands[args[0]](args[1:])
+}
+
+// bgpParseCmd turns saved (or piped) birdcl output into JSON:
+//
+//	kubectl exec -n calico-system $POD -- birdcl show protocols | learn-k8s bgp parse
+func bgpParseCmd(args []string) error {
+	fs := flag.NewFlagSet("bgp parse", flag.ExitOnError)
+	kind := fs.String("type", "auto", "what the input is: protocols, routes or auto")
+	fs.Parse(args)
+
+	in, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *kind == "auto" {
+		*kind = "routes"
+		if isProtocolsOutput(in) {
+			*kind = "protocols"
+		}
+	}
+
+	var out any
+	switch *kind {
+	case "protocols":
+		out, err = bird.ParseProtocols(bytes.NewReader(in))
+	case "routes":
+		out, err = bird.ParseRoutes(bytes.NewReader(in))
+	default:
+		return fmt.Errorf("unknown -type %q", *kind)
+	}
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+func isProtocolsOutput(in []byte) bool {
+	sc := bufio.NewScanner(bytes.NewReader(in))
+	for sc.Scan() {
+		if f := strings.Fields(sc.Text()); len(f) >= 3 && f[0] == "name" && f[1] == "proto" && f[2] == "table" {
+			return true
+		}
+	}
+	return false
+}
+
+// readInput reads a file, or stdin when name is "" or "-".
+func readInput(name string) ([]byte, error) {
+	if name == "" || name == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(name)
+}
+
+// bgpLabCmd peers two speakers inside this process over loopback, has one
+// announce some prefixes and withdraw one, and prints what the other saw.
+// It's the BGP speaker with nothing else in the way.
+func bgpLabCmd(args []string) error {
+	fs := flag.NewFlagSet("bgp lab", flag.ExitOnError)
+	announce := fs.String("announce", "192.168.10.0/26,192.168.10.64/26,192.168.10.128/26", "comma-separated prefixes the first speaker announces")
+	asA := fs.Uint("as-a", 64512, "AS of the announcing speaker")
+	asB := fs.Uint("as-b", 64512, "AS of the listening speaker; differ from -as-a for eBGP")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for each step")
+	fs.Parse(args)
+
+	var prefixes []netip.Prefix
+	for _, s := range splitList(*announce) {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return err
+		}
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return fmt.Errorf("nothing to -announce")
+	}
+
+	a, err := bgp.New(bgp.Config{AS: uint32(*asA), RouterID: netip.MustParseAddr("10.255.0.1"), HoldTime: 9 * time.Second})
+	if err != nil {
+		return err
+	}
+	b, err := bgp.New(bgp.Config{AS: uint32(*asB), RouterID: netip.MustParseAddr("10.255.0.2"), HoldTime: 9 * time.Second})
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	go b.Serve(ln)
+
+	for _, p := range prefixes {
+		if err := a.Announce(p, netip.Addr{}); err != nil {
+			return err
+		}
+	}
+	dialed := make(chan error, 1)
+	go func() { dialed <- a.Dial(ln.Addr().String()) }()
+
+	waitFor := func(what string, ok func() bool) error {
+		deadline := time.Now().Add(*timeout)
+		for !ok() {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	}
+
+	if err := waitFor("routes", func() bool { return len(b.Routes()) == len(prefixes) }); err != nil {
+		return err
+	}
+	fmt.Printf("speaker B (AS %d) learned from A (AS %d):\n", *asB, *asA)
+	printBGPRoutes(b.Routes())
+
+	a.Withdraw(prefixes[0])
+	if err := waitFor("the withdrawal", func() bool { return len(b.Routes()) == len(prefixes)-1 }); err != nil {
+		return err
+	}
+	fmt.Printf("\nafter A withdraws %s:\n", prefixes[0])
+	printBGPRoutes(b.Routes())
+
+	a.Close()
+	fmt.Printf("\nA shuts down: %v\n", <-dialed)
+	if err := waitFor("the session to drop", func() bool { return len(b.Routes()) == 0 }); err != nil {
+		return err
+	}
+	fmt.Println("\nwhat B saw:")
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, e := range b.Events() {
+		prefix := ""
+		if e.Prefix != nil {
+			prefix = e.Prefix.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Time.Format("15:04:05.000"), e.Kind, prefix, e.Detail)
+	}
+	return tw.Flush()
+}
+
+func printBGPRoutes(routes []bgp.Route) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tPEER\tNEXT HOP\tAS PATH\tLOCAL PREF")
+	for _, r := range routes {
+		pref := "-"
+		if r.LocalPref != nil {
+			pref = fmt.Sprint(*r.LocalPref)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%s\n", r.Prefix, r.Peer, r.NextHop, r.ASPath, pref)
+	}
+	tw.Flush()
+}
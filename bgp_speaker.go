@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/bgp"
+)
+
+// A BGP speaker Calico can peer with, so you can watch it advertise pod
+// blocks. Point a global BGPPeer at the pod (or the node running it with
+// hostNetwork) and look at /bgp/routes:
+//
+//	apiVersion: projectcalico.org/v3
+//	kind: BGPPeer
+//	metadata:
+//	  name: learn-k8s
+//	spec:
+//	  peerIP: 172.19.0.10
+//	  asNumber: 64512
+
+var (
+	bgpSocket   = ""
+	bgpAS       = uint(64512)
+	bgpRouterID = ""
+	bgpPeers    = ""
+	bgpAnnounce = ""
+	bgpNextHop  = ""
+)
+
+// bgpSpeaker is the server's speaker; nil unless -bgp is set.
+var bgpSpeaker *bgp.Speaker
+
+// bgpRetry is how long to wait before redialling a peer from -bgp-peer.
+const bgpRetry = 5 * time.Second
+
+func newBGPSpeaker() (*bgp.Speaker, error) {
+	var (
+		id  netip.Addr
+		err error
+	)
+	if bgpRouterID != "" {
+		id, err = netip.ParseAddr(bgpRouterID)
+	} else {
+		id, err = bgp.DefaultRouterID()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("-bgp-router-id: %w", err)
+	}
+	sp, err := bgp.New(bgp.Config{AS: uint32(bgpAS), RouterID: id, Logf: log.Printf})
+	if err != nil {
+		return nil, err
+	}
+	var nextHop netip.Addr
+	if bgpNextHop != "" {
+		if nextHop, err = netip.ParseAddr(bgpNextHop); err != nil {
+			return nil, fmt.Errorf("-bgp-next-hop: %w", err)
+		}
+	}
+	for _, s := range splitList(bgpAnnounce) {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("-bgp-announce: %w", err)
+		}
+		if err := sp.Announce(p, nextHop); err != nil {
+			return nil, fmt.Errorf("-bgp-announce: %w", err)
+		}
+	}
+	return sp, nil
+}
+
+func serveBGP(sp *bgp.Speaker, addr string) {
+	ln, err := listen(addr)
+	if err != nil {
+		log.Printf("failed to stand up bgp: %v\n", err)
+		return
+	}
+	log.Printf("standing up bgp on %v\n", addr)
+	if err := sp.Serve(ln); err != nil {
+		log.Printf("bgp: %v\n", err)
+	}
+}
+
+// dialBGP keeps a session up to a peer that won't connect to us.
+func dialBGP(sp *bgp.Speaker, addr string) {
+	for {
+		err := sp.Dial(addr)
+		log.Printf("bgp: peer %s: %v; retrying in %v\n", addr, err, bgpRetry)
+		time.Sleep(bgpRetry)
+	}
+}
+
+// bgpRoutesHandler shows what our peers have told us:
+//
+//	watch -n1 'curl -s localhost:8080/bgp/routes | jq -c ".routes[] | {prefix, peer, next_hop}"'
+func bgpRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Peers  []bgp.PeerStatus `json:"peers"`
+		Routes []bgp.Route      `json:"routes"`
+		Events []bgp.Event      `json:"events"`
+	}{
+		Peers:  orEmpty(bgpSpeaker.Peers()),
+		Routes: orEmpty(bgpSpeaker.Routes()),
+		Events: orEmpty(bgpSpeaker.Events()),
+	})
+}
+
+// splitList splits a comma-separated flag, dropping empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,289 @@
+// Package bird parses the text birdcl prints, as seen when you exec into a
+// calico-node pod:
+//
+//	kubectl exec -n calico-system <calico-node pod> -- birdcl show protocols
+//	kubectl exec -n calico-system <calico-node pod> -- birdcl show route
+//
+// Both the short and the "all" forms are understood. Lines that aren't part
+// of a table (the "Defaulted container" notice from kubectl, BIRD's "ready."
+// banner) are skipped.
+package bird
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Protocol is one row of `birdcl show protocols`.
+type Protocol struct {
+	Name  string `json:"name"`
+	Proto string `json:"proto"`
+	Table string `json:"table"`
+	State string `json:"state"`
+	Since string `json:"since"`
+	Info  string `json:"info,omitempty"`
+
+	// Details holds the indented "Key: value" lines printed by
+	// `show protocols all`, such as "BGP state" or "Neighbor address".
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// IsBGP reports whether p is a BGP session.
+func (p Protocol) IsBGP() bool { return p.Proto == "BGP" }
+
+// Established reports whether a BGP session is up and exchanging routes.
+func (p Protocol) Established() bool {
+	return p.IsBGP() && p.State == "up" && strings.HasPrefix(p.Info, "Established")
+}
+
+// Route is one line of `birdcl show route`. A prefix with several paths
+// prints one line per path; each becomes its own Route.
+type Route struct {
+	Prefix netip.Prefix `json:"prefix"`
+
+	// Kind is "unicast" for routes with next hops, otherwise the route
+	// type BIRD printed: "blackhole", "unreachable" or "prohibit".
+	Kind     string    `json:"kind"`
+	NextHops []NextHop `json:"next_hops,omitempty"`
+
+	Protocol string `json:"protocol"`
+	Since    string `json:"since"`
+	// From is the BGP peer the route was learned from, when that isn't the
+	// next hop (route reflection, or a full mesh relaying a /32).
+	From string `json:"from,omitempty"`
+
+	// Primary is the "*" BIRD puts on the route it exports to the kernel.
+	Primary    bool   `json:"primary"`
+	Preference int    `json:"preference"`
+	Metric     string `json:"metric,omitempty"`
+	// Flags is the bracketed suffix: the BGP origin ("i", "e", "?"),
+	// possibly after an AS path, e.g. "AS64512i".
+	Flags string `json:"flags,omitempty"`
+
+	// BGPNextHop is the BGP.next_hop attribute. Only `show route all`
+	// prints it.
+	BGPNextHop string            `json:"bgp_next_hop,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// NextHop is where a route sends traffic.
+type NextHop struct {
+	Gateway   string `json:"gateway,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	Weight    int    `json:"weight,omitempty"`
+}
+
+// ParseProtocols reads `show protocols` or `show protocols all` output.
+func ParseProtocols(r io.Reader) ([]Protocol, error) {
+	var (
+		out     []Protocol
+		inTable bool
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case isProtocolsHeader(fields):
+			inTable = true
+			continue
+		case !inTable:
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(out) == 0 {
+				return nil, fmt.Errorf("line %d: detail line before any protocol", n)
+			}
+			k, v, ok := strings.Cut(strings.TrimSpace(line), ":")
+			if !ok {
+				continue
+			}
+			p := &out[len(out)-1]
+			if p.Details == nil {
+				p.Details = map[string]string{}
+			}
+			p.Details[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			continue
+		}
+
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("line %d: want at least 5 columns, got %q", n, line)
+		}
+		p := Protocol{Name: fields[0], Proto: fields[1], Table: fields[2], State: fields[3], Since: fields[4]}
+		rest := fields[5:]
+		// "since" is a date and a time once the session is more than a day old
+		if len(rest) > 0 && isClock(rest[0]) {
+			p.Since += " " + rest[0]
+			rest = rest[1:]
+		}
+		p.Info = strings.Join(rest, " ")
+		out = append(out, p)
+	}
+	return out, sc.Err()
+}
+
+func isProtocolsHeader(fields []string) bool {
+	return len(fields) >= 4 && fields[0] == "name" && fields[1] == "proto" && fields[2] == "table" && fields[3] == "state"
+}
+
+func isClock(s string) bool {
+	return len(s) >= 8 && s[2] == ':' && s[5] == ':'
+}
+
+// ParseRoutes reads `show route` or `show route all` output.
+func ParseRoutes(r io.Reader) ([]Route, error) {
+	var (
+		out    []Route
+		prefix netip.Prefix
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || isNoise(trimmed) {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		fields := strings.Fields(trimmed)
+
+		// extra next hop of a multipath route: "\tvia 10.0.0.1 on eth0 weight 1"
+		if indented && fields[0] == "via" && !strings.Contains(trimmed, "[") {
+			if len(out) == 0 {
+				return nil, fmt.Errorf("line %d: next hop before any route", n)
+			}
+			hop, _ := parseNextHop(fields)
+			out[len(out)-1].NextHops = append(out[len(out)-1].NextHops, hop)
+			continue
+		}
+
+		// attribute of the previous route: "\tBGP.next_hop: 172.19.0.2"
+		if indented && !strings.Contains(trimmed, "[") {
+			if len(out) == 0 {
+				continue
+			}
+			k, v, ok := strings.Cut(trimmed, ":")
+			if !ok {
+				continue
+			}
+			rt := &out[len(out)-1]
+			if rt.Attributes == nil {
+				rt.Attributes = map[string]string{}
+			}
+			k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+			rt.Attributes[k] = v
+			if f := strings.Fields(v); k == "BGP.next_hop" && len(f) > 0 {
+				rt.BGPNextHop = f[0]
+			}
+			continue
+		}
+
+		// a new path; continuation lines leave the prefix off
+		if !indented {
+			p, err := netip.ParsePrefix(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+			prefix = p
+			trimmed = strings.TrimSpace(trimmed[len(fields[0]):])
+		} else if !prefix.IsValid() {
+			return nil, fmt.Errorf("line %d: continuation before any prefix", n)
+		}
+		rt, err := parseRouteLine(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		rt.Prefix = prefix
+		out = append(out, rt)
+	}
+	return out, sc.Err()
+}
+
+func isNoise(line string) bool {
+	return strings.HasPrefix(line, "BIRD ") || strings.HasPrefix(line, "Defaulted container") || strings.HasPrefix(line, "Table ")
+}
+
+// parseRouteLine parses everything after the prefix, e.g.
+//
+//	via 172.19.0.2 on eth0 [Mesh_172_19_0_4 16:01:02 from 172.19.0.4] * (100/0) [i]
+func parseRouteLine(s string) (Route, error) {
+	lb, rb := strings.Index(s, "["), strings.Index(s, "]")
+	if lb < 0 || rb < lb {
+		return Route{}, fmt.Errorf("no [protocol since] block in %q", s)
+	}
+	rt := Route{Kind: "unicast"}
+
+	dest := strings.Fields(s[:lb])
+	switch {
+	case len(dest) == 0:
+	case dest[0] == "via" || dest[0] == "dev":
+		hop, err := parseNextHop(dest)
+		if err != nil {
+			return Route{}, err
+		}
+		rt.NextHops = []NextHop{hop}
+	case dest[0] == "multipath":
+		// next hops follow on their own lines
+	default:
+		rt.Kind = dest[0]
+	}
+
+	src := strings.Fields(s[lb+1 : rb])
+	if len(src) == 0 {
+		return Route{}, fmt.Errorf("empty [protocol since] block in %q", s)
+	}
+	rt.Protocol = src[0]
+	var since []string
+	for i := 1; i < len(src); i++ {
+		if src[i] == "from" && i+1 < len(src) {
+			rt.From = src[i+1]
+			break
+		}
+		since = append(since, src[i])
+	}
+	rt.Since = strings.Join(since, " ")
+
+	for _, f := range strings.Fields(s[rb+1:]) {
+		switch {
+		case f == "*":
+			rt.Primary = true
+		case strings.HasPrefix(f, "(") && strings.HasSuffix(f, ")"):
+			pref, metric, _ := strings.Cut(f[1:len(f)-1], "/")
+			p, err := strconv.Atoi(pref)
+			if err != nil {
+				return Route{}, fmt.Errorf("bad preference %q", f)
+			}
+			rt.Preference, rt.Metric = p, metric
+		case strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]"):
+			rt.Flags = f[1 : len(f)-1]
+		}
+	}
+	return rt, nil
+}
+
+// parseNextHop parses "via GW on IFACE [weight N]" or "dev IFACE".
+func parseNextHop(fields []string) (NextHop, error) {
+	var hop NextHop
+	for i := 0; i+1 < len(fields); i += 2 {
+		switch fields[i] {
+		case "via":
+			hop.Gateway = fields[i+1]
+		case "on", "dev":
+			hop.Interface = fields[i+1]
+		case "weight":
+			w, err := strconv.Atoi(fields[i+1])
+			if err != nil {
+				return hop, fmt.Errorf("bad weight %q", fields[i+1])
+			}
+			hop.Weight = w
+		}
+	}
+	return hop, nil
+}
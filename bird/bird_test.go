@@ -0,0 +1,138 @@
+package bird
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open("../examples/bird/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestParseProtocolsFixture(t *testing.T) {
+	got, err := ParseProtocols(open(t, "show-protocols.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Protocol{
+		{Name: "static1", Proto: "Static", Table: "master", State: "up", Since: "16:01:01"},
+		{Name: "kernel1", Proto: "Kernel", Table: "master", State: "up", Since: "16:01:01"},
+		{Name: "device1", Proto: "Device", Table: "master", State: "up", Since: "16:01:01"},
+		{Name: "direct1", Proto: "Direct", Table: "master", State: "up", Since: "16:01:01"},
+		{Name: "Mesh_172_19_0_4", Proto: "BGP", Table: "master", State: "up", Since: "16:01:02", Info: "Established"},
+		{Name: "Mesh_172_19_0_2", Proto: "BGP", Table: "master", State: "up", Since: "16:01:03", Info: "Established"},
+		{Name: "Global_192_20_30_40", Proto: "BGP", Table: "master", State: "start", Since: "16:17:38", Info: "Connect"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+	var established []string
+	for _, p := range got {
+		if p.Established() {
+			established = append(established, p.Name)
+		}
+	}
+	if want := []string{"Mesh_172_19_0_4", "Mesh_172_19_0_2"}; !reflect.DeepEqual(established, want) {
+		t.Errorf("established = %v, want %v", established, want)
+	}
+}
+
+func TestParseRoutesFixtures(t *testing.T) {
+	block := netip.MustParsePrefix("192.168.240.192/26")
+	host := netip.MustParsePrefix("192.168.240.192/32")
+	via := func(gw string) []NextHop { return []NextHop{{Gateway: gw, Interface: "eth0"}} }
+
+	tests := []struct {
+		file string
+		want []Route
+	}{
+		{"show-route-bgp-next-hop.txt", []Route{
+			{Prefix: host, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", From: "172.19.0.4", Primary: true, Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: block, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_2", Since: "16:01:03", Primary: true, Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: block, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_2", Since: "16:01:03", Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: block, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", From: "172.19.0.4", Preference: 100, Metric: "0", Flags: "i"},
+		}},
+		{"show-route-protocol-mesh.txt", []Route{
+			{Prefix: host, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", From: "172.19.0.4", Primary: true, Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: block, Kind: "unicast", NextHops: via("172.19.0.2"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", From: "172.19.0.4", Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: netip.MustParsePrefix("192.168.156.64/26"), Kind: "unicast", NextHops: via("172.19.0.4"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", Preference: 100, Metric: "0", Flags: "i"},
+			{Prefix: netip.MustParsePrefix("192.168.156.64/26"), Kind: "unicast", NextHops: via("172.19.0.4"), Protocol: "Mesh_172_19_0_4", Since: "16:01:02", Preference: 100, Metric: "0", Flags: "i"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			got, err := ParseRoutes(open(t, tt.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRoutesAll(t *testing.T) {
+	in := `192.168.156.64/26  multipath [Mesh_172_19_0_4 2024-05-01 16:01:02] * (100/0) [AS64512i]
+	via 172.19.0.4 on eth0 weight 1
+	via 172.19.0.5 on eth0 weight 2
+	Type: BGP unicast univ
+	BGP.origin: IGP
+	BGP.next_hop: 172.19.0.4 fe80::42:acff:fe13:4
+	BGP.local_pref: 100
+10.96.0.0/12       blackhole [static1 16:01:01] * (200)
+	BGP.next_hop:
+`
+	got, err := ParseRoutes(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Route{
+		{
+			Prefix: netip.MustParsePrefix("192.168.156.64/26"), Kind: "unicast",
+			NextHops: []NextHop{
+				{Gateway: "172.19.0.4", Interface: "eth0", Weight: 1},
+				{Gateway: "172.19.0.5", Interface: "eth0", Weight: 2},
+			},
+			Protocol: "Mesh_172_19_0_4", Since: "2024-05-01 16:01:02", Primary: true, Preference: 100, Metric: "0", Flags: "AS64512i",
+			BGPNextHop: "172.19.0.4",
+			Attributes: map[string]string{
+				"Type":           "BGP unicast univ",
+				"BGP.origin":     "IGP",
+				"BGP.next_hop":   "172.19.0.4 fe80::42:acff:fe13:4",
+				"BGP.local_pref": "100",
+			},
+		},
+		// an empty next hop attribute mustn't trip the parser up
+		{
+			Prefix: netip.MustParsePrefix("10.96.0.0/12"), Kind: "blackhole",
+			Protocol: "static1", Since: "16:01:01", Primary: true, Preference: 200,
+			Attributes: map[string]string{"BGP.next_hop": ""},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestParseRoutesErrors(t *testing.T) {
+	for _, in := range []string{
+		"not-a-prefix via 10.0.0.1 on eth0 [x 16:00:00] (100)\n",
+		"10.0.0.0/24 via 10.0.0.1 on eth0\n",
+		"\tvia 10.0.0.1 on eth0 weight 1\n",
+		"10.0.0.0/24 via 10.0.0.1 on eth0 [x 16:00:00] (high)\n",
+	} {
+		if _, err := ParseRoutes(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: want an error", in)
+		}
+	}
+}
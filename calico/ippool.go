@@ -0,0 +1,272 @@
+// Package calico works out what a Calico IPPool means for a cluster: how
+// it's carved into blocks, how many nodes and pods it can hold, and which
+// node each block landed on.
+package calico
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/netip"
+	"sort"
+
+	"github.com/montybeatnik/learn-k8s/bird"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// IPPool is the spec of a crd.projectcalico.org/v1 (or projectcalico.org/v3)
+// IPPool.
+type IPPool struct {
+	Name         string       `json:"name"`
+	CIDR         netip.Prefix `json:"cidr"`
+	BlockSize    int          `json:"block_size"`
+	IPIPMode     string       `json:"ipip_mode"`
+	VXLANMode    string       `json:"vxlan_mode"`
+	NATOutgoing  bool         `json:"nat_outgoing"`
+	NodeSelector string       `json:"node_selector"`
+	Disabled     bool         `json:"disabled,omitempty"`
+}
+
+// Calico's defaults when the spec leaves them out.
+const (
+	defaultBlockSizeV4 = 26
+	defaultBlockSizeV6 = 122
+)
+
+type ipPoolObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		CIDR         string `json:"cidr"`
+		BlockSize    int    `json:"blockSize"`
+		IPIPMode     string `json:"ipipMode"`
+		VXLANMode    string `json:"vxlanMode"`
+		NATOutgoing  bool   `json:"natOutgoing"`
+		NodeSelector string `json:"nodeSelector"`
+		Disabled     bool   `json:"disabled"`
+	} `json:"spec"`
+}
+
+// ParseIPPools reads `kubectl get ippools -o json` or `-o yaml`, either a
+// single IPPool or a List of them.
+func ParseIPPools(r io.Reader) ([]IPPool, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimSpace(in); len(t) == 0 || t[0] != '{' {
+		if in, err = kube.YAMLToJSON(in); err != nil {
+			return nil, err
+		}
+	}
+
+	var list struct {
+		Kind  string         `json:"kind"`
+		Items []ipPoolObject `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return nil, err
+	}
+	objs := list.Items
+	if list.Kind == "IPPool" {
+		var one ipPoolObject
+		if err := json.Unmarshal(in, &one); err != nil {
+			return nil, err
+		}
+		objs = []ipPoolObject{one}
+	}
+	if len(objs) == 0 {
+		return nil, fmt.Errorf("no IPPool found (kind %q)", list.Kind)
+	}
+
+	var out []IPPool
+	for _, o := range objs {
+		cidr, err := netip.ParsePrefix(o.Spec.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("ippool %s: %w", o.Metadata.Name, err)
+		}
+		p := IPPool{
+			Name:         o.Metadata.Name,
+			CIDR:         cidr.Masked(),
+			BlockSize:    o.Spec.BlockSize,
+			IPIPMode:     orDefault(o.Spec.IPIPMode, "Never"),
+			VXLANMode:    orDefault(o.Spec.VXLANMode, "Never"),
+			NATOutgoing:  o.Spec.NATOutgoing,
+			NodeSelector: orDefault(o.Spec.NodeSelector, "all()"),
+			Disabled:     o.Spec.Disabled,
+		}
+		if p.BlockSize == 0 {
+			p.BlockSize = defaultBlockSizeV4
+			if cidr.Addr().Is6() {
+				p.BlockSize = defaultBlockSizeV6
+			}
+		}
+		if p.BlockSize < cidr.Bits() || p.BlockSize > cidr.Addr().BitLen() {
+			return nil, fmt.Errorf("ippool %s: blockSize /%d doesn't fit in %s", p.Name, p.BlockSize, cidr)
+		}
+		out = append(out, p)
+	}
+	return out, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Capacity is what a pool can hold.
+type Capacity struct {
+	Blocks      uint64 `json:"blocks"`
+	IPsPerBlock uint64 `json:"ips_per_block"`
+	TotalIPs    uint64 `json:"total_ips"`
+
+	// MaxNodes is one block each. Calico will hand a node a second block
+	// when its first fills up, so nodes beyond that count are only possible
+	// by borrowing addresses from other nodes' blocks, which breaks route
+	// aggregation.
+	MaxNodes uint64 `json:"max_nodes"`
+
+	// PodsPerNode is the fair share when Nodes nodes split the pool, whole
+	// blocks each, minus the one address Calico gives each node's tunnel
+	// device when IPIP or VXLAN is on: one per node, however many blocks it
+	// has. With more nodes than blocks they borrow from each other's blocks
+	// and the pool's addresses are simply split. 0 when no node count was
+	// given.
+	Nodes         int    `json:"nodes,omitempty"`
+	BlocksPerNode uint64 `json:"blocks_per_node,omitempty"`
+	PodsPerNode   uint64 `json:"pods_per_node,omitempty"`
+}
+
+// Encapsulated reports whether pod traffic between some nodes is tunnelled.
+func (p IPPool) Encapsulated() bool {
+	return p.IPIPMode != "Never" || p.VXLANMode != "Never"
+}
+
+// Overhead is the bytes encapsulation adds to a pod packet sent between
+// nodes: an outer IPv4 header for IPIP (20), or outer IP, UDP, VXLAN and
+// inner Ethernet headers for VXLAN (50, or 70 for an IPv6 pool). The pod
+// MTU has to be this much smaller than the nodes'.
+func (p IPPool) Overhead() int {
+	switch {
+	case p.VXLANMode != "Never":
+		if p.CIDR.Addr().Is6() {
+			return 70
+		}
+		return 50
+	case p.IPIPMode != "Never":
+		return 20
+	}
+	return 0
+}
+
+// Capacity sizes the pool for nodes nodes (0 if unknown). Counts saturate at
+// math.MaxUint64 for absurd IPv6 pools.
+func (p IPPool) Capacity(nodes int) Capacity {
+	c := Capacity{
+		Blocks:      pow2(p.BlockSize - p.CIDR.Bits()),
+		IPsPerBlock: pow2(p.CIDR.Addr().BitLen() - p.BlockSize),
+	}
+	c.TotalIPs = satMul(c.Blocks, c.IPsPerBlock)
+	c.MaxNodes = c.Blocks
+	if nodes > 0 {
+		c.Nodes = nodes
+		c.BlocksPerNode = c.Blocks / uint64(nodes)
+		c.PodsPerNode = satMul(c.BlocksPerNode, c.IPsPerBlock)
+		if c.BlocksPerNode == 0 {
+			c.PodsPerNode = c.TotalIPs / uint64(nodes)
+		}
+		if p.Encapsulated() && c.PodsPerNode > 0 && c.PodsPerNode != math.MaxUint64 {
+			c.PodsPerNode--
+		}
+	}
+	return c
+}
+
+func pow2(n int) uint64 {
+	if n >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << n
+}
+
+func satMul(a, b uint64) uint64 {
+	hi, lo := new(big.Int).SetUint64(a), new(big.Int).SetUint64(b)
+	if p := hi.Mul(hi, lo); p.IsUint64() {
+		return p.Uint64()
+	}
+	return math.MaxUint64
+}
+
+// Relation describes how the pool sits against the cluster's pod subnet
+// (kind's networking.podSubnet, kubeadm's --pod-network-cidr).
+type Relation string
+
+const (
+	Equal    Relation = "equal"
+	Inside   Relation = "inside"   // pool is part of the pod subnet: fine
+	Contains Relation = "contains" // pool is bigger than the pod subnet
+	Disjoint Relation = "disjoint" // pods get addresses the cluster doesn't consider pod IPs
+)
+
+// Against compares the pool with the pod subnet.
+func (p IPPool) Against(podSubnet netip.Prefix) Relation {
+	podSubnet = podSubnet.Masked()
+	switch {
+	case p.CIDR == podSubnet:
+		return Equal
+	case !p.CIDR.Overlaps(podSubnet):
+		return Disjoint
+	case p.CIDR.Bits() > podSubnet.Bits():
+		return Inside
+	}
+	// two overlapping prefixes: one holds the other
+	return Contains
+}
+
+// Block is one allocated block and the node it belongs to.
+type Block struct {
+	Prefix netip.Prefix `json:"prefix"`
+	Node   string       `json:"node"`
+	Via    string       `json:"via,omitempty"`
+}
+
+// Blocks maps the pool's blocks to nodes using routes from birdcl (`show
+// route`) on node self. Blocks reached via a peer belong to the node with
+// that InternalIP; self's own blocks show up as blackhole routes, which
+// Calico installs so traffic for unallocated addresses in them goes nowhere.
+func (p IPPool) Blocks(routes []bird.Route, nodes []kube.Node, self string) []Block {
+	byIP := map[string]string{}
+	for _, n := range nodes {
+		byIP[n.InternalIP] = n.Name
+	}
+	seen := map[netip.Prefix]bool{}
+	var out []Block
+	for _, r := range routes {
+		if r.Prefix.Bits() != p.BlockSize || !p.CIDR.Contains(r.Prefix.Addr()) || seen[r.Prefix] {
+			continue
+		}
+		b := Block{Prefix: r.Prefix}
+		switch {
+		case r.Kind == "blackhole":
+			b.Node = self
+		case r.BGPNextHop != "":
+			b.Via = r.BGPNextHop
+		case len(r.NextHops) > 0:
+			b.Via = r.NextHops[0].Gateway
+		}
+		if b.Via != "" {
+			b.Node = byIP[b.Via]
+		}
+		seen[r.Prefix] = true
+		out = append(out, b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Prefix.Addr().Less(out[j].Prefix.Addr()) })
+	return out
+}
@@ -0,0 +1,243 @@
+package calico
+
+import (
+	"math"
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/montybeatnik/learn-k8s/bird"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+func TestParseIPPoolsFixture(t *testing.T) {
+	f, err := os.Open("../examples/calico/ippool.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := ParseIPPools(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []IPPool{{
+		Name:         "default-ipv4-ippool",
+		CIDR:         netip.MustParsePrefix("192.168.0.0/16"),
+		BlockSize:    26,
+		IPIPMode:     "Never",
+		VXLANMode:    "CrossSubnet",
+		NATOutgoing:  true,
+		NodeSelector: "all()",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
+
+func TestParseIPPools(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []IPPool
+		wantErr string
+	}{
+		{
+			// the defaults Calico fills in, and a host address masked
+			name: "yaml list with defaults",
+			in: `apiVersion: v1
+kind: List
+items:
+- kind: IPPool
+  metadata:
+    name: v4
+  spec:
+    cidr: 10.244.1.7/16
+- kind: IPPool
+  metadata:
+    name: v6
+  spec:
+    cidr: fd00:10:244::/56
+    ipipMode: Always
+    disabled: true
+`,
+			want: []IPPool{
+				{Name: "v4", CIDR: netip.MustParsePrefix("10.244.0.0/16"), BlockSize: 26, IPIPMode: "Never", VXLANMode: "Never", NodeSelector: "all()"},
+				{Name: "v6", CIDR: netip.MustParsePrefix("fd00:10:244::/56"), BlockSize: 122, IPIPMode: "Always", VXLANMode: "Never", NodeSelector: "all()", Disabled: true},
+			},
+		},
+		{
+			name:    "block bigger than the pool",
+			in:      `{"kind":"IPPool","metadata":{"name":"p"},"spec":{"cidr":"10.0.0.0/24","blockSize":20}}`,
+			wantErr: "blockSize /20 doesn't fit",
+		},
+		{
+			name:    "block smaller than an address",
+			in:      `{"kind":"IPPool","metadata":{"name":"p"},"spec":{"cidr":"10.0.0.0/24","blockSize":33}}`,
+			wantErr: "blockSize /33 doesn't fit",
+		},
+		{
+			name:    "bad cidr",
+			in:      `{"kind":"IPPool","metadata":{"name":"p"},"spec":{"cidr":"10.0.0.0"}}`,
+			wantErr: "ippool p",
+		},
+		{
+			name:    "empty list",
+			in:      `{"kind":"IPPoolList","items":[]}`,
+			wantErr: "no IPPool found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIPPools(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func pool(cidr string, blockSize int, vxlan string) IPPool {
+	return IPPool{CIDR: netip.MustParsePrefix(cidr), BlockSize: blockSize, IPIPMode: "Never", VXLANMode: vxlan}
+}
+
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		name  string
+		pool  IPPool
+		nodes int
+		want  Capacity
+	}{
+		{
+			name: "no node count",
+			pool: pool("192.168.0.0/16", 26, "Never"),
+			want: Capacity{Blocks: 1024, IPsPerBlock: 64, TotalIPs: 65536, MaxNodes: 1024},
+		},
+		{
+			name:  "plain routing",
+			pool:  pool("192.168.0.0/16", 26, "Never"),
+			nodes: 3,
+			want:  Capacity{Blocks: 1024, IPsPerBlock: 64, TotalIPs: 65536, MaxNodes: 1024, Nodes: 3, BlocksPerNode: 341, PodsPerNode: 341 * 64},
+		},
+		{
+			// one tunnel address per node, not per block
+			name:  "vxlan",
+			pool:  pool("192.168.0.0/16", 26, "CrossSubnet"),
+			nodes: 3,
+			want:  Capacity{Blocks: 1024, IPsPerBlock: 64, TotalIPs: 65536, MaxNodes: 1024, Nodes: 3, BlocksPerNode: 341, PodsPerNode: 341*64 - 1},
+		},
+		{
+			name:  "ipip",
+			pool:  IPPool{CIDR: netip.MustParsePrefix("10.244.0.0/24"), BlockSize: 26, IPIPMode: "Always", VXLANMode: "Never"},
+			nodes: 4,
+			want:  Capacity{Blocks: 4, IPsPerBlock: 64, TotalIPs: 256, MaxNodes: 4, Nodes: 4, BlocksPerNode: 1, PodsPerNode: 63},
+		},
+		{
+			name:  "more nodes than blocks",
+			pool:  pool("10.244.0.0/24", 26, "Always"),
+			nodes: 10,
+			want:  Capacity{Blocks: 4, IPsPerBlock: 64, TotalIPs: 256, MaxNodes: 4, Nodes: 10, PodsPerNode: 25 - 1},
+		},
+		{
+			name:  "one block",
+			pool:  pool("10.244.0.0/26", 26, "Never"),
+			nodes: 1,
+			want:  Capacity{Blocks: 1, IPsPerBlock: 64, TotalIPs: 64, MaxNodes: 1, Nodes: 1, BlocksPerNode: 1, PodsPerNode: 64},
+		},
+		{
+			// every address a block, and the node's goes to the tunnel
+			name:  "/32 blocks",
+			pool:  pool("10.244.0.0/30", 32, "Always"),
+			nodes: 4,
+			want:  Capacity{Blocks: 4, IPsPerBlock: 1, TotalIPs: 4, MaxNodes: 4, Nodes: 4, BlocksPerNode: 1, PodsPerNode: 0},
+		},
+		{
+			// 2^74 blocks: the counts saturate rather than wrap
+			name:  "ipv6",
+			pool:  pool("fd00::/48", 122, "Always"),
+			nodes: 3,
+			want: Capacity{Blocks: math.MaxUint64, IPsPerBlock: 64, TotalIPs: math.MaxUint64, MaxNodes: math.MaxUint64,
+				Nodes: 3, BlocksPerNode: math.MaxUint64 / 3, PodsPerNode: math.MaxUint64},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pool.Capacity(tt.nodes); got != tt.want {
+				t.Errorf("got  %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOverhead(t *testing.T) {
+	tests := []struct {
+		pool IPPool
+		want int
+	}{
+		{pool("10.244.0.0/16", 26, "Never"), 0},
+		{IPPool{CIDR: netip.MustParsePrefix("10.244.0.0/16"), IPIPMode: "CrossSubnet", VXLANMode: "Never"}, 20},
+		{pool("10.244.0.0/16", 26, "Always"), 50},
+		{pool("fd00::/48", 122, "Always"), 70},
+	}
+	for _, tt := range tests {
+		if got := tt.pool.Overhead(); got != tt.want {
+			t.Errorf("%s ipip %s vxlan %s: Overhead() = %d, want %d", tt.pool.CIDR, tt.pool.IPIPMode, tt.pool.VXLANMode, got, tt.want)
+		}
+	}
+}
+
+func TestAgainst(t *testing.T) {
+	p := pool("10.244.0.0/16", 26, "Never")
+	for subnet, want := range map[string]Relation{
+		"10.244.0.0/16":  Equal,
+		"10.244.99.0/16": Equal,
+		"10.0.0.0/8":     Inside,
+		"10.244.0.0/24":  Contains,
+		"192.168.0.0/16": Disjoint,
+	} {
+		if got := p.Against(netip.MustParsePrefix(subnet)); got != want {
+			t.Errorf("Against(%s) = %s, want %s", subnet, got, want)
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	routes, err := bird.ParseRoutes(strings.NewReader(`192.168.240.192/32 via 172.19.0.2 on eth0 [Mesh_172_19_0_4 16:01:02 from 172.19.0.4] * (100/0) [i]
+192.168.240.192/26 via 172.19.0.2 on eth0 [Mesh_172_19_0_2 16:01:03] * (100/0) [i]
+                   via 172.19.0.2 on eth0 [Mesh_172_19_0_4 16:01:02 from 172.19.0.4] (100/0) [i]
+192.168.156.64/26  via 172.19.0.4 on eth0 [Mesh_172_19_0_4 16:01:02] * (100/0) [i]
+192.168.1.0/26     blackhole [static1 16:01:01] * (200)
+192.168.9.0/26     via 172.19.0.9 on eth0 [Mesh_172_19_0_9 16:01:02] * (100/0) [i]
+10.96.0.0/26       via 172.19.0.4 on eth0 [Mesh_172_19_0_4 16:01:02] * (100/0) [i]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []kube.Node{
+		{Name: "control-plane", InternalIP: "172.19.0.4"},
+		{Name: "worker", InternalIP: "172.19.0.3"},
+		{Name: "worker2", InternalIP: "172.19.0.2"},
+	}
+	got := pool("192.168.0.0/16", 26, "Never").Blocks(routes, nodes, "worker")
+	want := []Block{
+		// our own, as a blackhole
+		{Prefix: netip.MustParsePrefix("192.168.1.0/26"), Node: "worker"},
+		// a peer that isn't in the node list
+		{Prefix: netip.MustParsePrefix("192.168.9.0/26"), Via: "172.19.0.9"},
+		{Prefix: netip.MustParsePrefix("192.168.156.64/26"), Node: "control-plane", Via: "172.19.0.4"},
+		{Prefix: netip.MustParsePrefix("192.168.240.192/26"), Node: "worker2", Via: "172.19.0.2"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %+v\nwant %+v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/pcap"
+)
+
+// enablePcap turns on /debug/pcap. It's off by default: anyone who can reach
+// the port could read every packet in the pod.
+var enablePcap = false
+
+const (
+	pcapMaxDuration = 5 * time.Minute
+	pcapSnaplen     = 65535
+)
+
+// pcapHandler streams a packet capture in pcap format, tcpdump without
+// tcpdump. It needs CAP_NET_RAW. Query parameters:
+//
+//	?iface=eth0         interface to capture on (default eth0)
+//	?duration=10s       stop after this long (default 10s, at most 5m)
+//	?count=100          stop after this many packets (default 1000)
+//	?port=8080&port=53  either port matches
+//	?host=10.244.1.5    source or destination matches
+//	?proto=tcp          tcp, udp, sctp or icmp
+//
+// The connection the capture is streamed over is always left out.
+func pcapHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	iface := q.Get("iface")
+	if iface == "" {
+		iface = "eth0"
+	}
+	duration := 10 * time.Second
+	if v := q.Get("duration"); v != "" {
+		var err error
+		if duration, err = time.ParseDuration(v); err != nil || duration <= 0 || duration > pcapMaxDuration {
+			http.Error(w, "duration must be a positive duration up to "+pcapMaxDuration.String(), http.StatusBadRequest)
+			return
+		}
+	}
+	count := 1000
+	if v := q.Get("count"); v != "" {
+		var err error
+		if count, err = strconv.Atoi(v); err != nil || count <= 0 {
+			http.Error(w, "count must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter := pcap.Filter{Proto: q.Get("proto")}
+	for _, v := range q["port"] {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad port %q", v), http.StatusBadRequest)
+			return
+		}
+		filter.Ports = append(filter.Ports, uint16(p))
+	}
+	for _, v := range q["host"] {
+		h, err := netip.ParseAddr(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad host %q", v), http.StatusBadRequest)
+			return
+		}
+		filter.Hosts = append(filter.Hosts, h.Unmap())
+	}
+	filter.Skip = ownPorts(r)
+
+	src, err := pcap.Open(iface, filter, pcapSnaplen)
+	switch {
+	case errors.Is(err, os.ErrPermission):
+		http.Error(w, "capturing needs CAP_NET_RAW: "+err.Error(), http.StatusForbidden)
+		return
+	case errors.Is(err, errors.ErrUnsupported):
+		http.Error(w, "packet capture needs Linux", http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+
+	streaming(w)
+	hn, _ := os.Hostname()
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", hn+"-"+iface+".pcap"))
+	pw, err := pcap.NewWriter(w, pcapSnaplen, src.LinkType())
+	if err != nil {
+		return
+	}
+	rc := http.NewResponseController(w)
+	rc.Flush()
+
+	log.Printf("capturing on %s for %v: %s\n", iface, duration, filter)
+	src.SetDeadline(time.Now().Add(duration))
+	stop := context.AfterFunc(r.Context(), func() { src.SetDeadline(time.Now()) })
+	defer stop()
+
+	buf := make([]byte, pcapSnaplen)
+	n := 0
+	for ; n < count; n++ {
+		l, orig, err := src.ReadPacket(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("capture on %s: %v\n", iface, err)
+			}
+			break
+		}
+		if err := pw.WritePacket(time.Now(), buf[:l], orig); err != nil {
+			break
+		}
+		rc.Flush()
+	}
+	log.Printf("captured %d packets on %s\n", n, iface)
+}
+
+// ownPorts returns the local and remote ports of the connection r came in
+// on, so the capture doesn't record itself being sent.
+func ownPorts(r *http.Request) [2]uint16 {
+	local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return [2]uint16{}
+	}
+	remote, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return [2]uint16{}
+	}
+	return [2]uint16{uint16(local.Port), remote.Port()}
+}
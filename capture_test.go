@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/pcap"
+)
+
+// A capture on loopback, filtered to one UDP port, records the datagram
+// sent there and not the one sent elsewhere, nor the HTTP it streams over.
+func TestCaptureLoopback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, http.HandlerFunc(pcapHandler))
+	want, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	port := want.LocalAddr().(*net.UDPAddr).Port
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/debug/pcap?iface=lo&proto=udp&count=1&duration=5s&port=" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusForbidden, http.StatusNotImplemented:
+		msg, _ := io.ReadAll(resp.Body)
+		t.Skipf("can't capture here: %s", bytes.TrimSpace(msg))
+	default:
+		msg, _ := io.ReadAll(resp.Body)
+		t.Fatalf("%s: %s", resp.Status, msg)
+	}
+
+	// the headers come once the socket is open, so these are captured
+	c, err := net.Dial("udp", other.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("filtered out"))
+	c.Close()
+	c, err = net.Dial("udp", want.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("captured"))
+	c.Close()
+
+	var hdr [24]byte
+	if _, err := io.ReadFull(resp.Body, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	if magic, link := binary.LittleEndian.Uint32(hdr[:]), binary.LittleEndian.Uint32(hdr[20:]); magic != 0xa1b2c3d4 || pcap.LinkType(link) != pcap.LinkEthernet {
+		t.Fatalf("file header % x: want pcap magic and Ethernet link type", hdr)
+	}
+	var rec [16]byte
+	if _, err := io.ReadFull(resp.Body, rec[:]); err != nil {
+		t.Fatal(err)
+	}
+	caplen, origLen := binary.LittleEndian.Uint32(rec[8:]), binary.LittleEndian.Uint32(rec[12:])
+	if caplen != origLen || caplen > 1500 {
+		t.Fatalf("record header % x: want a whole, small packet", rec)
+	}
+	pkt := make([]byte, caplen)
+	if _, err := io.ReadFull(resp.Body, pkt); err != nil {
+		t.Fatal(err)
+	}
+	// Ethernet, IPv4 with no options, UDP
+	const udp = 14 + 20
+	if len(pkt) < udp+8 || int(binary.BigEndian.Uint16(pkt[udp+2:])) != port || !bytes.Equal(pkt[udp+8:], []byte("captured")) {
+		t.Errorf("captured % x, want the datagram to port %d", pkt, port)
+	}
+
+	// count=1: the capture ends after it
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("after the packet: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("capture still running after count packets")
+	}
+}
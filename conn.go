@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// connInfo is attached to every accepted connection through
+// http.Server.ConnContext. HTTP/2 requests inherit their connection's
+// context, so all streams on one connection share a connInfo.
+type connInfo struct {
+	id      uint64
+	server  string
+	created time.Time
+	conn    net.Conn
+
+	requests atomic.Int64
+
+	mu         sync.Mutex
+	state      http.ConnState
+	stateSince time.Time
+	remote     string
+	local      string
+	family     string
+	closed     time.Time
+}
+
+type connInfoKey struct{}
+
+type requestSeqKey struct{}
+
+// connTable is every connection our HTTP servers have open, plus the most
+// recently closed ones so short-lived curls still show up in /debug/conns.
+type connTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	open   map[net.Conn]*connInfo
+	closed []*connInfo
+}
+
+const keepClosedConns = 50
+
+var conns = &connTable{open: map[net.Conn]*connInfo{}}
+
+// add runs in the server's accept loop, so it must not block. In particular
+// it doesn't ask for RemoteAddr or the family: with -proxy-protocol both
+// wait for the header. They're filled in once the connection goes active.
+func (t *connTable) add(server string, c net.Conn) *connInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nextID++
+	now := time.Now()
+	ci := &connInfo{
+		id:         t.nextID,
+		server:     server,
+		created:    now,
+		conn:       c,
+		state:      http.StateNew,
+		stateSince: now,
+	}
+	t.open[c] = ci
+	return ci
+}
+
+// setState is the http.Server.ConnState hook.
+func (t *connTable) setState(c net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	ci, ok := t.open[c]
+	if ok && (state == http.StateClosed || state == http.StateHijacked) {
+		delete(t.open, c)
+		t.closed = append(t.closed, ci)
+		if len(t.closed) > keepClosedConns {
+			t.closed = t.closed[1:]
+		}
+	}
+	t.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	now := time.Now()
+	ci.state, ci.stateSince = state, now
+	if state == http.StateActive && ci.remote == "" {
+		// ConnState runs on the connection's goroutine from here on, so it's
+		// safe to wait for a PROXY header.
+		ci.remote, ci.local = c.RemoteAddr().String(), c.LocalAddr().String()
+		ci.family = addrFamily(c)
+	}
+	if state == http.StateClosed || state == http.StateHijacked {
+		ci.closed = now
+	}
+}
+
+// ConnStat is one row of /debug/conns.
+type ConnStat struct {
+	ID       uint64 `json:"id"`
+	Server   string `json:"server"`
+	Remote   string `json:"remote"`
+	Local    string `json:"local"`
+	Family   string `json:"family"`
+	State    string `json:"state"`
+	InState  string `json:"in_state"`
+	Age      string `json:"age"`
+	Requests int64  `json:"requests"`
+	BytesIn  int64  `json:"bytes_in"`
+	BytesOut int64  `json:"bytes_out"`
+}
+
+func (ci *connInfo) stat(now time.Time) ConnStat {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	end := now
+	if !ci.closed.IsZero() {
+		end = ci.closed
+	}
+	s := ConnStat{
+		ID:       ci.id,
+		Server:   ci.server,
+		Remote:   ci.remote,
+		Local:    ci.local,
+		Family:   ci.family,
+		State:    ci.state.String(),
+		InState:  now.Sub(ci.stateSince).Round(time.Millisecond).String(),
+		Age:      end.Sub(ci.created).Round(time.Millisecond).String(),
+		Requests: ci.requests.Load(),
+	}
+	if cc, ok := findConn[*countingConn](ci.conn); ok {
+		s.BytesIn, s.BytesOut = cc.in.Load(), cc.out.Load()
+	}
+	return s
+}
+
+// snapshot returns open and recently closed connections, oldest first.
+func (t *connTable) snapshot() (open, closed []ConnStat) {
+	t.mu.Lock()
+	openInfos := make([]*connInfo, 0, len(t.open))
+	for _, ci := range t.open {
+		openInfos = append(openInfos, ci)
+	}
+	closedInfos := append([]*connInfo{}, t.closed...)
+	t.mu.Unlock()
+
+	now := time.Now()
+	for _, ci := range openInfos {
+		open = append(open, ci.stat(now))
+	}
+	for _, ci := range closedInfos {
+		closed = append(closed, ci.stat(now))
+	}
+	sort.Slice(open, func(i, j int) bool { return open[i].ID < open[j].ID })
+	return open, closed
+}
+
+// connsHandler shows every connection the server is holding. Run a few
+// `curl`s and they come and go; a keep-alive client (a browser, `hey`, a
+// gRPC client) stays put, idle, waiting for its next request.
+func connsHandler(w http.ResponseWriter, r *http.Request) {
+	open, closed := conns.snapshot()
+	if open == nil {
+		open = []ConnStat{}
+	}
+	if closed == nil {
+		closed = []ConnStat{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Open   []ConnStat `json:"open"`
+		Closed []ConnStat `json:"recently_closed"`
+	}{open, closed})
+}
+
+// findConn digs through wrapped connections (anything with a NetConn
+// method, like tls.Conn) for one of type T.
+func findConn[T any](c net.Conn) (T, bool) {
+	for {
+		if t, ok := c.(T); ok {
+			return t, true
+		}
+		wc, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			var zero T
+			return zero, false
+		}
+		c = wc.NetConn()
+	}
+}
+
+// addrFamily returns the family the listener recorded, falling back to
+// guessing from the remote address.
+func addrFamily(c net.Conn) string {
+	if fc, ok := findConn[interface{ AddrFamily() string }](c); ok {
+		return fc.AddrFamily()
+	}
+	return connFamily(c, false)
+}
+
+// countingListener counts the bytes each accepted connection moves.
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: c}, nil
+}
+
+type countingConn struct {
+	net.Conn
+	in, out atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.out.Add(int64(n))
+	return n, err
+}
+
+func (c *countingConn) NetConn() net.Conn { return c.Conn }
+
+// countRequests numbers each request within its connection. The first request
+// on a fresh connection is 1; anything higher means the client reused it.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ci := requestConn(r); ci != nil {
+			seq := ci.requests.Add(1)
+			r = r.WithContext(context.WithValue(r.Context(), requestSeqKey{}, seq))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func requestConn(r *http.Request) *connInfo {
+	ci, _ := r.Context().Value(connInfoKey{}).(*connInfo)
+	return ci
+}
+
+// requestFamily returns the address family of the connection r arrived on.
+func requestFamily(r *http.Request) string {
+	ci := requestConn(r)
+	if ci == nil {
+		return ""
+	}
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+	return ci.family
+}
+
+// requestConnID returns the /debug/conns id of the connection r arrived on.
+func requestConnID(r *http.Request) uint64 {
+	if ci := requestConn(r); ci != nil {
+		return ci.id
+	}
+	return 0
+}
+
+// requestSeq returns the number countRequests gave r, or 0.
+func requestSeq(r *http.Request) int64 {
+	seq, _ := r.Context().Value(requestSeqKey{}).(int64)
+	return seq
+}
@@ -0,0 +1,377 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// resource is an API resource the controller reads and writes.
+type resource struct {
+	group, version, name string
+	kind                 string // for log lines and status messages
+}
+
+var (
+	learnApps   = resource{Group, Version, Resource, Kind}
+	deployments = resource{"apps", "v1", "deployments", "Deployment"}
+	services    = resource{"", "v1", "services", "Service"}
+)
+
+func (r resource) listPath(namespace string) string {
+	return kube.ListPath(r.group, r.version, r.name, namespace)
+}
+
+func (r resource) path(key string) string {
+	ns, name, _ := strings.Cut(key, "/")
+	return r.listPath(ns) + "/" + name
+}
+
+// Controller keeps every LearnApp's Deployment and Service in line with its
+// spec, and reports how that's going in the LearnApp's status.
+type Controller struct {
+	client *kube.Client
+	queue  *Queue
+
+	apps, deployments, services *Informer
+
+	// now is the clock conditions' lastTransitionTime is read from.
+	now func() time.Time
+}
+
+// New watches LearnApps in namespace, or in every namespace when it's "".
+func New(client *kube.Client, namespace string) *Controller {
+	c := &Controller{client: client, queue: NewQueue(), now: time.Now}
+	// a conflict clears up in milliseconds, but an object in the way stays
+	// until someone moves it; start slower so that doesn't flood the log
+	c.queue.BaseDelay = 100 * time.Millisecond
+
+	// only look at what we created: a namespace's other Deployments are
+	// none of our business, and caching them all would cost memory
+	owned := "?labelSelector=" + url.QueryEscape(LabelManagedBy+"="+ManagedBy)
+	c.apps = NewInformer(client, learnApps.listPath(namespace), func(key string, _ json.RawMessage) {
+		c.queue.Add(key)
+	})
+	c.deployments = NewInformer(client, deployments.listPath(namespace)+owned, c.enqueueOwner)
+	c.services = NewInformer(client, services.listPath(namespace)+owned, c.enqueueOwner)
+	return c
+}
+
+// enqueueOwner queues the LearnApp that controls obj, so a Deployment
+// someone scaled by hand, or one whose pods became ready, gets looked at.
+func (c *Controller) enqueueOwner(_ string, obj json.RawMessage) {
+	m := metaOf(obj)
+	if owner, ok := m.ControllerOf(); ok && owner.APIVersion == APIVersion && owner.Kind == Kind {
+		c.queue.Add(m.Namespace + "/" + owner.Name)
+	}
+}
+
+// Run starts the informers, waits for their first lists, then reconciles
+// with workers goroutines until ctx ends.
+func (c *Controller) Run(ctx context.Context, workers int) error {
+	informers := []*Informer{c.apps, c.deployments, c.services}
+	for _, i := range informers {
+		go i.Run(ctx)
+	}
+	// reconciling before every cache is filled would see Deployments as
+	// missing and try to create them again
+	for !c.apps.HasSynced() || !c.deployments.HasSynced() || !c.services.HasSynced() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	log.Printf("controller: caches synced, %d LearnApps; starting %d workers\n", len(c.apps.Keys()), workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c.processNext(ctx) {
+			}
+		}()
+	}
+	<-ctx.Done()
+	c.queue.ShutDown()
+	wg.Wait()
+	return nil
+}
+
+func (c *Controller) processNext(ctx context.Context) bool {
+	key, ok := c.queue.Get()
+	if !ok {
+		return false
+	}
+	defer c.queue.Done(key)
+
+	if err := c.reconcile(ctx, key); err != nil {
+		if kube.IsConflict(err) {
+			// routine: the cache hasn't caught up with our own last write
+			log.Printf("controller: %s: changed since the cache saw it; trying again\n", key)
+		} else {
+			log.Printf("controller: %s: %v (failure %d)\n", key, err, c.queue.Failures(key)+1)
+		}
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// errNotOwned is an object in the way: it has the name we'd give ours but
+// some other owner, or none.
+type errNotOwned struct {
+	res resource
+	key string
+}
+
+func (e errNotOwned) Error() string {
+	return fmt.Sprintf("%s %s exists and isn't controlled by this LearnApp", e.res.kind, e.key)
+}
+
+// reconcile makes the LearnApp key's Deployment and Service match its spec
+// and writes down in its status how that went.
+func (c *Controller) reconcile(ctx context.Context, key string) error {
+	raw, ok := c.apps.Get(key)
+	if !ok {
+		// deleted: the garbage collector removes what it owned
+		return nil
+	}
+	var app LearnApp
+	if err := json.Unmarshal(raw, &app); err != nil {
+		return err
+	}
+	if app.Metadata.DeletionTimestamp != "" {
+		return nil
+	}
+	app = app.withDefaults()
+
+	status := app.Status
+	status.Conditions = append([]Condition{}, app.Status.Conditions...)
+	status.ObservedGeneration = app.Metadata.Generation
+
+	if err := app.validate(); err != nil {
+		// nothing to retry until the spec changes, which queues it again
+		c.setCondition(&status, app, ConditionReconciled, "False", "InvalidSpec", err.Error())
+		return c.updateStatus(ctx, raw, app, status)
+	}
+
+	dep, err := c.apply(ctx, app, deployments, c.deployments, desiredDeployment(app), "spec.replicas", "spec.template")
+	if err == nil {
+		if app.Spec.Expose == ExposeNone {
+			err = c.deleteService(ctx, app)
+			status.Service = ""
+		} else {
+			_, err = c.apply(ctx, app, services, c.services, desiredService(app), "spec.type", "spec.selector", "spec.ports")
+			status.Service = app.Metadata.Name
+		}
+	}
+	if kube.IsConflict(err) {
+		// the informer is behind what we wrote last time; not worth a
+		// condition, it will have caught up by the retry
+		return err
+	}
+	switch {
+	case err == nil:
+		c.setCondition(&status, app, ConditionReconciled, "True", "Reconciled", "Deployment and Service match the spec")
+	case errors.As(err, new(errNotOwned)):
+		c.setCondition(&status, app, ConditionReconciled, "False", "NotOwned", err.Error())
+	default:
+		c.setCondition(&status, app, ConditionReconciled, "False", "ReconcileError", err.Error())
+	}
+
+	if dep != nil {
+		status.Replicas = int32(number(dep, "status.replicas"))
+		status.ReadyReplicas = int32(number(dep, "status.readyReplicas"))
+		want := *app.Spec.Replicas
+		msg := fmt.Sprintf("%d/%d replicas ready", status.ReadyReplicas, want)
+		if status.ReadyReplicas >= want && status.Replicas == want {
+			c.setCondition(&status, app, ConditionAvailable, "True", "ReplicasReady", msg)
+		} else {
+			c.setCondition(&status, app, ConditionAvailable, "False", "ReplicasNotReady", msg)
+		}
+	}
+
+	if serr := c.updateStatus(ctx, raw, app, status); err == nil {
+		err = serr
+	}
+	// an object in the way is retried with the usual backoff: we'd never
+	// hear it go, since it doesn't carry our label
+	return err
+}
+
+// apply creates want, or updates the fields at paths (and the labels and
+// owner) of the one the informer has, unless it already contains want. It
+// returns the object as the API server has it.
+func (c *Controller) apply(ctx context.Context, app LearnApp, res resource, inf *Informer, want map[string]any, paths ...string) (map[string]any, error) {
+	key := app.Metadata.Key()
+	raw, ok := inf.Get(key)
+	if !ok {
+		body, _ := json.Marshal(want)
+		out, err := c.client.Do(ctx, http.MethodPost, res.listPath(app.Metadata.Namespace), body)
+		if kube.IsConflict(err) {
+			// already there: either ours and the informer hasn't heard yet,
+			// or one without our label, which the informer never sees
+			out, err := c.client.Get(ctx, res.path(key))
+			if err != nil {
+				return nil, err
+			}
+			if owner, ok := metaOf(out).ControllerOf(); ok && owner.UID == app.Metadata.UID {
+				return decodeObject(out)
+			}
+			return nil, errNotOwned{res, key}
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("controller: %s: created %s\n", key, res.kind)
+		return decodeObject(out)
+	}
+
+	have, err := decodeObject(raw)
+	if err != nil {
+		return nil, err
+	}
+	if owner, ok := metaOf(raw).ControllerOf(); !ok || owner.UID != app.Metadata.UID {
+		return nil, errNotOwned{res, key}
+	}
+	if contains(have, want) {
+		return have, nil
+	}
+	for _, p := range append(paths, "metadata.ownerReferences") {
+		set(have, p, get(want, p))
+	}
+	// add our labels to whatever else is there
+	labels, _ := get(have, "metadata.labels").(map[string]any)
+	if labels == nil {
+		labels = map[string]any{}
+	}
+	for k, v := range get(want, "metadata.labels").(map[string]any) {
+		labels[k] = v
+	}
+	set(have, "metadata.labels", labels)
+	// have still carries the resourceVersion we read, so if the object has
+	// changed since, the API server answers 409 Conflict and we try again
+	// once the informer has caught up
+	body, _ := json.Marshal(have)
+	out, err := c.client.Do(ctx, http.MethodPut, res.path(key), body)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("controller: %s: updated %s\n", key, res.kind)
+	return decodeObject(out)
+}
+
+// deleteService removes the Service once spec.expose is None.
+func (c *Controller) deleteService(ctx context.Context, app LearnApp) error {
+	key := app.Metadata.Key()
+	raw, ok := c.services.Get(key)
+	if !ok {
+		return nil
+	}
+	if owner, ok := metaOf(raw).ControllerOf(); !ok || owner.UID != app.Metadata.UID {
+		return nil
+	}
+	_, err := c.client.Do(ctx, http.MethodDelete, services.path(key), nil)
+	if err != nil && !kube.IsNotFound(err) {
+		return err
+	}
+	log.Printf("controller: %s: deleted Service\n", key)
+	return nil
+}
+
+// setCondition sets one of status's conditions. lastTransitionTime only
+// moves when the condition's status does: it says since when, not when we
+// last looked.
+func (c *Controller) setCondition(status *LearnAppStatus, app LearnApp, typ, value, reason, message string) {
+	cond := Condition{
+		Type:               typ,
+		Status:             value,
+		ObservedGeneration: app.Metadata.Generation,
+		LastTransitionTime: c.now().UTC().Format(time.RFC3339),
+		Reason:             reason,
+		Message:            message,
+	}
+	for i, old := range status.Conditions {
+		if old.Type == typ {
+			if old.Status == value {
+				cond.LastTransitionTime = old.LastTransitionTime
+			}
+			status.Conditions[i] = cond
+			return
+		}
+	}
+	status.Conditions = append(status.Conditions, cond)
+}
+
+// updateStatus writes status through the status subresource, unless it's
+// what the LearnApp already says. Writing it anyway would change the
+// LearnApp's resourceVersion, which the informer would hand straight back
+// to us as a change to reconcile.
+func (c *Controller) updateStatus(ctx context.Context, raw json.RawMessage, app LearnApp, status LearnAppStatus) error {
+	if reflect.DeepEqual(status, app.Status) {
+		return nil
+	}
+	obj, err := decodeObject(raw)
+	if err != nil {
+		return err
+	}
+	b, _ := json.Marshal(status)
+	var st map[string]any
+	json.Unmarshal(b, &st)
+	obj["status"] = st
+	body, _ := json.Marshal(obj)
+	_, err = c.client.Do(ctx, http.MethodPut, learnApps.path(app.Metadata.Key())+"/status", body)
+	return err
+}
+
+func decodeObject(in []byte) (map[string]any, error) {
+	var obj map[string]any
+	err := json.Unmarshal(in, &obj)
+	return obj, err
+}
+
+// get returns the value at a dotted path such as spec.replicas.
+func get(obj map[string]any, path string) any {
+	var v any = obj
+	for _, k := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = m[k]
+	}
+	return v
+}
+
+// set puts v at a dotted path, creating the maps on the way.
+func set(obj map[string]any, path string, v any) {
+	keys := strings.Split(path, ".")
+	for _, k := range keys[:len(keys)-1] {
+		m, ok := obj[k].(map[string]any)
+		if !ok {
+			m = map[string]any{}
+			obj[k] = m
+		}
+		obj = m
+	}
+	obj[keys[len(keys)-1]] = v
+}
+
+// number reads a JSON number at path, 0 if there isn't one.
+func number(obj map[string]any, path string) float64 {
+	n, _ := get(obj, path).(float64)
+	return n
+}
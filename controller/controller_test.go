@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// run starts the controller against an in-memory API server and returns a
+// client for that server. Both stop when the test ends.
+func run(t *testing.T) *kube.Client {
+	t.Helper()
+	ts := httptest.NewServer(NewMemoryAPIServer(50 * time.Millisecond))
+	client := &kube.Client{Base: ts.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- New(client, "default").Run(ctx, 2) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil && err != context.Canceled {
+			t.Errorf("Run: %v", err)
+		}
+		ts.CloseClientConnections()
+		ts.Close()
+	})
+	return client
+}
+
+// create sends the example LearnApp, with spec replaced when it isn't nil.
+func create(t *testing.T, client *kube.Client, spec map[string]any) LearnApp {
+	t.Helper()
+	in, err := os.ReadFile("../examples/learnapp/learnapp.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spec != nil {
+		if in, err = kube.YAMLToJSON(in); err != nil {
+			t.Fatal(err)
+		}
+		obj, err := decodeObject(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj["spec"] = spec
+		in, _ = json.Marshal(obj)
+	}
+	out, err := client.Do(context.Background(), http.MethodPost, learnApps.listPath("default"), in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var app LearnApp
+	if err := json.Unmarshal(out, &app); err != nil {
+		t.Fatal(err)
+	}
+	return app
+}
+
+// waitFor reads path until ok says it's what the test is after, and
+// returns it; a 404 counts as nil.
+func waitFor(t *testing.T, client *kube.Client, path string, ok func(obj map[string]any) bool) map[string]any {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	var obj map[string]any
+	for {
+		out, err := client.Get(context.Background(), path)
+		switch {
+		case kube.IsNotFound(err):
+			obj = nil
+		case err != nil:
+			t.Fatal(err)
+		default:
+			if obj, err = decodeObject(out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ok(obj) {
+			return obj
+		}
+		if time.Now().After(deadline) {
+			body, _ := json.MarshalIndent(obj, "", "  ")
+			t.Fatalf("gave up waiting on %s:\n%s", path, body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// conditions is a LearnApp's status.conditions by type.
+func conditions(obj map[string]any) map[string]Condition {
+	var app LearnApp
+	if obj != nil {
+		b, _ := json.Marshal(obj)
+		json.Unmarshal(b, &app)
+	}
+	conds := map[string]Condition{}
+	for _, c := range app.Status.Conditions {
+		conds[c.Type] = c
+	}
+	return conds
+}
+
+func TestController(t *testing.T) {
+	client := run(t)
+	app := create(t, client, nil)
+	key := app.Metadata.Key()
+
+	dep := waitFor(t, client, deployments.path(key), func(obj map[string]any) bool { return obj != nil })
+	labels := map[string]any{LabelApp: "learn-k8s", LabelManagedBy: ManagedBy}
+	if got := get(dep, "metadata.labels"); !reflect.DeepEqual(got, labels) {
+		t.Errorf("Deployment labels %v, want %v", got, labels)
+	}
+	owner, ok := metaOf(mustJSON(dep)).ControllerOf()
+	if !ok || owner.UID != app.Metadata.UID || owner.Kind != Kind || owner.Name != "learn-k8s" {
+		t.Errorf("Deployment controller %+v, want the LearnApp %s", owner, app.Metadata.UID)
+	}
+	if n := number(dep, "spec.replicas"); n != 2 {
+		t.Errorf("Deployment replicas %v, want 2", n)
+	}
+	containers, _ := get(dep, "spec.template.spec.containers").([]any)
+	var images []any
+	for _, c := range containers {
+		images = append(images, get(c.(map[string]any), "image"))
+	}
+	if want := []any{"learn-k8s:v0.2.0", SidecarImage}; !reflect.DeepEqual(images, want) {
+		t.Errorf("Deployment images %v, want %v", images, want)
+	}
+
+	svc := waitFor(t, client, services.path(key), func(obj map[string]any) bool { return obj != nil })
+	if typ := get(svc, "spec.type"); typ != ExposeNodePort {
+		t.Errorf("Service type %v, want NodePort", typ)
+	}
+	if sel := get(svc, "spec.selector"); !reflect.DeepEqual(sel, map[string]any{LabelApp: "learn-k8s"}) {
+		t.Errorf("Service selector %v", sel)
+	}
+	ports, _ := get(svc, "spec.ports").([]any)
+	if len(ports) != 1 || number(ports[0].(map[string]any), "nodePort") != 30080 || number(ports[0].(map[string]any), "targetPort") != 8080 {
+		t.Errorf("Service ports %v, want 80 -> 8080 on nodePort 30080", ports)
+	}
+	if owner, ok := metaOf(mustJSON(svc)).ControllerOf(); !ok || owner.UID != app.Metadata.UID {
+		t.Errorf("Service controller %+v, want the LearnApp %s", owner, app.Metadata.UID)
+	}
+
+	// the replicas turn ready a little after the Deployment is created
+	got := waitFor(t, client, learnApps.path(key), func(obj map[string]any) bool {
+		return conditions(obj)[ConditionAvailable].Status == "True"
+	})
+	conds := conditions(got)
+	if c := conds[ConditionReconciled]; c.Status != "True" || c.Reason != "Reconciled" || c.ObservedGeneration != 1 {
+		t.Errorf("Reconciled %+v", c)
+	}
+	if c := conds[ConditionAvailable]; c.Reason != "ReplicasReady" || c.Message != "2/2 replicas ready" {
+		t.Errorf("Available %+v", c)
+	}
+	if number(got, "status.readyReplicas") != 2 || get(got, "status.service") != "learn-k8s" {
+		t.Errorf("status %v", get(got, "status"))
+	}
+
+	// scale up and stop exposing it: the Service goes, and Available is
+	// False until the new replica is ready too
+	obj := normalize(got)
+	set(obj, "spec.replicas", 3)
+	set(obj, "spec.expose", ExposeNone)
+	delete(obj["spec"].(map[string]any), "nodePort")
+	body, _ := json.Marshal(obj)
+	if _, err := client.Do(context.Background(), http.MethodPut, learnApps.path(key), body); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, client, services.path(key), func(obj map[string]any) bool { return obj == nil })
+	waitFor(t, client, deployments.path(key), func(obj map[string]any) bool { return number(obj, "spec.replicas") == 3 })
+	got = waitFor(t, client, learnApps.path(key), func(obj map[string]any) bool {
+		c := conditions(obj)[ConditionAvailable]
+		return c.Status == "True" && c.ObservedGeneration == 2
+	})
+	if c := conditions(got)[ConditionAvailable]; c.Message != "3/3 replicas ready" {
+		t.Errorf("Available %+v", c)
+	}
+	if s := get(got, "status.service"); s != nil {
+		t.Errorf("status.service %v after expose None", s)
+	}
+}
+
+func TestControllerInvalidSpec(t *testing.T) {
+	client := run(t)
+	app := create(t, client, map[string]any{"expose": ExposeClusterIP, "nodePort": 30080})
+	got := waitFor(t, client, learnApps.path(app.Metadata.Key()), func(obj map[string]any) bool {
+		return conditions(obj)[ConditionReconciled].Status != ""
+	})
+	if c := conditions(got)[ConditionReconciled]; c.Status != "False" || c.Reason != "InvalidSpec" {
+		t.Errorf("Reconciled %+v, want InvalidSpec", c)
+	}
+	if _, err := client.Get(context.Background(), deployments.path(app.Metadata.Key())); !kube.IsNotFound(err) {
+		t.Errorf("a Deployment for an invalid spec: err = %v", err)
+	}
+}
+
+func TestControllerNotOwned(t *testing.T) {
+	client := run(t)
+	// a Service of the same name that someone else made
+	svc := `{"apiVersion":"v1","kind":"Service","metadata":{"namespace":"default","name":"learn-k8s"},"spec":{"type":"ClusterIP"}}`
+	if _, err := client.Do(context.Background(), http.MethodPost, services.listPath("default"), []byte(svc)); err != nil {
+		t.Fatal(err)
+	}
+	app := create(t, client, nil)
+	got := waitFor(t, client, learnApps.path(app.Metadata.Key()), func(obj map[string]any) bool {
+		return conditions(obj)[ConditionReconciled].Status != ""
+	})
+	if c := conditions(got)[ConditionReconciled]; c.Status != "False" || c.Reason != "NotOwned" {
+		t.Errorf("Reconciled %+v, want NotOwned", c)
+	}
+	// and it's left alone
+	out := waitFor(t, client, services.path(app.Metadata.Key()), func(obj map[string]any) bool { return obj != nil })
+	if typ := get(out, "spec.type"); typ != ExposeClusterIP {
+		t.Errorf("Service type %v, want ClusterIP still", typ)
+	}
+}
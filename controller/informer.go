@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+const (
+	// informerRetry is how long an informer waits after losing the API
+	// server.
+	informerRetry = 2 * time.Second
+	// minWatchCycle spaces out watches that end as soon as they start.
+	minWatchCycle = time.Second
+)
+
+// Informer keeps a copy of every object a list path returns, kept current
+// by a watch, so the controller reads from memory rather than asking the
+// API server on every reconcile. OnChange hears about every object added,
+// changed or deleted, with the object as it is (or, when deleted, as it
+// last was).
+type Informer struct {
+	client   *kube.Client
+	path     string
+	onChange func(key string, obj json.RawMessage)
+
+	mu      sync.Mutex
+	objects map[string]json.RawMessage // by namespace/name
+	synced  bool
+}
+
+// NewInformer caches what path (a list path, optionally with a
+// labelSelector) returns.
+func NewInformer(client *kube.Client, path string, onChange func(key string, obj json.RawMessage)) *Informer {
+	return &Informer{client: client, path: path, onChange: onChange, objects: map[string]json.RawMessage{}}
+}
+
+// Run lists and watches until ctx ends.
+func (i *Informer) Run(ctx context.Context) {
+	for {
+		err := i.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("controller: %s: %v; retrying in %v\n", i.path, err, informerRetry)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(informerRetry):
+		}
+	}
+}
+
+// HasSynced reports whether the first list has arrived. Until it has, a
+// missing object might just not have been seen yet.
+func (i *Informer) HasSynced() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.synced
+}
+
+// Get returns the cached object with key namespace/name.
+func (i *Informer) Get(key string) (json.RawMessage, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	obj, ok := i.objects[key]
+	return obj, ok
+}
+
+// Keys lists the cached objects' keys, sorted.
+func (i *Informer) Keys() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	keys := make([]string, 0, len(i.objects))
+	for k := range i.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (i *Informer) listAndWatch(ctx context.Context) error {
+	in, err := i.client.Get(ctx, i.path)
+	if err != nil {
+		return err
+	}
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return err
+	}
+	rv := list.Metadata.ResourceVersion
+
+	// a relist replaces the cache; tell OnChange what differs from before
+	fresh := map[string]json.RawMessage{}
+	for _, obj := range list.Items {
+		fresh[metaOf(obj).Key()] = obj
+	}
+	type change struct {
+		key string
+		obj json.RawMessage
+	}
+	var changes []change
+	i.mu.Lock()
+	for key, obj := range fresh {
+		if old, ok := i.objects[key]; !ok || metaOf(old).ResourceVersion != metaOf(obj).ResourceVersion {
+			changes = append(changes, change{key, obj})
+		}
+	}
+	for key, old := range i.objects {
+		if _, ok := fresh[key]; !ok {
+			changes = append(changes, change{key, old})
+		}
+	}
+	i.objects, i.synced = fresh, true
+	i.mu.Unlock()
+	for _, c := range changes {
+		i.onChange(c.key, c.obj)
+	}
+
+	for {
+		started := time.Now()
+		err := i.client.Watch(ctx, i.path, rv, func(ev kube.WatchEvent) error {
+			m := metaOf(ev.Object)
+			rv = m.ResourceVersion
+			if ev.Type == "BOOKMARK" {
+				return nil
+			}
+			key := m.Key()
+			i.mu.Lock()
+			if ev.Type == "DELETED" {
+				delete(i.objects, key)
+			} else {
+				i.objects[key] = ev.Object
+			}
+			i.mu.Unlock()
+			i.onChange(key, ev.Object)
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, kube.ErrGone) {
+				log.Printf("controller: %s: watch expired, listing again\n", i.path)
+			}
+			return err
+		}
+		// the server ends watches now and then and we carry on from rv,
+		// but one that ends at once (a proxy dropping the stream, say)
+		// mustn't become a loop as fast as the API server can answer
+		if wait := minWatchCycle - time.Since(started); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
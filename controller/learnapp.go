@@ -0,0 +1,289 @@
+// Package controller reconciles LearnApp custom resources into the
+// Deployment and Service the README otherwise writes by hand. It's the
+// pattern every Kubernetes controller follows, with nothing but the
+// standard library: informers cache the objects and hear about changes, a
+// queue collects the keys of LearnApps that need a look, and workers
+// compare what is with what should be and close the gap.
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// The LearnApp custom resource, as defined in examples/learnapp/crd.yaml.
+const (
+	Group      = "learnk8s.io"
+	Version    = "v1alpha1"
+	APIVersion = Group + "/" + Version
+	Kind       = "LearnApp"
+	Resource   = "learnapps"
+)
+
+// Labels the controller puts on what it creates.
+const (
+	LabelApp       = "app"
+	LabelManagedBy = "app.kubernetes.io/managed-by"
+	ManagedBy      = "learn-k8s-controller"
+)
+
+// Defaults for fields a LearnApp leaves out. The CRD sets the same ones.
+const (
+	DefaultImage    = "learn-k8s:v0.2.0"
+	DefaultReplicas = 2
+	SidecarImage    = "nicolaka/netshoot:latest"
+)
+
+// Exposure types.
+const (
+	ExposeNone      = "None"
+	ExposeClusterIP = "ClusterIP"
+	ExposeNodePort  = "NodePort"
+)
+
+// LearnApp asks for the learn-k8s app to be running.
+type LearnApp struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   ObjectMeta     `json:"metadata"`
+	Spec       LearnAppSpec   `json:"spec"`
+	Status     LearnAppStatus `json:"status"`
+}
+
+// LearnAppSpec is what the user wants.
+type LearnAppSpec struct {
+	Image    string `json:"image,omitempty"`
+	Replicas *int32 `json:"replicas,omitempty"`
+	// Expose is None, ClusterIP or NodePort; NodePort picks NodePort when
+	// set, e.g. 30080 for kind's extraPortMapping.
+	Expose   string `json:"expose,omitempty"`
+	NodePort int32  `json:"nodePort,omitempty"`
+	// Sidecar adds the net-tools container.
+	Sidecar bool `json:"sidecar,omitempty"`
+}
+
+// LearnAppStatus is what the controller last saw.
+type LearnAppStatus struct {
+	// ObservedGeneration is the metadata.generation the status describes.
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	Replicas           int32       `json:"replicas"`
+	ReadyReplicas      int32       `json:"readyReplicas"`
+	Service            string      `json:"service,omitempty"`
+	Conditions         []Condition `json:"conditions,omitempty"`
+}
+
+// Condition types.
+const (
+	// Reconciled is True once the Deployment and Service match the spec.
+	ConditionReconciled = "Reconciled"
+	// Available is True once every replica is ready.
+	ConditionAvailable = "Available"
+)
+
+// Condition is one entry of status.conditions, shaped like the
+// metav1.Condition every built-in resource uses.
+type Condition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"` // True, False or Unknown
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime"`
+	Reason             string `json:"reason"`
+	Message            string `json:"message"`
+}
+
+// ObjectMeta is the part of metadata the controller uses.
+type ObjectMeta struct {
+	Namespace         string            `json:"namespace,omitempty"`
+	Name              string            `json:"name"`
+	UID               string            `json:"uid,omitempty"`
+	ResourceVersion   string            `json:"resourceVersion,omitempty"`
+	Generation        int64             `json:"generation,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+	OwnerReferences   []OwnerReference  `json:"ownerReferences,omitempty"`
+	DeletionTimestamp string            `json:"deletionTimestamp,omitempty"`
+}
+
+// Key is namespace/name, how the cache and the queue know an object.
+func (m ObjectMeta) Key() string { return m.Namespace + "/" + m.Name }
+
+// OwnerReference ties an object to the one it belongs to. When the owner
+// is deleted, the garbage collector deletes what it owns; the one with
+// Controller set is the object responsible for keeping it in shape.
+type OwnerReference struct {
+	APIVersion         string `json:"apiVersion"`
+	Kind               string `json:"kind"`
+	Name               string `json:"name"`
+	UID                string `json:"uid"`
+	Controller         bool   `json:"controller,omitempty"`
+	BlockOwnerDeletion bool   `json:"blockOwnerDeletion,omitempty"`
+}
+
+// ControllerOf returns the owner with Controller set, if there is one.
+func (m ObjectMeta) ControllerOf() (OwnerReference, bool) {
+	for _, o := range m.OwnerReferences {
+		if o.Controller {
+			return o, true
+		}
+	}
+	return OwnerReference{}, false
+}
+
+func metaOf(obj json.RawMessage) ObjectMeta {
+	var o struct {
+		Metadata ObjectMeta `json:"metadata"`
+	}
+	json.Unmarshal(obj, &o)
+	return o.Metadata
+}
+
+// withDefaults fills in what the spec leaves out.
+func (a LearnApp) withDefaults() LearnApp {
+	if a.Spec.Image == "" {
+		a.Spec.Image = DefaultImage
+	}
+	if a.Spec.Replicas == nil {
+		n := int32(DefaultReplicas)
+		a.Spec.Replicas = &n
+	}
+	if a.Spec.Expose == "" {
+		a.Spec.Expose = ExposeClusterIP
+	}
+	return a
+}
+
+func (a LearnApp) validate() error {
+	switch a.Spec.Expose {
+	case ExposeNone, ExposeClusterIP, ExposeNodePort:
+	default:
+		return fmt.Errorf("spec.expose is %q: want None, ClusterIP or NodePort", a.Spec.Expose)
+	}
+	if *a.Spec.Replicas < 0 {
+		return fmt.Errorf("spec.replicas is %d", *a.Spec.Replicas)
+	}
+	if a.Spec.NodePort != 0 && a.Spec.Expose != ExposeNodePort {
+		return fmt.Errorf("spec.nodePort is set but spec.expose is %s", a.Spec.Expose)
+	}
+	return nil
+}
+
+func (a LearnApp) ownerReference() OwnerReference {
+	return OwnerReference{
+		APIVersion:         APIVersion,
+		Kind:               Kind,
+		Name:               a.Metadata.Name,
+		UID:                a.Metadata.UID,
+		Controller:         true,
+		BlockOwnerDeletion: true,
+	}
+}
+
+func (a LearnApp) labels() map[string]any {
+	return map[string]any{LabelApp: a.Metadata.Name, LabelManagedBy: ManagedBy}
+}
+
+// desiredDeployment is the README's Deployment for a.
+func desiredDeployment(a LearnApp) map[string]any {
+	selector := map[string]any{LabelApp: a.Metadata.Name}
+	containers := []any{
+		map[string]any{
+			"name":            "learn-k8s",
+			"image":           a.Spec.Image,
+			"imagePullPolicy": "IfNotPresent",
+			"ports":           []any{map[string]any{"name": "http", "containerPort": 8080, "protocol": "TCP"}},
+			"readinessProbe": map[string]any{
+				"httpGet": map[string]any{"path": "/readyz", "port": 8080},
+			},
+		},
+	}
+	if a.Spec.Sidecar {
+		containers = append(containers, map[string]any{
+			"name":    "net-tools",
+			"image":   SidecarImage,
+			"command": []any{"sleep", "infinity"},
+		})
+	}
+	return normalize(map[string]any{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"metadata": map[string]any{
+			"namespace":       a.Metadata.Namespace,
+			"name":            a.Metadata.Name,
+			"labels":          a.labels(),
+			"ownerReferences": []any{a.ownerReference()},
+		},
+		"spec": map[string]any{
+			"replicas": *a.Spec.Replicas,
+			"selector": map[string]any{"matchLabels": selector},
+			"template": map[string]any{
+				"metadata": map[string]any{"labels": selector},
+				"spec":     map[string]any{"containers": containers},
+			},
+		},
+	})
+}
+
+// desiredService is the README's Service for a, with the type it asks for.
+func desiredService(a LearnApp) map[string]any {
+	port := map[string]any{"name": "http", "port": 80, "targetPort": 8080, "protocol": "TCP"}
+	if a.Spec.NodePort != 0 {
+		port["nodePort"] = a.Spec.NodePort
+	}
+	return normalize(map[string]any{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]any{
+			"namespace":       a.Metadata.Namespace,
+			"name":            a.Metadata.Name,
+			"labels":          a.labels(),
+			"ownerReferences": []any{a.ownerReference()},
+		},
+		"spec": map[string]any{
+			"type":     a.Spec.Expose,
+			"selector": map[string]any{LabelApp: a.Metadata.Name},
+			"ports":    []any{port},
+		},
+	})
+}
+
+// normalize round-trips v through JSON, so it compares equal to what's
+// decoded from the API server (numbers as float64, structs as maps).
+func normalize(v map[string]any) map[string]any {
+	b, _ := json.Marshal(v)
+	var out map[string]any
+	json.Unmarshal(b, &out)
+	return out
+}
+
+// contains reports whether every field set in want has the same value in
+// have. The API server fills in defaults (a container's
+// terminationMessagePath, a Service's clusterIP), so comparing whole
+// objects would always find a difference; a list must still have the same
+// length, so a removed container or port counts as a change.
+func contains(have, want any) bool {
+	switch w := want.(type) {
+	case map[string]any:
+		h, ok := have.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range w {
+			if !contains(h[k], v) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		h, ok := have.([]any)
+		if !ok || len(h) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !contains(h[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(have, want)
+}
@@ -0,0 +1,609 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// MemoryAPIServer is fake-apiserver -memory: an API server that keeps
+// whatever it's sent in memory, enough of one for the controller to run
+// against in a kind cluster's place, or in tests. Any resource under
+// /api/v1 or /apis/GROUP/VERSION can be created, read, listed (with an
+// equality labelSelector), replaced, watched and deleted; nothing is
+// validated. What a real cluster adds on top is faked where the
+// controller would notice:
+//
+//   - uid, creationTimestamp, generation and resourceVersion are filled in,
+//     and a replace based on a stale resourceVersion gets 409 Conflict
+//   - status only changes through the /status subresource, and generation
+//     only moves when the spec does
+//   - deleting an object deletes what names it in ownerReferences, like the
+//     garbage collector
+//   - Services get a clusterIP, and NodePort ones a nodePort
+//   - a Deployment's replicas all turn ready readyAfter it changes
+type MemoryAPIServer struct {
+	readyAfter time.Duration
+
+	mu      sync.Mutex
+	rv      uint64
+	objects map[memoryKey]map[string]any
+	events  []memoryEvent
+	// changed is closed, and replaced, whenever an event is added
+	changed  chan struct{}
+	nextIP   int
+	nextPort int
+}
+
+// memoryKey is where an object lives. resource is GROUP/VERSION/RESOURCE,
+// or VERSION/RESOURCE for the core API.
+type memoryKey struct {
+	resource, namespace, name string
+}
+
+type memoryEvent struct {
+	rv     uint64
+	key    memoryKey
+	labels map[string]string
+	line   []byte // the WatchEvent, with its newline
+}
+
+// NewMemoryAPIServer returns an empty API server. A Deployment's replicas
+// turn ready readyAfter it changes; 0 leaves them unready.
+func NewMemoryAPIServer(readyAfter time.Duration) *MemoryAPIServer {
+	return &MemoryAPIServer{
+		readyAfter: readyAfter,
+		objects:    map[memoryKey]map[string]any{},
+		changed:    make(chan struct{}),
+		nextIP:     1,
+		nextPort:   30000,
+	}
+}
+
+// memoryPath is a request path taken apart.
+type memoryPath struct {
+	apiVersion string // of the objects: v1, apps/v1, ...
+	memoryKey
+	subresource string
+}
+
+// parseMemoryPath reads /api/v1[/namespaces/NS]/RESOURCE[/NAME[/status]]
+// and the same under /apis/GROUP/VERSION.
+func parseMemoryPath(path string) (memoryPath, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	var p memoryPath
+	switch {
+	case len(parts) >= 3 && parts[0] == "api":
+		p.apiVersion, parts = parts[1], parts[2:]
+	case len(parts) >= 4 && parts[0] == "apis":
+		p.apiVersion, parts = parts[1]+"/"+parts[2], parts[3:]
+	default:
+		return p, false
+	}
+	if len(parts) >= 3 && parts[0] == "namespaces" {
+		p.namespace, parts = parts[1], parts[2:]
+	} else if len(parts) != 1 {
+		// only lists across namespaces: everything here is namespaced
+		return p, false
+	}
+	p.resource = p.apiVersion + "/" + parts[0]
+	switch len(parts) {
+	case 1:
+	case 2:
+		p.name = parts[1]
+	case 3:
+		p.name, p.subresource = parts[1], parts[2]
+		if p.subresource != "status" {
+			return p, false
+		}
+	default:
+		return p, false
+	}
+	return p, true
+}
+
+// qualifiedResource names the resource the way API errors do:
+// deployments.apps, or just services for the core API.
+func (p memoryPath) qualifiedResource() string {
+	resource := p.resource[strings.LastIndex(p.resource, "/")+1:]
+	if group, _, ok := strings.Cut(p.apiVersion, "/"); ok {
+		return resource + "." + group
+	}
+	return resource
+}
+
+func (m *MemoryAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := parseMemoryPath(r.URL.Path)
+	if !ok {
+		writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("the server could not find the requested resource (%s)", r.URL.Path))
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet && p.name == "":
+		if v := r.URL.Query().Get("watch"); v != "" && v != "0" && v != "false" {
+			m.watch(w, r, p)
+			return
+		}
+		m.list(w, r, p)
+	case r.Method == http.MethodGet:
+		m.get(w, p)
+	case r.Method == http.MethodPost && p.name == "" && p.namespace != "":
+		m.create(w, r, p)
+	case r.Method == http.MethodPut && p.name != "":
+		m.replace(w, r, p)
+	case r.Method == http.MethodDelete && p.name != "" && p.subresource == "":
+		m.delete(w, p)
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", fmt.Sprintf("%s is not supported on %s", r.Method, r.URL.Path))
+	}
+}
+
+func (m *MemoryAPIServer) list(w http.ResponseWriter, r *http.Request, p memoryPath) {
+	selector := parseSelector(r.URL.Query().Get("labelSelector"))
+	m.mu.Lock()
+	var keys []memoryKey
+	for k, obj := range m.objects {
+		if k.resource == p.resource && (p.namespace == "" || k.namespace == p.namespace) && selector.matches(objectLabels(obj)) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].namespace != keys[j].namespace {
+			return keys[i].namespace < keys[j].namespace
+		}
+		return keys[i].name < keys[j].name
+	})
+	items := []map[string]any{}
+	for _, k := range keys {
+		items = append(items, m.objects[k])
+	}
+	// encode while holding the lock: the objects are shared
+	body, _ := json.Marshal(map[string]any{
+		"kind":       "List",
+		"apiVersion": p.apiVersion,
+		"metadata":   map[string]string{"resourceVersion": strconv.FormatUint(m.rv, 10)},
+		"items":      items,
+	})
+	m.mu.Unlock()
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (m *MemoryAPIServer) get(w http.ResponseWriter, p memoryPath) {
+	m.mu.Lock()
+	obj, ok := m.objects[p.memoryKey]
+	body, _ := json.Marshal(obj)
+	m.mu.Unlock()
+	if !ok {
+		writeNotFound(w, p)
+		return
+	}
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (m *MemoryAPIServer) create(w http.ResponseWriter, r *http.Request, p memoryPath) {
+	obj, err := readObject(r.Body)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+	meta := objectMeta(obj)
+	name, _ := meta["name"].(string)
+	if name == "" {
+		writeStatus(w, http.StatusUnprocessableEntity, "Invalid", "metadata.name: Required value")
+		return
+	}
+	p.name = name
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[p.memoryKey]; ok {
+		writeStatus(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("%s %q already exists", p.qualifiedResource(), name))
+		return
+	}
+	m.rv++
+	meta["namespace"] = p.namespace
+	meta["uid"] = newUID()
+	meta["creationTimestamp"] = time.Now().UTC().Format(time.RFC3339)
+	meta["generation"] = 1
+	meta["resourceVersion"] = strconv.FormatUint(m.rv, 10)
+	delete(obj, "status")
+	m.allocate(p, obj, nil)
+	m.store(p.memoryKey, obj, "ADDED")
+	m.becomeReady(p.memoryKey, obj)
+
+	body, _ := json.Marshal(obj)
+	writeJSON(w, http.StatusCreated, body)
+}
+
+// replace is PUT: the whole object, or with /status, just its status.
+func (m *MemoryAPIServer) replace(w http.ResponseWriter, r *http.Request, p memoryPath) {
+	obj, err := readObject(r.Body)
+	if err != nil {
+		writeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.objects[p.memoryKey]
+	if !ok {
+		writeNotFound(w, p)
+		return
+	}
+	oldMeta := objectMeta(old)
+	if rv, _ := objectMeta(obj)["resourceVersion"].(string); rv != "" && rv != oldMeta["resourceVersion"] {
+		writeStatus(w, http.StatusConflict, "Conflict", fmt.Sprintf("Operation cannot be fulfilled on %s %q: the object has been modified; please apply your changes to the latest version and try again", p.qualifiedResource(), p.name))
+		return
+	}
+
+	var (
+		updated     map[string]any
+		specChanged bool
+	)
+	if p.subresource == "status" {
+		updated = clone(old)
+		updated["status"] = obj["status"]
+	} else {
+		updated = obj
+		meta := objectMeta(updated)
+		for _, k := range []string{"namespace", "name", "uid", "creationTimestamp", "generation"} {
+			meta[k] = oldMeta[k]
+		}
+		if old["status"] != nil {
+			updated["status"] = old["status"]
+		} else {
+			delete(updated, "status")
+		}
+		// both came through JSON, so their numbers are all float64s
+		if specChanged = !reflect.DeepEqual(updated["spec"], old["spec"]); specChanged {
+			gen, _ := oldMeta["generation"].(float64)
+			meta["generation"] = gen + 1
+		}
+		m.allocate(p, updated, old)
+	}
+	m.rv++
+	objectMeta(updated)["resourceVersion"] = strconv.FormatUint(m.rv, 10)
+	m.store(p.memoryKey, updated, "MODIFIED")
+	if specChanged {
+		m.becomeReady(p.memoryKey, updated)
+	}
+
+	body, _ := json.Marshal(updated)
+	writeJSON(w, http.StatusOK, body)
+}
+
+func (m *MemoryAPIServer) delete(w http.ResponseWriter, p memoryPath) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[p.memoryKey]
+	if !ok {
+		writeNotFound(w, p)
+		return
+	}
+	m.remove(p.memoryKey)
+	body, _ := json.Marshal(obj)
+	writeJSON(w, http.StatusOK, body)
+}
+
+// remove deletes an object, then whatever it owns.
+func (m *MemoryAPIServer) remove(key memoryKey) {
+	obj := m.objects[key]
+	delete(m.objects, key)
+	m.rv++
+	objectMeta(obj)["resourceVersion"] = strconv.FormatUint(m.rv, 10)
+	m.record(key, obj, "DELETED")
+
+	uid := objectMeta(obj)["uid"]
+	var owned []memoryKey
+	for k, o := range m.objects {
+		refs, _ := objectMeta(o)["ownerReferences"].([]any)
+		for _, ref := range refs {
+			if ref, ok := ref.(map[string]any); ok && ref["uid"] == uid && k.namespace == key.namespace {
+				owned = append(owned, k)
+				break
+			}
+		}
+	}
+	for _, k := range owned {
+		if _, ok := m.objects[k]; ok {
+			log.Printf("fake-apiserver: garbage collecting %s %s/%s, owned by %s/%s\n", k.resource, k.namespace, k.name, key.namespace, key.name)
+			m.remove(k)
+		}
+	}
+}
+
+// store saves obj under key and records the event, with m.mu held. The
+// copy kept has been through JSON, so its numbers are float64s whether they
+// came from a request or were set here.
+func (m *MemoryAPIServer) store(key memoryKey, obj map[string]any, typ string) {
+	obj = clone(obj)
+	m.objects[key] = obj
+	m.record(key, obj, typ)
+}
+
+func (m *MemoryAPIServer) record(key memoryKey, obj map[string]any, typ string) {
+	line, _ := json.Marshal(kube.WatchEvent{Type: typ, Object: mustJSON(obj)})
+	m.events = append(m.events, memoryEvent{rv: m.rv, key: key, labels: objectLabels(obj), line: append(line, '\n')})
+	log.Printf("fake-apiserver: %s %s %s/%s at resourceVersion %d\n", typ, key.resource, key.namespace, key.name, m.rv)
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// allocate gives a Service the clusterIP and nodePorts the API server
+// would, keeping the ones it had.
+func (m *MemoryAPIServer) allocate(p memoryPath, obj, old map[string]any) {
+	if p.resource != "v1/services" {
+		return
+	}
+	spec, _ := obj["spec"].(map[string]any)
+	if spec == nil {
+		return
+	}
+	oldSpec, _ := old["spec"].(map[string]any)
+	if spec["clusterIP"] == nil || spec["clusterIP"] == "" {
+		if ip, ok := oldSpec["clusterIP"].(string); ok {
+			spec["clusterIP"] = ip
+		} else {
+			spec["clusterIP"] = fmt.Sprintf("10.96.%d.%d", m.nextIP/254, m.nextIP%254+1)
+			m.nextIP++
+		}
+	}
+	if spec["type"] != "NodePort" && spec["type"] != "LoadBalancer" {
+		return
+	}
+	ports, _ := spec["ports"].([]any)
+	oldPorts, _ := oldSpec["ports"].([]any)
+	for i, port := range ports {
+		port, ok := port.(map[string]any)
+		if !ok || port["nodePort"] != nil {
+			continue
+		}
+		if i < len(oldPorts) {
+			if op, ok := oldPorts[i].(map[string]any); ok && op["nodePort"] != nil {
+				port["nodePort"] = op["nodePort"]
+				continue
+			}
+		}
+		port["nodePort"] = m.nextPort
+		m.nextPort++
+	}
+}
+
+// becomeReady marks a Deployment's replicas ready once readyAfter passes,
+// unless it has changed again by then.
+func (m *MemoryAPIServer) becomeReady(key memoryKey, obj map[string]any) {
+	if key.resource != "apps/v1/deployments" || m.readyAfter <= 0 {
+		return
+	}
+	gen := objectMeta(obj)["generation"]
+	time.AfterFunc(m.readyAfter, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		cur, ok := m.objects[key]
+		if !ok || fmt.Sprint(objectMeta(cur)["generation"]) != fmt.Sprint(gen) {
+			return
+		}
+		replicas := any(1)
+		if spec, ok := cur["spec"].(map[string]any); ok && spec["replicas"] != nil {
+			replicas = spec["replicas"]
+		}
+		updated := clone(cur)
+		updated["status"] = map[string]any{
+			"observedGeneration": gen,
+			"replicas":           replicas,
+			"updatedReplicas":    replicas,
+			"readyReplicas":      replicas,
+			"availableReplicas":  replicas,
+		}
+		m.rv++
+		objectMeta(updated)["resourceVersion"] = strconv.FormatUint(m.rv, 10)
+		m.store(key, updated, "MODIFIED")
+	})
+}
+
+// watch streams the events after the request's resourceVersion that match
+// its namespace and labelSelector, until the client goes away or
+// timeoutSeconds pass. Without a resourceVersion it starts with an ADDED
+// event for every object there is, as a real API server does.
+func (m *MemoryAPIServer) watch(w http.ResponseWriter, r *http.Request, p memoryPath) {
+	q := r.URL.Query()
+	selector := parseSelector(q.Get("labelSelector"))
+	var timeout <-chan time.Time
+	if secs, err := strconv.Atoi(q.Get("timeoutSeconds")); err == nil && secs > 0 {
+		timeout = time.After(time.Duration(secs) * time.Second)
+	}
+	matches := func(k memoryKey, labels map[string]string) bool {
+		return k.resource == p.resource && (p.namespace == "" || k.namespace == p.namespace) && selector.matches(labels)
+	}
+
+	var initial [][]byte
+	m.mu.Lock()
+	from, err := strconv.ParseUint(q.Get("resourceVersion"), 10, 64)
+	if err != nil {
+		from = m.rv
+		// sorted, so a watch from scratch starts the same way every time
+		keys := make([]memoryKey, 0, len(m.objects))
+		for k := range m.objects {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].namespace+"/"+keys[i].name < keys[j].namespace+"/"+keys[j].name })
+		for _, k := range keys {
+			if obj := m.objects[k]; matches(k, objectLabels(obj)) {
+				line, _ := json.Marshal(kube.WatchEvent{Type: "ADDED", Object: mustJSON(obj)})
+				initial = append(initial, append(line, '\n'))
+			}
+		}
+	}
+	next := sort.Search(len(m.events), func(i int) bool { return m.events[i].rv > from })
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	send := func(line []byte) bool {
+		if _, err := w.Write(line); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+	for _, line := range initial {
+		if !send(line) {
+			return
+		}
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	for {
+		m.mu.Lock()
+		events, changed := m.events, m.changed
+		m.mu.Unlock()
+		for ; next < len(events); next++ {
+			if e := events[next]; matches(e.key, e.labels) && !send(e.line) {
+				return
+			}
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// labelSelector is an equality-based selector: app=web,tier!=db.
+type labelSelector []labelRequirement
+
+type labelRequirement struct {
+	key, value string
+	not        bool
+}
+
+func parseSelector(s string) labelSelector {
+	var sel labelSelector
+	for _, req := range strings.Split(s, ",") {
+		if req = strings.TrimSpace(req); req == "" {
+			continue
+		}
+		var r labelRequirement
+		if k, v, ok := strings.Cut(req, "!="); ok {
+			r.key, r.value, r.not = k, v, true
+		} else {
+			k, v, _ := strings.Cut(req, "=")
+			r.key, r.value = k, strings.TrimPrefix(v, "=")
+		}
+		sel = append(sel, r)
+	}
+	return sel
+}
+
+func (s labelSelector) matches(labels map[string]string) bool {
+	for _, r := range s {
+		if (labels[r.key] == r.value) == r.not {
+			return false
+		}
+	}
+	return true
+}
+
+// readObject decodes a request body, JSON or YAML.
+func readObject(r io.Reader) (map[string]any, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimSpace(in); len(t) == 0 || t[0] != '{' {
+		if in, err = kube.YAMLToJSON(in); err != nil {
+			return nil, err
+		}
+	}
+	var obj map[string]any
+	if err := json.Unmarshal(in, &obj); err != nil {
+		return nil, err
+	}
+	if obj == nil {
+		return nil, fmt.Errorf("empty body")
+	}
+	if _, ok := obj["metadata"].(map[string]any); !ok {
+		obj["metadata"] = map[string]any{}
+	}
+	return obj, nil
+}
+
+// objectMeta is obj's metadata, which readObject made sure is there.
+func objectMeta(obj map[string]any) map[string]any {
+	meta, _ := obj["metadata"].(map[string]any)
+	return meta
+}
+
+func objectLabels(obj map[string]any) map[string]string {
+	labels := map[string]string{}
+	l, _ := objectMeta(obj)["labels"].(map[string]any)
+	for k, v := range l {
+		labels[k] = fmt.Sprint(v)
+	}
+	return labels
+}
+
+// clone is a deep copy of obj that has been through JSON, like normalize's.
+func clone(obj map[string]any) map[string]any { return normalize(obj) }
+
+func mustJSON(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// newUID is a random UUID, like the ones the API server hands out.
+func newUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func writeJSON(w http.ResponseWriter, code int, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(append(body, '\n'))
+}
+
+func writeNotFound(w http.ResponseWriter, p memoryPath) {
+	writeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("%s %q not found", p.qualifiedResource(), p.name))
+}
+
+// writeStatus answers with a failure Status object, the way the API server
+// reports every error.
+func writeStatus(w http.ResponseWriter, code int, reason, message string) {
+	body, _ := json.Marshal(map[string]any{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"metadata":   map[string]any{},
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	})
+	writeJSON(w, code, body)
+}
@@ -0,0 +1,142 @@
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+// Queue holds the keys ("namespace/name") of objects that need
+// reconciling. A key is only ever in the queue once, and never handed to
+// two workers at the same time: adding a key that's being worked on queues
+// it again for when the worker calls Done. That way a burst of watch
+// events for one object costs one reconcile, not one each.
+type Queue struct {
+	// BaseDelay is the first retry's delay after a failure; each further
+	// failure doubles it, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	keys       []string
+	dirty      map[string]bool // waiting in keys, or to go back in after Done
+	processing map[string]bool
+	failures   map[string]int
+	shutdown   bool
+}
+
+// NewQueue returns a queue whose retries start at 5ms and stop growing at
+// five minutes.
+func NewQueue() *Queue {
+	q := &Queue{
+		BaseDelay:  5 * time.Millisecond,
+		MaxDelay:   5 * time.Minute,
+		dirty:      map[string]bool{},
+		processing: map[string]bool{},
+		failures:   map[string]int{},
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Add queues key unless it's already waiting.
+func (q *Queue) Add(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.shutdown || q.dirty[key] {
+		return
+	}
+	q.dirty[key] = true
+	if q.processing[key] {
+		return
+	}
+	q.keys = append(q.keys, key)
+	q.cond.Signal()
+}
+
+// AddAfter queues key once d has passed.
+func (q *Queue) AddAfter(key string, d time.Duration) {
+	if d <= 0 {
+		q.Add(key)
+		return
+	}
+	time.AfterFunc(d, func() { q.Add(key) })
+}
+
+// AddRateLimited queues key again after a failure, waiting longer each
+// time it fails in a row.
+func (q *Queue) AddRateLimited(key string) {
+	q.mu.Lock()
+	n := q.failures[key]
+	q.failures[key]++
+	q.mu.Unlock()
+	q.AddAfter(key, q.backoff(n))
+}
+
+// backoff is the delay after n failures in a row: BaseDelay doubled n
+// times, up to MaxDelay.
+func (q *Queue) backoff(n int) time.Duration {
+	d := q.BaseDelay
+	for i := 0; i < n && d < q.MaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, q.MaxDelay)
+}
+
+// Forget clears key's failures, once it has been reconciled.
+func (q *Queue) Forget(key string) {
+	q.mu.Lock()
+	delete(q.failures, key)
+	q.mu.Unlock()
+}
+
+// Failures is how many times in a row key has failed.
+func (q *Queue) Failures(key string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.failures[key]
+}
+
+// Get waits for a key. It returns false once the queue is shut down.
+func (q *Queue) Get() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.keys) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+	if len(q.keys) == 0 {
+		return "", false
+	}
+	key := q.keys[0]
+	q.keys = q.keys[1:]
+	q.processing[key] = true
+	delete(q.dirty, key)
+	return key, true
+}
+
+// Done says the worker that got key from Get has finished with it.
+func (q *Queue) Done(key string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, key)
+	if q.dirty[key] {
+		q.keys = append(q.keys, key)
+		q.cond.Signal()
+	}
+}
+
+// Len is how many keys are waiting.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.keys)
+}
+
+// ShutDown makes Get return false once the waiting keys are gone; Add does
+// nothing after it.
+func (q *Queue) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.shutdown = true
+	q.cond.Broadcast()
+}
@@ -0,0 +1,120 @@
+package controller
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// next returns the next key, failing the test if none turns up in time.
+func next(t *testing.T, q *Queue) string {
+	t.Helper()
+	got := make(chan string, 1)
+	go func() {
+		key, _ := q.Get()
+		got <- key
+	}()
+	select {
+	case key := <-got:
+		return key
+	case <-time.After(2 * time.Second):
+		t.Fatal("no key to Get")
+		return ""
+	}
+}
+
+// empty checks that no key is waiting for a worker.
+func empty(t *testing.T, q *Queue) {
+	t.Helper()
+	if n := q.Len(); n != 0 {
+		t.Errorf("%d keys waiting, want none", n)
+	}
+}
+
+func TestQueueDeduplicates(t *testing.T) {
+	q := NewQueue()
+	for _, key := range []string{"default/a", "default/b", "default/a", "default/a", "default/b"} {
+		q.Add(key)
+	}
+	if n := q.Len(); n != 2 {
+		t.Fatalf("%d keys waiting after adding two, some twice; want 2", n)
+	}
+	got := []string{next(t, q), next(t, q)}
+	if want := []string{"default/a", "default/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v in the order added", got, want)
+	}
+	empty(t, q)
+}
+
+// A key added while a worker has it waits for Done rather than going to a
+// second worker, and however often it's added meanwhile, comes back once.
+func TestQueueRequeuesAfterDone(t *testing.T) {
+	q := NewQueue()
+	q.Add("default/a")
+	key := next(t, q)
+	q.Add(key)
+	q.Add(key)
+	q.Add("default/b")
+	if got := next(t, q); got != "default/b" {
+		t.Fatalf("got %s while default/a was being worked on, want default/b", got)
+	}
+	empty(t, q)
+
+	q.Done(key)
+	if got := next(t, q); got != key {
+		t.Fatalf("got %s after Done, want %s again", got, key)
+	}
+	q.Done(key)
+	q.Done("default/b")
+	empty(t, q)
+
+	// Done without a fresh Add doesn't bring it back
+	q.Add(key)
+	q.Done(next(t, q))
+	empty(t, q)
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := NewQueue()
+	q.BaseDelay, q.MaxDelay = 5*time.Millisecond, time.Second
+	want := []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+		80 * time.Millisecond, 160 * time.Millisecond, 320 * time.Millisecond, 640 * time.Millisecond,
+		time.Second, time.Second,
+	}
+	for n, d := range want {
+		if got := q.backoff(n); got != d {
+			t.Errorf("after %d failures: %v, want %v", n, got, d)
+		}
+	}
+	// doubling forever would overflow
+	if got := q.backoff(1 << 20); got != time.Second {
+		t.Errorf("after a million failures: %v, want the %v cap", got, time.Second)
+	}
+
+	q.BaseDelay, q.MaxDelay = time.Millisecond, 4*time.Millisecond
+	for i := 1; i <= 3; i++ {
+		q.AddRateLimited("default/a")
+		if n := q.Failures("default/a"); n != i {
+			t.Fatalf("Failures = %d after %d, want %d", n, i, i)
+		}
+		q.Done(next(t, q))
+	}
+	q.Forget("default/a")
+	if n := q.Failures("default/a"); n != 0 {
+		t.Errorf("Failures = %d after Forget, want 0", n)
+	}
+}
+
+func TestQueueShutDown(t *testing.T) {
+	q := NewQueue()
+	q.Add("default/a")
+	q.ShutDown()
+	q.Add("default/b")
+	if got := next(t, q); got != "default/a" {
+		t.Errorf("got %q, want the key waiting before ShutDown", got)
+	}
+	if key, ok := q.Get(); ok {
+		t.Errorf("Get after ShutDown gave %q, want false", key)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/montybeatnik/learn-k8s/controller"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// controllerCmd runs the LearnApp controller: for each LearnApp (see
+// examples/learnapp), a Deployment and a Service like the ones the README
+// applies by hand, kept that way. Outside a cluster point -k8s-api at
+// kubectl proxy, or at fake-apiserver -memory.
+func controllerCmd(args []string) error {
+	fs := flag.NewFlagSet("controller", flag.ExitOnError)
+	api := fs.String("k8s-api", "", "API server URL, e.g. kubectl proxy's http://127.0.0.1:8001; empty uses the pod's service account")
+	namespace := fs.String("namespace", "", "only reconcile LearnApps in this namespace; empty for all of them")
+	workers := fs.Int("workers", 2, "LearnApps reconciled at once")
+	fs.Parse(args)
+
+	client := &kube.Client{Base: *api}
+	if *api == "" {
+		var err error
+		if client, err = kube.InCluster(); err != nil {
+			return fmt.Errorf("%w (set -k8s-api to use kubectl proxy)", err)
+		}
+	}
+	if *workers < 1 {
+		return fmt.Errorf("-workers must be at least 1")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	where := "all namespaces"
+	if *namespace != "" {
+		where = "namespace " + *namespace
+	}
+	log.Printf("controller: watching %s in %s on %s\n", controller.Resource, where, client.Base)
+	return controller.New(client, *namespace).Run(ctx, *workers)
+}
@@ -0,0 +1,160 @@
+// Package docker reads `docker inspect` output. kind runs every Kubernetes
+// node as a container, so this is where a node's IP on the kind network and
+// its published ports come from.
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels kind puts on the containers it creates.
+const (
+	LabelKindCluster = "io.x-k8s.kind.cluster"
+	LabelKindRole    = "io.x-k8s.kind.role"
+)
+
+// Container is the part of `docker inspect` that describes where a
+// container sits on the network.
+type Container struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Hostname string            `json:"hostname,omitempty"`
+	Image    string            `json:"image"`
+	State    string            `json:"state"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Networks []Network         `json:"networks,omitempty"`
+	Ports    []PortMapping     `json:"ports,omitempty"`
+}
+
+// Network is the container's attachment to one docker network.
+type Network struct {
+	Name    string       `json:"name"`
+	IP      netip.Prefix `json:"ip"`
+	IPv6    netip.Prefix `json:"ipv6,omitzero"`
+	Gateway string       `json:"gateway,omitempty"`
+	MAC     string       `json:"mac,omitempty"`
+}
+
+// PortMapping is a published port: connections to HostIP:HostPort on the
+// machine running docker are forwarded to ContainerPort.
+type PortMapping struct {
+	HostIP        string `json:"host_ip"`
+	HostPort      int    `json:"host_port"`
+	ContainerPort int    `json:"container_port"`
+	Protocol      string `json:"protocol"`
+}
+
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%s -> %d/%s", netip.AddrPortFrom(netip.MustParseAddr(orAny(p.HostIP)), uint16(p.HostPort)), p.ContainerPort, p.Protocol)
+}
+
+func orAny(ip string) string {
+	if _, err := netip.ParseAddr(ip); err != nil {
+		return "0.0.0.0"
+	}
+	return ip
+}
+
+// KindCluster is the kind cluster the container is a node of, or "".
+func (c Container) KindCluster() string { return c.Labels[LabelKindCluster] }
+
+// KindRole is "control-plane", "worker" or "external-load-balancer" for kind
+// nodes.
+func (c Container) KindRole() string { return c.Labels[LabelKindRole] }
+
+type inspectObject struct {
+	ID     string `json:"Id"`
+	Name   string `json:"Name"`
+	Config struct {
+		Hostname string            `json:"Hostname"`
+		Image    string            `json:"Image"`
+		Labels   map[string]string `json:"Labels"`
+	} `json:"Config"`
+	State struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Ports    map[string][]struct{ HostIp, HostPort string } `json:"Ports"`
+		Networks map[string]struct {
+			IPAddress           string `json:"IPAddress"`
+			IPPrefixLen         int    `json:"IPPrefixLen"`
+			Gateway             string `json:"Gateway"`
+			GlobalIPv6Address   string `json:"GlobalIPv6Address"`
+			GlobalIPv6PrefixLen int    `json:"GlobalIPv6PrefixLen"`
+			MacAddress          string `json:"MacAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// ParseInspect reads `docker inspect <container>...`, a JSON array of
+// containers.
+func ParseInspect(r io.Reader) ([]Container, error) {
+	var objs []inspectObject
+	if err := json.NewDecoder(r).Decode(&objs); err != nil {
+		return nil, err
+	}
+	var out []Container
+	for _, o := range objs {
+		c := Container{
+			ID:       o.ID,
+			Name:     strings.TrimPrefix(o.Name, "/"),
+			Hostname: o.Config.Hostname,
+			Image:    o.Config.Image,
+			State:    o.State.Status,
+			Labels:   o.Config.Labels,
+		}
+		for name, n := range o.NetworkSettings.Networks {
+			nw := Network{Name: name, Gateway: n.Gateway, MAC: n.MacAddress}
+			if ip, err := netip.ParseAddr(n.IPAddress); err == nil {
+				nw.IP = netip.PrefixFrom(ip, n.IPPrefixLen)
+			}
+			if ip, err := netip.ParseAddr(n.GlobalIPv6Address); err == nil {
+				nw.IPv6 = netip.PrefixFrom(ip, n.GlobalIPv6PrefixLen)
+			}
+			c.Networks = append(c.Networks, nw)
+		}
+		sort.Slice(c.Networks, func(i, j int) bool { return c.Networks[i].Name < c.Networks[j].Name })
+
+		for port, bindings := range o.NetworkSettings.Ports {
+			num, proto, _ := strings.Cut(port, "/")
+			cp, err := strconv.Atoi(num)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad port %q", c.Name, port)
+			}
+			// exposed but not published ports have no bindings
+			for _, b := range bindings {
+				hp, err := strconv.Atoi(b.HostPort)
+				if err != nil {
+					return nil, fmt.Errorf("%s: bad host port %q", c.Name, b.HostPort)
+				}
+				c.Ports = append(c.Ports, PortMapping{HostIP: b.HostIp, HostPort: hp, ContainerPort: cp, Protocol: proto})
+			}
+		}
+		sort.Slice(c.Ports, func(i, j int) bool {
+			a, b := c.Ports[i], c.Ports[j]
+			if a.ContainerPort != b.ContainerPort {
+				return a.ContainerPort < b.ContainerPort
+			}
+			return a.HostIP < b.HostIP
+		})
+		out = append(out, c)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// HasIP reports whether ip is the container's address on any network.
+func (c Container) HasIP(ip string) bool {
+	for _, n := range c.Networks {
+		if n.IP.Addr().String() == ip || (n.IPv6.IsValid() && n.IPv6.Addr().String() == ip) {
+			return true
+		}
+	}
+	return false
+}
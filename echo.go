@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/pmtu"
+)
+
+// Plain TCP and UDP listeners for looking at Services below HTTP. Each line
+// (TCP) or datagram (UDP) gets one JSON line back saying which pod answered
+// and where it thinks the client is:
+//
+//	echo hi | nc -q1 localhost 9000
+//	echo hi | nc -u -w1 localhost 9001
+//
+// Path MTU probes (see /diag/mtu) are the exception: they come back as
+// sent, so the reply is no bigger than the probe.
+
+type echoReply struct {
+	Hostname string `json:"hostname"`
+	Proto    string `json:"proto"`
+	Client   string `json:"client"`
+	Echo     string `json:"echo"`
+}
+
+// echoIdleTimeout drops TCP clients that stop talking.
+const echoIdleTimeout = 5 * time.Minute
+
+func newEchoReply(proto string, client net.Addr, payload string) []byte {
+	hn, _ := os.Hostname()
+	b, _ := json.Marshal(echoReply{
+		Hostname: hn,
+		Proto:    proto,
+		Client:   client.String(),
+		Echo:     strings.TrimRight(payload, "\r\n"),
+	})
+	return append(b, '\n')
+}
+
+func serveTCPEcho(addr string) {
+	ln, err := listen(addr)
+	if err != nil {
+		log.Printf("failed to stand up tcp echo: %v\n", err)
+		return
+	}
+	log.Printf("standing up tcp echo on %v\n", addr)
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = acceptBackoff(delay)
+			log.Printf("tcp echo: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go handleTCPEcho(conn)
+	}
+}
+
+// acceptBackoff is how long to wait after a failed Accept, such as EMFILE
+// when we've run out of file descriptors, given the last wait: 5ms, doubling
+// up to a second, as http.Server.Serve does.
+func acceptBackoff(last time.Duration) time.Duration {
+	if last == 0 {
+		return 5 * time.Millisecond
+	}
+	return min(2*last, time.Second)
+}
+
+func handleTCPEcho(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(echoIdleTimeout))
+		if !sc.Scan() {
+			return
+		}
+		if _, err := conn.Write(newEchoReply("tcp", conn.RemoteAddr(), sc.Text())); err != nil {
+			return
+		}
+	}
+}
+
+func serveUDPEcho(addr string) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Printf("failed to stand up udp echo: %v\n", err)
+		return
+	}
+	log.Printf("standing up udp echo on %v\n", addr)
+	echoUDP(pc)
+}
+
+// echoUDP answers datagrams on pc until it's closed. A failed read, such as
+// ENOBUFS under memory pressure, is retried with the same backoff as a failed
+// Accept rather than taking the listener down for good.
+func echoUDP(pc net.PacketConn) {
+	buf := make([]byte, 64*1024)
+	var delay time.Duration
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			delay = acceptBackoff(delay)
+			log.Printf("udp echo: %v; retrying in %v\n", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if bytes.HasPrefix(buf[:n], []byte(pmtu.ProbeToken)) {
+			pc.WriteTo(buf[:n], from)
+			continue
+		}
+		pc.WriteTo(newEchoReply("udp", from, string(buf[:n])), from)
+	}
+}
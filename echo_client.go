@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// echoClientCmd probes a TCP or UDP echo listener n times and counts which
+// pod answered.
+//
+// By default all probes share one socket. For TCP that is one connection, so
+// one pod. For UDP there is no connection, but conntrack remembers the
+// (source port, destination) flow and keeps DNATing it to the same pod until
+// the entry times out. With -new-conn every probe uses a fresh source port and
+// the Service spreads them out.
+//
+//	learn-k8s echo-client -proto udp -addr learn-k8s:9001 -n 20
+func echoClientCmd(args []string) error {
+	fs := flag.NewFlagSet("echo-client", flag.ExitOnError)
+	proto := fs.String("proto", "tcp", "tcp or udp")
+	addr := fs.String("addr", "localhost:9000", "echo listener address")
+	n := fs.Int("n", 10, "number of probes")
+	newConn := fs.Bool("new-conn", false, "use a new socket for every probe")
+	timeout := fs.Duration("timeout", 2*time.Second, "how long to wait for each reply")
+	fs.Parse(args)
+
+	if *proto != "tcp" && *proto != "udp" {
+		return fmt.Errorf("unknown -proto %q", *proto)
+	}
+
+	var (
+		conn   net.Conn
+		reader *bufio.Reader
+	)
+	closeConn := func() {
+		if conn != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	defer closeConn()
+
+	counts := map[string]int{}
+	lost := 0
+	for i := 0; i < *n; i++ {
+		if *newConn {
+			closeConn()
+		}
+		if conn == nil {
+			c, err := net.DialTimeout(*proto, *addr, *timeout)
+			if err != nil {
+				return err
+			}
+			conn, reader = c, bufio.NewReader(c)
+		}
+
+		conn.SetDeadline(time.Now().Add(*timeout))
+		if _, err := fmt.Fprintf(conn, "probe %d\n", i); err != nil {
+			return err
+		}
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			// UDP gives no guarantees; a missing reply is part of the lesson
+			if *proto == "udp" {
+				lost++
+				closeConn()
+				continue
+			}
+			return err
+		}
+		var reply echoReply
+		if err := json.Unmarshal(line, &reply); err != nil {
+			return err
+		}
+		counts[reply.Hostname]++
+	}
+
+	printCounts(os.Stdout, counts)
+	if lost > 0 {
+		fmt.Printf("%-40s %d\n", "(no reply)", lost)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/pmtu"
+)
+
+// flakyPacketConn fails its first reads before passing them through.
+type flakyPacketConn struct {
+	net.PacketConn
+	fails int
+}
+
+func (c *flakyPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.fails > 0 {
+		c.fails--
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Err: syscall.ENOBUFS}
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+func TestEchoUDPRetries(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		echoUDP(&flakyPacketConn{PacketConn: pc, fails: 3})
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte("hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no reply after failed reads: %v", err)
+	}
+	var reply echoReply
+	if err := json.Unmarshal(buf[:n], &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Proto != "udp" || reply.Echo != "hi" || reply.Client != conn.LocalAddr().String() {
+		t.Errorf("reply %+v", reply)
+	}
+
+	// closing the socket is the one error that stops it
+	pc.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("still serving after Close")
+	}
+}
+
+// Path MTU probes come back byte for byte: wrapped in JSON, the reply would
+// be bigger than the probe, and lost on a return path the probe just fits.
+func TestEchoUDPProbe(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go echoUDP(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	probe := append([]byte(pmtu.ProbeToken+"1 "), bytes.Repeat([]byte{'x'}, 1400)...)
+	if _, err := conn.Write(probe); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], probe) {
+		t.Errorf("probe of %d bytes came back as %d: %.40q", len(probe), n, buf[:n])
+	}
+}
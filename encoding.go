@@ -0,0 +1,587 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types the root handler can answer with. JSON stays the default so
+// `curl localhost:8080` behaves exactly as it always has.
+const (
+	contentTypeJSON    = "application/json"
+	contentTypeProto   = "application/x-protobuf"
+	contentTypeMsgpack = "application/msgpack"
+)
+
+// negotiate picks a response media type from an Accept header. Unknown or
+// missing headers fall back to JSON.
+func negotiate(accept string) string {
+	best, bestQ := contentTypeJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		ct := canonicalContentType(mt)
+		if ct == "" || q <= bestQ {
+			continue
+		}
+		best, bestQ = ct, q
+	}
+	return best
+}
+
+// canonicalContentType maps the aliases seen in the wild onto the types we
+// actually produce.
+func canonicalContentType(mt string) string {
+	switch mt {
+	case "application/json", "*/*", "application/*":
+		return contentTypeJSON
+	case "application/x-protobuf", "application/protobuf", "application/vnd.google.protobuf":
+		return contentTypeProto
+	case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+		return contentTypeMsgpack
+	}
+	return ""
+}
+
+// encodeResponse renders resp in the given media type.
+func encodeResponse(ct string, resp Response) ([]byte, error) {
+	switch ct {
+	case contentTypeJSON:
+		b, err := json.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+		// match json.Encoder, which is what curl users have always seen
+		return append(b, '\n'), nil
+	case contentTypeProto:
+		return resp.appendProto(nil), nil
+	case contentTypeMsgpack:
+		return resp.appendMsgpack(nil), nil
+	}
+	return nil, fmt.Errorf("unsupported content type %q", ct)
+}
+
+// decodeResponse is the inverse of encodeResponse. The server never needs
+// it; it exists for clients and the encoding benchmark.
+func decodeResponse(ct string, b []byte) (Response, error) {
+	var resp Response
+	switch ct {
+	case contentTypeJSON:
+		err := json.Unmarshal(b, &resp)
+		return resp, err
+	case contentTypeProto:
+		err := resp.unmarshalProto(b)
+		return resp, err
+	case contentTypeMsgpack:
+		err := resp.unmarshalMsgpack(b)
+		return resp, err
+	}
+	return resp, fmt.Errorf("unsupported content type %q", ct)
+}
+
+// --- Protocol Buffers -------------------------------------------------------
+//
+// The wire format is small enough to write by hand, which keeps the image
+// free of generated code. The schema is:
+//
+//	message Response {
+//	  google.protobuf.Timestamp time_stamp = 1;
+//	  string hostname = 2;
+//	  string protocol = 3;
+//	  int64 conn_requests = 4;
+//	  string addr_family = 5;
+//	  string remote_addr = 6;
+//	  uint64 conn_id = 7;
+//	  Namespaces namespaces = 8;
+//	}
+//
+//	message Namespaces {
+//	  uint64 net = 1;
+//	  uint64 uts = 2;
+//	  uint64 ipc = 3;
+//	  uint64 pid = 4;
+//	  uint64 mnt = 5;
+//	}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+var errProtoTruncated = errors.New("proto: truncated message")
+
+func appendTag(b []byte, field int, wire int) []byte {
+	return binary.AppendUvarint(b, uint64(field)<<3|uint64(wire))
+}
+
+func appendProtoString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendProtoVarint(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendTag(b, field, wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoTimestamp(b []byte, field int, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var ts []byte
+	ts = appendProtoVarint(ts, 1, uint64(t.Unix()))
+	ts = appendProtoVarint(ts, 2, uint64(t.Nanosecond()))
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(ts)))
+	return append(b, ts...)
+}
+
+func (r Response) appendProto(b []byte) []byte {
+	b = appendProtoTimestamp(b, 1, r.TimeStamp)
+	b = appendProtoString(b, 2, r.Hostname)
+	b = appendProtoString(b, 3, r.Protocol)
+	b = appendProtoVarint(b, 4, uint64(r.ConnRequests))
+	b = appendProtoString(b, 5, r.AddrFamily)
+	b = appendProtoString(b, 6, r.RemoteAddr)
+	b = appendProtoVarint(b, 7, r.ConnID)
+	b = appendProtoNamespaces(b, 8, r.Namespaces)
+	return b
+}
+
+func appendProtoNamespaces(b []byte, field int, ns *Namespaces) []byte {
+	if ns == nil {
+		return b
+	}
+	var m []byte
+	for i, kind := range nsKinds {
+		m = appendProtoVarint(m, i+1, *ns.get(kind))
+	}
+	b = appendTag(b, field, wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(m)))
+	return append(b, m...)
+}
+
+// protoFields walks a message and calls fn for every field. For varints v
+// holds the value; for length-delimited fields data holds the payload.
+func protoFields(b []byte, fn func(field, wire int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		field, wire := int(key>>3), int(key&7)
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+			if err := fn(field, wire, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errProtoTruncated
+			}
+			data := b[n : n+int(l)]
+			b = b[n+int(l):]
+			if err := fn(field, wire, 0, data); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("proto: unsupported wire type %d", wire)
+		}
+	}
+	return nil
+}
+
+func unmarshalProtoTimestamp(b []byte) (time.Time, error) {
+	var sec, nsec int64
+	err := protoFields(b, func(field, wire int, v uint64, _ []byte) error {
+		switch field {
+		case 1:
+			sec = int64(v)
+		case 2:
+			nsec = int64(v)
+		}
+		return nil
+	})
+	return time.Unix(sec, nsec).UTC(), err
+}
+
+func unmarshalProtoNamespaces(b []byte) (*Namespaces, error) {
+	ns := &Namespaces{}
+	err := protoFields(b, func(field, wire int, v uint64, _ []byte) error {
+		if field >= 1 && field <= len(nsKinds) {
+			*ns.get(nsKinds[field-1]) = v
+		}
+		return nil
+	})
+	return ns, err
+}
+
+func (r *Response) unmarshalProto(b []byte) error {
+	return protoFields(b, func(field, wire int, v uint64, data []byte) error {
+		var err error
+		switch field {
+		case 1:
+			r.TimeStamp, err = unmarshalProtoTimestamp(data)
+		case 2:
+			r.Hostname = string(data)
+		case 3:
+			r.Protocol = string(data)
+		case 4:
+			r.ConnRequests = int64(v)
+		case 5:
+			r.AddrFamily = string(data)
+		case 6:
+			r.RemoteAddr = string(data)
+		case 7:
+			r.ConnID = v
+		case 8:
+			r.Namespaces, err = unmarshalProtoNamespaces(data)
+		}
+		return err
+	})
+}
+
+// --- MessagePack ------------------------------------------------------------
+//
+// Just enough of https://github.com/msgpack/msgpack/blob/master/spec.md to
+// write Response as a map keyed by the same names the JSON uses. Time is
+// written with the standard timestamp extension (type -1).
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return append(b, byte(v))
+	case v < 0 && v >= -32:
+		return append(b, byte(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	}
+}
+
+func appendMsgpackTime(b []byte, t time.Time) []byte {
+	// timestamp 96: ext8, length 12, type -1, uint32 nanos, int64 seconds
+	b = append(b, 0xc7, 12, 0xff)
+	b = binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	return binary.BigEndian.AppendUint64(b, uint64(t.Unix()))
+}
+
+func (r Response) appendMsgpack(b []byte) []byte {
+	n := 7
+	if r.Namespaces != nil {
+		n++
+	}
+	b = appendMsgpackMapHeader(b, n)
+	b = appendMsgpackString(b, "time_stamp")
+	b = appendMsgpackTime(b, r.TimeStamp)
+	b = appendMsgpackString(b, "hostname")
+	b = appendMsgpackString(b, r.Hostname)
+	b = appendMsgpackString(b, "protocol")
+	b = appendMsgpackString(b, r.Protocol)
+	b = appendMsgpackString(b, "conn_requests")
+	b = appendMsgpackInt(b, r.ConnRequests)
+	b = appendMsgpackString(b, "addr_family")
+	b = appendMsgpackString(b, r.AddrFamily)
+	b = appendMsgpackString(b, "remote_addr")
+	b = appendMsgpackString(b, r.RemoteAddr)
+	b = appendMsgpackString(b, "conn_id")
+	b = appendMsgpackInt(b, int64(r.ConnID))
+	if r.Namespaces != nil {
+		b = appendMsgpackString(b, "namespaces")
+		b = appendMsgpackMapHeader(b, len(nsKinds))
+		for _, kind := range nsKinds {
+			b = appendMsgpackString(b, kind)
+			b = appendMsgpackInt(b, int64(*r.Namespaces.get(kind)))
+		}
+	}
+	return b
+}
+
+// msgpackReader decodes the subset of MessagePack that appendMsgpack writes.
+type msgpackReader struct {
+	b []byte
+}
+
+var errMsgpackTruncated = errors.New("msgpack: truncated input")
+
+func (m *msgpackReader) next(n int) ([]byte, error) {
+	if len(m.b) < n {
+		return nil, errMsgpackTruncated
+	}
+	p := m.b[:n]
+	m.b = m.b[n:]
+	return p, nil
+}
+
+func (m *msgpackReader) byte() (byte, error) {
+	p, err := m.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return p[0], nil
+}
+
+func (m *msgpackReader) mapHeader() (int, error) {
+	c, err := m.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		p, err := m.next(2)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint16(p)), nil
+	case c == 0xdf:
+		p, err := m.next(4)
+		if err != nil {
+			return 0, err
+		}
+		return int(binary.BigEndian.Uint32(p)), nil
+	}
+	return 0, fmt.Errorf("msgpack: expected map, got 0x%02x", c)
+}
+
+// value decodes a single value into a Go string, int64, bool, time.Time,
+// []any or map[string]any.
+func (m *msgpackReader) value() (any, error) {
+	c, err := m.byte()
+	if err != nil {
+		return nil, err
+	}
+	strOf := func(n int) (any, error) {
+		p, err := m.next(n)
+		return string(p), err
+	}
+	lenOf := func(size int) (int, error) {
+		p, err := m.next(size)
+		if err != nil {
+			return 0, err
+		}
+		switch size {
+		case 1:
+			return int(p[0]), nil
+		case 2:
+			return int(binary.BigEndian.Uint16(p)), nil
+		}
+		return int(binary.BigEndian.Uint32(p)), nil
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return strOf(int(c & 0x1f))
+	case c&0xf0 == 0x80:
+		return m.mapEntries(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return m.arrayValue(int(c & 0x0f))
+	}
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := lenOf(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return strOf(n)
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		size := 1 << (c - 0xcc)
+		p, err := m.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range p {
+			v = v<<8 | uint64(x)
+		}
+		return int64(v), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		p, err := m.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var v uint64
+		for _, x := range p {
+			v = v<<8 | uint64(x)
+		}
+		shift := 64 - 8*size
+		return int64(v<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		n, err := lenOf(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return m.arrayValue(n)
+	case 0xde, 0xdf:
+		n, err := lenOf(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return m.mapEntries(n)
+	case 0xc7:
+		p, err := m.next(2)
+		if err != nil {
+			return nil, err
+		}
+		data, err := m.next(int(p[0]))
+		if err != nil {
+			return nil, err
+		}
+		if int8(p[1]) != -1 || len(data) != 12 {
+			return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(p[1]))
+		}
+		nsec := binary.BigEndian.Uint32(data[:4])
+		sec := int64(binary.BigEndian.Uint64(data[4:]))
+		return time.Unix(sec, int64(nsec)).UTC(), nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", c)
+}
+
+// capped bounds a length read off the wire by what's left to read: every
+// element takes at least a byte, so a lying header can't make us allocate
+// more than the input could hold.
+func (m *msgpackReader) capped(n int) int {
+	return min(n, len(m.b))
+}
+
+func (m *msgpackReader) arrayValue(n int) (any, error) {
+	out := make([]any, 0, m.capped(n))
+	for i := 0; i < n; i++ {
+		v, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+func (m *msgpackReader) mapValue() (any, error) {
+	n, err := m.mapHeader()
+	if err != nil {
+		return nil, err
+	}
+	return m.mapEntries(n)
+}
+
+func (m *msgpackReader) mapEntries(n int) (any, error) {
+	// a key and a value: at least two bytes an entry
+	out := make(map[string]any, min(n, len(m.b)/2))
+	for i := 0; i < n; i++ {
+		k, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key is %T, want string", k)
+		}
+		v, err := m.value()
+		if err != nil {
+			return nil, err
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+func (r *Response) unmarshalMsgpack(b []byte) error {
+	m := &msgpackReader{b: b}
+	v, err := m.mapValue()
+	if err != nil {
+		return err
+	}
+	for k, v := range v.(map[string]any) {
+		switch k {
+		case "time_stamp":
+			r.TimeStamp, _ = v.(time.Time)
+		case "hostname":
+			r.Hostname, _ = v.(string)
+		case "protocol":
+			r.Protocol, _ = v.(string)
+		case "conn_requests":
+			r.ConnRequests, _ = v.(int64)
+		case "addr_family":
+			r.AddrFamily, _ = v.(string)
+		case "remote_addr":
+			r.RemoteAddr, _ = v.(string)
+		case "conn_id":
+			id, _ := v.(int64)
+			r.ConnID = uint64(id)
+		case "namespaces":
+			m, _ := v.(map[string]any)
+			r.Namespaces = &Namespaces{}
+			for _, kind := range nsKinds {
+				id, _ := m[kind].(int64)
+				*r.Namespaces.get(kind) = uint64(id)
+			}
+		}
+	}
+	return nil
+}
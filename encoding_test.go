@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var encodings = []string{contentTypeJSON, contentTypeProto, contentTypeMsgpack}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	ts := time.Date(2026, 3, 14, 15, 9, 26, 535897932, time.UTC)
+	tests := []struct {
+		name string
+		resp Response
+	}{
+		{"minimal", Response{TimeStamp: ts}},
+		{"full", Response{
+			TimeStamp:    ts,
+			Hostname:     "learn-k8s-7d4b9c8f6-x2x9q",
+			Protocol:     "HTTP/1.1",
+			ConnRequests: 3,
+			AddrFamily:   "ipv4",
+			RemoteAddr:   "10.244.1.5:40122",
+			ConnID:       42,
+			Namespaces:   &Namespaces{Net: 4026532281, UTS: 4026532279, IPC: 4026532280, PID: 4026532282, Mnt: 4026532278},
+		}},
+		{
+			// str8 and str16 lengths, and the widest integers
+			name: "long and large",
+			resp: Response{
+				TimeStamp:    ts,
+				Hostname:     strings.Repeat("h", 200),
+				RemoteAddr:   strings.Repeat("r", 300),
+				ConnRequests: 1 << 40,
+				ConnID:       1<<63 + 1,
+			},
+		},
+		{"negative", Response{TimeStamp: ts, ConnRequests: -20}},
+	}
+	for _, ct := range encodings {
+		for _, tt := range tests {
+			t.Run(ct+"/"+tt.name, func(t *testing.T) {
+				b, err := encodeResponse(ct, tt.resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := decodeResponse(ct, b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.resp) {
+					t.Errorf("got  %+v\nwant %+v", got, tt.resp)
+				}
+			})
+		}
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	resp := Response{
+		TimeStamp:  time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC),
+		Hostname:   "web",
+		RemoteAddr: "10.244.1.5:40122",
+		ConnID:     7,
+		Namespaces: &Namespaces{Net: 1, PID: 2},
+	}
+	// every prefix is short: the map header promises more than is there
+	b := resp.appendMsgpack(nil)
+	for i := range len(b) {
+		if _, err := decodeResponse(contentTypeMsgpack, b[:i]); !errors.Is(err, errMsgpackTruncated) {
+			t.Errorf("msgpack cut at %d of %d: err = %v", i, len(b), err)
+		}
+	}
+	// protobuf has no header, so a cut between fields is a valid (shorter)
+	// message; a cut inside one isn't
+	b = resp.appendProto(nil)
+	for i := range len(b) {
+		got, err := decodeResponse(contentTypeProto, b[:i])
+		if err == nil && reflect.DeepEqual(got, resp) {
+			t.Errorf("proto cut at %d of %d decoded in full", i, len(b))
+		}
+	}
+	if _, err := decodeResponse(contentTypeProto, b[:len(b)-1]); !errors.Is(err, errProtoTruncated) {
+		t.Errorf("proto without its last byte: err = %v", err)
+	}
+}
+
+func TestDecodeMsgpackLyingLength(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"map32", []byte{0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{"array32", []byte{0x81, 0xa1, 'a', 0xdd, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"nested map32", []byte{0x81, 0xa1, 'a', 0xdf, 0xff, 0xff, 0xff, 0xff}},
+		{"str32", []byte{0x81, 0xa1, 'a', 0xdb, 0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without the cap each of these would ask for gigabytes up front
+			allocs := testing.AllocsPerRun(10, func() {
+				if _, err := decodeResponse(contentTypeMsgpack, tt.in); !errors.Is(err, errMsgpackTruncated) {
+					t.Errorf("err = %v, want truncated", err)
+				}
+			})
+			if allocs > 10 {
+				t.Errorf("%v allocations", allocs)
+			}
+		})
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept, want string
+	}{
+		{"", contentTypeJSON},
+		{"text/html", contentTypeJSON},
+		{"application/x-protobuf", contentTypeProto},
+		{"application/vnd.msgpack", contentTypeMsgpack},
+		{"application/json;q=0.5, application/msgpack", contentTypeMsgpack},
+		{"application/protobuf;q=0.9, application/json", contentTypeJSON},
+		{"*/*;q=0.1, application/x-msgpack;q=0.8", contentTypeMsgpack},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
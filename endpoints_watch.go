@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+var (
+	watchEndpoints = ""
+	k8sAPI         = ""
+)
+
+// endpoints is the watcher behind /k8s/endpoints/history, when
+// -watch-endpoints is set.
+var endpoints *endpointWatcher
+
+const (
+	endpointsRetry = 5 * time.Second
+	// minWatchCycle spaces out watches that end as soon as they start.
+	minWatchCycle = time.Second
+	// keepEndpointChanges is how much history /k8s/endpoints/history keeps.
+	keepEndpointChanges = 500
+)
+
+// Endpoint states.
+const (
+	EndpointAbsent      = "absent"
+	EndpointReady       = "ready"
+	EndpointNotReady    = "not ready"
+	EndpointTerminating = "terminating"
+)
+
+// EndpointState is where one address behind the Service stands.
+type EndpointState struct {
+	IP    string    `json:"ip"`
+	Pod   string    `json:"pod,omitempty"`
+	Node  string    `json:"node,omitempty"`
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+}
+
+// EndpointChange is an address moving from one state to another, e.g. from
+// absent to not ready when a pod starts, then to ready when its readiness
+// probe passes.
+type EndpointChange struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+	Pod  string    `json:"pod,omitempty"`
+	Node string    `json:"node,omitempty"`
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	// ResourceVersion is the EndpointSlice version that showed the change.
+	ResourceVersion string `json:"resource_version,omitempty"`
+}
+
+// endpointWatcher follows the EndpointSlices of one Service and keeps a
+// timeline of its addresses. It lists the slices, then watches from the
+// list's resourceVersion; when the watch falls too far behind it lists
+// again, so changes missed in between show up at that point.
+type endpointWatcher struct {
+	client    *kube.Client
+	namespace string
+	service   string
+
+	mu      sync.Mutex
+	slices  map[string]kube.EndpointSlice // by slice name
+	current map[string]EndpointState      // by IP
+	history []EndpointChange
+	// listed is set after the first list, which is the baseline: what it
+	// finds goes into current, not history.
+	listed bool
+	synced bool
+	err    string
+}
+
+// newEndpointWatcher watches spec, a Service's name or namespace/name. The
+// namespace defaults to the pod's own. With api empty it talks to the API
+// server the pod runs under, as the pod's service account.
+func newEndpointWatcher(spec, api string) (*endpointWatcher, error) {
+	w := &endpointWatcher{
+		slices:  map[string]kube.EndpointSlice{},
+		current: map[string]EndpointState{},
+	}
+	var err error
+	if api == "" {
+		if w.client, err = kube.InCluster(); err != nil {
+			return nil, fmt.Errorf("-watch-endpoints: %w (set -k8s-api to use kubectl proxy)", err)
+		}
+	} else {
+		w.client = &kube.Client{Base: api}
+	}
+	if ns, name, ok := strings.Cut(spec, "/"); ok {
+		w.namespace, w.service = ns, name
+	} else {
+		w.service = spec
+		if w.namespace, err = kube.InClusterNamespace(); err != nil {
+			w.namespace = "default"
+		}
+	}
+	return w, nil
+}
+
+// run lists and watches until ctx ends.
+func (w *endpointWatcher) run(ctx context.Context) {
+	for {
+		err := w.listAndWatch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		w.mu.Lock()
+		w.synced, w.err = false, err.Error()
+		w.mu.Unlock()
+		log.Printf("endpoints: %s/%s: %v; retrying in %v\n", w.namespace, w.service, err, endpointsRetry)
+		time.Sleep(endpointsRetry)
+	}
+}
+
+func (w *endpointWatcher) listAndWatch(ctx context.Context) error {
+	path := kube.ListPath("discovery.k8s.io", "v1", "endpointslices", w.namespace) +
+		"?labelSelector=" + url.QueryEscape(kube.LabelServiceName+"="+w.service)
+	in, err := w.client.Get(ctx, path)
+	if err != nil {
+		return err
+	}
+	list, err := kube.ParseEndpointSlices(bytes.NewReader(in))
+	if err != nil {
+		return err
+	}
+	rv := kube.ResourceVersion(in)
+	slices := map[string]kube.EndpointSlice{}
+	for _, s := range list {
+		slices[s.Name] = s
+	}
+	w.mu.Lock()
+	w.slices = slices
+	w.update(rv)
+	w.listed, w.synced, w.err = true, true, ""
+	w.mu.Unlock()
+
+	for {
+		started := time.Now()
+		err := w.client.Watch(ctx, path, rv, func(ev kube.WatchEvent) error {
+			rv = kube.ResourceVersion(ev.Object)
+			if ev.Type == "BOOKMARK" {
+				return nil
+			}
+			s, err := kube.DecodeEndpointSlice(ev.Object)
+			if err != nil {
+				return err
+			}
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			switch ev.Type {
+			case "ADDED", "MODIFIED":
+				w.slices[s.Name] = s
+			case "DELETED":
+				delete(w.slices, s.Name)
+			}
+			w.update(rv)
+			return nil
+		})
+		if err != nil {
+			if errors.Is(err, kube.ErrGone) {
+				log.Printf("endpoints: %s/%s: watch expired, listing again\n", w.namespace, w.service)
+			}
+			return err
+		}
+		// The server ends every watch after a while; carry on from rv. A
+		// proxy that closes the stream straight away would otherwise have
+		// us watching in a tight loop.
+		if wait := minWatchCycle - time.Since(started); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// update works out each address's state from the slices and records what
+// changed; w.mu must be held.
+func (w *endpointWatcher) update(rv string) {
+	now := time.Now()
+	next := map[string]EndpointState{}
+	for _, name := range sortedKeys(w.slices) {
+		for _, e := range w.slices[name].Endpoints {
+			st := EndpointNotReady
+			switch {
+			case e.Terminating:
+				st = EndpointTerminating
+			case e.Ready:
+				st = EndpointReady
+			}
+			for _, ip := range e.Addresses {
+				next[ip] = EndpointState{IP: ip, Pod: e.Pod, Node: e.Node, State: st, Since: now}
+			}
+		}
+	}
+
+	for _, ip := range sortedKeys(next) {
+		n := next[ip]
+		old, ok := w.current[ip]
+		switch {
+		case !ok:
+			w.record(EndpointChange{IP: ip, Pod: n.Pod, Node: n.Node, From: EndpointAbsent, To: n.State, ResourceVersion: rv}, now)
+		case old.State != n.State:
+			w.record(EndpointChange{IP: ip, Pod: n.Pod, Node: n.Node, From: old.State, To: n.State, ResourceVersion: rv}, now)
+		default:
+			n.Since = old.Since
+		}
+		next[ip] = n
+	}
+	for _, ip := range sortedKeys(w.current) {
+		if _, ok := next[ip]; !ok {
+			old := w.current[ip]
+			w.record(EndpointChange{IP: ip, Pod: old.Pod, Node: old.Node, From: old.State, To: EndpointAbsent, ResourceVersion: rv}, now)
+		}
+	}
+	w.current = next
+}
+
+// record appends c to the history; w.mu must be held.
+func (w *endpointWatcher) record(c EndpointChange, now time.Time) {
+	if !w.listed {
+		return
+	}
+	c.Time = now
+	log.Printf("endpoints: %s %s (%s): %s -> %s\n", w.service, c.IP, c.Pod, c.From, c.To)
+	w.history = append(w.history, c)
+	if len(w.history) > keepEndpointChanges {
+		w.history = w.history[1:]
+	}
+}
+
+// endpointsHistoryHandler shows the Service's addresses now and how they
+// got there, oldest change first:
+//
+//	kubectl scale deploy/learn-k8s --replicas 4
+//	curl -s localhost:8080/k8s/endpoints/history | jq -c '.history[] | {time, pod, from, to}'
+func endpointsHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	endpoints.mu.Lock()
+	current := make([]EndpointState, 0, len(endpoints.current))
+	for _, s := range endpoints.current {
+		current = append(current, s)
+	}
+	history := append([]EndpointChange{}, endpoints.history...)
+	synced, lastErr := endpoints.synced, endpoints.err
+	endpoints.mu.Unlock()
+	sort.Slice(current, func(i, j int) bool { return current[i].IP < current[j].IP })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Namespace string           `json:"namespace"`
+		Service   string           `json:"service"`
+		Synced    bool             `json:"synced"`
+		Error     string           `json:"error,omitempty"`
+		Current   []EndpointState  `json:"current"`
+		History   []EndpointChange `json:"history"`
+	}{
+		Namespace: endpoints.namespace,
+		Service:   endpoints.service,
+		Synced:    synced,
+		Error:     lastErr,
+		Current:   current,
+		History:   history,
+	})
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// slice is an EndpointSlice for the web Service at resource version rv;
+// each endpoint is "ip pod state".
+func slice(rv string, endpoints ...string) string {
+	var eps []string
+	for _, e := range endpoints {
+		var ip, pod, state string
+		fmt.Sscan(e, &ip, &pod, &state)
+		eps = append(eps, fmt.Sprintf(`{"addresses":[%q],"conditions":{"ready":%t,"terminating":%t},"targetRef":{"kind":"Pod","name":%q}}`,
+			ip, state == "ready", state == "terminating", pod))
+	}
+	return fmt.Sprintf(`{"kind":"EndpointSlice","metadata":{"namespace":"default","name":"web-abc","resourceVersion":%q,"labels":{%q:"web"}},"endpoints":[%s]}`,
+		rv, kube.LabelServiceName, strings.Join(eps, ","))
+}
+
+// fakeSliceAPI answers lists with lists[n] and watches with watches[n] for
+// the nth of each, and records the resourceVersion every watch asked for.
+type fakeSliceAPI struct {
+	t       *testing.T
+	lists   []string
+	watches [][]string
+
+	mu      sync.Mutex
+	listed  int
+	watched []string
+}
+
+func (f *fakeSliceAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" ||
+		r.URL.Query().Get("labelSelector") != kube.LabelServiceName+"=web" {
+		f.t.Errorf("unexpected request %s", r.URL)
+		http.NotFound(w, r)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Query().Get("watch") == "" {
+		fmt.Fprint(w, f.lists[min(f.listed, len(f.lists)-1)])
+		f.listed++
+		return
+	}
+	n := len(f.watched)
+	f.watched = append(f.watched, r.URL.Query().Get("resourceVersion"))
+	if n < len(f.watches) {
+		for _, ev := range f.watches[n] {
+			fmt.Fprintln(w, ev)
+		}
+	}
+	// then end the stream, as the server does when timeoutSeconds is up
+}
+
+func TestEndpointWatcherRelist(t *testing.T) {
+	list := func(rv string, items ...string) string {
+		return fmt.Sprintf(`{"kind":"EndpointSliceList","metadata":{"resourceVersion":%q},"items":[%s]}`, rv, strings.Join(items, ","))
+	}
+	api := &fakeSliceAPI{
+		t: t,
+		lists: []string{
+			list("100", slice("99", "10.244.1.2 web-a ready")),
+			// what changed while the watch was gone
+			list("200", slice("180", "10.244.1.2 web-a terminating", "10.244.2.3 web-b ready")),
+		},
+		watches: [][]string{
+			{
+				`{"type":"MODIFIED","object":` + slice("101", "10.244.1.2 web-a ready", "10.244.2.3 web-b notready") + `}`,
+				`{"type":"BOOKMARK","object":{"kind":"EndpointSlice","metadata":{"resourceVersion":"150"}}}`,
+			},
+			{`{"type":"ERROR","object":{"kind":"Status","code":410,"message":"too old resource version: 150 (170)"}}`},
+		},
+	}
+	ts := httptest.NewServer(api)
+	defer ts.Close()
+	w, err := newEndpointWatcher("default/web", ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.listAndWatch(context.Background()); !errors.Is(err, kube.ErrGone) {
+		t.Fatalf("err = %v, want ErrGone", err)
+	}
+	// the second watch carries on from the bookmark
+	if want := "100 150"; strings.Join(api.watched, " ") != want {
+		t.Errorf("watched from %q, want %q", api.watched, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if err := w.listAndWatch(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want the context's", err)
+	}
+	// a watch that ends at once waits before the next one
+	if want := "100 150 200"; strings.Join(api.watched, " ") != want {
+		t.Errorf("watched from %q, want %q", api.watched, want)
+	}
+
+	var got []string
+	for _, c := range w.history {
+		got = append(got, fmt.Sprintf("%s %s %s->%s", c.ResourceVersion, c.Pod, c.From, c.To))
+	}
+	want := []string{
+		"101 web-b absent->not ready",
+		"200 web-a ready->terminating",
+		"200 web-b not ready->ready",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("history\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if st := w.current["10.244.2.3"]; st.State != EndpointReady || st.Pod != "web-b" {
+		t.Errorf("current 10.244.2.3 = %+v", st)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/montybeatnik/learn-k8s/kubeproxy"
+)
+
+// explainSvcCmd shows how kube-proxy routes a Service, from rules saved on
+// a node:
+//
+//	docker exec calico-cluster-worker iptables-save > rules.txt
+//	learn-k8s explain-svc -port 30080 rules.txt
+func explainSvcCmd(args []string) error {
+	fs := flag.NewFlagSet("explain-svc", flag.ExitOnError)
+	kind := fs.String("type", "auto", "what the input is: iptables, ipvs or auto")
+	port := fs.Int("port", 0, "only Services with a frontend or endpoint on this port")
+	svc := fs.String("svc", "", "only Services whose name contains this, e.g. default/learn-k8s")
+	asJSON := fs.Bool("json", false, "print JSON instead of text")
+	fs.Parse(args)
+
+	in, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *kind == "auto" {
+		*kind = "iptables"
+		if bytes.Contains(in, []byte("IP Virtual Server")) || bytes.Contains(in, []byte("RemoteAddress:Port")) {
+			*kind = "ipvs"
+		}
+	}
+	var services []kubeproxy.Service
+	switch *kind {
+	case "iptables":
+		services, err = kubeproxy.ParseIPTables(bytes.NewReader(in))
+	case "ipvs":
+		services, err = kubeproxy.ParseIPVS(bytes.NewReader(in))
+	default:
+		return fmt.Errorf("unknown -type %q", *kind)
+	}
+	if err != nil {
+		return err
+	}
+
+	var matched []kubeproxy.Service
+	for _, s := range services {
+		if (*svc == "" || strings.Contains(s.Name, *svc)) && (*port == 0 || servicePort(s, *port)) {
+			matched = append(matched, s)
+		}
+	}
+	if len(matched) == 0 {
+		return fmt.Errorf("no matching Services among %d", len(services))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(matched)
+	}
+	return printServices(os.Stdout, matched)
+}
+
+// printServices writes one block per Service. Notes sit in the share column
+// so their text lines up with the endpoint addresses above them.
+func printServices(w io.Writer, services []kubeproxy.Service) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, s := range services {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\n", s.Name)
+		for _, f := range s.Frontends {
+			ip := f.IP
+			if ip == "" {
+				ip = "<node IP>"
+			}
+			fmt.Fprintf(tw, "  %s %s:%d/%s -> %s\n", f.Kind, ip, f.Port, f.Protocol, f.Chain)
+			for _, ep := range f.Endpoints {
+				how := ""
+				switch {
+				case ep.Chain != "" && ep.Probability > 0:
+					how = fmt.Sprintf("%s, --probability %.5f", ep.Chain, ep.Probability)
+				case ep.Chain != "":
+					how = ep.Chain + ", takes the rest"
+				default:
+					how = fmt.Sprintf("weight %d", ep.Weight)
+				}
+				fmt.Fprintf(tw, "    %5.1f%%\t%s\t(%s)\n", ep.Share*100, ep.Addr, how)
+			}
+			for _, n := range f.Notes {
+				fmt.Fprintf(tw, "    %6s\t%s\n", "note:", n)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func servicePort(s kubeproxy.Service, port int) bool {
+	suffix := fmt.Sprintf(":%d", port)
+	for _, f := range s.Frontends {
+		if f.Port == port {
+			return true
+		}
+		for _, ep := range f.Endpoints {
+			if strings.HasSuffix(ep.Addr, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/montybeatnik/learn-k8s/kubeproxy"
+)
+
+// Notes line up with the endpoint addresses, whether or not the frontend
+// has any endpoints.
+func TestPrintServicesAlignsNotes(t *testing.T) {
+	f, err := os.Open("examples/kube-proxy/iptables-save.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	services, err := kubeproxy.ParseIPTables(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if err := printServices(&b, services); err != nil {
+		t.Fatal(err)
+	}
+
+	col := -1
+	for _, line := range strings.Split(b.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !(fields[0] == "note:" || strings.HasSuffix(fields[0], "%")) {
+			continue
+		}
+		rest := line[strings.Index(line, fields[0])+len(fields[0]):]
+		at := len(line) - len(strings.TrimLeft(rest, " "))
+		if col < 0 {
+			col = at
+		}
+		if at != col {
+			t.Errorf("column %d, want %d:\n%s", at, col, b.String())
+			break
+		}
+	}
+	if col < 0 {
+		t.Fatalf("no endpoint or note rows in\n%s", b.String())
+	}
+}
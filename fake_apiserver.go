@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/controller"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// fakeAPIServerCmd replays a recorded watch stream the way an API server
+// would serve it, so the -watch-endpoints watcher can be tried without a
+// cluster:
+//
+//	learn-k8s fake-apiserver -events examples/kind/endpointslice-watch.jsonl &
+//	learn-k8s -k8s-api http://127.0.0.1:8001 -watch-endpoints default/learn-k8s
+//
+// The first event is the state at startup; the rest are let out one per
+// -interval. A list returns the objects as of the last event let out, and a
+// watch streams every event after its resourceVersion, then waits for more.
+// resourceVersions in the file must be increasing numbers. Paths and label
+// selectors are ignored: every request gets the one stream.
+//
+// With -memory it's instead an API server that starts empty and keeps what
+// it's sent, for the controller command to run against:
+//
+//	learn-k8s fake-apiserver -memory &
+//	learn-k8s controller -k8s-api http://127.0.0.1:8001
+func fakeAPIServerCmd(args []string) error {
+	fs := flag.NewFlagSet("fake-apiserver", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8001", "address to listen on; kubectl proxy's by default")
+	eventsFile := fs.String("events", "", "watch events, one JSON object per line, as `kubectl get --raw '...?watch=1'` prints them")
+	interval := fs.Duration("interval", 2*time.Second, "time between events")
+	memory := fs.Bool("memory", false, "keep objects that are created, replaced and deleted, instead of replaying -events")
+	readyAfter := fs.Duration("ready-after", time.Second, "with -memory, how long a Deployment's replicas take to turn ready; 0 never")
+	fs.Parse(args)
+
+	if *memory {
+		log.Printf("fake-apiserver: in memory on %s\n", *addr)
+		return http.ListenAndServe(*addr, controller.NewMemoryAPIServer(*readyAfter))
+	}
+
+	in, err := readInput(*eventsFile)
+	if err != nil {
+		return err
+	}
+	f := &fakeAPIServer{changed: make(chan struct{})}
+	sc := bufio.NewScanner(bytes.NewReader(in))
+	sc.Buffer(nil, 1<<20)
+	for n := 1; sc.Scan(); n++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ev kube.WatchEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return fmt.Errorf("%s line %d: %w", *eventsFile, n, err)
+		}
+		rv, err := strconv.ParseUint(kube.ResourceVersion(ev.Object), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%s line %d: resourceVersion must be a number", *eventsFile, n)
+		}
+		f.events = append(f.events, fakeEvent{rv: rv, line: append(append([]byte{}, line...), '\n'), ev: ev})
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	if len(f.events) == 0 {
+		return fmt.Errorf("%s: no events", *eventsFile)
+	}
+	f.released = 1
+
+	go func() {
+		for range time.Tick(*interval) {
+			if !f.release() {
+				return
+			}
+		}
+	}()
+	log.Printf("fake-apiserver: %d events on %s\n", len(f.events), *addr)
+	return http.ListenAndServe(*addr, f)
+}
+
+type fakeEvent struct {
+	rv   uint64
+	line []byte // with its newline
+	ev   kube.WatchEvent
+}
+
+type fakeAPIServer struct {
+	events []fakeEvent
+
+	mu       sync.Mutex
+	released int
+	// changed is closed, and replaced, whenever an event is let out
+	changed chan struct{}
+}
+
+// release lets out the next event, reporting whether there was one.
+func (f *fakeAPIServer) release() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.released == len(f.events) {
+		return false
+	}
+	f.released++
+	e := f.events[f.released-1]
+	log.Printf("fake-apiserver: %s at resourceVersion %d\n", e.ev.Type, e.rv)
+	close(f.changed)
+	f.changed = make(chan struct{})
+	return true
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if v := r.URL.Query().Get("watch"); v != "" && v != "0" && v != "false" {
+		f.watch(w, r)
+		return
+	}
+	f.list(w, r)
+}
+
+// list answers with the objects the released events leave behind.
+func (f *fakeAPIServer) list(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	events := f.events[:f.released]
+	f.mu.Unlock()
+
+	objects := map[string]json.RawMessage{}
+	var order []string
+	for _, e := range events {
+		var meta struct {
+			Metadata struct {
+				Namespace string `json:"namespace"`
+				Name      string `json:"name"`
+			} `json:"metadata"`
+		}
+		json.Unmarshal(e.ev.Object, &meta)
+		key := meta.Metadata.Namespace + "/" + meta.Metadata.Name
+		switch e.ev.Type {
+		case "ADDED", "MODIFIED":
+			if _, ok := objects[key]; !ok {
+				order = append(order, key)
+			}
+			objects[key] = e.ev.Object
+		case "DELETED":
+			delete(objects, key)
+		}
+	}
+	items := []json.RawMessage{}
+	for _, key := range order {
+		if o, ok := objects[key]; ok {
+			items = append(items, o)
+		}
+	}
+	log.Printf("fake-apiserver: list from %s: %d items at resourceVersion %d\n", r.RemoteAddr, len(items), events[len(events)-1].rv)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"kind":       "List",
+		"apiVersion": "v1",
+		"metadata":   map[string]string{"resourceVersion": strconv.FormatUint(events[len(events)-1].rv, 10)},
+		"items":      items,
+	})
+}
+
+// watch streams the events after the request's resourceVersion, flushing
+// each one, until the client goes away or timeoutSeconds pass.
+func (f *fakeAPIServer) watch(w http.ResponseWriter, r *http.Request) {
+	from, _ := strconv.ParseUint(r.URL.Query().Get("resourceVersion"), 10, 64)
+	var timeout <-chan time.Time
+	if secs, err := strconv.Atoi(r.URL.Query().Get("timeoutSeconds")); err == nil && secs > 0 {
+		timeout = time.After(time.Duration(secs) * time.Second)
+	}
+	log.Printf("fake-apiserver: watch from %s after resourceVersion %d\n", r.RemoteAddr, from)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	next := 0
+	for {
+		f.mu.Lock()
+		released, changed := f.released, f.changed
+		f.mu.Unlock()
+		for ; next < released; next++ {
+			e := f.events[next]
+			if e.rv <= from {
+				continue
+			}
+			if _, err := w.Write(e.line); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/docker"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// TrafficFlow is the way into one port of a Service: from the machine
+// running kind, through a node, to the containers behind it.
+type TrafficFlow struct {
+	Service         string   `json:"service"`
+	Type            string   `json:"type"`
+	ClusterIP       string   `json:"cluster_ip,omitempty"`
+	LoadBalancerIPs []string `json:"load_balancer_ips,omitempty"`
+	// Selector is empty for Services whose endpoints are managed by hand.
+	Selector  map[string]string `json:"selector,omitempty"`
+	Port      kube.ServicePort  `json:"port"`
+	HostPorts []FlowHostPort    `json:"host_ports,omitempty"`
+	Backends  []FlowBackend     `json:"backends"`
+}
+
+// FlowHostPort is a port published on the docker host (a kind
+// extraPortMapping) that lands on the Service's NodePort.
+type FlowHostPort struct {
+	docker.PortMapping
+	Node   string `json:"node"`
+	NodeIP string `json:"node_ip,omitempty"`
+}
+
+// FlowBackend is one endpoint of the Service port and the container port it
+// ends up at.
+type FlowBackend struct {
+	IP          string `json:"ip"`
+	Port        int    `json:"port"`
+	Ready       bool   `json:"ready"`
+	Terminating bool   `json:"terminating,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	Node        string `json:"node,omitempty"`
+	Container   string `json:"container,omitempty"`
+	PortName    string `json:"port_name,omitempty"`
+}
+
+// flowCmd draws how traffic reaches Services, either from saved kubectl
+// output or live through `kubectl proxy`, so the picture matches the
+// cluster rather than the README:
+//
+//	kubectl proxy &
+//	docker inspect $(docker ps -q --filter label=io.x-k8s.kind.cluster) > docker.json
+//	learn-k8s flow -api http://127.0.0.1:8001 -docker docker.json -svc default/learn-k8s
+//	learn-k8s flow -services svc.json -endpoints eps.json -pods pods.json -kind-config kind-config.yaml -o dot | dot -Tsvg > flow.svg
+func flowCmd(args []string) error {
+	fs := flag.NewFlagSet("flow", flag.ExitOnError)
+	api := fs.String("api", "", "read Services, EndpointSlices and pods from this API server URL, e.g. kubectl proxy's http://127.0.0.1:8001")
+	servicesFile := fs.String("services", "", "`kubectl get services -A -o json` output")
+	endpointsFile := fs.String("endpoints", "", "`kubectl get endpointslices -A -o json` (or endpoints) output")
+	podsFile := fs.String("pods", "", "`kubectl get pods -A -o json` output")
+	dockerFile := fs.String("docker", "", "`docker inspect` output for the node containers, for published ports")
+	kindConfig := fs.String("kind-config", "", "kind cluster config, for extraPortMappings when there's no -docker")
+	namespace := fs.String("namespace", "", "only Services in this namespace")
+	svc := fs.String("svc", "", "only Services whose namespace/name contains this")
+	output := fs.String("o", "mermaid", "output format: mermaid, dot or json")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the API server")
+	fs.Parse(args)
+
+	var (
+		services []kube.Service
+		slices   []kube.EndpointSlice
+		pods     []kube.Pod
+		err      error
+	)
+	switch {
+	case *api != "":
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		services, slices, pods, err = fetchFlowInputs(ctx, &kube.Client{Base: *api}, *namespace)
+		if err != nil {
+			return err
+		}
+	case *servicesFile != "":
+		if services, err = parseFile(*servicesFile, kube.ParseServices); err != nil {
+			return err
+		}
+		if *endpointsFile != "" {
+			if slices, err = parseFile(*endpointsFile, kube.ParseEndpointSlices); err != nil {
+				return err
+			}
+		}
+		if *podsFile != "" {
+			if pods, err = parseFile(*podsFile, kube.ParsePods); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("need -api or -services")
+	}
+
+	var mappings []FlowHostPort
+	switch {
+	case *dockerFile != "":
+		containers, err := parseFile(*dockerFile, docker.ParseInspect)
+		if err != nil {
+			return err
+		}
+		mappings = dockerPortMappings(containers)
+	case *kindConfig != "":
+		if mappings, err = kindPortMappings(*kindConfig); err != nil {
+			return err
+		}
+	}
+
+	var keep []kube.Service
+	for _, s := range services {
+		if (*namespace == "" || s.Namespace == *namespace) && (*svc == "" || strings.Contains(s.Namespace+"/"+s.Name, *svc)) {
+			keep = append(keep, s)
+		}
+	}
+	if len(keep) == 0 {
+		return fmt.Errorf("no matching Services among %d", len(services))
+	}
+
+	flows := buildFlows(keep, slices, pods, mappings)
+	switch *output {
+	case "mermaid":
+		return flowGraphOf(flows).writeMermaid(os.Stdout)
+	case "dot":
+		return flowGraphOf(flows).writeDOT(os.Stdout)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(flows)
+	}
+	return fmt.Errorf("unknown -o %q: want mermaid, dot or json", *output)
+}
+
+// parseFile reads name (or stdin for "-") with parse.
+func parseFile[T any](name string, parse func(io.Reader) ([]T, error)) ([]T, error) {
+	in, err := readInput(name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := parse(bytes.NewReader(in))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return out, nil
+}
+
+// fetchFlowInputs lists what kubectl would have saved, from the API server.
+func fetchFlowInputs(ctx context.Context, c *kube.Client, namespace string) ([]kube.Service, []kube.EndpointSlice, []kube.Pod, error) {
+	in, err := c.Get(ctx, kube.ListPath("", "v1", "services", namespace))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	services, err := kube.ParseServices(bytes.NewReader(in))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("services: %w", err)
+	}
+	if in, err = c.Get(ctx, kube.ListPath("discovery.k8s.io", "v1", "endpointslices", namespace)); err != nil {
+		return nil, nil, nil, err
+	}
+	slices, err := kube.ParseEndpointSlices(bytes.NewReader(in))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("endpointslices: %w", err)
+	}
+	if in, err = c.Get(ctx, kube.ListPath("", "v1", "pods", namespace)); err != nil {
+		return nil, nil, nil, err
+	}
+	pods, err := kube.ParsePods(bytes.NewReader(in))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("pods: %w", err)
+	}
+	return services, slices, pods, nil
+}
+
+// dockerPortMappings lists the ports each kind node container publishes.
+func dockerPortMappings(containers []docker.Container) []FlowHostPort {
+	var out []FlowHostPort
+	for _, c := range containers {
+		var ip string
+		if len(c.Networks) > 0 {
+			ip = c.Networks[0].IP.Addr().String()
+		}
+		for _, p := range c.Ports {
+			out = append(out, FlowHostPort{PortMapping: p, Node: c.Name, NodeIP: ip})
+		}
+	}
+	return out
+}
+
+// kindPortMappings reads the extraPortMappings from a kind cluster config.
+// Nodes are named the way kind names their containers: kind-control-plane,
+// kind-worker, kind-worker2 and so on, after the config's name.
+func kindPortMappings(name string) ([]FlowHostPort, error) {
+	in, err := readInput(name)
+	if err != nil {
+		return nil, err
+	}
+	js, err := kube.YAMLToJSON(in)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	var cfg struct {
+		Name  string `json:"name"`
+		Nodes []struct {
+			Role              string `json:"role"`
+			ExtraPortMappings []struct {
+				ContainerPort int    `json:"containerPort"`
+				HostPort      int    `json:"hostPort"`
+				ListenAddress string `json:"listenAddress"`
+				Protocol      string `json:"protocol"`
+			} `json:"extraPortMappings"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(js, &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	cluster := cfg.Name
+	if cluster == "" {
+		cluster = "kind"
+	}
+	var out []FlowHostPort
+	seen := map[string]int{}
+	for _, n := range cfg.Nodes {
+		role := n.Role
+		if role == "" {
+			role = "control-plane"
+		}
+		seen[role]++
+		node := cluster + "-" + role
+		if seen[role] > 1 {
+			node += strconv.Itoa(seen[role])
+		}
+		for _, m := range n.ExtraPortMappings {
+			p := docker.PortMapping{
+				HostIP:        m.ListenAddress,
+				HostPort:      m.HostPort,
+				ContainerPort: m.ContainerPort,
+				Protocol:      strings.ToLower(m.Protocol),
+			}
+			if p.HostIP == "" {
+				p.HostIP = "0.0.0.0"
+			}
+			if p.Protocol == "" {
+				p.Protocol = "tcp"
+			}
+			if p.HostPort == 0 {
+				// kind picks a free port when hostPort is left out
+				continue
+			}
+			out = append(out, FlowHostPort{PortMapping: p, Node: node})
+		}
+	}
+	return out, nil
+}
+
+// buildFlows follows each Service port down to its backends. Host ports are
+// the published ports that forward to the Service's NodePort; backends come
+// from the EndpointSlices, with the container port filled in from the pod.
+// Without any slices, backends are worked out from the pods the way the
+// EndpointSlice controller does it.
+func buildFlows(services []kube.Service, slices []kube.EndpointSlice, pods []kube.Pod, mappings []FlowHostPort) []TrafficFlow {
+	podByName := map[string]kube.Pod{}
+	for _, p := range pods {
+		podByName[p.Namespace+"/"+p.Name] = p
+	}
+
+	var flows []TrafficFlow
+	for _, s := range services {
+		for _, sp := range s.Ports {
+			f := TrafficFlow{
+				Service:         s.Namespace + "/" + s.Name,
+				Type:            s.Type,
+				ClusterIP:       s.ClusterIP,
+				LoadBalancerIPs: s.LoadBalancerIPs,
+				Selector:        s.Selector,
+				Port:            sp,
+				Backends:        []FlowBackend{},
+			}
+			if sp.NodePort != 0 {
+				for _, m := range mappings {
+					if m.ContainerPort == sp.NodePort && strings.EqualFold(m.Protocol, sp.Protocol) {
+						f.HostPorts = append(f.HostPorts, m)
+					}
+				}
+			}
+			if slices == nil {
+				f.Backends = selectBackends(s, sp, pods)
+			}
+			for _, sl := range slices {
+				if sl.Namespace != s.Namespace || sl.Service != s.Name {
+					continue
+				}
+				for _, ep := range sl.Ports {
+					if ep.Name != sp.Name || !strings.EqualFold(ep.Protocol, sp.Protocol) {
+						continue
+					}
+					for _, e := range sl.Endpoints {
+						if len(e.Addresses) == 0 {
+							continue
+						}
+						b := FlowBackend{
+							IP:          e.Addresses[0],
+							Port:        ep.Port,
+							Ready:       e.Ready,
+							Terminating: e.Terminating,
+							Pod:         e.Pod,
+							Node:        e.Node,
+						}
+						if p, ok := podByName[s.Namespace+"/"+e.Pod]; ok && e.Pod != "" {
+							if b.Node == "" {
+								b.Node = p.Node
+							}
+							if cp, ok := containerPort(p, strconv.Itoa(ep.Port), ep.Protocol); ok {
+								b.Container, b.PortName = cp.Container, cp.Name
+							}
+						}
+						f.Backends = append(f.Backends, b)
+					}
+				}
+			}
+			flows = append(flows, f)
+		}
+	}
+	return flows
+}
+
+// selectBackends picks the pods matching the Service's selector and
+// resolves targetPort against their container ports. A named targetPort can
+// land on a different port number in each pod.
+func selectBackends(s kube.Service, sp kube.ServicePort, pods []kube.Pod) []FlowBackend {
+	out := []FlowBackend{}
+	for _, p := range pods {
+		if p.Namespace != s.Namespace || !p.Matches(s.Selector) || p.IP() == "" {
+			continue
+		}
+		b := FlowBackend{IP: p.IP(), Ready: p.Phase == "Running", Pod: p.Name, Node: p.Node}
+		if cp, ok := containerPort(p, sp.TargetPort, sp.Protocol); ok {
+			b.Port, b.Container, b.PortName = cp.Port, cp.Container, cp.Name
+		} else if n, err := strconv.Atoi(sp.TargetPort); err == nil {
+			// a number needn't be declared in the pod spec
+			b.Port = n
+		} else {
+			// the controller leaves out pods without the named port
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// containerPort finds the pod's declared port by number or by name.
+func containerPort(p kube.Pod, port, protocol string) (kube.ContainerPort, bool) {
+	for _, cp := range p.Ports {
+		if (strconv.Itoa(cp.Port) == port || cp.Name == port) && strings.EqualFold(cp.Protocol, protocol) {
+			return cp, true
+		}
+	}
+	return kube.ContainerPort{}, false
+}
+
+// flowGraph is the flows as boxes and arrows, ready for Mermaid or DOT.
+// Boxes shared between flows, such as a pod behind several Service ports,
+// are drawn once.
+type flowGraph struct {
+	nodes []flowNode
+	index map[string]int
+	edges []flowEdge
+	seen  map[flowEdge]bool
+}
+
+type flowNode struct {
+	key   string
+	kind  string // host, node, nodeport, lb, service, pod, container, endpoint or none
+	label []string
+}
+
+type flowEdge struct {
+	from, to string
+	label    string
+	dashed   bool
+}
+
+func (g *flowGraph) node(key, kind string, label ...string) string {
+	if _, ok := g.index[key]; !ok {
+		g.index[key] = len(g.nodes)
+		g.nodes = append(g.nodes, flowNode{key: key, kind: kind, label: label})
+	}
+	return key
+}
+
+func (g *flowGraph) edge(from, to, label string, dashed bool) {
+	e := flowEdge{from, to, label, dashed}
+	if !g.seen[e] {
+		g.seen[e] = true
+		g.edges = append(g.edges, e)
+	}
+}
+
+func flowGraphOf(flows []TrafficFlow) *flowGraph {
+	g := &flowGraph{index: map[string]int{}, seen: map[flowEdge]bool{}}
+	for _, f := range flows {
+		proto := strings.ToLower(f.Port.Protocol)
+		frontend := fmt.Sprintf("%s:%d/%s", f.ClusterIP, f.Port.Port, proto)
+		if f.ClusterIP == "None" || f.ClusterIP == "" {
+			frontend = fmt.Sprintf("headless :%d/%s", f.Port.Port, proto)
+		}
+		label := []string{"Service " + f.Service, f.Type + " " + frontend}
+		if f.Port.Name != "" {
+			label[0] += " (" + f.Port.Name + ")"
+		}
+		svc := g.node(fmt.Sprintf("svc %s %d/%s", f.Service, f.Port.Port, proto), "service", label...)
+
+		for _, hp := range f.HostPorts {
+			host := g.node("host "+hp.PortMapping.String(), "host", "your machine", strings.Split(hp.PortMapping.String(), " ")[0]+"/"+hp.Protocol)
+			nodeAddr := fmt.Sprintf(":%d", hp.ContainerPort)
+			if hp.NodeIP != "" {
+				nodeAddr = hp.NodeIP + nodeAddr
+			}
+			node := g.node(fmt.Sprintf("node %s %d/%s", hp.Node, hp.ContainerPort, proto), "node", hp.Node, nodeAddr)
+			g.edge(host, node, "kind extraPortMapping", false)
+			g.edge(node, svc, fmt.Sprintf("NodePort %d", f.Port.NodePort), false)
+		}
+		if f.Port.NodePort != 0 && len(f.HostPorts) == 0 {
+			np := g.node(fmt.Sprintf("nodeport %d/%s", f.Port.NodePort, proto), "nodeport", "any node", fmt.Sprintf(":%d/%s", f.Port.NodePort, proto))
+			g.edge(np, svc, "NodePort", false)
+		}
+		for _, ip := range f.LoadBalancerIPs {
+			addr := fmt.Sprintf("%s:%d/%s", ip, f.Port.Port, proto)
+			g.edge(g.node("lb "+addr, "lb", "LoadBalancer", addr), svc, "", false)
+		}
+
+		if len(f.Backends) == 0 {
+			none := "no endpoints"
+			if len(f.Selector) == 0 {
+				none += "\n(no selector)"
+			}
+			g.edge(svc, g.node("none "+svc, "none", none), "", true)
+		}
+		for _, b := range f.Backends {
+			if b.Pod == "" {
+				// not a pod, e.g. the API server behind default/kubernetes
+				g.edge(svc, g.node("ip "+b.IP, "endpoint", "endpoint", fmt.Sprintf("%s:%d", b.IP, b.Port)), "DNAT", !b.Ready)
+				continue
+			}
+			ns, _, _ := strings.Cut(f.Service, "/")
+			pod := g.node("pod "+ns+"/"+b.Pod, "pod", "pod "+b.Pod, b.IP, "on "+orDash(b.Node))
+			how := fmt.Sprintf("DNAT %s:%d", b.IP, b.Port)
+			switch {
+			case b.Terminating:
+				how += " (terminating)"
+			case !b.Ready:
+				how += " (not ready)"
+			}
+			g.edge(svc, pod, how, !b.Ready)
+
+			port := fmt.Sprintf(":%d/%s", b.Port, proto)
+			if b.PortName != "" {
+				port += " " + b.PortName
+			}
+			c := "container ?"
+			if b.Container != "" {
+				c = "container " + b.Container
+			}
+			g.edge(pod, g.node(fmt.Sprintf("port %s %d/%s", pod, b.Port, proto), "container", c, port), "", false)
+		}
+	}
+	return g
+}
+
+// writeMermaid renders the graph as a Mermaid flowchart, which GitHub draws
+// inline in a ```mermaid block.
+func (g *flowGraph) writeMermaid(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	shapes := map[string][2]string{
+		"host":      {"([", "])"},
+		"node":      {"[[", "]]"},
+		"nodeport":  {"[[", "]]"},
+		"lb":        {"([", "])"},
+		"service":   {"{{", "}}"},
+		"pod":       {"(", ")"},
+		"container": {"[", "]"},
+		"endpoint":  {"(", ")"},
+		"none":      {">", "]"},
+	}
+	for i, n := range g.nodes {
+		s := shapes[n.kind]
+		fmt.Fprintf(&b, "  n%d%s%s%s\n", i, s[0], mermaidText(strings.Join(n.label, "\n")), s[1])
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.dashed {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			arrow += "|" + mermaidText(e.label) + "|"
+		}
+		fmt.Fprintf(&b, "  n%d %s n%d\n", g.index[e.from], arrow, g.index[e.to])
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// mermaidText quotes s for a Mermaid label.
+func mermaidText(s string) string {
+	r := strings.NewReplacer(`"`, "#quot;", "\n", "<br/>")
+	return `"` + r.Replace(s) + `"`
+}
+
+// writeDOT renders the graph for Graphviz.
+func (g *flowGraph) writeDOT(w io.Writer) error {
+	var b strings.Builder
+	b.WriteString("digraph flow {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=9];\n")
+	shapes := map[string]string{
+		"host":      "house",
+		"node":      "component",
+		"nodeport":  "component",
+		"lb":        "house",
+		"service":   "hexagon",
+		"pod":       "ellipse",
+		"container": "box",
+		"endpoint":  "ellipse",
+		"none":      "note",
+	}
+	for _, n := range g.nodes {
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", dotID(n.key), dotID(strings.Join(n.label, "\n")), shapes[n.kind])
+	}
+	for _, e := range g.edges {
+		var attrs []string
+		if e.label != "" {
+			attrs = append(attrs, "label="+dotID(e.label))
+		}
+		if e.dashed {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(&b, "  %s -> %s", dotID(e.from), dotID(e.to))
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, " [%s]", strings.Join(attrs, ", "))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
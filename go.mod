@@ -1,3 +1,3 @@
 module github.com/montybeatnik/learn-k8s
 
-go 1.23.5
+go 1.24.0
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A small gRPC server written against net/http. gRPC is "just" HTTP/2 with
+// length-prefixed protobuf messages and a status in the trailers, so we don't
+// need the grpc-go module for two services. The schema lives in
+// proto/learnk8s.proto.
+//
+// Kubernetes speaks the standard health protocol for `grpc:` probes:
+//
+//	readinessProbe:
+//	  grpc:
+//	    port: 9090
+
+// gRPC status codes we use. See
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK              = 0
+	grpcInvalidArgument = 3
+	grpcNotFound        = 5
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+	grpcUnavailable     = 14
+)
+
+// Serving states from grpc.health.v1.HealthCheckResponse.
+const (
+	healthServing        = 1
+	healthNotServing     = 2
+	healthServiceUnknown = 3
+)
+
+const (
+	grpcInfoService   = "learnk8s.v1.Info"
+	grpcHealthService = "grpc.health.v1.Health"
+
+	// grpcMaxMessage matches grpc-go's default receive limit.
+	grpcMaxMessage = 4 << 20
+)
+
+// grpcError carries a status code back to the handler.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return fmt.Sprintf("grpc status %d: %s", e.code, e.msg) }
+
+func grpcErrorf(code int, format string, args ...any) error {
+	return &grpcError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// grpcStream is handed to each method. Send writes one framed message.
+type grpcStream struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func (s *grpcStream) Send(msg []byte) error {
+	if err := writeGRPCMessage(s.w, msg); err != nil {
+		return err
+	}
+	http.NewResponseController(s.w).Flush()
+	return nil
+}
+
+// grpcMethods maps "/package.Service/Method" to its implementation. Each
+// method gets the single request message the client sent.
+var grpcMethods = map[string]func(s *grpcStream, req []byte) error{
+	"/" + grpcInfoService + "/GetInfo":    grpcGetInfo,
+	"/" + grpcInfoService + "/StreamInfo": grpcStreamInfo,
+	"/" + grpcHealthService + "/Check":    grpcHealthCheck,
+	"/" + grpcHealthService + "/Watch":    grpcHealthWatch,
+}
+
+func grpcHandler(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !isGRPC(r) {
+		http.Error(w, "gRPC requires HTTP/2 and content-type application/grpc", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	code, msg, wrote := grpcOK, "", false
+	defer func() {
+		// Once the body has started, the status has to go out as HTTP/2
+		// trailers. Before that gRPC allows a "trailers-only" response where
+		// it rides along with the headers.
+		prefix := ""
+		if wrote {
+			prefix = http.TrailerPrefix
+		}
+		w.Header().Set(prefix+"Grpc-Status", strconv.Itoa(code))
+		if msg != "" {
+			w.Header().Set(prefix+"Grpc-Message", msg)
+		}
+	}()
+
+	method, ok := grpcMethods[r.URL.Path]
+	if !ok {
+		code, msg = grpcUnimplemented, "unknown method "+r.URL.Path
+		return
+	}
+
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		code, msg = grpcInvalidArgument, err.Error()
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	wrote = true
+
+	if err := method(&grpcStream{w: w, r: r}, req); err != nil {
+		var gerr *grpcError
+		if errors.As(err, &gerr) {
+			code, msg = gerr.code, gerr.msg
+		} else {
+			code, msg = grpcInternal, err.Error()
+		}
+	}
+}
+
+func isGRPC(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	return ct == "application/grpc" || strings.HasPrefix(ct, "application/grpc+") || strings.HasPrefix(ct, "application/grpc;")
+}
+
+// readGRPCMessage reads one length-prefixed message: a compressed flag byte,
+// a big-endian uint32 length and the protobuf payload.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("reading message header: %w", err)
+	}
+	if hdr[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > grpcMaxMessage {
+		return nil, fmt.Errorf("message of %d bytes exceeds limit of %d", n, grpcMaxMessage)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("reading message body: %w", err)
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w io.Writer, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func grpcGetInfo(s *grpcStream, _ []byte) error {
+	return s.Send(newResponse(s.r).appendProto(nil))
+}
+
+func grpcStreamInfo(s *grpcStream, req []byte) error {
+	var count, intervalMS uint64
+	err := protoFields(req, func(field, wire int, v uint64, _ []byte) error {
+		switch field {
+		case 1:
+			count = v
+		case 2:
+			intervalMS = v
+		}
+		return nil
+	})
+	if err != nil {
+		return grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	streaming(s.w)
+	interval := time.Second
+	if intervalMS > 0 {
+		interval = time.Duration(intervalMS) * time.Millisecond
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for sent := uint64(0); count == 0 || sent < count; sent++ {
+		if sent > 0 {
+			select {
+			case <-s.r.Context().Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+		if err := s.Send(newResponse(s.r).appendProto(nil)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthStatus reports the serving state of a service name. The empty name
+// means the server as a whole. Like /readyz, we stop serving while
+// overloaded.
+func healthStatus(service string) int {
+	switch service {
+	case "", grpcInfoService, grpcHealthService:
+		if load.overloaded(time.Now()) {
+			return healthNotServing
+		}
+		return healthServing
+	}
+	return healthServiceUnknown
+}
+
+func parseHealthRequest(req []byte) (string, error) {
+	var service string
+	err := protoFields(req, func(field, wire int, _ uint64, data []byte) error {
+		if field == 1 {
+			service = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", grpcErrorf(grpcInvalidArgument, "%v", err)
+	}
+	return service, nil
+}
+
+func grpcHealthCheck(s *grpcStream, req []byte) error {
+	service, err := parseHealthRequest(req)
+	if err != nil {
+		return err
+	}
+	status := healthStatus(service)
+	if status == healthServiceUnknown {
+		return grpcErrorf(grpcNotFound, "unknown service %q", service)
+	}
+	return s.Send(appendProtoVarint(nil, 1, uint64(status)))
+}
+
+// healthWatchInterval is how often Watch looks at the status again. Being
+// overloaded is a matter of time passing, so there's no event to wait on.
+var healthWatchInterval = time.Second
+
+// grpcHealthWatch sends the current status, then a new one every time it
+// changes, as the health protocol asks, until the client goes away.
+func grpcHealthWatch(s *grpcStream, req []byte) error {
+	service, err := parseHealthRequest(req)
+	if err != nil {
+		return err
+	}
+	streaming(s.w)
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	sent := 0
+	for {
+		if status := healthStatus(service); status != sent {
+			if err := s.Send(appendProtoVarint(nil, 1, uint64(status))); err != nil {
+				return err
+			}
+			sent = status
+		}
+		select {
+		case <-s.r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// serveGRPC stands up a cleartext HTTP/2 (h2c) server for gRPC. Clients must
+// use prior knowledge, which is what every gRPC client does with plaintext.
+func serveGRPC(addr string) {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := newServer(addr, shedLoad(http.HandlerFunc(grpcHandler)))
+	srv.Protocols = &protocols
+
+	ln, err := listen(addr)
+	if err != nil {
+		log.Printf("failed to stand up gRPC server: %v\n", err)
+		return
+	}
+	log.Printf("standing up gRPC server on %v\n", addr)
+	if err := srv.Serve(ln); err != nil {
+		log.Printf("failed to stand up gRPC server: %v\n", err)
+	}
+}
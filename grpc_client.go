@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// grpcClientCmd calls Info/GetInfo n times and counts which pod answered.
+// By default every call shares one HTTP/2 connection, which is how real gRPC
+// clients behave. Behind a ClusterIP Service that connection is pinned to
+// one pod by kube-proxy, so every answer comes from the same hostname. Pass
+// -new-conn to dial per call and watch the spread come back.
+//
+//	learn-k8s grpc-client -addr learn-k8s:9090 -n 20
+func grpcClientCmd(args []string) error {
+	fs := flag.NewFlagSet("grpc-client", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:9090", "gRPC server address")
+	n := fs.Int("n", 10, "number of calls")
+	newConn := fs.Bool("new-conn", false, "dial a new connection for every call")
+	fs.Parse(args)
+
+	client := newH2CClient()
+	counts := map[string]int{}
+	for i := 0; i < *n; i++ {
+		if *newConn {
+			client.CloseIdleConnections()
+		}
+		msg, err := grpcCall(client, *addr, "/"+grpcInfoService+"/GetInfo", nil)
+		if err != nil {
+			return err
+		}
+		var resp Response
+		if err := resp.unmarshalProto(msg); err != nil {
+			return err
+		}
+		counts[resp.Hostname]++
+	}
+
+	printCounts(os.Stdout, counts)
+	return nil
+}
+
+// newH2CClient returns an http.Client that speaks HTTP/2 over plaintext
+// with prior knowledge.
+func newH2CClient() *http.Client {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: &protocols}}
+}
+
+// grpcCall makes a unary call and returns the single response message.
+func grpcCall(client *http.Client, addr, method string, req []byte) ([]byte, error) {
+	var body bytes.Buffer
+	writeGRPCMessage(&body, req)
+	hreq, err := http.NewRequest(http.MethodPost, "http://"+addr+method, &body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	hreq.Header.Set("TE", "trailers")
+
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	msg, readErr := readGRPCMessage(resp.Body)
+	io.Copy(io.Discard, resp.Body)
+
+	// trailers are only populated once the body has been read to EOF
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+	}
+	if code, _ := strconv.Atoi(status); status != "" && code != grpcOK {
+		message := resp.Trailer.Get("Grpc-Message") + resp.Header.Get("Grpc-Message")
+		return nil, fmt.Errorf("%s: grpc status %d: %s", method, code, message)
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("%s: %w", method, readErr)
+	}
+	return msg, nil
+}
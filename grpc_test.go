@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// grpcServer serves gRPC over h2c on a loopback port, the way serveGRPC
+// does, and returns its address. Closing it waits for the handlers, which
+// read globals the tests put back.
+func grpcServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handlers sync.WaitGroup
+	h := shedLoad(http.HandlerFunc(grpcHandler))
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	srv := newServer(ln.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlers.Add(1)
+		defer handlers.Done()
+		h.ServeHTTP(w, r)
+	}))
+	srv.Protocols = &protocols
+	go srv.Serve(ln)
+	t.Cleanup(func() {
+		srv.Close()
+		handlers.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// grpcStreamCall starts a server-streaming call and hands back its messages
+// as they arrive; the channel closes when the stream ends.
+func grpcStreamCall(t *testing.T, addr, method string, req []byte) <-chan []byte {
+	t.Helper()
+	var body bytes.Buffer
+	writeGRPCMessage(&body, req)
+	ctx, cancel := context.WithCancel(context.Background())
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+addr+method, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hreq.Header.Set("Content-Type", "application/grpc")
+	resp, err := newH2CClient().Do(hreq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cancel()
+		resp.Body.Close()
+	})
+	msgs := make(chan []byte, 16)
+	go func() {
+		defer close(msgs)
+		for {
+			msg, err := readGRPCMessage(resp.Body)
+			if err != nil {
+				return
+			}
+			msgs <- msg
+		}
+	}()
+	return msgs
+}
+
+// nextMessage waits for the stream's next message; ok is false once it
+// has ended.
+func nextMessage(t *testing.T, msgs <-chan []byte) (msg []byte, ok bool) {
+	t.Helper()
+	select {
+	case msg, ok = <-msgs:
+		return msg, ok
+	case <-time.After(2 * time.Second):
+		t.Fatal("no message after 2s")
+		return nil, false
+	}
+}
+
+// healthOf decodes a HealthCheckResponse.
+func healthOf(t *testing.T, msg []byte) int {
+	t.Helper()
+	status := 0
+	if err := protoFields(msg, func(field, _ int, v uint64, _ []byte) error {
+		if field == 1 {
+			status = int(v)
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return status
+}
+
+func TestGRPCInfo(t *testing.T) {
+	addr := grpcServer(t)
+	client := newH2CClient()
+	var seq []int64
+	for range 2 {
+		msg, err := grpcCall(client, addr, "/"+grpcInfoService+"/GetInfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp Response
+		if err := resp.unmarshalProto(msg); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Protocol != "HTTP/2.0" || resp.AddrFamily != "ipv4" || !strings.HasPrefix(resp.RemoteAddr, "127.0.0.1:") {
+			t.Errorf("GetInfo = %+v", resp)
+		}
+		seq = append(seq, resp.ConnRequests)
+	}
+	// both calls went down the one connection
+	if seq[1] != seq[0]+1 {
+		t.Errorf("conn_requests %v, want one after the other", seq)
+	}
+
+	// count 3, 1ms apart
+	msgs := grpcStreamCall(t, addr, "/"+grpcInfoService+"/StreamInfo", appendProtoVarint(appendProtoVarint(nil, 1, 3), 2, 1))
+	n := 0
+	for {
+		msg, ok := nextMessage(t, msgs)
+		if !ok {
+			break
+		}
+		var resp Response
+		if err := resp.unmarshalProto(msg); err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != 3 {
+		t.Errorf("StreamInfo sent %d messages, want 3", n)
+	}
+
+	if _, err := grpcCall(client, addr, "/"+grpcInfoService+"/Nope", nil); err == nil || !strings.Contains(err.Error(), "grpc status 12") {
+		t.Errorf("unknown method: err = %v, want Unimplemented", err)
+	}
+}
+
+func TestGRPCHealthCheck(t *testing.T) {
+	addr := grpcServer(t)
+	client := newH2CClient()
+	check := func(service string) (int, error) {
+		msg, err := grpcCall(client, addr, "/"+grpcHealthService+"/Check", appendProtoString(nil, 1, service))
+		if err != nil {
+			return 0, err
+		}
+		return healthOf(t, msg), nil
+	}
+	for _, service := range []string{"", grpcInfoService, grpcHealthService} {
+		if got, err := check(service); err != nil || got != healthServing {
+			t.Errorf("Check(%q) = %d, %v; want SERVING", service, got, err)
+		}
+	}
+	if _, err := check("learnk8s.v1.Nope"); err == nil || !strings.Contains(err.Error(), "grpc status 5") {
+		t.Errorf("unknown service: err = %v, want NotFound", err)
+	}
+
+	s := withLoad(t, "fixed", 1)
+	overload(s)
+	if got, err := check(""); err != nil || got != healthNotServing {
+		t.Errorf("Check while overloaded = %d, %v; want NOT_SERVING", got, err)
+	}
+}
+
+// overload has s shed for the whole of -unready-after, up to now.
+func overload(s *shedder) {
+	now := time.Now()
+	s.acquire(now.Add(-unreadyAfter))
+	s.acquire(now.Add(-unreadyAfter))
+	s.acquire(now)
+}
+
+func TestGRPCHealthWatch(t *testing.T) {
+	oldInterval, oldUnready := healthWatchInterval, unreadyAfter
+	healthWatchInterval, unreadyAfter = 10*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { healthWatchInterval, unreadyAfter = oldInterval, oldUnready })
+	s := withLoad(t, "fixed", 1)
+	addr := grpcServer(t)
+
+	msgs := grpcStreamCall(t, addr, "/"+grpcHealthService+"/Watch", nil)
+	var got []int
+	for range 3 {
+		msg, ok := nextMessage(t, msgs)
+		if !ok {
+			t.Fatalf("stream ended after %v", got)
+		}
+		got = append(got, healthOf(t, msg))
+		if len(got) == 1 {
+			// shedding flips it, and a quiet -unready-after flips it back
+			overload(s)
+		}
+	}
+	if want := []int{healthServing, healthNotServing, healthServing}; !slices.Equal(got, want) {
+		t.Errorf("Watch sent %v, want %v", got, want)
+	}
+	// nothing more while nothing changes
+	select {
+	case msg := <-msgs:
+		t.Errorf("unchanged status sent again: %d", healthOf(t, msg))
+	case <-time.After(5 * healthWatchInterval):
+	}
+
+	// an unknown service is reported, not refused, and the stream stays open
+	msgs = grpcStreamCall(t, addr, "/"+grpcHealthService+"/Watch", appendProtoString(nil, 1, "learnk8s.v1.Nope"))
+	if msg, _ := nextMessage(t, msgs); healthOf(t, msg) != healthServiceUnknown {
+		t.Errorf("unknown service: %d, want SERVICE_UNKNOWN", healthOf(t, msg))
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// net/http speaks cleartext HTTP/2 when the client starts with the HTTP/2
+// preface ("prior knowledge", curl --http2-prior-knowledge). It does not
+// implement the HTTP/1.1 `Upgrade: h2c` dance (curl --http2), so we do that
+// part here:
+//
+//  1. answer the HTTP/1.1 request with 101 Switching Protocols,
+//  2. hijack the connection,
+//  3. splice the original request back in as HTTP/2 stream 1, right after
+//     the client's preface and SETTINGS frame,
+//  4. hand the connection to the same http.Server, which now sees an
+//     ordinary prior-knowledge HTTP/2 connection.
+//
+// See RFC 7540 section 3.2.
+
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+const (
+	http2FrameHeaders  = 0x1
+	http2FrameSettings = 0x4
+
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+
+	// http2MaxFrame is the initial SETTINGS_MAX_FRAME_SIZE every peer accepts.
+	http2MaxFrame = 16384
+)
+
+// upgradeTimeout bounds how long we wait for the client's preface after 101.
+const upgradeTimeout = 10 * time.Second
+
+// h2cUpgrade serves HTTP/1.1 requests that ask to upgrade to h2c over l.
+// Everything else goes to next.
+func h2cUpgrade(next http.Handler, l *connListener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 1 || !wantsH2C(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Replaying a request body on stream 1 isn't worth the trouble; the
+		// RFC lets us ignore the upgrade and answer over HTTP/1.1 instead.
+		if r.ContentLength != 0 || len(r.TransferEncoding) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		headers, err := upgradeHeadersFrame(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			conn.Close()
+			return
+		}
+
+		conn.SetReadDeadline(time.Now().Add(upgradeTimeout))
+		prefix, err := readClientStart(rw.Reader)
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("h2c upgrade from %v: %v\n", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+
+		l.push(&upgradedConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(append(prefix, headers...)), rw.Reader),
+		})
+	})
+}
+
+// wantsH2C reports whether r carries a well-formed h2c upgrade request.
+func wantsH2C(r *http.Request) bool {
+	if !headerHasToken(r.Header, "Upgrade", "h2c") || !headerHasToken(r.Header, "Connection", "upgrade") {
+		return false
+	}
+	return len(r.Header.Values("HTTP2-Settings")) == 1
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// readClientStart reads the connection preface and the SETTINGS frame that
+// must follow it, returning them verbatim.
+func readClientStart(r io.Reader) ([]byte, error) {
+	buf := make([]byte, len(http2Preface)+9)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("reading preface: %w", err)
+	}
+	if string(buf[:len(http2Preface)]) != http2Preface {
+		return nil, errors.New("client did not send the HTTP/2 preface")
+	}
+	hdr := buf[len(http2Preface):]
+	if hdr[3] != http2FrameSettings {
+		return nil, fmt.Errorf("first frame has type %d, want SETTINGS", hdr[3])
+	}
+	n := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	if n > http2MaxFrame {
+		return nil, fmt.Errorf("SETTINGS frame of %d bytes is too large", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading SETTINGS: %w", err)
+	}
+	return append(buf, payload...), nil
+}
+
+// upgradeHeadersFrame encodes r as the HEADERS frame that opens stream 1.
+// HPACK lets us send every field as a plain literal, so no Huffman coding or
+// header table is needed.
+func upgradeHeadersFrame(r *http.Request) ([]byte, error) {
+	var block []byte
+	field := func(name, value string) {
+		block = append(block, 0x00) // literal without indexing, new name
+		block = appendHPACKString(block, name)
+		block = appendHPACKString(block, value)
+	}
+	field(":method", r.Method)
+	field(":scheme", "http")
+	field(":authority", r.Host)
+	field(":path", r.URL.RequestURI())
+	for name, values := range r.Header {
+		switch lower := strings.ToLower(name); lower {
+		case "connection", "upgrade", "http2-settings", "keep-alive", "proxy-connection", "transfer-encoding", "host", "te":
+			// connection-specific; not allowed in HTTP/2
+		default:
+			for _, v := range values {
+				field(lower, v)
+			}
+		}
+	}
+	if len(block) > http2MaxFrame {
+		return nil, errors.New("request headers too large to replay")
+	}
+
+	frame := []byte{byte(len(block) >> 16), byte(len(block) >> 8), byte(len(block)),
+		http2FrameHeaders, http2FlagEndStream | http2FlagEndHeaders}
+	frame = binary.BigEndian.AppendUint32(frame, 1)
+	return append(frame, block...), nil
+}
+
+// appendHPACKString writes a string literal (RFC 7541 section 5.2) without
+// Huffman coding.
+func appendHPACKString(b []byte, s string) []byte {
+	n := len(s)
+	if n < 127 {
+		b = append(b, byte(n))
+	} else {
+		b = append(b, 127)
+		for n -= 127; n >= 128; n >>= 7 {
+			b = append(b, byte(n&0x7f)|0x80)
+		}
+		b = append(b, byte(n))
+	}
+	return append(b, s...)
+}
+
+// upgradedConn is a hijacked connection whose reads start with bytes we
+// already consumed (or made up).
+type upgradedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+func (c *upgradedConn) NetConn() net.Conn { return c.Conn }
+
+// connListener is a net.Listener fed by hand, so connections that were
+// upgraded inside a handler can be served like freshly accepted ones.
+type connListener struct {
+	addr  net.Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+func (l *connListener) push(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr { return l.addr }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/montybeatnik/learn-k8s/bird"
+	"github.com/montybeatnik/learn-k8s/calico"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// ippoolCmd explains a Calico IPPool:
+//
+//	kubectl get ippools default-ipv4-ippool -o json | learn-k8s ippool -kind-config config.yaml
+//
+// With -nodes and -routes (birdcl `show route` from one calico-node) it also
+// lists which node each block went to.
+func ippoolCmd(args []string) error {
+	fs := flag.NewFlagSet("ippool", flag.ExitOnError)
+	podSubnet := fs.String("pod-subnet", "", "the cluster's pod CIDR to check the pool against")
+	kindConfig := fs.String("kind-config", "", "kind cluster config to read networking.podSubnet from")
+	nodesFile := fs.String("nodes", "", "`kubectl get nodes -o wide` or -o json output")
+	routesFiles := fs.String("routes", "", "comma-separated `birdcl show route` outputs to map blocks to nodes")
+	localNode := fs.String("node", "", "node the routes were captured on; owns the blackhole routes")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Parse(args)
+
+	in, err := readInput(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	pools, err := calico.ParseIPPools(bytes.NewReader(in))
+	if err != nil {
+		return err
+	}
+
+	if *kindConfig != "" {
+		if *podSubnet, err = kindPodSubnet(*kindConfig); err != nil {
+			return err
+		}
+	}
+	var subnet netip.Prefix
+	if *podSubnet != "" {
+		if subnet, err = netip.ParsePrefix(*podSubnet); err != nil {
+			return fmt.Errorf("pod subnet: %w", err)
+		}
+	}
+	var nodes []kube.Node
+	if *nodesFile != "" {
+		if in, err = readInput(*nodesFile); err != nil {
+			return err
+		}
+		if nodes, err = kube.ParseNodes(bytes.NewReader(in)); err != nil {
+			return fmt.Errorf("%s: %w", *nodesFile, err)
+		}
+	}
+	var routes []bird.Route
+	if *routesFiles != "" {
+		for _, name := range strings.Split(*routesFiles, ",") {
+			if in, err = readInput(strings.TrimSpace(name)); err != nil {
+				return err
+			}
+			rs, err := bird.ParseRoutes(bytes.NewReader(in))
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			routes = append(routes, rs...)
+		}
+	}
+
+	type report struct {
+		Pool      calico.IPPool   `json:"pool"`
+		Capacity  calico.Capacity `json:"capacity"`
+		PodSubnet string          `json:"pod_subnet,omitempty"`
+		Relation  calico.Relation `json:"relation,omitempty"`
+		Blocks    []calico.Block  `json:"blocks,omitempty"`
+	}
+	var (
+		reports  []report
+		disjoint []string
+	)
+	for _, p := range pools {
+		rep := report{Pool: p, Capacity: p.Capacity(len(nodes))}
+		if subnet.IsValid() {
+			rep.PodSubnet, rep.Relation = subnet.String(), p.Against(subnet)
+			if rep.Relation == calico.Disjoint && !p.Disabled {
+				disjoint = append(disjoint, p.Name)
+			}
+		}
+		if routes != nil {
+			rep.Blocks = p.Blocks(routes, nodes, *localNode)
+		}
+		reports = append(reports, rep)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for i, rep := range reports {
+			if i > 0 {
+				fmt.Fprintln(tw)
+			}
+			p, c := rep.Pool, rep.Capacity
+			fmt.Fprintf(tw, "pool\t%s\n", p.Name)
+			fmt.Fprintf(tw, "cidr\t%s\n", p.CIDR)
+			fmt.Fprintf(tw, "block size\t/%d\n", p.BlockSize)
+			fmt.Fprintf(tw, "blocks\t%d\n", c.Blocks)
+			fmt.Fprintf(tw, "ips per block\t%d\n", c.IPsPerBlock)
+			fmt.Fprintf(tw, "max nodes\t%d (one block each)\n", c.MaxNodes)
+			if c.Nodes > 0 {
+				share := fmt.Sprintf("%d blocks each", c.BlocksPerNode)
+				if c.BlocksPerNode == 0 {
+					share = "more nodes than blocks, so they borrow addresses"
+				}
+				if p.Encapsulated() {
+					share += ", less one address for the tunnel device"
+				}
+				fmt.Fprintf(tw, "pods per node\t%d with %d nodes sharing the pool (%s; kubelet's max-pods, 110 by default, bites first)\n", c.PodsPerNode, c.Nodes, share)
+			}
+			fmt.Fprintf(tw, "encapsulation\t%s\n", encapsulation(p))
+			fmt.Fprintf(tw, "nat outgoing\t%v\n", p.NATOutgoing)
+			fmt.Fprintf(tw, "node selector\t%s\n", p.NodeSelector)
+			if rep.PodSubnet != "" {
+				fmt.Fprintf(tw, "pod subnet\t%s: pool is %s\n", rep.PodSubnet, relationHint(rep.Relation))
+			}
+			for _, b := range rep.Blocks {
+				node := b.Node
+				if node == "" {
+					node = "?"
+				}
+				if b.Via != "" {
+					node += " via " + b.Via
+				}
+				fmt.Fprintf(tw, "block\t%s on %s\n", b.Prefix, node)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	if len(disjoint) > 0 {
+		return fmt.Errorf("pool %s is outside the pod subnet %s", strings.Join(disjoint, ", "), subnet)
+	}
+	return nil
+}
+
+func encapsulation(p calico.IPPool) string {
+	var modes []string
+	for _, m := range []struct{ name, mode string }{{"IPIP", p.IPIPMode}, {"VXLAN", p.VXLANMode}} {
+		switch m.mode {
+		case "Always":
+			modes = append(modes, m.name+" between all nodes")
+		case "CrossSubnet":
+			modes = append(modes, m.name+" only between nodes on different subnets")
+		}
+	}
+	if len(modes) == 0 {
+		return "none: pod traffic is routed as-is, so the network between nodes must know the pod routes (BGP)"
+	}
+	return strings.Join(modes, "; ")
+}
+
+func relationHint(r calico.Relation) string {
+	switch r {
+	case calico.Equal:
+		return "the same range"
+	case calico.Inside:
+		return "inside it"
+	case calico.Contains:
+		return "bigger than it; pods outside the subnet look external to kube-proxy"
+	}
+	return "outside it; kube-proxy will treat pod traffic as external"
+}
+
+// kindPodSubnet reads networking.podSubnet from a kind cluster config.
+func kindPodSubnet(name string) (string, error) {
+	in, err := readInput(name)
+	if err != nil {
+		return "", err
+	}
+	js, err := kube.YAMLToJSON(in)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	var cfg struct {
+		Networking struct {
+			PodSubnet string `json:"podSubnet"`
+		} `json:"networking"`
+	}
+	if err := json.Unmarshal(js, &cfg); err != nil {
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	if cfg.Networking.PodSubnet == "" {
+		// kind's default when the config doesn't set one
+		return "10.244.0.0/16", nil
+	}
+	// kind accepts "v4,v6" for dual-stack; the pool is one family
+	first, _, _ := strings.Cut(cfg.Networking.PodSubnet, ",")
+	return first, nil
+}
@@ -0,0 +1,261 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Client fetches the same JSON kubectl prints straight from an API server.
+// Base is where `kubectl proxy` listens (http://127.0.0.1:8001 by default),
+// which takes care of authentication, or what InCluster found.
+type Client struct {
+	Base string
+	// TokenFile holds a bearer token. It's read before every request:
+	// kubelet rotates the service account token behind it.
+	TokenFile string
+	HTTP      *http.Client
+}
+
+// serviceAccountDir is where kubelet mounts a pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// InCluster is a Client for the API server a pod runs under, acting as the
+// pod's service account.
+func InCluster() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a pod: KUBERNETES_SERVICE_HOST is unset")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s/ca.crt: no certificates", serviceAccountDir)
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	return &Client{
+		Base:      "https://" + net.JoinHostPort(host, port),
+		TokenFile: serviceAccountDir + "/token",
+		HTTP:      &http.Client{Transport: tr},
+	}, nil
+}
+
+// InClusterNamespace is the namespace of the pod we're running in.
+func InClusterNamespace() (string, error) {
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// Get fetches an API path such as /api/v1/pods.
+func (c *Client) Get(ctx context.Context, path string) ([]byte, error) {
+	return c.Do(ctx, http.MethodGet, path, nil)
+}
+
+// Do sends a request with an optional JSON body and returns the response
+// body. A refusal from the API server comes back as a *StatusError.
+func (c *Client) Do(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	resp, err := c.do(ctx, method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, newStatusError(method, path, resp, out)
+	}
+	return out, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.Base, "/")+path, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.TokenFile != "" {
+		token, err := os.ReadFile(c.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	return hc.Do(req)
+}
+
+// StatusError is the API server turning a request down. Reason is the
+// Status object's, e.g. NotFound, AlreadyExists or Conflict.
+type StatusError struct {
+	Method  string
+	Path    string
+	Status  string
+	Code    int
+	Reason  string
+	Message string
+}
+
+func newStatusError(method, path string, resp *http.Response, body []byte) *StatusError {
+	e := &StatusError{Method: method, Path: path, Status: resp.Status, Code: resp.StatusCode}
+	var st struct {
+		Reason  string `json:"reason"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &st) == nil {
+		e.Reason, e.Message = st.Reason, st.Message
+	}
+	return e
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s: %s: %s", e.Method, e.Path, e.Status, e.Message)
+	}
+	return fmt.Sprintf("%s %s: %s", e.Method, e.Path, e.Status)
+}
+
+// IsNotFound reports whether err is a 404 from the API server.
+func IsNotFound(err error) bool { return statusCode(err) == http.StatusNotFound }
+
+// IsConflict reports whether err is a 409: the object already exists, or
+// it changed since the resourceVersion the update was based on.
+func IsConflict(err error) bool { return statusCode(err) == http.StatusConflict }
+
+func statusCode(err error) int {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	return 0
+}
+
+// WatchEvent is one object of a watch stream.
+type WatchEvent struct {
+	// Type is ADDED, MODIFIED, DELETED, BOOKMARK or ERROR.
+	Type string `json:"type"`
+	// Object is the object as it is now; for DELETED, as it was last. A
+	// BOOKMARK's object only carries a resourceVersion, and an ERROR's is
+	// a Status.
+	Object json.RawMessage `json:"object"`
+}
+
+// ErrGone is what Watch returns when the resourceVersion it was asked to
+// start from has been compacted away. List again and watch from the list's
+// resourceVersion.
+var ErrGone = errors.New("resource version too old")
+
+// Watch streams changes to what path lists, starting after resourceVersion
+// ("" starts with an ADDED event for everything that exists). It calls fn
+// for each event until fn fails, ctx ends or the server closes the stream,
+// which it's asked to do after five minutes; Watch returns nil then, and
+// the caller should watch again from the last resourceVersion it saw.
+//
+// On the wire a watch is a long GET whose chunked response body is one
+// WatchEvent JSON object after another.
+func (c *Client) Watch(ctx context.Context, path, resourceVersion string, fn func(WatchEvent) error) error {
+	u, err := url.Parse(path)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("watch", "1")
+	q.Set("allowWatchBookmarks", "true")
+	// don't rely on the server's timeout, which can be an hour
+	q.Set("timeoutSeconds", "300")
+	if resourceVersion != "" {
+		q.Set("resourceVersion", resourceVersion)
+	}
+	u.RawQuery = q.Encode()
+
+	resp, err := c.do(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return ErrGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return newStatusError("watch", path, resp, body)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev WatchEvent
+		if err := dec.Decode(&ev); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if ev.Type == "ERROR" {
+			var st struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			}
+			json.Unmarshal(ev.Object, &st)
+			if st.Code == http.StatusGone {
+				return ErrGone
+			}
+			return fmt.Errorf("watch %s: %d %s", path, st.Code, st.Message)
+		}
+		if err := fn(ev); err != nil {
+			return err
+		}
+	}
+}
+
+// ResourceVersion is metadata.resourceVersion of an object or a list: the
+// point in the API server's history it was read at.
+func ResourceVersion(in []byte) string {
+	var o struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+	}
+	json.Unmarshal(in, &o)
+	return o.Metadata.ResourceVersion
+}
+
+// ListPath is the API path listing resource in namespace, or in every
+// namespace when namespace is "". group is "" for the core API.
+func ListPath(group, version, resource, namespace string) string {
+	p := "/api/" + version
+	if group != "" {
+		p = "/apis/" + group + "/" + version
+	}
+	if namespace != "" {
+		p += "/namespaces/" + namespace
+	}
+	return p + "/" + resource
+}
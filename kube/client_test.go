@@ -0,0 +1,233 @@
+package kube
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const sliceList = `{"kind":"EndpointSliceList","metadata":{"resourceVersion":"100"},"items":[]}`
+
+func TestClientGet(t *testing.T) {
+	token := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(token, []byte("first\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	var auth []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = append(auth, r.Header.Get("Authorization"))
+		if r.URL.Path != "/apis/discovery.k8s.io/v1/namespaces/default/endpointslices" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"kind":"Status","reason":"NotFound","message":"the server could not find the requested resource"}`)
+			return
+		}
+		if r.Header.Get("Accept") != "application/json" {
+			t.Errorf("Accept = %q", r.Header.Get("Accept"))
+		}
+		fmt.Fprint(w, sliceList)
+	}))
+	defer ts.Close()
+	c := &Client{Base: ts.URL + "/", TokenFile: token}
+
+	in, err := c.Get(context.Background(), ListPath("discovery.k8s.io", "v1", "endpointslices", "default"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rv := ResourceVersion(in); rv != "100" {
+		t.Errorf("resourceVersion %q, want 100", rv)
+	}
+
+	// the token is read again for every request: kubelet rotates it
+	if err := os.WriteFile(token, []byte("second"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Get(context.Background(), ListPath("", "v1", "nodes", ""))
+	if !IsNotFound(err) || IsConflict(err) {
+		t.Errorf("err = %v, want a 404", err)
+	}
+	var se *StatusError
+	if !errors.As(err, &se) || se.Reason != "NotFound" || !strings.Contains(se.Error(), "GET /api/v1/nodes: 404 Not Found: the server could not find") {
+		t.Errorf("err = %#v", err)
+	}
+	if want := []string{"Bearer first", "Bearer second"}; !reflect.DeepEqual(auth, want) {
+		t.Errorf("Authorization %q, want %q", auth, want)
+	}
+}
+
+func TestClientDo(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s with Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, `{"kind":"Status","reason":"Conflict","message":"the object has been modified"}`)
+	}))
+	defer ts.Close()
+	c := &Client{Base: ts.URL}
+	if _, err := c.Do(context.Background(), http.MethodPut, "/api/v1/namespaces/default/services/web", []byte(`{}`)); !IsConflict(err) {
+		t.Errorf("err = %v, want a 409", err)
+	}
+	if IsConflict(errors.New("409")) {
+		t.Error("IsConflict of an error that isn't a StatusError")
+	}
+}
+
+// watchServer streams lines as one watch response, after checking the
+// query Watch sent.
+func watchServer(t *testing.T, rv string, lines ...string) *Client {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("watch") != "1" || q.Get("allowWatchBookmarks") != "true" || q.Get("resourceVersion") != rv ||
+			q.Get("labelSelector") != "app=web" || q.Get("timeoutSeconds") == "" {
+			t.Errorf("watch query %q", r.URL.RawQuery)
+		}
+		for _, l := range lines {
+			fmt.Fprintln(w, l)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return &Client{Base: ts.URL}
+}
+
+func TestWatch(t *testing.T) {
+	c := watchServer(t, "100",
+		`{"type":"ADDED","object":{"metadata":{"name":"web-abc","resourceVersion":"101"}}}`,
+		`{"type":"BOOKMARK","object":{"metadata":{"resourceVersion":"150"}}}`,
+		`{"type":"DELETED","object":{"metadata":{"name":"web-abc","resourceVersion":"151"}}}`,
+	)
+	var got []string
+	err := c.Watch(context.Background(), "/apis/discovery.k8s.io/v1/endpointslices?labelSelector=app%3Dweb", "100", func(ev WatchEvent) error {
+		got = append(got, ev.Type+" "+ResourceVersion(ev.Object))
+		return nil
+	})
+	// the stream ending is the server's timeout, not a failure
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"ADDED 101", "BOOKMARK 150", "DELETED 151"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events %q, want %q", got, want)
+	}
+}
+
+func TestWatchErrors(t *testing.T) {
+	stop := errors.New("stop")
+	tests := []struct {
+		name   string
+		status int
+		lines  []string
+		fn     func(WatchEvent) error
+		want   func(error) bool
+	}{
+		{
+			name:   "410 response",
+			status: http.StatusGone,
+			want:   func(err error) bool { return errors.Is(err, ErrGone) },
+		},
+		{
+			// what the API server sends once the stream has started
+			name:  "410 event",
+			lines: []string{`{"type":"ERROR","object":{"kind":"Status","code":410,"reason":"Expired","message":"too old resource version: 100 (200)"}}`},
+			want:  func(err error) bool { return errors.Is(err, ErrGone) },
+		},
+		{
+			name:  "other error event",
+			lines: []string{`{"type":"ERROR","object":{"kind":"Status","code":500,"message":"etcd is sad"}}`},
+			want:  func(err error) bool { return err != nil && strings.Contains(err.Error(), "500 etcd is sad") },
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+			lines:  []string{`{"kind":"Status","reason":"Forbidden","message":"cannot watch endpointslices"}`},
+			want: func(err error) bool {
+				var se *StatusError
+				return errors.As(err, &se) && se.Reason == "Forbidden" && se.Method == "watch"
+			},
+		},
+		{
+			name:  "fn fails",
+			lines: []string{`{"type":"ADDED","object":{}}`, `{"type":"ADDED","object":{}}`},
+			fn:    func(WatchEvent) error { return stop },
+			want:  func(err error) bool { return errors.Is(err, stop) },
+		},
+		{
+			name:  "garbage",
+			lines: []string{`{"type":"ADDED","object":{}}`, `<html>`},
+			want:  func(err error) bool { return err != nil && !errors.Is(err, ErrGone) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+				}
+				for _, l := range tt.lines {
+					fmt.Fprintln(w, l)
+				}
+			}))
+			defer ts.Close()
+			fn := tt.fn
+			if fn == nil {
+				fn = func(WatchEvent) error { return nil }
+			}
+			if err := (&Client{Base: ts.URL}).Watch(context.Background(), "/api/v1/pods", "100", fn); !tt.want(err) {
+				t.Errorf("err = %v", err)
+			}
+		})
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"type":"ADDED","object":{}}`)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	err := (&Client{Base: ts.URL}).Watch(ctx, "/api/v1/pods", "", func(WatchEvent) error {
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err = %v, want context.Canceled", err)
+	}
+}
+
+func TestResourceVersion(t *testing.T) {
+	for in, want := range map[string]string{
+		`{"metadata":{"resourceVersion":"42"}}`: "42",
+		`{"metadata":{}}`:                       "",
+		`not json`:                              "",
+	} {
+		if got := ResourceVersion([]byte(in)); got != want {
+			t.Errorf("ResourceVersion(%s) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestListPath(t *testing.T) {
+	tests := []struct {
+		group, version, resource, namespace string
+		want                                string
+	}{
+		{"", "v1", "pods", "default", "/api/v1/namespaces/default/pods"},
+		{"", "v1", "nodes", "", "/api/v1/nodes"},
+		{"apps", "v1", "deployments", "kube-system", "/apis/apps/v1/namespaces/kube-system/deployments"},
+		{"learnk8s.io", "v1alpha1", "learnapps", "", "/apis/learnk8s.io/v1alpha1/learnapps"},
+	}
+	for _, tt := range tests {
+		if got := ListPath(tt.group, tt.version, tt.resource, tt.namespace); got != tt.want {
+			t.Errorf("ListPath(%q, %q, %q, %q) = %q, want %q", tt.group, tt.version, tt.resource, tt.namespace, got, tt.want)
+		}
+	}
+}
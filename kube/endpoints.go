@@ -0,0 +1,211 @@
+package kube
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// LabelServiceName is the label tying an EndpointSlice to its Service.
+const LabelServiceName = "kubernetes.io/service-name"
+
+// EndpointSlice is the list of backends the control plane keeps for a
+// Service. kube-proxy programs its rules from these.
+type EndpointSlice struct {
+	Namespace   string         `json:"namespace"`
+	Name        string         `json:"name"`
+	Service     string         `json:"service"`
+	AddressType string         `json:"address_type,omitempty"`
+	Ports       []EndpointPort `json:"ports,omitempty"`
+	Endpoints   []Endpoint     `json:"endpoints,omitempty"`
+}
+
+// EndpointPort is a port every endpoint in the slice serves. Name matches
+// the Service port's name, and Port is the targetPort resolved for these
+// pods.
+type EndpointPort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// Endpoint is one backend, usually a pod.
+type Endpoint struct {
+	Addresses []string `json:"addresses"`
+	// Ready endpoints get traffic. Serving is readiness ignoring
+	// termination, and Terminating is set once the pod is being deleted;
+	// kube-proxy falls back to serving, terminating endpoints only when a
+	// Service has no ready ones.
+	Ready       bool   `json:"ready"`
+	Serving     bool   `json:"serving"`
+	Terminating bool   `json:"terminating,omitempty"`
+	Node        string `json:"node,omitempty"`
+	// Pod is the targetRef when it names a Pod.
+	Pod string `json:"pod,omitempty"`
+}
+
+type endpointSliceObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Namespace string            `json:"namespace"`
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	AddressType string `json:"addressType"`
+	Ports       []struct {
+		Name     string `json:"name"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+	} `json:"ports"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			// unset means true, except terminating
+			Ready       *bool `json:"ready"`
+			Serving     *bool `json:"serving"`
+			Terminating *bool `json:"terminating"`
+		} `json:"conditions"`
+		NodeName  string    `json:"nodeName"`
+		TargetRef objectRef `json:"targetRef"`
+	} `json:"endpoints"`
+
+	// legacy Endpoints
+	Subsets []struct {
+		Addresses         []endpointAddress `json:"addresses"`
+		NotReadyAddresses []endpointAddress `json:"notReadyAddresses"`
+		Ports             []struct {
+			Name     string `json:"name"`
+			Port     int    `json:"port"`
+			Protocol string `json:"protocol"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type objectRef struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+type endpointAddress struct {
+	IP        string    `json:"ip"`
+	NodeName  string    `json:"nodeName"`
+	TargetRef objectRef `json:"targetRef"`
+}
+
+// ParseEndpointSlices reads `kubectl get endpointslices -o json`, a List or
+// a single EndpointSlice. It also takes the older `kubectl get endpoints -o
+// json`, turning each subset of an Endpoints object into a slice. Slices
+// come back sorted by namespace, Service and name.
+func ParseEndpointSlices(r io.Reader) ([]EndpointSlice, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Kind  string                `json:"kind"`
+		Items []endpointSliceObject `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return nil, err
+	}
+	items := list.Items
+	if list.Kind == "EndpointSlice" || list.Kind == "Endpoints" {
+		var one endpointSliceObject
+		if err := json.Unmarshal(in, &one); err != nil {
+			return nil, err
+		}
+		items = []endpointSliceObject{one}
+	}
+
+	var out []EndpointSlice
+	for _, o := range items {
+		if o.Kind == "Endpoints" || list.Kind == "EndpointsList" {
+			out = append(out, o.fromEndpoints()...)
+			continue
+		}
+		out = append(out, o.slice())
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		return a.Name < b.Name
+	})
+	return out, nil
+}
+
+// DecodeEndpointSlice reads one EndpointSlice object, such as a watch
+// event's.
+func DecodeEndpointSlice(in []byte) (EndpointSlice, error) {
+	var o endpointSliceObject
+	if err := json.Unmarshal(in, &o); err != nil {
+		return EndpointSlice{}, err
+	}
+	return o.slice(), nil
+}
+
+func (o endpointSliceObject) slice() EndpointSlice {
+	s := EndpointSlice{
+		Namespace:   o.Metadata.Namespace,
+		Name:        o.Metadata.Name,
+		Service:     o.Metadata.Labels[LabelServiceName],
+		AddressType: o.AddressType,
+	}
+	for _, p := range o.Ports {
+		s.Ports = append(s.Ports, EndpointPort{Name: p.Name, Port: p.Port, Protocol: orDefault(p.Protocol, "TCP")})
+	}
+	for _, e := range o.Endpoints {
+		ep := Endpoint{
+			Addresses: e.Addresses,
+			Ready:     e.Conditions.Ready == nil || *e.Conditions.Ready,
+			Node:      e.NodeName,
+		}
+		ep.Serving = ep.Ready
+		if e.Conditions.Serving != nil {
+			ep.Serving = *e.Conditions.Serving
+		}
+		if e.Conditions.Terminating != nil {
+			ep.Terminating = *e.Conditions.Terminating
+		}
+		if e.TargetRef.Kind == "Pod" {
+			ep.Pod = e.TargetRef.Name
+		}
+		s.Endpoints = append(s.Endpoints, ep)
+	}
+	return s
+}
+
+// fromEndpoints turns the subsets of an Endpoints object, which is named
+// after its Service, into slices.
+func (o endpointSliceObject) fromEndpoints() []EndpointSlice {
+	var out []EndpointSlice
+	for _, sub := range o.Subsets {
+		s := EndpointSlice{
+			Namespace: o.Metadata.Namespace,
+			Name:      o.Metadata.Name,
+			Service:   o.Metadata.Name,
+		}
+		for _, p := range sub.Ports {
+			s.Ports = append(s.Ports, EndpointPort{Name: p.Name, Port: p.Port, Protocol: orDefault(p.Protocol, "TCP")})
+		}
+		add := func(a endpointAddress, ready bool) {
+			ep := Endpoint{Addresses: []string{a.IP}, Ready: ready, Serving: ready, Node: a.NodeName}
+			if a.TargetRef.Kind == "Pod" {
+				ep.Pod = a.TargetRef.Name
+			}
+			s.Endpoints = append(s.Endpoints, ep)
+		}
+		for _, a := range sub.Addresses {
+			add(a, true)
+		}
+		for _, a := range sub.NotReadyAddresses {
+			add(a, false)
+		}
+		out = append(out, s)
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+// Package kube reads what kubectl prints, so the tools in this repo can work
+// from saved output. Client fetches the same JSON from an API server when
+// there's one to hand.
+package kube
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Node is the part of a Node that the networking tools care about.
+type Node struct {
+	Name       string `json:"name"`
+	Ready      bool   `json:"ready"`
+	Roles      string `json:"roles,omitempty"`
+	InternalIP string `json:"internal_ip,omitempty"`
+	ExternalIP string `json:"external_ip,omitempty"`
+	// PodCIDR is spec.podCIDR, the node's range under the host-local IPAM.
+	// Calico ignores it; only -o json carries it.
+	PodCIDR string `json:"pod_cidr,omitempty"`
+}
+
+// ParseNodes reads either `kubectl get nodes -o wide` or `kubectl get nodes
+// -o json` (a List or a single Node).
+func ParseNodes(r io.Reader) ([]Node, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimSpace(in); len(t) > 0 && t[0] == '{' {
+		return parseNodesJSON(t)
+	}
+	return parseNodesTable(in)
+}
+
+type nodeObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Name   string            `json:"name"`
+		Labels map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		PodCIDR string `json:"podCIDR"`
+	} `json:"spec"`
+	Status struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+func parseNodesJSON(in []byte) ([]Node, error) {
+	var list struct {
+		Kind  string       `json:"kind"`
+		Items []nodeObject `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return nil, err
+	}
+	items := list.Items
+	if list.Kind == "Node" {
+		var one nodeObject
+		if err := json.Unmarshal(in, &one); err != nil {
+			return nil, err
+		}
+		items = []nodeObject{one}
+	}
+
+	var out []Node
+	for _, o := range items {
+		n := Node{Name: o.Metadata.Name, PodCIDR: o.Spec.PodCIDR}
+		for _, a := range o.Status.Addresses {
+			switch {
+			case a.Type == "InternalIP" && n.InternalIP == "":
+				n.InternalIP = a.Address
+			case a.Type == "ExternalIP" && n.ExternalIP == "":
+				n.ExternalIP = a.Address
+			}
+		}
+		for _, c := range o.Status.Conditions {
+			if c.Type == "Ready" {
+				n.Ready = c.Status == "True"
+			}
+		}
+		var roles []string
+		for k := range o.Metadata.Labels {
+			if role, ok := strings.CutPrefix(k, "node-role.kubernetes.io/"); ok {
+				roles = append(roles, role)
+			}
+		}
+		sort.Strings(roles)
+		n.Roles = strings.Join(roles, ",")
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// parseNodesTable cuts each row at the header's column offsets. kubectl pads
+// columns to line up, and some values (OS-IMAGE) contain spaces, so
+// splitting on whitespace isn't enough.
+func parseNodesTable(in []byte) ([]Node, error) {
+	var (
+		out     []Node
+		columns []string
+		starts  []int
+	)
+	sc := bufio.NewScanner(bytes.NewReader(in))
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if columns == nil {
+			if !strings.HasPrefix(line, "NAME ") {
+				return nil, fmt.Errorf("line %d: want a NAME ... header, got %q", n, line)
+			}
+			columns, starts = tableHeader(line)
+			continue
+		}
+
+		row := map[string]string{}
+		for i, col := range columns {
+			if starts[i] >= len(line) {
+				break
+			}
+			end := len(line)
+			if i+1 < len(starts) && starts[i+1] < end {
+				end = starts[i+1]
+			}
+			row[col] = strings.TrimSpace(line[starts[i]:end])
+		}
+		node := Node{
+			Name:       row["NAME"],
+			Ready:      strings.Split(row["STATUS"], ",")[0] == "Ready",
+			Roles:      none(row["ROLES"]),
+			InternalIP: none(row["INTERNAL-IP"]),
+			ExternalIP: none(row["EXTERNAL-IP"]),
+		}
+		if node.Name == "" {
+			return nil, fmt.Errorf("line %d: no node name in %q", n, line)
+		}
+		out = append(out, node)
+	}
+	if columns == nil {
+		return nil, fmt.Errorf("no nodes table found")
+	}
+	return out, sc.Err()
+}
+
+func tableHeader(line string) (columns []string, starts []int) {
+	for i := 0; i < len(line); {
+		if line[i] == ' ' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && line[j] != ' ' {
+			j++
+		}
+		columns = append(columns, line[i:j])
+		starts = append(starts, i)
+		i = j
+	}
+	return columns, starts
+}
+
+// none maps kubectl's "<none>" placeholder to "".
+func none(s string) string {
+	if s == "<none>" {
+		return ""
+	}
+	return s
+}
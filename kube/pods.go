@@ -0,0 +1,151 @@
+package kube
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+)
+
+// Pod is the part of a Pod that says where it runs and how to reach it.
+type Pod struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Labels are what Service selectors match.
+	Labels map[string]string `json:"labels,omitempty"`
+	Node   string            `json:"node,omitempty"`
+	Phase  string            `json:"phase"`
+	IPs    []string          `json:"ips,omitempty"`
+	// HostNetwork pods share the node's network namespace, so their IP is
+	// the node's.
+	HostNetwork bool            `json:"host_network,omitempty"`
+	Ports       []ContainerPort `json:"ports,omitempty"`
+}
+
+// ContainerPort is one entry of a container's ports list.
+type ContainerPort struct {
+	Container string `json:"container"`
+	Name      string `json:"name,omitempty"`
+	Port      int    `json:"port"`
+	Protocol  string `json:"protocol"`
+	HostPort  int    `json:"host_port,omitempty"`
+}
+
+// IP is the pod's first IP, or "" before it has one.
+func (p Pod) IP() string {
+	if len(p.IPs) == 0 {
+		return ""
+	}
+	return p.IPs[0]
+}
+
+// Matches reports whether the pod carries every label in selector, the way
+// a Service picks its pods. An empty selector matches nothing: such a
+// Service's endpoints are managed by hand.
+func (p Pod) Matches(selector map[string]string) bool {
+	if len(selector) == 0 {
+		return false
+	}
+	for k, v := range selector {
+		if p.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+type podObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Namespace string            `json:"namespace"`
+		Name      string            `json:"name"`
+		Labels    map[string]string `json:"labels"`
+	} `json:"metadata"`
+	Spec struct {
+		NodeName    string `json:"nodeName"`
+		HostNetwork bool   `json:"hostNetwork"`
+		Containers  []struct {
+			Name  string `json:"name"`
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+				Protocol      string `json:"protocol"`
+				HostPort      int    `json:"hostPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase  string `json:"phase"`
+		PodIP  string `json:"podIP"`
+		PodIPs []struct {
+			IP string `json:"ip"`
+		} `json:"podIPs"`
+	} `json:"status"`
+}
+
+// ParsePods reads `kubectl get pods -o json`, a List or a single Pod. Pods
+// come back sorted by namespace and name.
+func ParsePods(r io.Reader) ([]Pod, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Kind  string      `json:"kind"`
+		Items []podObject `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return nil, err
+	}
+	items := list.Items
+	if list.Kind == "Pod" {
+		var one podObject
+		if err := json.Unmarshal(in, &one); err != nil {
+			return nil, err
+		}
+		items = []podObject{one}
+	}
+
+	var out []Pod
+	for _, o := range items {
+		p := Pod{
+			Namespace:   o.Metadata.Namespace,
+			Name:        o.Metadata.Name,
+			Labels:      o.Metadata.Labels,
+			Node:        o.Spec.NodeName,
+			Phase:       o.Status.Phase,
+			HostNetwork: o.Spec.HostNetwork,
+		}
+		for _, ip := range o.Status.PodIPs {
+			p.IPs = append(p.IPs, ip.IP)
+		}
+		if len(p.IPs) == 0 && o.Status.PodIP != "" {
+			p.IPs = []string{o.Status.PodIP}
+		}
+		for _, c := range o.Spec.Containers {
+			for _, cp := range c.Ports {
+				p.Ports = append(p.Ports, ContainerPort{
+					Container: c.Name,
+					Name:      cp.Name,
+					Port:      cp.ContainerPort,
+					Protocol:  orDefault(cp.Protocol, "TCP"),
+					HostPort:  cp.HostPort,
+				})
+			}
+		}
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
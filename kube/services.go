@@ -0,0 +1,137 @@
+package kube
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// Service is the part of a Service that says where clients connect.
+type Service struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	// ClusterIP is "None" for a headless Service.
+	ClusterIP string `json:"cluster_ip,omitempty"`
+	// LoadBalancerIPs are status.loadBalancer.ingress, filled in by
+	// whatever implements LoadBalancer (MetalLB, cloud-provider-kind).
+	LoadBalancerIPs []string          `json:"load_balancer_ips,omitempty"`
+	Selector        map[string]string `json:"selector,omitempty"`
+	Ports           []ServicePort     `json:"ports,omitempty"`
+}
+
+// ServicePort is one entry of spec.ports.
+type ServicePort struct {
+	Name     string `json:"name,omitempty"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// TargetPort is a number or the name of a container port.
+	TargetPort string `json:"target_port"`
+	NodePort   int    `json:"node_port,omitempty"`
+}
+
+type serviceObject struct {
+	Kind     string `json:"kind"`
+	Metadata struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		Type      string            `json:"type"`
+		ClusterIP string            `json:"clusterIP"`
+		Selector  map[string]string `json:"selector"`
+		Ports     []struct {
+			Name       string          `json:"name"`
+			Port       int             `json:"port"`
+			Protocol   string          `json:"protocol"`
+			TargetPort json.RawMessage `json:"targetPort"`
+			NodePort   int             `json:"nodePort"`
+		} `json:"ports"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				IP       string `json:"ip"`
+				Hostname string `json:"hostname"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+// ParseServices reads `kubectl get services -o json` or `-o yaml`, a List
+// or a single Service, sorted by namespace and name.
+func ParseServices(r io.Reader) ([]Service, error) {
+	in, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if t := bytes.TrimSpace(in); len(t) == 0 || t[0] != '{' {
+		if in, err = YAMLToJSON(in); err != nil {
+			return nil, err
+		}
+	}
+	var list struct {
+		Kind  string          `json:"kind"`
+		Items []serviceObject `json:"items"`
+	}
+	if err := json.Unmarshal(in, &list); err != nil {
+		return nil, err
+	}
+	items := list.Items
+	if list.Kind == "Service" {
+		var one serviceObject
+		if err := json.Unmarshal(in, &one); err != nil {
+			return nil, err
+		}
+		items = []serviceObject{one}
+	}
+
+	var out []Service
+	for _, o := range items {
+		s := Service{
+			Namespace: orDefault(o.Metadata.Namespace, "default"),
+			Name:      o.Metadata.Name,
+			Type:      orDefault(o.Spec.Type, "ClusterIP"),
+			ClusterIP: o.Spec.ClusterIP,
+			Selector:  o.Spec.Selector,
+		}
+		for _, ing := range o.Status.LoadBalancer.Ingress {
+			s.LoadBalancerIPs = append(s.LoadBalancerIPs, orDefault(ing.IP, ing.Hostname))
+		}
+		for _, p := range o.Spec.Ports {
+			sp := ServicePort{
+				Name:       p.Name,
+				Port:       p.Port,
+				Protocol:   orDefault(p.Protocol, "TCP"),
+				TargetPort: intOrString(p.TargetPort),
+				NodePort:   p.NodePort,
+			}
+			if sp.TargetPort == "" {
+				// the API server defaults targetPort to port
+				sp.TargetPort = strconv.Itoa(p.Port)
+			}
+			s.Ports = append(s.Ports, sp)
+		}
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// intOrString renders an IntOrString field, 8080 or "http", as a string.
+func intOrString(raw json.RawMessage) string {
+	var n int
+	if json.Unmarshal(raw, &n) == nil {
+		return strconv.Itoa(n)
+	}
+	var s string
+	json.Unmarshal(raw, &s)
+	return s
+}
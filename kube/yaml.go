@@ -0,0 +1,265 @@
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// YAMLToJSON converts the YAML kubectl and kind use into JSON, so it can be
+// decoded with encoding/json. It covers what manifests actually contain:
+// block mappings and sequences, plain and quoted scalars, literal (|) and
+// folded (>) blocks, and short flow lists like [a, b]. Anchors, tags and
+// multi-line flow collections aren't supported. Only the first document of a
+// multi-document stream is read.
+func YAMLToJSON(in []byte) ([]byte, error) {
+	p := &yamlParser{}
+	for n, raw := range strings.Split(string(in), "\n") {
+		raw = strings.TrimRight(raw, " \t\r")
+		trimmed := strings.TrimLeft(raw, " ")
+		if trimmed == "---" || strings.HasPrefix(trimmed, "--- ") {
+			if len(p.lines) > 0 {
+				break
+			}
+			continue
+		}
+		if trimmed == "..." {
+			break
+		}
+		p.lines = append(p.lines, yamlLine{n: n + 1, indent: len(raw) - len(trimmed), raw: raw, text: stripComment(trimmed)})
+	}
+
+	var v any
+	if i := p.skipBlank(); i < len(p.lines) {
+		var err error
+		if v, err = p.node(p.lines[i].indent); err != nil {
+			return nil, err
+		}
+		if i := p.skipBlank(); i < len(p.lines) {
+			return nil, fmt.Errorf("yaml line %d: unexpected indentation", p.lines[i].n)
+		}
+	}
+	return json.Marshal(v)
+}
+
+type yamlLine struct {
+	n      int
+	indent int
+	raw    string
+	text   string // without indentation or comment
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+func (p *yamlParser) skipBlank() int {
+	for p.i < len(p.lines) && p.lines[p.i].text == "" {
+		p.i++
+	}
+	return p.i
+}
+
+func isSeqItem(s string) bool { return s == "-" || strings.HasPrefix(s, "- ") }
+
+// node parses the mapping or sequence starting at the current line.
+func (p *yamlParser) node(indent int) (any, error) {
+	if isSeqItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) mapping(indent int) (any, error) {
+	m := map[string]any{}
+	for p.skipBlank() < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent < indent || (l.indent == indent && isSeqItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("yaml line %d: unexpected indentation", l.n)
+		}
+		key, rest, ok := cutKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("yaml line %d: want key: value, got %q", l.n, l.text)
+		}
+		p.i++
+		v, err := p.value(indent, rest, true)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+func (p *yamlParser) sequence(indent int) (any, error) {
+	s := []any{}
+	for p.skipBlank() < len(p.lines) {
+		l := p.lines[p.i]
+		if l.indent != indent || !isSeqItem(l.text) {
+			if l.indent > indent {
+				return nil, fmt.Errorf("yaml line %d: unexpected indentation", l.n)
+			}
+			break
+		}
+		rest := strings.TrimLeft(strings.TrimPrefix(l.text, "-"), " ")
+		if _, _, ok := cutKey(rest); ok && !isQuoted(rest) {
+			// "- key: value" opens a mapping indented to where key starts
+			inner := indent + (len(l.text) - len(rest))
+			p.lines[p.i] = yamlLine{n: l.n, indent: inner, raw: l.raw, text: rest}
+			v, err := p.mapping(inner)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			continue
+		}
+		p.i++
+		v, err := p.value(indent, rest, false)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, v)
+	}
+	return s, nil
+}
+
+// value parses what follows "key:" or "-". An empty rest means the value is
+// the indented block below (or, for a mapping key, a sequence at the same
+// indentation, which YAML allows).
+func (p *yamlParser) value(indent int, rest string, inMapping bool) (any, error) {
+	if rest == "|" || rest == "|-" || rest == "|+" || rest == ">" || rest == ">-" || rest == ">+" {
+		return p.blockScalar(indent, rest), nil
+	}
+	if rest != "" {
+		return scalar(rest)
+	}
+	if p.skipBlank() >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.i]
+	switch {
+	case next.indent > indent:
+		return p.node(next.indent)
+	case inMapping && next.indent == indent && isSeqItem(next.text):
+		return p.sequence(indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) blockScalar(indent int, style string) string {
+	var lines []string
+	blockIndent := -1
+	for ; p.i < len(p.lines); p.i++ {
+		l := p.lines[p.i]
+		if strings.TrimSpace(l.raw) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if l.indent <= indent {
+			break
+		}
+		if blockIndent < 0 {
+			blockIndent = l.indent
+		}
+		lines = append(lines, l.raw[min(blockIndent, l.indent):])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	sep := "\n"
+	if style[0] == '>' {
+		sep = " "
+	}
+	s := strings.Join(lines, sep)
+	if !strings.HasSuffix(style, "-") && s != "" {
+		s += "\n"
+	}
+	return s
+}
+
+// cutKey splits "key: value". Keys may be quoted.
+func cutKey(s string) (key, rest string, ok bool) {
+	if isQuoted(s) {
+		q := s[0]
+		end := strings.IndexByte(s[1:], q)
+		if end < 0 || !strings.HasPrefix(s[end+2:], ":") {
+			return "", "", false
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+3:]), true
+	}
+	if k, r, found := strings.Cut(s, ": "); found {
+		return k, strings.TrimSpace(r), true
+	}
+	if strings.HasSuffix(s, ":") {
+		return s[:len(s)-1], "", true
+	}
+	return "", "", false
+}
+
+func isQuoted(s string) bool { return s != "" && (s[0] == '"' || s[0] == '\'') }
+
+// stripComment drops a trailing "# comment" that isn't inside quotes.
+func stripComment(s string) string {
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t'):
+			return strings.TrimRight(s[:i], " \t")
+		}
+	}
+	return s
+}
+
+func scalar(s string) (any, error) {
+	switch {
+	case s == "":
+		return nil, nil
+	case s[0] == '"':
+		return strconv.Unquote(s)
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("yaml: unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case s == "[]":
+		return []any{}, nil
+	case s == "{}":
+		return map[string]any{}, nil
+	case s[0] == '[' && s[len(s)-1] == ']':
+		var out []any
+		for _, item := range strings.Split(s[1:len(s)-1], ",") {
+			v, err := scalar(strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	switch s {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
@@ -0,0 +1,382 @@
+// Package kubeproxy reconstructs Services from the rules kube-proxy
+// programs on a node, as dumped by `iptables-save` (iptables mode) or
+// `ipvsadm -Ln` (IPVS mode). It answers "when I hit this ClusterIP or
+// NodePort, which pod do I get, and how often?" from the rules themselves.
+package kubeproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Service is one Service port, reached through one or more frontends.
+type Service struct {
+	// Name is namespace/name, plus :port-name for named ports. IPVS
+	// doesn't record names, so there it's the virtual server address.
+	Name      string     `json:"name"`
+	Frontends []Frontend `json:"frontends"`
+}
+
+// Frontend is one way into a Service: its ClusterIP, a NodePort, an
+// external or load balancer IP.
+type Frontend struct {
+	Kind     string `json:"kind"`
+	IP       string `json:"ip,omitempty"` // empty for NodePorts: any local address
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// Chain is the iptables chain the frontend jumps to, or the IPVS
+	// scheduler.
+	Chain     string     `json:"chain"`
+	Endpoints []Endpoint `json:"endpoints"`
+	Notes     []string   `json:"notes,omitempty"`
+}
+
+// Endpoint is a pod (or, for the kubernetes Service, a node) that traffic
+// is DNATed to.
+type Endpoint struct {
+	Addr string `json:"addr"`
+	// Share is the fraction of new connections that end up here.
+	Share float64 `json:"share"`
+	// Chain is the KUBE-SEP chain in iptables mode.
+	Chain string `json:"chain,omitempty"`
+	// Probability is what the rule says (-m statistic --probability),
+	// which is the chance of matching given every earlier rule didn't.
+	// 0 means the rule matches unconditionally.
+	Probability float64 `json:"probability,omitempty"`
+	// Weight is the IPVS real server weight.
+	Weight int `json:"weight,omitempty"`
+}
+
+// rule is one -A line.
+type rule struct {
+	chain       string
+	dst         string
+	proto       string
+	dport       int
+	comment     string
+	probability float64
+	target      string
+	toDest      string
+	// conds are the matches that make the rule conditional, e.g.
+	// "! -s 10.244.0.0/16" or "--src-type LOCAL".
+	conds []string
+}
+
+// ParseIPTables reads `iptables-save` output (or just its nat table) and
+// returns the Services kube-proxy has programmed, sorted by name.
+func ParseIPTables(r io.Reader) ([]Service, error) {
+	chains := map[string][]rule{}
+	var rejects []rule // filter-table REJECTs for Services with no endpoints
+	table := ""
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			continue
+		case (table != "nat" && table != "filter") || !strings.HasPrefix(line, "-A "):
+			continue
+		}
+		args, err := splitArgs(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		ru, err := parseRule(args[1:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch {
+		case table == "nat":
+			chains[ru.chain] = append(chains[ru.chain], ru)
+		case ru.target == "REJECT" && strings.HasSuffix(ru.comment, " has no endpoints"):
+			rejects = append(rejects, ru)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("no nat table rules found; is this iptables-save output?")
+	}
+
+	byName := map[string]*Service{}
+	var order []string
+	addFrontend := func(name string, f Frontend) {
+		svc, ok := byName[name]
+		if !ok {
+			svc = &Service{Name: name}
+			byName[name] = svc
+			order = append(order, name)
+		}
+		svc.Frontends = append(svc.Frontends, f)
+	}
+
+	for _, ru := range chains["KUBE-SERVICES"] {
+		if !isServiceChain(ru.target) {
+			continue
+		}
+		name, kind := splitComment(ru.comment)
+		f := Frontend{Kind: kind, IP: strings.TrimSuffix(ru.dst, "/32"), Port: ru.dport, Protocol: ru.proto, Chain: ru.target}
+		walk(chains, &f, ru.target, 1, map[string]bool{})
+		addFrontend(name, f)
+	}
+	for _, ru := range chains["KUBE-NODEPORTS"] {
+		if !isServiceChain(ru.target) {
+			continue
+		}
+		name, _ := splitComment(ru.comment)
+		f := Frontend{Kind: "NodePort", Port: ru.dport, Protocol: ru.proto, Chain: ru.target}
+		// older kube-proxy marks NodePort traffic for SNAT right here
+		for _, m := range chains["KUBE-NODEPORTS"] {
+			if m.target == "KUBE-MARK-MASQ" && m.comment == ru.comment && m.dport == ru.dport {
+				f.Notes = append(f.Notes, "masqueraded: the pod sees a node IP as the client")
+			}
+		}
+		walk(chains, &f, ru.target, 1, map[string]bool{})
+		addFrontend(name, f)
+	}
+	for _, ru := range rejects {
+		name := strings.TrimSuffix(ru.comment, " has no endpoints")
+		f := Frontend{Kind: "ClusterIP", IP: strings.TrimSuffix(ru.dst, "/32"), Port: ru.dport, Protocol: ru.proto, Chain: "REJECT"}
+		if ru.chain == "KUBE-EXTERNAL-SERVICES" {
+			f.Kind = "NodePort"
+		}
+		f.Notes = []string{"no ready endpoints: connections are refused"}
+		addFrontend(name, f)
+	}
+
+	sort.Strings(order)
+	out := make([]Service, 0, len(order))
+	for _, name := range order {
+		svc := *byName[name]
+		sort.SliceStable(svc.Frontends, func(i, j int) bool {
+			return kindOrder[svc.Frontends[i].Kind] < kindOrder[svc.Frontends[j].Kind]
+		})
+		out = append(out, svc)
+	}
+	return out, nil
+}
+
+var kindOrder = map[string]int{"ClusterIP": 0, "ExternalIP": 1, "LoadBalancer": 2, "NodePort": 3}
+
+// isServiceChain reports whether a chain is one of kube-proxy's per-Service
+// chains: SVC (all endpoints), SVL (node-local endpoints), EXT (external
+// traffic), FW (load balancer firewall), XLB (pre-1.25 local).
+func isServiceChain(name string) bool {
+	for _, p := range []string{"KUBE-SVC-", "KUBE-SVL-", "KUBE-EXT-", "KUBE-FW-", "KUBE-XLB-"} {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// walk follows chain the way the kernel would for a new connection. share
+// is the fraction of traffic that reaches it. A rule with -m statistic
+// takes its probability of whatever is left; an unconditional jump or DNAT
+// takes everything left. Jumps that depend on the source (pod traffic,
+// local traffic) are noted rather than followed, since they apply to a
+// different set of clients.
+func walk(chains map[string][]rule, f *Frontend, chain string, share float64, seen map[string]bool) {
+	if seen[chain] {
+		return
+	}
+	seen[chain] = true
+	defer delete(seen, chain)
+
+	isSEP := strings.HasPrefix(chain, "KUBE-SEP-")
+	left := share
+	for _, ru := range chains[chain] {
+		if left <= 0 {
+			break
+		}
+		if !appliesTo(ru, f) {
+			continue
+		}
+		switch ru.target {
+		case "KUBE-MARK-MASQ":
+			switch {
+			case isSEP:
+				// the hairpin rule: a pod reaching itself through the Service
+			case len(ru.conds) == 0:
+				f.Notes = appendOnce(f.Notes, "masqueraded: the pod sees a node IP as the client")
+			default:
+				f.Notes = appendOnce(f.Notes, "masqueraded when "+strings.Join(ru.conds, " ")+": "+ru.comment)
+			}
+			continue
+		case "KUBE-MARK-DROP", "DROP", "REJECT":
+			if len(ru.conds) == 0 {
+				f.Notes = appendOnce(f.Notes, "dropped: "+ru.comment)
+				return
+			}
+			f.Notes = appendOnce(f.Notes, "dropped when "+strings.Join(ru.conds, " "))
+			continue
+		case "RETURN", "ACCEPT":
+			if len(ru.conds) == 0 {
+				return
+			}
+			continue
+		case "DNAT":
+			f.Endpoints = append(f.Endpoints, Endpoint{Addr: ru.toDest, Share: left, Chain: chain})
+			return
+		}
+		if _, ok := chains[ru.target]; !ok {
+			continue
+		}
+		switch {
+		case ru.probability > 0:
+			taken := left * ru.probability
+			n := len(f.Endpoints)
+			walk(chains, f, ru.target, taken, seen)
+			if n < len(f.Endpoints) && strings.HasPrefix(ru.target, "KUBE-SEP-") {
+				f.Endpoints[n].Probability = ru.probability
+			}
+			left -= taken
+		case len(ru.conds) > 0:
+			f.Notes = appendOnce(f.Notes, fmt.Sprintf("when %s: %s instead (%s)", strings.Join(ru.conds, " "), ru.target, ru.comment))
+		default:
+			walk(chains, f, ru.target, left, seen)
+			left = 0
+		}
+	}
+	if left > 0 && !isSEP && len(chains[chain]) > 0 && len(f.Endpoints) == 0 {
+		f.Notes = appendOnce(f.Notes, chain+" has no endpoints")
+	}
+}
+
+// appliesTo rules out rules that match on a destination other than the
+// frontend's, like the ClusterIP masquerade rule seen from a NodePort.
+func appliesTo(ru rule, f *Frontend) bool {
+	for _, c := range ru.conds {
+		if d, ok := strings.CutPrefix(c, "-d "); ok && f.IP != strings.TrimSuffix(d, "/32") {
+			return false
+		}
+	}
+	return true
+}
+
+func appendOnce(s []string, v string) []string {
+	for _, x := range s {
+		if x == v {
+			return s
+		}
+	}
+	return append(s, v)
+}
+
+// splitComment turns kube-proxy's rule comment into the Service name and
+// the frontend kind: "default/learn-k8s:http cluster IP".
+func splitComment(c string) (name, kind string) {
+	for suffix, k := range map[string]string{
+		" cluster IP":      "ClusterIP",
+		" external IP":     "ExternalIP",
+		" loadbalancer IP": "LoadBalancer",
+	} {
+		if n, ok := strings.CutSuffix(c, suffix); ok {
+			return n, k
+		}
+	}
+	return c, "NodePort"
+}
+
+func parseRule(args []string) (rule, error) {
+	if len(args) == 0 {
+		return rule{}, fmt.Errorf("-A without a chain")
+	}
+	ru := rule{chain: args[0]}
+	negate := false
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		next := func() string {
+			if i+1 < len(args) {
+				i++
+				return args[i]
+			}
+			return ""
+		}
+		if a == "!" {
+			negate = true
+			continue
+		}
+		not := ""
+		if negate {
+			not, negate = "! ", false
+		}
+		switch a {
+		case "-d", "--destination":
+			v := next()
+			if not == "" && ru.chain == "KUBE-SERVICES" {
+				ru.dst = v
+			} else {
+				ru.conds = append(ru.conds, not+"-d "+v)
+			}
+		case "-s", "--source", "-i", "-o":
+			ru.conds = append(ru.conds, not+a+" "+next())
+		case "--src-type", "--dst-type":
+			ru.conds = append(ru.conds, not+a+" "+next())
+		case "-p", "--protocol":
+			ru.proto = next()
+		case "--dport":
+			p, err := strconv.Atoi(next())
+			if err != nil {
+				return rule{}, fmt.Errorf("bad --dport in %s rule", ru.chain)
+			}
+			ru.dport = p
+		case "--comment":
+			ru.comment = next()
+		case "--probability":
+			p, err := strconv.ParseFloat(next(), 64)
+			if err != nil {
+				return rule{}, fmt.Errorf("bad --probability in %s rule", ru.chain)
+			}
+			ru.probability = p
+		case "-j", "--jump", "-g", "--goto":
+			ru.target = next()
+		case "--to-destination":
+			ru.toDest = next()
+		}
+	}
+	return ru, nil
+}
+
+// splitArgs splits an iptables-save line on spaces, honouring the double
+// quotes it puts around comments.
+func splitArgs(line string) ([]string, error) {
+	var (
+		out []string
+		cur strings.Builder
+		in  bool
+		has bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case in && c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case c == '"':
+			in, has = !in, true
+		case c == ' ' && !in:
+			if has || cur.Len() > 0 {
+				out = append(out, cur.String())
+				cur.Reset()
+				has = false
+			}
+		default:
+			cur.WriteByte(c)
+		}
+	}
+	if in {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if has || cur.Len() > 0 {
+		out = append(out, cur.String())
+	}
+	return out, nil
+}
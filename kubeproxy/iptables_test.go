@@ -0,0 +1,174 @@
+package kubeproxy
+
+import (
+	"math"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open("../examples/kube-proxy/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// equalServices compares shares and probabilities to within rounding: the
+// rules carry probabilities like 0.33333333349.
+func equalServices(t *testing.T, got, want []Service) {
+	t.Helper()
+	near := func(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+	clean := func(ss []Service) []Service {
+		out := make([]Service, len(ss))
+		for i, s := range ss {
+			out[i] = Service{Name: s.Name}
+			for _, f := range s.Frontends {
+				f.Endpoints = append([]Endpoint{}, f.Endpoints...)
+				for j := range f.Endpoints {
+					f.Endpoints[j].Share, f.Endpoints[j].Probability = 0, 0
+				}
+				out[i].Frontends = append(out[i].Frontends, f)
+			}
+		}
+		return out
+	}
+	if !reflect.DeepEqual(clean(got), clean(want)) {
+		t.Fatalf("got\n%+v\nwant\n%+v", got, want)
+	}
+	for i := range got {
+		for j, f := range got[i].Frontends {
+			for k, ep := range f.Endpoints {
+				w := want[i].Frontends[j].Endpoints[k]
+				if !near(ep.Share, w.Share) || !near(ep.Probability, w.Probability) {
+					t.Errorf("%s %s %s: share %v, probability %v; want %v, %v",
+						got[i].Name, f.Kind, ep.Addr, ep.Share, ep.Probability, w.Share, w.Probability)
+				}
+			}
+		}
+	}
+}
+
+func TestParseIPTablesFixture(t *testing.T) {
+	got, err := ParseIPTables(open(t, "iptables-save.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const third = 1.0 / 3
+	learnK8s := []Endpoint{
+		{Addr: "10.244.1.2:8080", Share: third, Chain: "KUBE-SEP-2ZRQ3CAZLCKKJ4DA", Probability: 0.33333333349},
+		{Addr: "10.244.2.3:8080", Share: third, Chain: "KUBE-SEP-6E7XQMQ4RAYOWTTM", Probability: 0.5},
+		{Addr: "10.244.2.4:8080", Share: third, Chain: "KUBE-SEP-OJQ4WX2QCZYHKSXW"},
+	}
+	refused := []string{"no ready endpoints: connections are refused"}
+	want := []Service{
+		{Name: "default/kubernetes:https", Frontends: []Frontend{{
+			Kind: "ClusterIP", IP: "10.96.0.1", Port: 443, Protocol: "tcp", Chain: "KUBE-SVC-NPX46M4PTMTKRN6Y",
+			Endpoints: []Endpoint{{Addr: "172.19.0.4:6443", Share: 1, Chain: "KUBE-SEP-YIL6JZP7A3QYXJU2"}},
+			Notes:     []string{"masqueraded when ! -s 10.244.0.0/16 -d 10.96.0.1/32: default/kubernetes:https cluster IP"},
+		}}},
+		{Name: "default/learn-k8s", Frontends: []Frontend{
+			{
+				Kind: "ClusterIP", IP: "10.96.183.20", Port: 80, Protocol: "tcp", Chain: "KUBE-SVC-XHSBKQPPXKKY2H6Q",
+				Endpoints: learnK8s,
+				Notes:     []string{"masqueraded when ! -s 10.244.0.0/16 -d 10.96.183.20/32: default/learn-k8s cluster IP"},
+			},
+			// through KUBE-EXT to the same KUBE-SVC; the ClusterIP's
+			// masquerade rule names another destination, so doesn't apply
+			{
+				Kind: "NodePort", Port: 30080, Protocol: "tcp", Chain: "KUBE-EXT-XHSBKQPPXKKY2H6Q",
+				Endpoints: learnK8s,
+				Notes:     []string{"masqueraded: the pod sees a node IP as the client"},
+			},
+		}},
+		{Name: "default/nginx", Frontends: []Frontend{
+			{Kind: "ClusterIP", IP: "10.96.77.12", Port: 80, Protocol: "tcp", Chain: "REJECT", Notes: refused},
+			{Kind: "NodePort", Port: 30081, Protocol: "tcp", Chain: "REJECT", Notes: refused},
+		}},
+		{Name: "kube-system/kube-dns:dns", Frontends: []Frontend{{
+			Kind: "ClusterIP", IP: "10.96.0.10", Port: 53, Protocol: "udp", Chain: "KUBE-SVC-TCOU7JCQXEZGVUNU",
+			Endpoints: []Endpoint{{Addr: "10.244.0.3:53", Share: 1, Chain: "KUBE-SEP-IT2ZTR26TO4XFPTO"}},
+			Notes:     []string{"masqueraded when ! -s 10.244.0.0/16 -d 10.96.0.10/32: kube-system/kube-dns:dns cluster IP"},
+		}}},
+	}
+	equalServices(t, got, want)
+}
+
+func TestParseIPTablesChains(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules string
+		want  Frontend
+	}{
+		{
+			name: "no endpoints",
+			rules: `-A KUBE-SERVICES -d 10.96.1.1/32 -p tcp -m comment --comment "default/web cluster IP" --dport 80 -j KUBE-SVC-A
+-A KUBE-SVC-A ! -s 10.244.0.0/16 -d 10.96.1.1/32 -p tcp -m comment --comment "default/web cluster IP" --dport 80 -j KUBE-MARK-MASQ`,
+			want: Frontend{Kind: "ClusterIP", IP: "10.96.1.1", Port: 80, Protocol: "tcp", Chain: "KUBE-SVC-A",
+				Notes: []string{"masqueraded when ! -s 10.244.0.0/16 -d 10.96.1.1/32: default/web cluster IP", "KUBE-SVC-A has no endpoints"}},
+		},
+		{
+			// externalTrafficPolicy: Local sends pod traffic to every
+			// endpoint, and the rest to the node's own
+			name: "local traffic policy",
+			rules: `-A KUBE-SERVICES -d 10.96.1.1/32 -p tcp -m comment --comment "default/web loadbalancer IP" --dport 80 -j KUBE-EXT-A
+-A KUBE-EXT-A -s 10.244.0.0/16 -m comment --comment "pod traffic for default/web external destinations" -j KUBE-SVC-A
+-A KUBE-EXT-A -j KUBE-SVL-A
+-A KUBE-SVC-A -j KUBE-SEP-A
+-A KUBE-SVL-A -j KUBE-SEP-B
+-A KUBE-SEP-A -p tcp -j DNAT --to-destination 10.244.1.2:8080
+-A KUBE-SEP-B -p tcp -j DNAT --to-destination 10.244.2.3:8080`,
+			want: Frontend{Kind: "LoadBalancer", IP: "10.96.1.1", Port: 80, Protocol: "tcp", Chain: "KUBE-EXT-A",
+				Endpoints: []Endpoint{{Addr: "10.244.2.3:8080", Share: 1, Chain: "KUBE-SEP-B"}},
+				Notes:     []string{"when -s 10.244.0.0/16: KUBE-SVC-A instead (pod traffic for default/web external destinations)"}},
+		},
+		{
+			name: "firewall drop",
+			rules: `-A KUBE-SERVICES -d 192.0.2.1/32 -p tcp -m comment --comment "default/web loadbalancer IP" --dport 80 -j KUBE-FW-A
+-A KUBE-FW-A -s 203.0.113.0/24 -m comment --comment "default/web loadbalancer IP" -j KUBE-EXT-A
+-A KUBE-FW-A -m comment --comment "other traffic to default/web will be dropped" -j KUBE-MARK-DROP
+-A KUBE-EXT-A -j KUBE-SEP-A
+-A KUBE-SEP-A -p tcp -j DNAT --to-destination 10.244.1.2:8080`,
+			want: Frontend{Kind: "LoadBalancer", IP: "192.0.2.1", Port: 80, Protocol: "tcp", Chain: "KUBE-FW-A",
+				Notes: []string{"when -s 203.0.113.0/24: KUBE-EXT-A instead (default/web loadbalancer IP)", "dropped: other traffic to default/web will be dropped"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIPTables(strings.NewReader("*nat\n" + tt.rules + "\nCOMMIT\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			equalServices(t, got, []Service{{Name: "default/web", Frontends: []Frontend{tt.want}}})
+		})
+	}
+}
+
+func TestParseIPTablesErrors(t *testing.T) {
+	for _, in := range []string{
+		"*filter\n-A INPUT -j ACCEPT\nCOMMIT\n",
+		"*nat\n-A KUBE-SERVICES -m comment --comment \"unterminated -j KUBE-SVC-A\n",
+		"*nat\n-A KUBE-SERVICES -p tcp --dport http -j KUBE-SVC-A\n",
+		"*nat\n-A KUBE-SVC-A -m statistic --probability half -j KUBE-SEP-A\n",
+	} {
+		if _, err := ParseIPTables(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: want an error", in)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	got, err := splitArgs(`-A X -m comment --comment "a \"quoted\" name" --comment "" -j Y`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"-A", "X", "-m", "comment", "--comment", `a "quoted" name`, "--comment", "", "-j", "Y"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
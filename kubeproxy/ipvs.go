@@ -0,0 +1,124 @@
+package kubeproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// nodePortMin and nodePortMax are the default --service-node-port-range.
+const (
+	nodePortMin = 30000
+	nodePortMax = 32767
+)
+
+// ParseIPVS reads `ipvsadm -Ln` output. IPVS knows nothing about Service
+// names, so each virtual server becomes its own Service named after its
+// address; ports in the NodePort range are reported as NodePorts.
+func ParseIPVS(r io.Reader) ([]Service, error) {
+	var (
+		out []Service
+		cur *Frontend
+	)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0,
+			strings.HasPrefix(line, "IP Virtual Server"),
+			fields[0] == "Prot",
+			fields[0] == "->" && len(fields) > 1 && fields[1] == "RemoteAddress:Port":
+			continue
+
+		case fields[0] == "->":
+			if cur == nil {
+				return nil, fmt.Errorf("line %d: real server before any virtual server", n)
+			}
+			if len(fields) < 4 {
+				return nil, fmt.Errorf("line %d: want -> addr forward weight, got %q", n, line)
+			}
+			w, err := strconv.Atoi(fields[3])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad weight %q", n, fields[3])
+			}
+			cur.Endpoints = append(cur.Endpoints, Endpoint{Addr: fields[1], Weight: w})
+
+		case fields[0] == "TCP" || fields[0] == "UDP" || fields[0] == "SCTP":
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("line %d: want proto addr scheduler, got %q", n, line)
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			port, err := strconv.Atoi(fields[1][i+1:])
+			if i < 0 || err != nil {
+				return nil, fmt.Errorf("line %d: bad address %q", n, fields[1])
+			}
+			f := Frontend{
+				Kind:     "ClusterIP",
+				IP:       strings.Trim(fields[1][:i], "[]"),
+				Port:     port,
+				Protocol: strings.ToLower(fields[0]),
+				Chain:    fields[2],
+			}
+			if port >= nodePortMin && port <= nodePortMax {
+				f.Kind = "NodePort"
+			}
+			if len(fields) > 3 {
+				// "persistent 10800" is sessionAffinity: ClientIP
+				f.Notes = append(f.Notes, "flags: "+strings.Join(fields[3:], " "))
+			}
+			out = append(out, Service{Name: fields[1], Frontends: []Frontend{f}})
+			cur = &out[len(out)-1].Frontends[0]
+
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", n, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for i := range out {
+		shareByScheduler(&out[i].Frontends[0])
+	}
+	return out, nil
+}
+
+// shareByScheduler fills in Share. Round robin ignores weights (apart from
+// 0, which takes a server out); the weighted and least-connection
+// schedulers split by weight when connection counts are even.
+func shareByScheduler(f *Frontend) {
+	total := 0
+	live := 0
+	for _, ep := range f.Endpoints {
+		total += ep.Weight
+		if ep.Weight > 0 {
+			live++
+		}
+	}
+	if live == 0 {
+		f.Notes = append(f.Notes, "no real servers with weight > 0: connections are refused")
+		return
+	}
+	for i := range f.Endpoints {
+		ep := &f.Endpoints[i]
+		switch {
+		case ep.Weight == 0:
+		case f.Chain == "rr":
+			ep.Share = 1 / float64(live)
+		default:
+			ep.Share = float64(ep.Weight) / float64(total)
+		}
+	}
+	switch f.Chain {
+	case "rr":
+		f.Notes = append(f.Notes, "round robin: each new connection goes to the next real server in turn")
+	case "wrr":
+		f.Notes = append(f.Notes, "weighted round robin")
+	case "lc", "wlc":
+		f.Notes = append(f.Notes, "least connections: shares assume connections are spread evenly")
+	case "sh", "dh":
+		f.Notes = append(f.Notes, "hashed: the same client (sh) or destination (dh) always gets the same server")
+	}
+}
@@ -0,0 +1,112 @@
+package kubeproxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseIPVSFixture(t *testing.T) {
+	got, err := ParseIPVS(open(t, "ipvsadm-Ln.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const third = 1.0 / 3
+	rr := []string{"round robin: each new connection goes to the next real server in turn"}
+	learnK8s := []Endpoint{
+		{Addr: "10.244.1.2:8080", Share: third, Weight: 1},
+		{Addr: "10.244.2.3:8080", Share: third, Weight: 1},
+		{Addr: "10.244.2.4:8080", Share: third, Weight: 1},
+	}
+	want := []Service{
+		{Name: "172.19.0.3:30080", Frontends: []Frontend{{
+			Kind: "NodePort", IP: "172.19.0.3", Port: 30080, Protocol: "tcp", Chain: "rr", Endpoints: learnK8s, Notes: rr,
+		}}},
+		{Name: "10.96.0.1:443", Frontends: []Frontend{{
+			Kind: "ClusterIP", IP: "10.96.0.1", Port: 443, Protocol: "tcp", Chain: "rr",
+			Endpoints: []Endpoint{{Addr: "172.19.0.4:6443", Share: 1, Weight: 1}}, Notes: rr,
+		}}},
+		{Name: "10.96.183.20:80", Frontends: []Frontend{{
+			Kind: "ClusterIP", IP: "10.96.183.20", Port: 80, Protocol: "tcp", Chain: "rr", Endpoints: learnK8s, Notes: rr,
+		}}},
+		{Name: "10.96.0.10:53", Frontends: []Frontend{{
+			Kind: "ClusterIP", IP: "10.96.0.10", Port: 53, Protocol: "udp", Chain: "rr",
+			Endpoints: []Endpoint{{Addr: "10.244.0.3:53", Share: 1, Weight: 1}}, Notes: rr,
+		}}},
+	}
+	equalServices(t, got, want)
+}
+
+func TestParseIPVSSchedulers(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		shares []float64
+		notes  []string
+	}{
+		{
+			// rr ignores weights, apart from taking weight 0 out
+			name:   "rr",
+			in:     "TCP  10.96.1.1:80 rr\n  -> 10.244.1.2:8080 Masq 3 0 0\n  -> 10.244.1.3:8080 Masq 1 0 0\n  -> 10.244.1.4:8080 Masq 0 0 0\n",
+			shares: []float64{0.5, 0.5, 0},
+			notes:  []string{"round robin: each new connection goes to the next real server in turn"},
+		},
+		{
+			name:   "wrr",
+			in:     "TCP  10.96.1.1:80 wrr\n  -> 10.244.1.2:8080 Masq 3 0 0\n  -> 10.244.1.3:8080 Masq 1 0 0\n",
+			shares: []float64{0.75, 0.25},
+			notes:  []string{"weighted round robin"},
+		},
+		{
+			name:   "session affinity",
+			in:     "TCP  [fd00::1]:80 wlc persistent 10800\n  -> [fd00:10:244::2]:8080 Masq 1 0 0\n",
+			shares: []float64{1},
+			notes:  []string{"flags: persistent 10800", "least connections: shares assume connections are spread evenly"},
+		},
+		{
+			name:  "all drained",
+			in:    "UDP  10.96.1.1:53 rr\n  -> 10.244.1.2:53 Masq 0 0 0\n",
+			notes: []string{"no real servers with weight > 0: connections are refused"},
+			// shares stay 0
+			shares: []float64{0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseIPVS(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("got %d Services, want 1", len(got))
+			}
+			f := got[0].Frontends[0]
+			if len(f.Endpoints) != len(tt.shares) {
+				t.Fatalf("got %d endpoints, want %d", len(f.Endpoints), len(tt.shares))
+			}
+			for i, ep := range f.Endpoints {
+				if ep.Share != tt.shares[i] {
+					t.Errorf("%s: share %v, want %v", ep.Addr, ep.Share, tt.shares[i])
+				}
+			}
+			if strings.Join(f.Notes, "|") != strings.Join(tt.notes, "|") {
+				t.Errorf("notes %q, want %q", f.Notes, tt.notes)
+			}
+		})
+	}
+}
+
+func TestParseIPVSErrors(t *testing.T) {
+	for _, in := range []string{
+		"  -> 10.244.1.2:8080 Masq 1 0 0\n",
+		"TCP  10.96.1.1:80 rr\n  -> 10.244.1.2:8080 Masq\n",
+		"TCP  10.96.1.1:80 rr\n  -> 10.244.1.2:8080 Masq heavy 0 0\n",
+		"TCP  10.96.1.1 rr\n",
+		"TCP  10.96.1.1:80\n",
+		"FWM  42 rr\n",
+	} {
+		if _, err := ParseIPVS(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: want an error", in)
+		}
+	}
+}
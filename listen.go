@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IP stacks for TCP listeners on a wildcard address (":8080"), picked with
+// -stack.
+const (
+	// stackDual is one IPv6 socket that also accepts IPv4 clients as
+	// v4-mapped addresses (::ffff:a.b.c.d). This is what Go does by default.
+	stackDual = "dual"
+	// stackSplit is two sockets: tcp4 on 0.0.0.0 and a v6-only tcp6 on [::].
+	stackSplit = "split"
+	stackIPv4  = "ipv4"
+	stackIPv6  = "ipv6"
+)
+
+var stack = stackDual
+
+// listen turns an address flag into a listener. Besides the usual ":8080" it
+// understands:
+//
+//	unix:///run/app/app.sock   a unix domain socket (e.g. on a shared emptyDir)
+//	fd://                      the first socket handed over by systemd
+//	fd://3, fd://http          a socket by LISTEN_FDS index or LISTEN_FDNAMES name
+//
+// With -proxy-protocol every listener expects a PROXY protocol header from
+// trusted peers. Every listener counts bytes for /debug/conns and holds at
+// most -max-conns connections.
+func listen(addr string) (net.Listener, error) {
+	var (
+		ln  net.Listener
+		err error
+	)
+	switch {
+	case strings.HasPrefix(addr, "unix://"):
+		ln, err = listenUnix(strings.TrimPrefix(addr, "unix://"))
+	case strings.HasPrefix(addr, "fd://"):
+		ln, err = activatedListener(strings.TrimPrefix(addr, "fd://"))
+		if err == nil {
+			ln = newFamilyListener(ln)
+		}
+	default:
+		ln, err = listenTCP(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if proxyProtocol {
+		if ln, err = newProxyListener(ln, proxyTrusted); err != nil {
+			return nil, err
+		}
+	}
+	return countingListener{newLimitListener(ln, maxConns)}, nil
+}
+
+// listenTCP applies -stack. Addresses that name a host are bound as given;
+// the stack only matters for wildcards.
+func listenTCP(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "" && host != "0.0.0.0" && host != "::" {
+		return listenFamily("tcp", addr)
+	}
+
+	switch stack {
+	case stackDual:
+		// as given: Go opens a dual-stack socket where it can, and falls
+		// back to IPv4 on hosts with IPv6 turned off
+		return listenFamily("tcp", addr)
+	case stackIPv4:
+		return listenFamily("tcp4", net.JoinHostPort("0.0.0.0", port))
+	case stackIPv6:
+		// Go sets IPV6_V6ONLY for "tcp6", so IPv4 clients are refused
+		return listenFamily("tcp6", net.JoinHostPort("::", port))
+	case stackSplit:
+		v4, err4 := listenFamily("tcp4", net.JoinHostPort("0.0.0.0", port))
+		v6, err6 := listenFamily("tcp6", net.JoinHostPort("::", port))
+		switch {
+		case err4 != nil && err6 != nil:
+			return nil, errors.Join(err4, err6)
+		case err6 != nil:
+			log.Printf("no IPv6 listener on %v: %v\n", addr, err6)
+			return v4, nil
+		case err4 != nil:
+			log.Printf("no IPv4 listener on %v: %v\n", addr, err4)
+			return v6, nil
+		}
+		return newMultiListener(v4, v6), nil
+	}
+	return nil, fmt.Errorf("unknown -stack %q", stack)
+}
+
+func listenFamily(network, addr string) (net.Listener, error) {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newFamilyListener(ln), nil
+}
+
+// familyListener tags every accepted connection with its address family.
+// Once accepted, a v4-mapped client on an IPv6 socket looks just like a
+// client on an IPv4 socket, so we decide while we still know which socket it
+// came in on.
+type familyListener struct {
+	net.Listener
+	v6Socket bool
+}
+
+func newFamilyListener(ln net.Listener) net.Listener {
+	tcp, ok := ln.Addr().(*net.TCPAddr)
+	return &familyListener{Listener: ln, v6Socket: ok && tcp.IP.To4() == nil}
+}
+
+func (l *familyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &familyConn{Conn: c, family: connFamily(c, l.v6Socket)}, nil
+}
+
+// connFamily is "ipv4", "ipv6", "ipv4-mapped" (an IPv4 client on an IPv6
+// socket) or the network name for anything that isn't IP.
+func connFamily(c net.Conn, v6Socket bool) string {
+	tcp, ok := c.RemoteAddr().(*net.TCPAddr)
+	switch {
+	case !ok:
+		return c.RemoteAddr().Network()
+	case tcp.IP.To4() == nil:
+		return "ipv6"
+	case v6Socket:
+		return "ipv4-mapped"
+	}
+	return "ipv4"
+}
+
+type familyConn struct {
+	net.Conn
+	family string
+}
+
+func (c *familyConn) AddrFamily() string { return c.family }
+
+func (c *familyConn) NetConn() net.Conn { return c.Conn }
+
+// multiListener accepts from several listeners at once. Accept only fails
+// once they're closed; other errors are retried.
+type multiListener struct {
+	lns   []net.Listener
+	conns chan net.Conn
+	errs  chan error
+}
+
+func newMultiListener(lns ...net.Listener) net.Listener {
+	m := &multiListener{lns: lns, conns: make(chan net.Conn), errs: make(chan error, len(lns))}
+	for _, ln := range lns {
+		go func() {
+			var delay time.Duration
+			for {
+				c, err := ln.Accept()
+				if errors.Is(err, net.ErrClosed) {
+					m.errs <- err
+					return
+				}
+				if err != nil {
+					// one family failing mustn't take the other down with it
+					delay = acceptBackoff(delay)
+					log.Printf("accept on %v: %v; retrying in %v\n", ln.Addr(), err, delay)
+					time.Sleep(delay)
+					continue
+				}
+				delay = 0
+				m.conns <- c
+			}
+		}()
+	}
+	return m
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-m.conns:
+		return c, nil
+	case err := <-m.errs:
+		return nil, err
+	}
+}
+
+func (m *multiListener) Close() error {
+	var errs []error
+	for _, ln := range m.lns {
+		errs = append(errs, ln.Close())
+	}
+	return errors.Join(errs...)
+}
+
+func (m *multiListener) Addr() net.Addr { return m.lns[0].Addr() }
+
+func listenUnix(path string) (net.Listener, error) {
+	// A socket file left behind by a previous run (the container restarted,
+	// the emptyDir didn't) would make bind fail with "address in use".
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return listenFamily("unix", path)
+}
+
+// Socket activation, as described in sd_listen_fds(3): the parent passes
+// listening sockets starting at fd 3 and says how many in LISTEN_FDS. The
+// environment is consumed on first use so child processes don't see it.
+const listenFDsStart = 3
+
+var (
+	activationOnce  sync.Once
+	activationFiles []*os.File
+	activationNames []string
+	activationUsed  = map[int]bool{}
+	activationMu    sync.Mutex
+)
+
+func loadActivation() {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < n; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFDsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		activationFiles = append(activationFiles, os.NewFile(uintptr(listenFDsStart+i), name))
+		activationNames = append(activationNames, name)
+	}
+}
+
+// activatedListener returns the inherited socket selected by sel: empty for
+// the first unused one, a number for an fd, anything else for a name.
+func activatedListener(sel string) (net.Listener, error) {
+	activationOnce.Do(loadActivation)
+	activationMu.Lock()
+	defer activationMu.Unlock()
+
+	if len(activationFiles) == 0 {
+		return nil, errors.New("no sockets passed in LISTEN_FDS")
+	}
+	idx := -1
+	for i, name := range activationNames {
+		if activationUsed[i] {
+			continue
+		}
+		if sel == "" || sel == name || sel == strconv.Itoa(listenFDsStart+i) {
+			idx = i
+			break
+		}
+	}
+	if idx < 0 {
+		return nil, fmt.Errorf("no unused inherited socket matches %q", sel)
+	}
+
+	f := activationFiles[idx]
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("fd %d: %w", f.Fd(), err)
+	}
+	// FileListener dups the descriptor, so the original can go
+	f.Close()
+	activationUsed[idx] = true
+	return ln, nil
+}
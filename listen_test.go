@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs an http.Server with our limits on ln until the test ends.
+func serve(t *testing.T, ln net.Listener, h http.Handler) {
+	t.Helper()
+	srv := newServer(ln.Addr().String(), h)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func TestListenUnixProbe(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.sock")
+	// a socket file left behind by the last run
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("listen over a stale socket: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/family", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestFamily(r))
+	})
+	serve(t, ln, mux)
+
+	if err := probeCmd([]string{"-socket", "unix://" + path, "-path", "/healthz"}); err != nil {
+		t.Errorf("probe /healthz: %v", err)
+	}
+	if err := probeCmd([]string{"-socket", "unix://" + path, "-path", "/missing"}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("probe /missing: err = %v, want a 404", err)
+	}
+	if err := probeCmd([]string{"-socket", "unix://" + filepath.Join(t.TempDir(), "none.sock"), "-timeout", "100ms"}); err == nil {
+		t.Error("probe of a socket nobody listens on succeeded")
+	}
+
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "GET /family HTTP/1.1\r\nHost: unix\r\nConnection: close\r\n\r\n")
+	body, _ := io.ReadAll(c)
+	if !strings.HasSuffix(string(body), "\r\n\r\nunix") {
+		t.Errorf("family over a unix socket:\n%s", body)
+	}
+}
+
+func TestListenTCPProbe(t *testing.T) {
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, http.HandlerFunc(healthzHandler))
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	// ":PORT" is probed on localhost, like the server's own flag
+	if err := probeCmd([]string{"-socket", ":" + port, "-path", "/healthz"}); err != nil {
+		t.Errorf("probe :%s: %v", port, err)
+	}
+}
+
+func TestListenActivated(t *testing.T) {
+	if _, err := listen("fd://"); err == nil || !strings.Contains(err.Error(), "LISTEN_FDS") {
+		t.Errorf("fd:// with nothing passed: err = %v", err)
+	}
+
+	// the socket systemd would have opened, handed to a child as fd 3
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivatedChild$")
+	cmd.Env = append(os.Environ(), "LEARN_K8S_ACTIVATED_CHILD=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	// only the child may accept from here on
+	f.Close()
+	ln.Close()
+
+	var body []byte
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + "/")
+		if err == nil {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nothing answering on the passed socket: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if want := "fd 3 as http, environment cleared"; string(body) != want {
+		t.Errorf("child said %q, want %q", body, want)
+	}
+}
+
+// TestActivatedChild is the child TestListenActivated starts. Like systemd,
+// it sets LISTEN_PID once it knows its own pid.
+func TestActivatedChild(t *testing.T) {
+	if os.Getenv("LEARN_K8S_ACTIVATED_CHILD") == "" {
+		t.Skip("run by TestListenActivated")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	ln, err := listen("fd://http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "fd 3 as http"
+	if _, err := listen("fd://3"); err == nil {
+		msg += ", handed out twice"
+	}
+	if os.Getenv("LISTEN_FDS") == "" && os.Getenv("LISTEN_PID") == "" {
+		msg += ", environment cleared"
+	}
+	http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, msg)
+	}))
+}
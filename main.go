@@ -1,36 +1,216 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"time"
 )
 
-var socket = ":8080"
+var (
+	socket     = ":8080"
+	grpcSocket = ""
+	enableH2C  = false
+	tcpEcho    = ""
+	udpEcho    = ""
+)
 
 type Response struct {
-	TimeStamp time.Time `json:"time_stamp"`
-	Hostname  string    `json:"hostname"`
+	TimeStamp    time.Time `json:"time_stamp"`
+	Hostname     string    `json:"hostname"`
+	Protocol     string    `json:"protocol"`
+	ConnRequests int64     `json:"conn_requests"`
+	AddrFamily   string    `json:"addr_family"`
+	RemoteAddr   string    `json:"remote_addr"`
+	ConnID       uint64    `json:"conn_id"`
+
+	// Namespaces is only filled in with -report-ns.
+	Namespaces *Namespaces `json:"namespaces,omitempty"`
+}
+
+// commands are the non-server modes of the binary. With no arguments (which is
+// how the container runs it) we stand up the server.
+var commands = map[string]func(args []string) error{
+	"bench":          benchCmd,
+	"bench-encoding": benchEncodingCmd,
+	"bgp":            bgpCmd,
+	"controller":     controllerCmd,
+	"echo-client":    echoClientCmd,
+	"explain-svc":    explainSvcCmd,
+	"fake-apiserver": fakeAPIServerCmd,
+	"flow":           flowCmd,
+	"grpc-client":    grpcClientCmd,
+	"ippool":         ippoolCmd,
+	"ns-compare":     nsCompareCmd,
+	"probe":          probeCmd,
+	"topology":       topologyCmd,
+}
+
+// newResponse gathers what we know about the pod serving r. Every protocol
+// the app speaks (JSON, gRPC, ...) answers with the same data.
+func newResponse(r *http.Request) Response {
+	hn, _ := os.Hostname()
+	resp := Response{
+		TimeStamp:    time.Now(),
+		Hostname:     hn,
+		Protocol:     r.Proto,
+		ConnRequests: requestSeq(r),
+		AddrFamily:   requestFamily(r),
+		RemoteAddr:   r.RemoteAddr,
+		ConnID:       requestConnID(r),
+	}
+	if reportNS {
+		if ns, err := readNamespaces(procSelfNS); err == nil {
+			resp.Namespaces = &ns
+		}
+	}
+	return resp
 }
 
 func jsonHandler(w http.ResponseWriter, r *http.Request) {
+	// gRPC shares the port when h2c is on
+	if isGRPC(r) {
+		grpcHandler(w, r)
+		return
+	}
+
 	// 1. Create the data
-	hn, _ := os.Hostname()
-	resp := Response{TimeStamp: time.Now(), Hostname: hn}
+	resp := newResponse(r)
+
+	// 2. Pick an encoding (JSON unless the client asks for something else)
+	ct := negotiate(r.Header.Get("Accept"))
+	body, err := encodeResponse(ct, resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	// 2. Set the header before writing the response
-	w.Header().Set("Content-Type", "application/json")
+	// 3. Set the header before writing the response
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Vary", "Accept")
 
-	// 3. Encode and send the response
-	json.NewEncoder(w).Encode(resp)
+	// 4. Send the response
+	w.Write(body)
 }
 
 func main() {
-	http.HandleFunc("/", jsonHandler)
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				log.Fatalf("%s: %v\n", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	flag.StringVar(&socket, "socket", socket, "address the HTTP server listens on: host:port, unix:///path or fd://")
+	flag.StringVar(&grpcSocket, "grpc", grpcSocket, "address for the gRPC (h2c) server, e.g. :9090; empty disables it")
+	flag.BoolVar(&enableH2C, "h2c", enableH2C, "also serve cleartext HTTP/2 (prior knowledge and Upgrade: h2c) on -socket")
+	flag.StringVar(&tcpEcho, "tcp-echo", tcpEcho, "address for the TCP echo listener, e.g. :9000; empty disables it")
+	flag.StringVar(&udpEcho, "udp-echo", udpEcho, "address for the UDP echo listener, e.g. :9001; empty disables it")
+	flag.StringVar(&stack, "stack", stack, "IP stack for wildcard TCP listeners: dual (one v6 socket, v4-mapped), split (tcp4 + tcp6), ipv4 or ipv6")
+	flag.BoolVar(&proxyProtocol, "proxy-protocol", proxyProtocol, "expect a PROXY protocol v1/v2 header on TCP listeners")
+	flag.StringVar(&proxyTrusted, "proxy-trusted", proxyTrusted, "comma-separated CIDRs allowed to, and required to, send PROXY headers; needed with -proxy-protocol")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", readHeaderTimeout, "time allowed to read request headers")
+	flag.DurationVar(&readTimeout, "read-timeout", readTimeout, "time allowed to read a whole request")
+	flag.DurationVar(&writeTimeout, "write-timeout", writeTimeout, "time allowed to write a response")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "how long a keep-alive connection may sit idle")
+	flag.IntVar(&maxHeaderBytes, "max-header-bytes", maxHeaderBytes, "largest request header accepted")
+	flag.IntVar(&maxConns, "max-conns", maxConns, "concurrent connections per listener; 0 is unlimited")
+	flag.StringVar(&concurrencyMode, "concurrency", concurrencyMode, "in-flight request cap: off, fixed, aimd or gradient")
+	flag.IntVar(&concurrencyLimit, "concurrency-limit", concurrencyLimit, "the cap for fixed, the ceiling for aimd and gradient")
+	flag.DurationVar(&latencyTarget, "latency-target", latencyTarget, "aimd backs off when a request takes longer than this")
+	flag.DurationVar(&unreadyAfter, "unready-after", unreadyAfter, "fail /readyz after shedding for this long; 0 never fails it")
+	flag.StringVar(&procNet, "proc-net", procNet, "where to read /proc/net tables; /host/proc/1/net shows the node's with the host's /proc mounted")
+	flag.BoolVar(&enablePcap, "pcap", enablePcap, "serve packet captures on /debug/pcap (needs CAP_NET_RAW)")
+	flag.StringVar(&ippoolFile, "ippool", ippoolFile, "file holding kubectl get ippools -o yaml, so /diag/mtu knows the pod's encapsulation")
+	flag.BoolVar(&reportNS, "report-ns", reportNS, "include the namespace inodes from /ns in every response")
+	flag.StringVar(&watchEndpoints, "watch-endpoints", watchEndpoints, "Service (name or namespace/name) whose EndpointSlices to watch for /k8s/endpoints/history; empty disables it")
+	flag.StringVar(&k8sAPI, "k8s-api", k8sAPI, "API server URL for -watch-endpoints, e.g. kubectl proxy's http://127.0.0.1:8001; empty uses the pod's service account")
+	flag.StringVar(&bgpSocket, "bgp", bgpSocket, "address for a passive BGP speaker, e.g. :179; empty disables it")
+	flag.UintVar(&bgpAS, "bgp-as", bgpAS, "our BGP AS number")
+	flag.StringVar(&bgpRouterID, "bgp-router-id", bgpRouterID, "our BGP router ID; defaults to the first non-loopback IPv4 address")
+	flag.StringVar(&bgpPeers, "bgp-peer", bgpPeers, "comma-separated host:port peers to dial rather than wait for")
+	flag.StringVar(&bgpAnnounce, "bgp-announce", bgpAnnounce, "comma-separated prefixes to announce to every peer")
+	flag.StringVar(&bgpNextHop, "bgp-next-hop", bgpNextHop, "IPv4 next hop for -bgp-announce; defaults to our address on each session, or the router ID on sessions over IPv6")
+	flag.Parse()
+
+	var err error
+	if load, err = newShedder(concurrencyMode, concurrencyLimit, latencyTarget); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+
+	if grpcSocket != "" {
+		go serveGRPC(grpcSocket)
+	}
+	if tcpEcho != "" {
+		go serveTCPEcho(tcpEcho)
+	}
+	if udpEcho != "" {
+		go serveUDPEcho(udpEcho)
+	}
+	if watchEndpoints != "" {
+		if endpoints, err = newEndpointWatcher(watchEndpoints, k8sAPI); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		go endpoints.run(context.Background())
+	}
+	if bgpSocket != "" || bgpPeers != "" {
+		if bgpSpeaker, err = newBGPSpeaker(); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if bgpSocket != "" {
+			go serveBGP(bgpSpeaker, bgpSocket)
+		}
+		for _, peer := range splitList(bgpPeers) {
+			go dialBGP(bgpSpeaker, peer)
+		}
+	}
+
+	// "/" also carries gRPC when -h2c is on, so it takes a message's worth
+	handle("/", grpcMaxMessage+5, jsonHandler)
+	handle("/net/interfaces", noBody, interfacesHandler)
+	handle("/net/conntrack", noBody, conntrackHandler)
+	handle("/net/sockets", noBody, socketsHandler)
+	handle("/ns", noBody, nsHandler)
+	handle("/diag/mtu", noBody, mtuHandler)
+	handle("/payload", noBody, payloadHandler)
+	handle("/bench/download", noBody, benchDownloadHandler)
+	handle("/bench/upload", -1, benchUploadHandler)
+	handle("/debug/conns", noBody, connsHandler)
+	handle("/healthz", noBody, healthzHandler)
+	handle("/readyz", noBody, readyzHandler)
+	handle("/slow", noBody, slowHandler)
+	if enablePcap {
+		handle("/debug/pcap", noBody, pcapHandler)
+	}
+	if bgpSpeaker != nil {
+		handle("/bgp/routes", noBody, bgpRoutesHandler)
+	}
+	if endpoints != nil {
+		handle("/k8s/endpoints/history", noBody, endpointsHistoryHandler)
+	}
+	srv := newServer(socket, shedLoad(http.DefaultServeMux))
+
+	ln, err := listen(socket)
+	if err != nil {
+		log.Fatalf("failed to stand up server: %v\n", err)
+	}
+	if enableH2C {
+		var protocols http.Protocols
+		protocols.SetHTTP1(true)
+		protocols.SetUnencryptedHTTP2(true)
+		srv.Protocols = &protocols
+
+		upgraded := newConnListener(ln.Addr())
+		srv.Handler = h2cUpgrade(srv.Handler, upgraded)
+		go srv.Serve(upgraded)
+	}
+
 	log.Printf("standing up server on %v\n", socket)
-	if err := http.ListenAndServe(socket, nil); err != nil {
+	if err := srv.Serve(ln); err != nil {
 		log.Printf("failed to stand up server: %v\n", err)
 	}
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/montybeatnik/learn-k8s/calico"
+	"github.com/montybeatnik/learn-k8s/pmtu"
+)
+
+// ippoolFile is `kubectl get ippools -o yaml` mounted into the pod (from a
+// ConfigMap, say), so /diag/mtu knows which encapsulation the pod is behind.
+var ippoolFile = ""
+
+// MTUReport is the answer from /diag/mtu.
+type MTUReport struct {
+	Target string `json:"target"`
+	pmtu.Result
+	Encapsulation *Encapsulation `json:"encapsulation,omitempty"`
+	Hints         []string       `json:"hints,omitempty"`
+}
+
+// Encapsulation is what the IPPool's tunnel mode costs.
+type Encapsulation struct {
+	Pool        string `json:"pool,omitempty"`
+	Mode        string `json:"mode"`
+	Overhead    int    `json:"overhead"`
+	UnderlayMTU int    `json:"underlay_mtu"`
+	// PodMTU is the largest pod MTU the tunnel can carry without
+	// fragmenting: UnderlayMTU less Overhead.
+	PodMTU int `json:"pod_mtu"`
+}
+
+// mtuHandler probes the path MTU to a target. Query parameters:
+//
+//	?target=10.244.2.3:9001  host:port; the port defaults to 9001 for udp
+//	                         (-udp-echo) and 8080 for tcp
+//	?proto=udp               udp (DF probes) or tcp (MSS)
+//	?encap=vxlan             ipip, vxlan or none; defaults to the -ippool
+//	                         pool that holds our address
+//	?underlay=1500           the nodes' MTU
+//	?timeout=300ms           how long to wait for each probe
+func mtuHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	proto := q.Get("proto")
+	if proto == "" {
+		proto = "udp"
+	}
+	port := map[string]string{"udp": "9001", "tcp": "8080"}[proto]
+	if port == "" {
+		http.Error(w, "proto must be udp or tcp", http.StatusBadRequest)
+		return
+	}
+	timeout := 300 * time.Millisecond
+	if v := q.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = time.ParseDuration(v); err != nil || timeout <= 0 || timeout > 5*time.Second {
+			http.Error(w, "timeout must be a duration up to 5s", http.StatusBadRequest)
+			return
+		}
+	}
+	underlay := 1500
+	if v := q.Get("underlay"); v != "" {
+		var err error
+		if underlay, err = strconv.Atoi(v); err != nil || underlay < 576 {
+			http.Error(w, "underlay must be an MTU of at least 576", http.StatusBadRequest)
+			return
+		}
+	}
+	target, err := resolveTarget(r.Context(), q.Get("target"), port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	probe := pmtu.ProbeUDP
+	if proto == "tcp" {
+		probe = pmtu.ProbeTCP
+	}
+	res, err := probe(r.Context(), target, timeout)
+	switch {
+	case errors.Is(err, errors.ErrUnsupported):
+		http.Error(w, "path MTU probing needs Linux", http.StatusNotImplemented)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	report := MTUReport{Target: target.String(), Result: res}
+	pool, err := podPool(q.Get("encap"), res.Local.Addr())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if pool != nil {
+		report.Encapsulation = &Encapsulation{
+			Pool:        pool.Name,
+			Mode:        encapsulation(*pool),
+			Overhead:    pool.Overhead(),
+			UnderlayMTU: underlay,
+			PodMTU:      underlay - pool.Overhead(),
+		}
+	}
+	report.Hints = mtuHints(report)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
+
+// resolveTarget turns host[:port] into an address, using port when there
+// isn't one.
+func resolveTarget(ctx context.Context, target, port string) (netip.AddrPort, error) {
+	if target == "" {
+		return netip.AddrPort{}, fmt.Errorf("target is required, e.g. ?target=10.244.2.3:9001")
+	}
+	host, p, err := net.SplitHostPort(target)
+	if err != nil {
+		host, p = strings.Trim(target, "[]"), port
+	}
+	n, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bad port %q", p)
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(n)), nil
+}
+
+// podPool is the IPPool behind local: one made up from ?encap=, or the
+// -ippool pool whose CIDR holds local. It's nil when we can't tell.
+func podPool(encap string, local netip.Addr) (*calico.IPPool, error) {
+	local = local.Unmap()
+	p := &calico.IPPool{CIDR: netip.PrefixFrom(local, local.BitLen()), IPIPMode: "Never", VXLANMode: "Never"}
+	switch strings.ToLower(encap) {
+	case "ipip":
+		p.IPIPMode = "Always"
+		return p, nil
+	case "vxlan":
+		p.VXLANMode = "Always"
+		return p, nil
+	case "none":
+		return p, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("encap must be ipip, vxlan or none")
+	}
+
+	if ippoolFile == "" {
+		return nil, nil
+	}
+	f, err := os.Open(ippoolFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pools, err := calico.ParseIPPools(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ippoolFile, err)
+	}
+	for i := range pools {
+		if pools[i].CIDR.Contains(local) {
+			return &pools[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func mtuHints(r MTUReport) []string {
+	var hints []string
+	if e := r.Encapsulation; e != nil && r.InterfaceMTU > e.PodMTU {
+		hints = append(hints, fmt.Sprintf("%s has MTU %d but %s leaves room for %d: full-size packets to pods on other nodes won't fit the tunnel. Lower the MTU in Calico's config (or check -underlay).",
+			r.Interface, r.InterfaceMTU, e.Mode, e.PodMTU))
+	}
+	switch {
+	case r.Method == "icmp":
+		hints = append(hints, "the target didn't echo, so path_mtu is only what ICMP told the kernel; a black hole looks like no problem. Run the target with -udp-echo :9001 for a real answer.")
+	case r.Method == "tcp mss" && r.PathMTU < r.InterfaceMTU:
+		hints = append(hints, fmt.Sprintf("the connection settled on segments that fit %d-byte packets, less than %s's %d: the other end (or ICMP from the path) asked for smaller ones. TCP copes; UDP doesn't, so try proto=udp against -udp-echo.",
+			r.PathMTU, r.Interface, r.InterfaceMTU))
+	case r.PathMTU < r.InterfaceMTU:
+		hints = append(hints, fmt.Sprintf("packets over %d bytes don't arrive, though %s would send up to %d. TCP recovers only if something on the path sends ICMP \"fragmentation needed\"; otherwise large responses stall. Try /payload?size=%d from the other side.",
+			r.PathMTU, r.Interface, r.InterfaceMTU, 4*r.InterfaceMTU))
+	}
+	if r.KernelMTU > 0 && r.KernelMTU < r.InterfaceMTU {
+		hints = append(hints, fmt.Sprintf("a router on the path reported an MTU of %d; the kernel now sends smaller packets to %s", r.KernelMTU, r.Target))
+	}
+	return hints
+}
+
+// maxPayload caps /payload so it can't be used to exhaust the pod.
+const maxPayload = 64 << 20
+
+// payloadHandler answers with size bytes of filler, for testing what
+// happens to responses bigger than one packet:
+//
+//	curl -s -o /dev/null -w '%{size_download} bytes in %{time_total}s\n' 'learn-k8s:8080/payload?size=100000'
+func payloadHandler(w http.ResponseWriter, r *http.Request) {
+	size, err := strconv.Atoi(r.URL.Query().Get("size"))
+	if err != nil || size < 0 || size > maxPayload {
+		http.Error(w, fmt.Sprintf("size must be a number of bytes up to %d", maxPayload), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	line := []byte(strings.Repeat("learn-k8s ", 103)[:1023] + "\n")
+	for size > 0 {
+		n := min(size, len(line))
+		if _, err := w.Write(line[:n]); err != nil {
+			return
+		}
+		size -= n
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/montybeatnik/learn-k8s/procnet"
+)
+
+// procNet is where the /proc/net tables are read from.
+var procNet = "/proc/net"
+
+// Interface is one network interface as seen from inside the pod. In a
+// plain pod that's lo and eth0 (the pod end of the veth pair).
+type Interface struct {
+	Index        int      `json:"index"`
+	Name         string   `json:"name"`
+	MTU          int      `json:"mtu"`
+	HardwareAddr string   `json:"hardware_addr,omitempty"`
+	Flags        string   `json:"flags"`
+	IPv4         []string `json:"ipv4"`
+	IPv6         []string `json:"ipv6"`
+}
+
+func listInterfaces() ([]Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Interface, 0, len(ifaces))
+	for _, ifc := range ifaces {
+		iface := Interface{
+			Index:        ifc.Index,
+			Name:         ifc.Name,
+			MTU:          ifc.MTU,
+			HardwareAddr: ifc.HardwareAddr.String(),
+			Flags:        ifc.Flags.String(),
+			IPv4:         []string{},
+			IPv6:         []string{},
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			if ipnet.IP.To4() != nil {
+				iface.IPv4 = append(iface.IPv4, ipnet.String())
+			} else {
+				iface.IPv6 = append(iface.IPv6, ipnet.String())
+			}
+		}
+		out = append(out, iface)
+	}
+	return out, nil
+}
+
+// interfacesHandler is `ip -br addr` for an image that has no ip command.
+func interfacesHandler(w http.ResponseWriter, r *http.Request) {
+	ifaces, err := listInterfaces()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ifaces)
+}
+
+// ConntrackEntry is one row of /net/conntrack.
+type ConntrackEntry struct {
+	procnet.Conntrack
+	NAT string `json:"nat,omitempty"`
+}
+
+// conntrackHandler is `conntrack -L` without the conntrack tool. Filters:
+//
+//	?port=8080&port=30080  either tuple uses one of these ports
+//	?proto=tcp
+//	?nat=1                 only connections that were DNATed or SNATed
+//
+// The table belongs to the network namespace we run in. In a normal pod
+// that's the pod's, where traffic arrives already translated; run the pod
+// with hostNetwork to see kube-proxy's DNAT and SNAT on the node.
+func conntrackHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		f   *os.File
+		err error
+	)
+	for _, name := range []string{"nf_conntrack", "ip_conntrack"} {
+		if f, err = os.Open(filepath.Join(procNet, name)); err == nil {
+			break
+		}
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "no conntrack table here: the nf_conntrack module isn't loaded, or it isn't exposed in this network namespace", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	all, err := procnet.ParseConntrack(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	q := r.URL.Query()
+	var ports []uint16
+	for _, v := range q["port"] {
+		p, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			http.Error(w, "port must be a number", http.StatusBadRequest)
+			return
+		}
+		ports = append(ports, uint16(p))
+	}
+	natOnly := q.Get("nat") != "" && q.Get("nat") != "0" && q.Get("nat") != "false"
+
+	out := []ConntrackEntry{}
+	for _, c := range all {
+		if p := q.Get("proto"); p != "" && c.Proto != p {
+			continue
+		}
+		if len(ports) > 0 && !hasAnyPort(c, ports) {
+			continue
+		}
+		e := ConntrackEntry{Conntrack: c, NAT: c.NAT()}
+		if natOnly && e.NAT == "" {
+			continue
+		}
+		out = append(out, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func hasAnyPort(c procnet.Conntrack, ports []uint16) bool {
+	for _, p := range ports {
+		if c.HasPort(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// SocketEntry is one row of /net/sockets. PID and FD are set for sockets
+// this server holds.
+type SocketEntry struct {
+	procnet.Socket
+	PID int `json:"pid,omitempty"`
+	FD  int `json:"fd,omitempty"`
+}
+
+// socketsHandler is `ss -tuanp` for an image with no ss or netstat:
+//
+//	curl localhost:8080/net/sockets | jq '.listening[] | select(.pid)'
+//
+// ?port= keeps sockets with that local or remote port. Like
+// /net/conntrack, it shows the network namespace we're in, so in a pod it
+// proves the server really is bound to :8080 there.
+func socketsHandler(w http.ResponseWriter, r *http.Request) {
+	var port uint64
+	if v := r.URL.Query().Get("port"); v != "" {
+		var err error
+		if port, err = strconv.ParseUint(v, 10, 16); err != nil {
+			http.Error(w, "port must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fds, _ := procnet.SocketFDs("/proc", "self")
+	pid := os.Getpid()
+	out := struct {
+		Listening   []SocketEntry `json:"listening"`
+		Established []SocketEntry `json:"established"`
+		Other       []SocketEntry `json:"other"`
+	}{[]SocketEntry{}, []SocketEntry{}, []SocketEntry{}}
+	found := false
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		f, err := os.Open(filepath.Join(procNet, proto))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // e.g. no IPv6 in this namespace
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		socks, err := procnet.ParseSockets(f, proto)
+		f.Close()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		found = true
+		for _, s := range socks {
+			if port != 0 && uint64(s.Local.Port()) != port && uint64(s.Remote.Port()) != port {
+				continue
+			}
+			e := SocketEntry{Socket: s}
+			if fd, ok := fds[s.Inode]; ok && s.Inode != 0 {
+				e.PID, e.FD = pid, fd
+			}
+			switch {
+			case s.Listening():
+				out.Listening = append(out.Listening, e)
+			case s.State == "ESTABLISHED":
+				out.Established = append(out.Established, e)
+			default:
+				out.Other = append(out.Other, e)
+			}
+		}
+	}
+	if !found {
+		http.Error(w, "no socket tables under "+procNet, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
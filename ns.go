@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var (
+	procSelfNS = "/proc/self/ns"
+	reportNS   = false
+)
+
+// Namespaces identifies the Linux namespaces the server runs in. Each value
+// is the inode behind /proc/self/ns/<kind>; two processes are in the same
+// namespace exactly when the inodes match.
+type Namespaces struct {
+	Net uint64 `json:"net"`
+	UTS uint64 `json:"uts"`
+	IPC uint64 `json:"ipc"`
+	PID uint64 `json:"pid"`
+	Mnt uint64 `json:"mnt"`
+}
+
+// nsKinds lists the namespaces we report, in the order we print them.
+var nsKinds = []string{"net", "uts", "ipc", "pid", "mnt"}
+
+// get returns the inode for kind, one of nsKinds.
+func (n *Namespaces) get(kind string) *uint64 {
+	switch kind {
+	case "net":
+		return &n.Net
+	case "uts":
+		return &n.UTS
+	case "ipc":
+		return &n.IPC
+	case "pid":
+		return &n.PID
+	case "mnt":
+		return &n.Mnt
+	}
+	return nil
+}
+
+// readNamespaces resolves the links in dir, which look like
+// "net -> net:[4026532345]".
+func readNamespaces(dir string) (Namespaces, error) {
+	var ns Namespaces
+	for _, kind := range nsKinds {
+		link, err := os.Readlink(filepath.Join(dir, kind))
+		if err != nil {
+			return ns, err
+		}
+		id, err := parseNSLink(kind, link)
+		if err != nil {
+			return ns, err
+		}
+		*ns.get(kind) = id
+	}
+	return ns, nil
+}
+
+func parseNSLink(kind, link string) (uint64, error) {
+	s, ok := strings.CutPrefix(link, kind+":[")
+	if !ok || !strings.HasSuffix(s, "]") {
+		return 0, fmt.Errorf("unexpected %s namespace link %q", kind, link)
+	}
+	return strconv.ParseUint(strings.TrimSuffix(s, "]"), 10, 64)
+}
+
+// nsHandler is `ls -l /proc/self/ns` for the server process. Containers in
+// one pod share net, uts and ipc, so comparing this against another
+// container's answer shows what a pod really is.
+func nsHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := readNamespaces(procSelfNS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ns)
+}
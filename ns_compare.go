@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// nsExplain says what sharing (or not sharing) each namespace means for two
+// containers.
+var nsExplain = map[string][2]string{
+	"net": {
+		"same pod (or both hostNetwork): one IP, one set of ports, and each can reach the other on localhost",
+		"different pods: traffic between them leaves through eth0 and the CNI",
+	},
+	"uts": {
+		"same hostname, the pod's name",
+		"separate hostnames",
+	},
+	"ipc": {
+		"can share System V IPC and POSIX message queues, as containers in one pod do",
+		"separate IPC, so they are not in the same pod",
+	},
+	"pid": {
+		"can see each other's processes: shareProcessNamespace: true (or hostPID)",
+		"the default: each container sees only its own processes and its entrypoint is PID 1",
+	},
+	"mnt": {
+		"same filesystem, so these are the same container",
+		"each container has its own root filesystem from its own image",
+	},
+}
+
+// nsCompareCmd fetches /ns from two servers and explains which namespaces
+// they share. Run the image twice in one pod (say on :8080 and :8081) and
+// compare it against a pod on another node:
+//
+//	learn-k8s ns-compare localhost:8080 localhost:8081
+//	learn-k8s ns-compare localhost:8080 10.244.2.3:8080
+func nsCompareCmd(args []string) error {
+	fs := flag.NewFlagSet("ns-compare", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 2*time.Second, "request timeout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ns-compare [flags] ADDR_A ADDR_B")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("want two addresses, got %d", fs.NArg())
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	var ns [2]Namespaces
+	for i, addr := range fs.Args() {
+		var err error
+		if ns[i], err = fetchNamespaces(client, addr); err != nil {
+			return err
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAMESPACE\tA\tB\t")
+	for _, kind := range nsKinds {
+		a, b := *ns[0].get(kind), *ns[1].get(kind)
+		verdict := "separate"
+		if a == b {
+			verdict = "shared"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", kind, a, b, verdict)
+	}
+	tw.Flush()
+
+	fmt.Println()
+	for _, kind := range nsKinds {
+		i := 1
+		if *ns[0].get(kind) == *ns[1].get(kind) {
+			i = 0
+		}
+		fmt.Printf("%-4s %s\n", kind, nsExplain[kind][i])
+	}
+	return nil
+}
+
+// fetchNamespaces GETs /ns from addr, which is host:port, :port or a URL.
+func fetchNamespaces(client *http.Client, addr string) (Namespaces, error) {
+	var ns Namespaces
+	url := addr
+	if !strings.Contains(url, "://") {
+		if strings.HasPrefix(url, ":") {
+			url = "localhost" + url
+		}
+		url = "http://" + url
+	}
+	resp, err := client.Get(strings.TrimSuffix(url, "/") + "/ns")
+	if err != nil {
+		return ns, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ns, fmt.Errorf("%s: %s", addr, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&ns); err != nil {
+		return ns, fmt.Errorf("%s: %w", addr, err)
+	}
+	return ns, nil
+}
@@ -0,0 +1,338 @@
+package pcap
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Instruction is one classic BPF instruction (struct sock_filter), the
+// format the kernel runs on every packet before handing it to the socket.
+type Instruction struct {
+	Op     uint16
+	Jt, Jf uint8
+	K      uint32
+}
+
+// Opcodes from linux/filter.h, combined into the handful we emit.
+const (
+	opLdAbsW  = 0x20 // A = word at [k]
+	opLdAbsH  = 0x28 // A = half word at [k]
+	opLdAbsB  = 0x30 // A = byte at [k]
+	opLdIndH  = 0x48 // A = half word at [X+k]
+	opLdxMSH  = 0xb1 // X = 4*([k]&0xf), the IPv4 header length
+	opAndK    = 0x54 // A &= k
+	opJa      = 0x05 // jump k instructions
+	opJeqK    = 0x15 // A == k ? jt : jf
+	opJsetK   = 0x45 // A & k ? jt : jf
+	opRetK    = 0x06 // accept k bytes of the packet; 0 drops it
+	maxFilter = 8
+)
+
+// IP protocol numbers we filter on.
+var protoNumbers = map[string][2]uint32{ // IPv4, IPv6
+	"tcp":  {6, 6},
+	"udp":  {17, 17},
+	"sctp": {132, 132},
+	"icmp": {1, 58},
+}
+
+// Filter is what tcpdump would write as
+//
+//	proto and (host H1 or host H2) and (port P1 or port P2)
+//
+// Empty fields match everything. Skip drops one connection, given by its
+// two ports, which is how a capture streamed over the network leaves its
+// own packets out.
+type Filter struct {
+	Proto string
+	Hosts []netip.Addr
+	Ports []uint16
+	Skip  [2]uint16
+}
+
+// String renders f as a tcpdump expression.
+func (f Filter) String() string {
+	var clauses []string
+	if f.Proto != "" {
+		clauses = append(clauses, f.Proto)
+	}
+	or := func(word string, items []string) {
+		switch len(items) {
+		case 0:
+		case 1:
+			clauses = append(clauses, word+" "+items[0])
+		default:
+			clauses = append(clauses, "("+word+" "+strings.Join(items, " or "+word+" ")+")")
+		}
+	}
+	var hosts, ports []string
+	for _, h := range f.Hosts {
+		hosts = append(hosts, h.String())
+	}
+	for _, p := range f.Ports {
+		ports = append(ports, strconv.Itoa(int(p)))
+	}
+	or("host", hosts)
+	or("port", ports)
+	if f.Skip != [2]uint16{} {
+		clauses = append(clauses, fmt.Sprintf("not (port %d and port %d)", f.Skip[0], f.Skip[1]))
+	}
+	return strings.Join(clauses, " and ")
+}
+
+func (f Filter) empty() bool {
+	return f.Proto == "" && len(f.Hosts) == 0 && len(f.Ports) == 0 && f.Skip == [2]uint16{}
+}
+
+// Compile turns f into a program for link. Accepted packets are cut to
+// snaplen bytes.
+func (f Filter) Compile(link LinkType, snaplen uint32) ([]Instruction, error) {
+	if f.Proto != "" {
+		if _, ok := protoNumbers[f.Proto]; !ok {
+			return nil, fmt.Errorf("unknown protocol %q: want tcp, udp, sctp or icmp", f.Proto)
+		}
+		if f.Proto == "icmp" && len(f.Ports) > 0 {
+			return nil, fmt.Errorf("icmp has no ports")
+		}
+	}
+	if len(f.Hosts) > maxFilter || len(f.Ports) > maxFilter {
+		return nil, fmt.Errorf("at most %d hosts and %d ports", maxFilter, maxFilter)
+	}
+	if f.empty() {
+		return []Instruction{{Op: opRetK, K: snaplen}}, nil
+	}
+
+	// Anything that isn't IP only gets through when we filter on nothing
+	// but the skipped connection.
+	other := "reject"
+	if f.Proto == "" && len(f.Hosts) == 0 && len(f.Ports) == 0 {
+		other = "accept"
+	}
+
+	a := &asm{labels: map[string]int{}}
+	var nh uint32
+	switch link {
+	case LinkEthernet:
+		nh = 14
+		a.emit(opLdAbsH, 12)
+		a.jump(opJeqK, 0x0800, "v4", "")
+		a.jump(opJeqK, 0x86dd, "v6", other)
+	case LinkRaw:
+		a.emit(opLdAbsB, 0)
+		a.emit(opAndK, 0xf0)
+		a.jump(opJeqK, 0x40, "v4", "")
+		a.jump(opJeqK, 0x60, "v6", other)
+	default:
+		return nil, fmt.Errorf("no filter support for link type %d", link)
+	}
+
+	a.label("v4")
+	f.compileV4(a, nh)
+	a.label("v6")
+	f.compileV6(a, nh)
+	a.label("accept")
+	a.emit(opRetK, snaplen)
+	a.label("reject")
+	a.emit(opRetK, 0)
+	return a.resolve()
+}
+
+func (f Filter) compileV4(a *asm, nh uint32) {
+	if f.Proto != "" {
+		a.emit(opLdAbsB, nh+9)
+		a.jump(opJeqK, protoNumbers[f.Proto][0], "", "reject")
+	}
+	if len(f.Hosts) > 0 {
+		ok := a.newLabel()
+		for _, h := range f.Hosts {
+			if !h.Is4() {
+				continue
+			}
+			w := be32(h.AsSlice())
+			a.emit(opLdAbsW, nh+12)
+			a.jump(opJeqK, w, ok, "")
+			a.emit(opLdAbsW, nh+16)
+			a.jump(opJeqK, w, ok, "")
+		}
+		a.ja("reject")
+		a.label(ok)
+	}
+	if len(f.Ports) == 0 && f.Skip == [2]uint16{} {
+		a.ja("accept")
+		return
+	}
+
+	// without ports a packet that has none (ICMP, a fragment) still passes
+	noPorts := "accept"
+	if len(f.Ports) > 0 {
+		noPorts = "reject"
+	}
+	tp := a.newLabel()
+	a.emit(opLdAbsB, nh+9)
+	a.jump(opJeqK, 6, tp, "")
+	a.jump(opJeqK, 17, tp, "")
+	a.jump(opJeqK, 132, tp, noPorts)
+	a.label(tp)
+	a.emit(opLdAbsH, nh+6)
+	a.jump(opJsetK, 0x1fff, noPorts, "")
+	a.emit(opLdxMSH, nh)
+	f.compilePorts(a, opLdIndH, nh)
+}
+
+func (f Filter) compileV6(a *asm, nh uint32) {
+	if f.Proto != "" {
+		a.emit(opLdAbsB, nh+6)
+		a.jump(opJeqK, protoNumbers[f.Proto][1], "", "reject")
+	}
+	if len(f.Hosts) > 0 {
+		ok := a.newLabel()
+		for _, h := range f.Hosts {
+			if !h.Is6() || h.Is4In6() {
+				continue
+			}
+			b := h.AsSlice()
+			for _, off := range []uint32{nh + 8, nh + 24} { // src, dst
+				miss := a.newLabel()
+				for i := uint32(0); i < 4; i++ {
+					a.emit(opLdAbsW, off+4*i)
+					if i < 3 {
+						a.jump(opJeqK, be32(b[4*i:]), "", miss)
+					} else {
+						a.jump(opJeqK, be32(b[4*i:]), ok, miss)
+					}
+				}
+				a.label(miss)
+			}
+		}
+		a.ja("reject")
+		a.label(ok)
+	}
+	if len(f.Ports) == 0 && f.Skip == [2]uint16{} {
+		a.ja("accept")
+		return
+	}
+
+	// extension headers would move the ports; like tcpdump's simple
+	// filters, we only look right after the fixed header
+	noPorts := "accept"
+	if len(f.Ports) > 0 {
+		noPorts = "reject"
+	}
+	tp := a.newLabel()
+	a.emit(opLdAbsB, nh+6)
+	a.jump(opJeqK, 6, tp, "")
+	a.jump(opJeqK, 17, tp, "")
+	a.jump(opJeqK, 132, tp, noPorts)
+	a.label(tp)
+	f.compilePorts(a, opLdAbsH, nh+40)
+}
+
+// compilePorts loads the source and destination ports at off with ld (with
+// X already holding the IPv4 header length for indirect loads) and ends in
+// accept or reject.
+func (f Filter) compilePorts(a *asm, ld uint16, off uint32) {
+	if f.Skip != [2]uint16{} {
+		p, q := uint32(f.Skip[0]), uint32(f.Skip[1])
+		alt, cont := a.newLabel(), a.newLabel()
+		a.emit(ld, off)
+		a.jump(opJeqK, p, "", alt)
+		a.emit(ld, off+2)
+		a.jump(opJeqK, q, "reject", alt)
+		a.label(alt)
+		a.emit(ld, off)
+		a.jump(opJeqK, q, "", cont)
+		a.emit(ld, off+2)
+		a.jump(opJeqK, p, "reject", cont)
+		a.label(cont)
+	}
+	if len(f.Ports) == 0 {
+		a.ja("accept")
+		return
+	}
+	for _, p := range f.Ports {
+		a.emit(ld, off)
+		a.jump(opJeqK, uint32(p), "accept", "")
+		a.emit(ld, off+2)
+		a.jump(opJeqK, uint32(p), "accept", "")
+	}
+	a.ja("reject")
+}
+
+func be32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// asm assembles instructions whose jumps name labels. Classic BPF only
+// jumps forward, so every label is placed after the jumps that use it.
+type asm struct {
+	ins    []Instruction
+	fixups []fixup
+	labels map[string]int
+	n      int
+}
+
+type fixup struct {
+	at        int
+	jt, jf, k string
+}
+
+func (a *asm) emit(op uint16, k uint32) {
+	a.ins = append(a.ins, Instruction{Op: op, K: k})
+}
+
+// jump emits a conditional jump; an empty label falls through.
+func (a *asm) jump(op uint16, k uint32, jt, jf string) {
+	a.fixups = append(a.fixups, fixup{at: len(a.ins), jt: jt, jf: jf})
+	a.emit(op, k)
+}
+
+func (a *asm) ja(label string) {
+	a.fixups = append(a.fixups, fixup{at: len(a.ins), k: label})
+	a.emit(opJa, 0)
+}
+
+func (a *asm) label(name string) { a.labels[name] = len(a.ins) }
+
+func (a *asm) newLabel() string {
+	a.n++
+	return "L" + strconv.Itoa(a.n)
+}
+
+func (a *asm) resolve() ([]Instruction, error) {
+	offset := func(at int, label string, max int) (int, error) {
+		if label == "" {
+			return 0, nil
+		}
+		to, ok := a.labels[label]
+		if !ok {
+			return 0, fmt.Errorf("bpf: undefined label %s", label)
+		}
+		d := to - at - 1
+		if d < 0 || d > max {
+			return 0, fmt.Errorf("bpf: filter too long to jump to %s", label)
+		}
+		return d, nil
+	}
+	for _, fx := range a.fixups {
+		in := &a.ins[fx.at]
+		jt, err := offset(fx.at, fx.jt, 255)
+		if err != nil {
+			return nil, err
+		}
+		jf, err := offset(fx.at, fx.jf, 255)
+		if err != nil {
+			return nil, err
+		}
+		k, err := offset(fx.at, fx.k, 1<<31)
+		if err != nil {
+			return nil, err
+		}
+		in.Jt, in.Jf = uint8(jt), uint8(jf)
+		if in.Op == opJa {
+			in.K = uint32(k)
+		}
+	}
+	return a.ins, nil
+}
@@ -0,0 +1,310 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// run interprets prog on pkt the way the kernel does, returning how many
+// bytes it keeps. A load past the end of the packet drops it.
+func run(t *testing.T, prog []Instruction, pkt []byte) uint32 {
+	t.Helper()
+	var a, x uint32
+	for pc := 0; pc < len(prog); pc++ {
+		in := prog[pc]
+		load := func(off uint32, size int) bool {
+			if int(off)+size > len(pkt) {
+				return false
+			}
+			switch size {
+			case 1:
+				a = uint32(pkt[off])
+			case 2:
+				a = uint32(binary.BigEndian.Uint16(pkt[off:]))
+			case 4:
+				a = binary.BigEndian.Uint32(pkt[off:])
+			}
+			return true
+		}
+		ok := true
+		switch in.Op {
+		case opLdAbsW:
+			ok = load(in.K, 4)
+		case opLdAbsH:
+			ok = load(in.K, 2)
+		case opLdAbsB:
+			ok = load(in.K, 1)
+		case opLdIndH:
+			ok = load(x+in.K, 2)
+		case opLdxMSH:
+			if int(in.K) >= len(pkt) {
+				return 0
+			}
+			x = 4 * uint32(pkt[in.K]&0xf)
+		case opAndK:
+			a &= in.K
+		case opJa:
+			pc += int(in.K)
+		case opJeqK:
+			if a == in.K {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case opJsetK:
+			if a&in.K != 0 {
+				pc += int(in.Jt)
+			} else {
+				pc += int(in.Jf)
+			}
+		case opRetK:
+			return in.K
+		default:
+			t.Fatalf("instruction %d: unknown opcode %#x", pc, in.Op)
+		}
+		if !ok {
+			return 0
+		}
+	}
+	t.Fatal("ran off the end of the program")
+	return 0
+}
+
+// transport is the first 8 bytes of a TCP, UDP or SCTP header: ports, then
+// padding.
+func transport(sport, dport uint16) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b, sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	return b
+}
+
+func ipv4(proto uint8, src, dst string, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(20+len(payload)))
+	b[8], b[9] = 64, proto
+	copy(b[12:], netip.MustParseAddr(src).AsSlice())
+	copy(b[16:], netip.MustParseAddr(dst).AsSlice())
+	return append(b, payload...)
+}
+
+// withOptions adds 4 bytes of IPv4 options, moving the ports.
+func withOptions(pkt []byte) []byte {
+	b := append(append(append([]byte{}, pkt[:20]...), 1, 1, 1, 0), pkt[20:]...)
+	b[0] = 0x46
+	return b
+}
+
+// fragment makes pkt a later fragment, whose payload has no ports.
+func fragment(pkt []byte) []byte {
+	b := append([]byte{}, pkt...)
+	binary.BigEndian.PutUint16(b[6:], 185)
+	return b
+}
+
+func ipv6(next uint8, src, dst string, payload []byte) []byte {
+	b := make([]byte, 40, 40+len(payload))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(len(payload)))
+	b[6], b[7] = next, 64
+	copy(b[8:], netip.MustParseAddr(src).AsSlice())
+	copy(b[24:], netip.MustParseAddr(dst).AsSlice())
+	return append(b, payload...)
+}
+
+func ether(l3 []byte) []byte {
+	b := make([]byte, 14, 14+len(l3))
+	switch l3[0] >> 4 {
+	case 4:
+		binary.BigEndian.PutUint16(b[12:], 0x0800)
+	case 6:
+		binary.BigEndian.PutUint16(b[12:], 0x86dd)
+	}
+	return append(b, l3...)
+}
+
+// arp is an ARP frame, with no IP header at all.
+var arp = func() []byte {
+	b := make([]byte, 42)
+	b[12], b[13] = 0x08, 0x06
+	return b
+}()
+
+func TestCompile(t *testing.T) {
+	const snaplen = 65535
+	tcp := func(sport, dport uint16) []byte {
+		return ether(ipv4(6, "10.0.0.2", "10.0.0.1", transport(sport, dport)))
+	}
+	icmp := ether(ipv4(1, "10.0.0.2", "10.0.0.1", []byte{8, 0, 0, 0, 0, 0, 0, 0}))
+	type packet struct {
+		name string
+		pkt  []byte
+		want bool
+	}
+	tests := []struct {
+		name    string
+		filter  Filter
+		link    LinkType
+		packets []packet
+	}{
+		{
+			name: "everything",
+			link: LinkEthernet,
+			packets: []packet{
+				{"tcp", tcp(40000, 8080), true},
+				{"arp", arp, true},
+			},
+		},
+		{
+			name:   "port",
+			filter: Filter{Ports: []uint16{8080, 53}},
+			link:   LinkEthernet,
+			packets: []packet{
+				{"to the port", tcp(40000, 8080), true},
+				{"from the port", tcp(8080, 40000), true},
+				{"the other port", ether(ipv4(17, "10.0.0.2", "10.0.0.1", transport(40000, 53))), true},
+				{"neither", tcp(40000, 80), false},
+				{"after options", ether(withOptions(ipv4(6, "10.0.0.2", "10.0.0.1", transport(40000, 8080)))), true},
+				{"port in the options' place", ether(withOptions(ipv4(6, "10.0.0.2", "10.0.0.1", transport(40000, 80)))), false},
+				{"sctp", ether(ipv4(132, "10.0.0.2", "10.0.0.1", transport(40000, 8080))), true},
+				{"later fragment", ether(fragment(ipv4(6, "10.0.0.2", "10.0.0.1", transport(40000, 8080)))), false},
+				{"icmp", icmp, false},
+				{"ipv6", ether(ipv6(6, "fd00::2", "fd00::1", transport(40000, 8080))), true},
+				{"ipv6 other port", ether(ipv6(6, "fd00::2", "fd00::1", transport(40000, 80))), false},
+				{"ipv6 extension header", ether(ipv6(0, "fd00::2", "fd00::1", transport(40000, 8080))), false},
+				{"arp", arp, false},
+				{"truncated", tcp(40000, 8080)[:36], false},
+			},
+		},
+		{
+			name: "host, protocol and port",
+			filter: Filter{
+				Proto: "udp",
+				Hosts: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+				Ports: []uint16{53},
+			},
+			link: LinkEthernet,
+			packets: []packet{
+				{"to the host", ether(ipv4(17, "10.0.0.2", "10.0.0.1", transport(40000, 53))), true},
+				{"from the host", ether(ipv4(17, "10.0.0.1", "10.0.0.2", transport(53, 40000))), true},
+				{"tcp", ether(ipv4(6, "10.0.0.2", "10.0.0.1", transport(40000, 53))), false},
+				{"other host", ether(ipv4(17, "10.0.0.2", "10.0.0.3", transport(40000, 53))), false},
+				{"other port", ether(ipv4(17, "10.0.0.2", "10.0.0.1", transport(40000, 54))), false},
+				{"ipv6 to the host", ether(ipv6(17, "fd00::2", "fd00::1", transport(40000, 53))), true},
+				{"ipv6 from the host", ether(ipv6(17, "fd00::1", "fd00::2", transport(53, 40000))), true},
+				{"ipv6 first word differs", ether(ipv6(17, "fd00::2", "fd01::1", transport(40000, 53))), false},
+				{"ipv6 last word differs", ether(ipv6(17, "fd00::2", "fd00::1:1", transport(40000, 53))), false},
+				{"ipv6 tcp", ether(ipv6(6, "fd00::2", "fd00::1", transport(40000, 53))), false},
+			},
+		},
+		{
+			name: "raw",
+			filter: Filter{
+				Proto: "udp",
+				Hosts: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+				Ports: []uint16{53},
+			},
+			link: LinkRaw,
+			packets: []packet{
+				{"ipv4", ipv4(17, "10.0.0.2", "10.0.0.1", transport(40000, 53)), true},
+				{"ipv4 other port", ipv4(17, "10.0.0.2", "10.0.0.1", transport(40000, 54)), false},
+				{"ipv6", ipv6(17, "fd00::2", "fd00::1", transport(40000, 53)), true},
+				{"not ip", []byte{0x20, 0, 0, 0}, false},
+			},
+		},
+		{
+			name:   "icmp",
+			filter: Filter{Proto: "icmp"},
+			link:   LinkEthernet,
+			packets: []packet{
+				{"icmp", icmp, true},
+				{"icmpv6", ether(ipv6(58, "fd00::2", "fd00::1", []byte{128, 0, 0, 0})), true},
+				{"tcp", tcp(40000, 8080), false},
+			},
+		},
+		{
+			// not (port 8080 and port 40000): the capture's own connection
+			name:   "negated",
+			filter: Filter{Skip: [2]uint16{8080, 40000}},
+			link:   LinkEthernet,
+			packets: []packet{
+				{"the connection", tcp(40000, 8080), false},
+				{"the connection, replying", tcp(8080, 40000), false},
+				{"both ports the same", tcp(8080, 8080), true},
+				{"another client", tcp(40001, 8080), true},
+				{"ipv6", ether(ipv6(6, "fd00::2", "fd00::1", transport(8080, 40000))), false},
+				{"ipv6 another client", ether(ipv6(6, "fd00::2", "fd00::1", transport(8080, 40001))), true},
+				{"icmp", icmp, true},
+				{"later fragment", ether(fragment(ipv4(6, "10.0.0.2", "10.0.0.1", transport(40000, 8080)))), true},
+				{"arp", arp, true},
+			},
+		},
+		{
+			name:   "port, negated",
+			filter: Filter{Ports: []uint16{8080}, Skip: [2]uint16{8080, 40000}},
+			link:   LinkEthernet,
+			packets: []packet{
+				{"the connection", tcp(40000, 8080), false},
+				{"another client", tcp(40001, 8080), true},
+				{"another port", tcp(40000, 80), false},
+				{"arp", arp, false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prog, err := tt.filter.Compile(tt.link, snaplen)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range tt.packets {
+				want := uint32(0)
+				if p.want {
+					want = snaplen
+				}
+				if got := run(t, prog, p.pkt); got != want {
+					t.Errorf("%s: %q keeps %d bytes, want %d", p.name, tt.filter, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	many := make([]uint16, maxFilter+1)
+	for _, tt := range []struct {
+		filter Filter
+		link   LinkType
+		want   string
+	}{
+		{Filter{Proto: "gre"}, LinkEthernet, "unknown protocol"},
+		{Filter{Proto: "icmp", Ports: []uint16{53}}, LinkEthernet, "icmp has no ports"},
+		{Filter{Ports: many}, LinkEthernet, "at most"},
+		{Filter{Proto: "tcp"}, 113, "link type 113"},
+	} {
+		if _, err := tt.filter.Compile(tt.link, 65535); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q on %d: err = %v, want %q", tt.filter, tt.link, err, tt.want)
+		}
+	}
+}
+
+func TestFilterString(t *testing.T) {
+	for _, tt := range []struct {
+		filter Filter
+		want   string
+	}{
+		{Filter{}, ""},
+		{Filter{Proto: "udp", Ports: []uint16{53}}, "udp and port 53"},
+		{
+			Filter{Hosts: []netip.Addr{netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")}, Ports: []uint16{80, 443}, Skip: [2]uint16{8080, 40000}},
+			"(host 10.0.0.1 or host fd00::1) and (port 80 or port 443) and not (port 8080 and port 40000)",
+		},
+	} {
+		if got := tt.filter.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
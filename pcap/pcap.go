@@ -0,0 +1,61 @@
+// Package pcap captures packets with an AF_PACKET socket and writes them in
+// the classic libpcap file format, which Wireshark and tcpdump -r read. It
+// is what tcpdump does, minus tcpdump: the app image has no shell, let alone
+// capture tools.
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// LinkType says what header each packet starts with, using the numbers
+// from https://www.tcpdump.org/linktypes.html.
+type LinkType uint32
+
+const (
+	// LinkEthernet is used for eth0, veths and loopback (whose header is an
+	// Ethernet header of zeros).
+	LinkEthernet LinkType = 1
+	// LinkRaw packets start at the IP header, as on tunl0 (Calico IPIP)
+	// and WireGuard interfaces.
+	LinkRaw LinkType = 101
+)
+
+// Writer writes a pcap stream.
+type Writer struct {
+	w   io.Writer
+	buf []byte
+}
+
+// NewWriter writes the file header and returns a Writer for packets of the
+// given link type, each cut to at most snaplen bytes.
+func NewWriter(w io.Writer, snaplen uint32, link LinkType) (*Writer, error) {
+	h := make([]byte, 0, 24)
+	h = binary.LittleEndian.AppendUint32(h, 0xa1b2c3d4) // microsecond timestamps
+	h = binary.LittleEndian.AppendUint16(h, 2)
+	h = binary.LittleEndian.AppendUint16(h, 4)
+	h = binary.LittleEndian.AppendUint32(h, 0) // GMT
+	h = binary.LittleEndian.AppendUint32(h, 0) // accuracy
+	h = binary.LittleEndian.AppendUint32(h, snaplen)
+	h = binary.LittleEndian.AppendUint32(h, uint32(link))
+	if _, err := w.Write(h); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w}, nil
+}
+
+// WritePacket writes one packet captured at ts. data may be shorter than
+// origLen, the length it had on the wire.
+func (pw *Writer) WritePacket(ts time.Time, data []byte, origLen int) error {
+	b := pw.buf[:0]
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts.Unix()))
+	b = binary.LittleEndian.AppendUint32(b, uint32(ts.Nanosecond()/1000))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(origLen))
+	b = append(b, data...)
+	pw.buf = b
+	_, err := pw.w.Write(b)
+	return err
+}
@@ -0,0 +1,136 @@
+//go:build linux
+
+package pcap
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Source is an AF_PACKET socket bound to one interface.
+type Source struct {
+	f        *os.File
+	rc       syscall.RawConn
+	link     LinkType
+	loopback bool
+}
+
+// Open starts capturing on iface, keeping packets that match filter. It
+// needs CAP_NET_RAW; without it the error wraps os.ErrPermission.
+func Open(iface string, filter Filter, snaplen uint32) (*Source, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	link, err := linkType(ifi)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := filter.Compile(link, snaplen)
+	if err != nil {
+		return nil, err
+	}
+
+	proto := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, int(proto))
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	// attach the filter before binding so nothing unfiltered queues up
+	lsf := make([]syscall.SockFilter, len(prog))
+	for i, in := range prog {
+		lsf[i] = syscall.SockFilter{Code: in.Op, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+	if err := syscall.AttachLsf(fd, lsf); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt SO_ATTACH_FILTER", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: proto, Ifindex: ifi.Index}); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	// anything that arrived on other interfaces before the bind
+	buf := make([]byte, 1)
+	for {
+		if _, _, err := syscall.Recvfrom(fd, buf, 0); err != nil {
+			break
+		}
+	}
+
+	// a non-blocking fd goes through the runtime poller, so deadlines work
+	f := os.NewFile(uintptr(fd), "packet:"+iface)
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Source{f: f, rc: rc, link: link, loopback: ifi.Flags&net.FlagLoopback != 0}, nil
+}
+
+// linkType maps the interface's ARPHRD_* type from sysfs onto a pcap link
+// type.
+func linkType(ifi *net.Interface) (LinkType, error) {
+	b, err := os.ReadFile("/sys/class/net/" + ifi.Name + "/type")
+	if err != nil {
+		// no sysfs: guess from the hardware address
+		if len(ifi.HardwareAddr) == 6 || ifi.Flags&net.FlagLoopback != 0 {
+			return LinkEthernet, nil
+		}
+		return LinkRaw, nil
+	}
+	hatype, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, err
+	}
+	switch hatype {
+	case 1, 772: // ARPHRD_ETHER, ARPHRD_LOOPBACK
+		return LinkEthernet, nil
+	case 768, 776, 778, 65534: // ARPHRD_TUNNEL, _SIT, _IPGRE, _NONE
+		return LinkRaw, nil
+	}
+	return 0, fmt.Errorf("%s: unsupported hardware type %d", ifi.Name, hatype)
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// LinkType is the header the packets start with.
+func (s *Source) LinkType() LinkType { return s.link }
+
+// ReadPacket reads the next packet into buf. origLen is its length on the
+// wire, which is more than n when the packet was cut to fit.
+func (s *Source) ReadPacket(buf []byte) (n, origLen int, err error) {
+	for {
+		var (
+			from  syscall.Sockaddr
+			opErr error
+		)
+		err = s.rc.Read(func(fd uintptr) bool {
+			origLen, from, opErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_TRUNC)
+			return opErr != syscall.EAGAIN
+		})
+		if err == nil {
+			err = opErr
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		// loopback shows every packet twice, once going out and once
+		// coming in; like tcpdump, keep the second
+		if ll, ok := from.(*syscall.SockaddrLinklayer); ok && s.loopback && ll.Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		return min(origLen, len(buf)), origLen, nil
+	}
+}
+
+// SetDeadline makes a blocked ReadPacket return os.ErrDeadlineExceeded at
+// t.
+func (s *Source) SetDeadline(t time.Time) error { return s.f.SetReadDeadline(t) }
+
+// Close stops the capture.
+func (s *Source) Close() error { return s.f.Close() }
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package pcap
+
+import (
+	"errors"
+	"time"
+)
+
+// Source is an AF_PACKET socket, which only Linux has.
+type Source struct{}
+
+// Open always fails: AF_PACKET is Linux only.
+func Open(iface string, filter Filter, snaplen uint32) (*Source, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func (s *Source) LinkType() LinkType { return 0 }
+
+func (s *Source) ReadPacket(buf []byte) (n, origLen int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
+
+func (s *Source) SetDeadline(t time.Time) error { return errors.ErrUnsupported }
+
+func (s *Source) Close() error { return nil }
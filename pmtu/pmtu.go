@@ -0,0 +1,108 @@
+// Package pmtu finds the largest packet that gets from here to a target in
+// one piece. Inside a pod that's usually smaller than the node's 1500:
+// Calico's IPIP and VXLAN tunnels spend part of every packet on their own
+// headers, and when the pod's MTU doesn't allow for that, big packets
+// vanish while small ones (handshakes, health checks) sail through.
+package pmtu
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// Probe is one packet sent with Don't Fragment set.
+type Probe struct {
+	// Size is the whole IP packet, headers included, so it compares
+	// directly with an MTU.
+	Size   int    `json:"size"`
+	Result string `json:"result"`
+}
+
+// Probe results.
+const (
+	ProbeOK      = "ok"
+	ProbeNoReply = "no reply"
+	ProbeTooBig  = "too big for the interface"
+)
+
+// Result is what we learned about the path to a target.
+type Result struct {
+	Local        netip.AddrPort `json:"local"`
+	Interface    string         `json:"interface"`
+	InterfaceMTU int            `json:"interface_mtu"`
+	PathMTU      int            `json:"path_mtu"`
+	// Method is how PathMTU was found: "udp echo" (the largest probe the
+	// target echoed), "icmp" (what the kernel learned from "fragmentation
+	// needed" errors) or "tcp mss" (the segment size TCP settled on).
+	Method string `json:"method"`
+	// KernelMTU is the route's MTU as the kernel knows it after probing. It
+	// only drops below InterfaceMTU when a router on the path says so.
+	KernelMTU int     `json:"kernel_mtu"`
+	Probes    []Probe `json:"probes,omitempty"`
+
+	// SendMSS is the largest TCP payload we send: the smaller of what the
+	// peer advertised and what our own path allows. AdvMSS is what we
+	// advertised.
+	SendMSS int `json:"send_mss,omitempty"`
+	AdvMSS  int `json:"adv_mss,omitempty"`
+}
+
+// InterfaceOf returns the interface that has ip.
+func InterfaceOf(ip netip.Addr) (*net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if p, ok := a.(*net.IPNet); ok {
+				if addr, ok := netip.AddrFromSlice(p.IP); ok && addr.Unmap() == ip.Unmap() {
+					return &ifaces[i], nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no interface has %v", ip)
+}
+
+// ipHeader is the IP header in front of every probe.
+func ipHeader(ip netip.Addr) int {
+	if ip.Unmap().Is4() {
+		return 20
+	}
+	return 40
+}
+
+// minProbe is the smallest packet worth probing with: comfortably under
+// IPv6's 1280 minimum, which every link has to carry.
+const minProbe = 576
+
+// ProbeToken starts the payload of every UDP probe. An echo server should
+// send such datagrams back byte for byte: a reply any bigger than the probe
+// could be lost on a narrower return path, and the search would report an
+// MTU smaller than the one it went looking for.
+const ProbeToken = "pmtu "
+
+// search returns the largest size from lo to hi that fits, given that lo
+// does. It tries hi first, since most paths are clear, then halves the
+// range until ctx ends.
+func search(ctx context.Context, lo, hi int, fits func(size int) bool) int {
+	if fits(hi) {
+		return hi
+	}
+	for hi-lo > 1 && ctx.Err() == nil {
+		mid := (lo + hi) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
@@ -0,0 +1,196 @@
+//go:build linux
+
+package pmtu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ProbeUDP sends Don't Fragment datagrams to target. If target echoes them
+// back unchanged (learn-k8s -udp-echo, or any RFC 862 echo server) it binary
+// searches for the largest one that makes the round trip, which finds black
+// holes too. Otherwise it can only report what ICMP taught the kernel.
+func ProbeUDP(ctx context.Context, target netip.AddrPort, timeout time.Duration) (Result, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	res, err := localInfo(conn.LocalAddr().(*net.UDPAddr).AddrPort())
+	if err != nil {
+		return res, err
+	}
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return res, err
+	}
+	// DF on, and send even what the kernel believes won't fit, so a stale
+	// path MTU can't hide the real one
+	level, opt, mtuOpt, probe := ipOpts(target.Addr())
+	if err := setsockopt(rc, level, opt, probe); err != nil {
+		return res, os.NewSyscallError("setsockopt", err)
+	}
+
+	hdr := ipHeader(target.Addr()) + 8
+	seq := 0
+	try := func(size int) string {
+		for attempt := 0; attempt < 2; attempt++ {
+			seq++
+			token := fmt.Appendf(nil, "%s%d ", ProbeToken, seq)
+			payload := append(token, bytes.Repeat([]byte{'x'}, size-hdr-len(token))...)
+			if _, err := conn.Write(payload); err != nil {
+				if errors.Is(err, syscall.EMSGSIZE) {
+					return ProbeTooBig
+				}
+				return err.Error()
+			}
+			if r := awaitEcho(conn, token, timeout); r != ProbeNoReply {
+				return r
+			}
+		}
+		return ProbeNoReply
+	}
+	record := func(size int) bool {
+		r := try(size)
+		res.Probes = append(res.Probes, Probe{Size: size, Result: r})
+		return r == ProbeOK
+	}
+
+	if !record(minProbe) {
+		// nothing echoes: send full-size probes and see whether a router
+		// answers "fragmentation needed"
+		for i := 0; i < 2; i++ {
+			conn.Write(make([]byte, res.InterfaceMTU-hdr))
+			time.Sleep(timeout / 2)
+		}
+		res.Method = "icmp"
+		res.KernelMTU, _ = getsockopt(rc, level, mtuOpt)
+		res.PathMTU = res.KernelMTU
+		return res, ctx.Err()
+	}
+
+	res.Method = "udp echo"
+	res.PathMTU = search(ctx, minProbe, res.InterfaceMTU, record)
+	res.KernelMTU, _ = getsockopt(rc, level, mtuOpt)
+	return res, ctx.Err()
+}
+
+// awaitEcho reads until the reply carrying token turns up, skipping late
+// answers to earlier probes.
+func awaitEcho(conn *net.UDPConn, token []byte, timeout time.Duration) string {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := conn.Read(buf)
+		switch {
+		case errors.Is(err, syscall.ECONNREFUSED):
+			return "port unreachable"
+		case err != nil:
+			return ProbeNoReply
+		case bytes.Contains(buf[:n], token):
+			return ProbeOK
+		}
+	}
+}
+
+// ProbeTCP connects to target and reports the MSS the two ends agreed on.
+// Each side advertises its own interface MTU less headers, and the kernel
+// lowers the send MSS further if ICMP says the path is narrower.
+func ProbeTCP(ctx context.Context, target netip.AddrPort, timeout time.Duration) (Result, error) {
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", target.String())
+	if err != nil {
+		return Result{}, err
+	}
+	defer conn.Close()
+
+	res, err := localInfo(conn.LocalAddr().(*net.TCPAddr).AddrPort())
+	if err != nil {
+		return res, err
+	}
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return res, err
+	}
+	var info syscall.TCPInfo
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(info))
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&size)), 0)
+		if errno != 0 {
+			serr = errno
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		return res, os.NewSyscallError("getsockopt TCP_INFO", err)
+	}
+
+	res.Method = "tcp mss"
+	res.KernelMTU = int(info.Pmtu)
+	res.SendMSS = int(info.Snd_mss)
+	res.AdvMSS = int(info.Advmss)
+	// the MSS doesn't count the IP and TCP headers, nor the 12 bytes of
+	// timestamps when they're on
+	res.PathMTU = res.SendMSS + ipHeader(target.Addr()) + 20
+	if info.Options&1 != 0 { // TCPI_OPT_TIMESTAMPS
+		res.PathMTU += 12
+	}
+	return res, nil
+}
+
+func localInfo(local netip.AddrPort) (Result, error) {
+	res := Result{Local: local}
+	ifi, err := InterfaceOf(local.Addr())
+	if err != nil {
+		return res, err
+	}
+	res.Interface, res.InterfaceMTU = ifi.Name, ifi.MTU
+	return res, nil
+}
+
+// ipOpts returns the socket option level, the PMTU discovery option and its
+// "probe" value, and the option that reads the path MTU back.
+func ipOpts(ip netip.Addr) (level, discover, mtu, probe int) {
+	if ip.Unmap().Is4() {
+		return syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_MTU, syscall.IP_PMTUDISC_PROBE
+	}
+	return syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_MTU, syscall.IPV6_PMTUDISC_PROBE
+}
+
+func setsockopt(rc syscall.RawConn, level, opt, v int) error {
+	var serr error
+	err := rc.Control(func(fd uintptr) { serr = syscall.SetsockoptInt(int(fd), level, opt, v) })
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+func getsockopt(rc syscall.RawConn, level, opt int) (int, error) {
+	var (
+		v    int
+		serr error
+	)
+	err := rc.Control(func(fd uintptr) { v, serr = syscall.GetsockoptInt(int(fd), level, opt) })
+	if err != nil {
+		return 0, err
+	}
+	return v, serr
+}
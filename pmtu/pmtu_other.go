@@ -0,0 +1,20 @@
+//go:build !linux
+
+package pmtu
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"time"
+)
+
+// ProbeUDP needs Linux's IP_MTU_DISCOVER and IP_MTU socket options.
+func ProbeUDP(ctx context.Context, target netip.AddrPort, timeout time.Duration) (Result, error) {
+	return Result{}, errors.ErrUnsupported
+}
+
+// ProbeTCP needs Linux's TCP_INFO.
+func ProbeTCP(ctx context.Context, target netip.AddrPort, timeout time.Duration) (Result, error) {
+	return Result{}, errors.ErrUnsupported
+}
@@ -0,0 +1,67 @@
+package pmtu
+
+import (
+	"context"
+	"math/bits"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		name   string
+		lo, hi int
+		path   int // the largest packet that gets through
+		want   int
+	}{
+		{"clear path", 576, 1500, 1500, 1500},
+		{"vxlan", 576, 1500, 1450, 1450},
+		{"ipip", 576, 1500, 1480, 1480},
+		{"one short of the interface", 576, 1500, 1499, 1499},
+		{"only the smallest", 576, 1500, 576, 576},
+		{"one over the smallest", 576, 1500, 577, 577},
+		{"jumbo frames", 576, 9001, 8951, 8951},
+		// a path wider than the interface is still capped by it
+		{"interface is the limit", 576, 1280, 1500, 1280},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var probes []int
+			got := search(context.Background(), tt.lo, tt.hi, func(size int) bool {
+				if size < tt.lo || size > tt.hi {
+					t.Errorf("probed %d, outside %d-%d", size, tt.lo, tt.hi)
+				}
+				probes = append(probes, size)
+				return size <= tt.path
+			})
+			if got != tt.want {
+				t.Errorf("path MTU %d, want %d (probes %v)", got, tt.want, probes)
+			}
+			if probes[0] != tt.hi {
+				t.Errorf("first probe %d, want the interface's %d", probes[0], tt.hi)
+			}
+			// hi, then a binary search
+			if most := 1 + bits.Len(uint(tt.hi-tt.lo)); len(probes) > most {
+				t.Errorf("%d probes %v, want at most %d", len(probes), probes, most)
+			}
+		})
+	}
+}
+
+func TestSearchCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	probes := 0
+	got := search(ctx, 576, 1500, func(size int) bool {
+		probes++
+		if probes == 3 {
+			cancel()
+		}
+		return size <= 1450
+	})
+	if probes != 3 {
+		t.Errorf("%d probes, want it to stop at the third, when ctx ended", probes)
+	}
+	// the best answer so far, which did make the round trip
+	if got < 576 || got > 1450 {
+		t.Errorf("path MTU %d, want one that was echoed", got)
+	}
+}
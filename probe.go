@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// probeCmd does a GET against the server and exits non-zero unless it gets a
+// 2xx. Kubernetes httpGet probes can't reach a unix socket, but an exec probe
+// running this binary can:
+//
+//	livenessProbe:
+//	  exec:
+//	    command: ["/server", "probe", "-socket", "unix:///run/app/app.sock"]
+func probeCmd(args []string) error {
+	fs := flag.NewFlagSet("probe", flag.ExitOnError)
+	addr := fs.String("socket", socket, "server address: host:port or unix:///path")
+	path := fs.String("path", "/", "request path")
+	timeout := fs.Duration("timeout", time.Second, "request timeout")
+	verbose := fs.Bool("v", false, "print the response body")
+	fs.Parse(args)
+
+	client := &http.Client{Timeout: *timeout}
+	host := *addr
+	if sock, ok := strings.CutPrefix(*addr, "unix://"); ok {
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", sock)
+			},
+		}
+		host = "unix"
+	} else if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+
+	resp, err := client.Get("http://" + host + *path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if *verbose {
+		io.Copy(os.Stdout, resp.Body)
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", *path, resp.Status)
+	}
+	return nil
+}
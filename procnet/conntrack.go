@@ -0,0 +1,175 @@
+// Package procnet parses the tables Linux publishes under /proc/net, for
+// images too small to carry conntrack, ss or netstat. Each table describes
+// the network namespace of the process reading it: inside a pod that's the
+// pod's own namespace, not the node's.
+package procnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Tuple is one direction of a tracked connection.
+type Tuple struct {
+	Src     netip.Addr `json:"src"`
+	Dst     netip.Addr `json:"dst"`
+	SrcPort uint16     `json:"sport,omitempty"`
+	DstPort uint16     `json:"dport,omitempty"`
+	// Packets and Bytes are only filled in when nf_conntrack_acct is on.
+	Packets uint64 `json:"packets,omitempty"`
+	Bytes   uint64 `json:"bytes,omitempty"`
+}
+
+func (t Tuple) String() string {
+	if t.SrcPort == 0 && t.DstPort == 0 {
+		return fmt.Sprintf("%s -> %s", t.Src, t.Dst)
+	}
+	return fmt.Sprintf("%s -> %s",
+		netip.AddrPortFrom(t.Src, t.SrcPort), netip.AddrPortFrom(t.Dst, t.DstPort))
+}
+
+// Conntrack is one line of /proc/net/nf_conntrack.
+type Conntrack struct {
+	Family  string `json:"family"`
+	Proto   string `json:"proto"`
+	Timeout int    `json:"timeout"`
+	State   string `json:"state,omitempty"` // TCP only
+	// Original is the packet as the client sent it; Reply is what the
+	// answer is expected to look like. They differ when NAT is involved.
+	Original Tuple    `json:"original"`
+	Reply    Tuple    `json:"reply"`
+	Flags    []string `json:"flags,omitempty"` // ASSURED, UNREPLIED, ...
+	Mark     uint32   `json:"mark"`
+	Zone     int      `json:"zone,omitempty"`
+}
+
+// DNAT reports whether the destination was rewritten, which is what
+// kube-proxy does to send Service traffic to a pod.
+func (c Conntrack) DNAT() bool {
+	return c.Reply.Src != c.Original.Dst || c.Reply.SrcPort != c.Original.DstPort
+}
+
+// SNAT reports whether the source was rewritten (masquerade), so the pod
+// sees a node address instead of the client.
+func (c Conntrack) SNAT() bool {
+	return c.Reply.Dst != c.Original.Src || c.Reply.DstPort != c.Original.SrcPort
+}
+
+// NAT names the rewrites applied: "DNAT", "SNAT", "DNAT+SNAT" or "".
+func (c Conntrack) NAT() string {
+	switch d, s := c.DNAT(), c.SNAT(); {
+	case d && s:
+		return "DNAT+SNAT"
+	case d:
+		return "DNAT"
+	case s:
+		return "SNAT"
+	}
+	return ""
+}
+
+// HasPort reports whether either tuple uses port p on either side.
+func (c Conntrack) HasPort(p uint16) bool {
+	for _, t := range []Tuple{c.Original, c.Reply} {
+		if t.SrcPort == p || t.DstPort == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseConntrack reads /proc/net/nf_conntrack, or the older
+// /proc/net/ip_conntrack which leaves out the leading family columns.
+func ParseConntrack(r io.Reader) ([]Conntrack, error) {
+	var out []Conntrack
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		c, err := parseConntrackLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		out = append(out, c)
+	}
+	return out, sc.Err()
+}
+
+func parseConntrackLine(fields []string) (Conntrack, error) {
+	var c Conntrack
+	if fields[0] == "ipv4" || fields[0] == "ipv6" {
+		c.Family, fields = fields[0], fields[2:]
+	}
+	if len(fields) < 3 {
+		return c, fmt.Errorf("too few fields")
+	}
+	c.Proto = fields[0]
+	t, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return c, fmt.Errorf("bad timeout %q", fields[2])
+	}
+	c.Timeout = t
+
+	// The original tuple's keys come first, then the same keys again for
+	// the reply; seeing src= a second time moves us to the reply.
+	tuple, seenSrc := &c.Original, false
+	for _, f := range fields[3:] {
+		if strings.HasPrefix(f, "[") && strings.HasSuffix(f, "]") {
+			c.Flags = append(c.Flags, f[1:len(f)-1])
+			continue
+		}
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			if c.State == "" && strings.ToUpper(f) == f {
+				c.State = f
+			}
+			continue
+		}
+		switch k {
+		case "src":
+			if seenSrc {
+				tuple = &c.Reply
+			}
+			seenSrc = true
+			if tuple.Src, err = netip.ParseAddr(v); err != nil {
+				return c, err
+			}
+		case "dst":
+			if tuple.Dst, err = netip.ParseAddr(v); err != nil {
+				return c, err
+			}
+		case "sport", "dport":
+			p, err := strconv.ParseUint(v, 10, 16)
+			if err != nil {
+				return c, fmt.Errorf("bad %s %q", k, v)
+			}
+			if k == "sport" {
+				tuple.SrcPort = uint16(p)
+			} else {
+				tuple.DstPort = uint16(p)
+			}
+		case "packets":
+			tuple.Packets, _ = strconv.ParseUint(v, 10, 64)
+		case "bytes":
+			tuple.Bytes, _ = strconv.ParseUint(v, 10, 64)
+		case "mark":
+			m, _ := strconv.ParseUint(v, 10, 32)
+			c.Mark = uint32(m)
+		case "zone":
+			c.Zone, _ = strconv.Atoi(v)
+		}
+	}
+	if c.Family == "" {
+		c.Family = "ipv4"
+		if c.Original.Src.Is6() {
+			c.Family = "ipv6"
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,148 @@
+package procnet
+
+import (
+	"net/netip"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, name string) *os.File {
+	t.Helper()
+	f, err := os.Open("../examples/procnet/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// tuple builds a Tuple from "addr:port" pairs, or bare addresses.
+func tuple(src, dst string) Tuple {
+	var t Tuple
+	if ap, err := netip.ParseAddrPort(src); err == nil {
+		t.Src, t.SrcPort = ap.Addr(), ap.Port()
+	} else {
+		t.Src = netip.MustParseAddr(src)
+	}
+	if ap, err := netip.ParseAddrPort(dst); err == nil {
+		t.Dst, t.DstPort = ap.Addr(), ap.Port()
+	} else {
+		t.Dst = netip.MustParseAddr(dst)
+	}
+	return t
+}
+
+func TestParseConntrackFixture(t *testing.T) {
+	got, err := ParseConntrack(open(t, "nf_conntrack"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assured := []string{"ASSURED"}
+	tests := []struct {
+		want Conntrack
+		nat  string
+	}{
+		// a NodePort from outside: DNAT to the pod, SNAT to the node
+		{Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 86397, State: "ESTABLISHED",
+			Original: tuple("172.19.0.1:52814", "172.19.0.3:30080"), Reply: tuple("10.244.2.3:8080", "172.19.0.3:52814"), Flags: assured}, "DNAT+SNAT"},
+		// a ClusterIP from a pod: DNAT only
+		{Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 117, State: "TIME_WAIT",
+			Original: tuple("10.244.1.5:40122", "10.96.183.20:80"), Reply: tuple("10.244.1.2:8080", "10.244.1.5:40122"), Flags: assured}, "DNAT"},
+		{Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 86399, State: "ESTABLISHED",
+			Original: tuple("10.244.1.2:47710", "10.96.0.1:443"), Reply: tuple("172.19.0.4:6443", "10.244.1.2:47710"), Flags: assured}, "DNAT"},
+		{Conntrack{Family: "ipv4", Proto: "udp", Timeout: 28,
+			Original: tuple("10.244.1.2:38181", "10.96.0.10:53"), Reply: tuple("10.244.0.3:53", "10.244.1.2:38181")}, "DNAT"},
+		{Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 431999, State: "ESTABLISHED",
+			Original: tuple("127.0.0.1:36012", "127.0.0.1:8080"), Reply: tuple("127.0.0.1:8080", "127.0.0.1:36012"), Flags: assured}, ""},
+		// VXLAN nobody answered
+		{Conntrack{Family: "ipv4", Proto: "udp", Timeout: 29,
+			Original: tuple("172.19.0.3:4789", "172.19.0.2:4789"), Reply: tuple("172.19.0.2:4789", "172.19.0.3:4789"), Flags: []string{"UNREPLIED"}}, ""},
+		// no ports; type, code and id are ignored
+		{Conntrack{Family: "ipv4", Proto: "icmp", Timeout: 29,
+			Original: tuple("172.19.0.1", "172.19.0.3"), Reply: tuple("172.19.0.3", "172.19.0.1")}, ""},
+		{Conntrack{Family: "ipv6", Proto: "tcp", Timeout: 86396, State: "ESTABLISHED",
+			Original: tuple("[fd00:10:244::1]:33322", "[fd00:10:96::c0a8]:80"), Reply: tuple("[fd00:10:244:1::2]:8080", "[fd00:10:244::1]:33322"), Flags: assured}, "DNAT"},
+	}
+	if len(got) != len(tests) {
+		t.Fatalf("got %d entries, want %d", len(got), len(tests))
+	}
+	for i, tt := range tests {
+		if !reflect.DeepEqual(got[i], tt.want) {
+			t.Errorf("line %d:\ngot  %+v\nwant %+v", i+1, got[i], tt.want)
+		}
+		if nat := got[i].NAT(); nat != tt.nat {
+			t.Errorf("line %d: NAT() = %q, want %q", i+1, nat, tt.nat)
+		}
+	}
+}
+
+func TestParseConntrackLine(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want Conntrack
+	}{
+		{
+			// /proc/net/ip_conntrack has no family columns
+			name: "ip_conntrack",
+			in:   "tcp      6 300 SYN_SENT src=10.244.1.2 dst=10.96.0.1 sport=1 dport=443 [UNREPLIED] src=172.19.0.4 dst=10.244.1.2 sport=6443 dport=1 mark=0 use=1",
+			want: Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 300, State: "SYN_SENT",
+				Original: tuple("10.244.1.2:1", "10.96.0.1:443"), Reply: tuple("172.19.0.4:6443", "10.244.1.2:1"), Flags: []string{"UNREPLIED"}},
+		},
+		{
+			name: "ip_conntrack ipv6",
+			in:   "udp      17 30 src=fd00::1 dst=fd00::2 sport=5353 dport=53 src=fd00::2 dst=fd00::1 sport=53 dport=5353 mark=0 use=1",
+			want: Conntrack{Family: "ipv6", Proto: "udp", Timeout: 30,
+				Original: tuple("[fd00::1]:5353", "[fd00::2]:53"), Reply: tuple("[fd00::2]:53", "[fd00::1]:5353")},
+		},
+		{
+			name: "accounting, mark and zone",
+			in:   "ipv4     2 tcp      6 10 CLOSE src=10.0.0.1 dst=10.0.0.2 sport=1 dport=2 packets=3 bytes=180 src=10.0.0.2 dst=10.0.0.1 sport=2 dport=1 packets=2 bytes=120 mark=16384 zone=7 use=1",
+			want: Conntrack{Family: "ipv4", Proto: "tcp", Timeout: 10, State: "CLOSE",
+				Original: Tuple{Src: netip.MustParseAddr("10.0.0.1"), Dst: netip.MustParseAddr("10.0.0.2"), SrcPort: 1, DstPort: 2, Packets: 3, Bytes: 180},
+				Reply:    Tuple{Src: netip.MustParseAddr("10.0.0.2"), Dst: netip.MustParseAddr("10.0.0.1"), SrcPort: 2, DstPort: 1, Packets: 2, Bytes: 120},
+				Mark:     16384, Zone: 7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseConntrack(strings.NewReader(tt.in + "\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseConntrackErrors(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"too few fields", "ipv4 2 tcp 6", "too few fields"},
+		{"bad timeout", "ipv4 2 tcp 6 soon ESTABLISHED src=10.0.0.1", "bad timeout"},
+		{"bad address", "ipv4 2 tcp 6 10 src=10.0.0.256 dst=10.0.0.2", "10.0.0.256"},
+		{"bad port", "ipv4 2 tcp 6 10 src=10.0.0.1 dst=10.0.0.2 sport=70000 dport=2", "bad sport"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseConntrack(strings.NewReader("\n" + tt.in + "\n"))
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.HasPrefix(err.Error(), "line 2:") {
+				t.Errorf("err = %v, want line 2 and %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestConntrackHasPort(t *testing.T) {
+	c := Conntrack{Original: tuple("172.19.0.1:52814", "172.19.0.3:30080"), Reply: tuple("10.244.2.3:8080", "172.19.0.3:52814")}
+	for port, want := range map[uint16]bool{30080: true, 8080: true, 52814: true, 80: false} {
+		if got := c.HasPort(port); got != want {
+			t.Errorf("HasPort(%d) = %v, want %v", port, got, want)
+		}
+	}
+}
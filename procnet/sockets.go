@@ -0,0 +1,140 @@
+package procnet
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Socket is one row of /proc/net/tcp, tcp6, udp or udp6.
+type Socket struct {
+	Proto  string         `json:"proto"`
+	Local  netip.AddrPort `json:"local"`
+	Remote netip.AddrPort `json:"remote"`
+	State  string         `json:"state"`
+	// For a listening TCP socket RxQueue is the accept queue: connections
+	// the kernel has completed that the program hasn't accepted yet.
+	// Otherwise they're bytes waiting to be sent (TxQueue) or read
+	// (RxQueue).
+	TxQueue uint64 `json:"tx_queue"`
+	RxQueue uint64 `json:"rx_queue"`
+	UID     int    `json:"uid"`
+	Inode   uint64 `json:"inode"`
+}
+
+// tcpStates are the kernel's TCP states (include/net/tcp_states.h), by the
+// hex code /proc prints.
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+	"0C": "NEW_SYN_RECV",
+}
+
+// Listening reports whether s is waiting for connections (TCP) or bound
+// without a peer (UDP).
+func (s Socket) Listening() bool { return s.State == "LISTEN" || s.State == "UNCONN" }
+
+// ParseSockets reads one of the /proc/net socket tables. proto is the file
+// name ("tcp", "udp6", ...), which decides how states are named.
+func ParseSockets(r io.Reader, proto string) ([]Socket, error) {
+	var out []Socket
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		fields := strings.Fields(sc.Text())
+		if len(fields) == 0 || fields[0] == "sl" {
+			continue
+		}
+		if len(fields) < 10 {
+			return nil, fmt.Errorf("%s line %d: want at least 10 fields, got %d", proto, n, len(fields))
+		}
+		s := Socket{Proto: proto}
+		var err error
+		if s.Local, err = parseHexAddrPort(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", proto, n, err)
+		}
+		if s.Remote, err = parseHexAddrPort(fields[2]); err != nil {
+			return nil, fmt.Errorf("%s line %d: %w", proto, n, err)
+		}
+		s.State = tcpStates[strings.ToUpper(fields[3])]
+		if strings.HasPrefix(proto, "udp") {
+			// UDP reuses TCP's codes: 01 once connect()ed, 07 otherwise
+			s.State = "UNCONN"
+			if fields[3] == "01" {
+				s.State = "ESTABLISHED"
+			}
+		}
+		tx, rx, _ := strings.Cut(fields[4], ":")
+		s.TxQueue, _ = strconv.ParseUint(tx, 16, 64)
+		s.RxQueue, _ = strconv.ParseUint(rx, 16, 64)
+		s.UID, _ = strconv.Atoi(fields[7])
+		s.Inode, _ = strconv.ParseUint(fields[9], 10, 64)
+		out = append(out, s)
+	}
+	return out, sc.Err()
+}
+
+// parseHexAddrPort decodes "0100007F:1F90" (127.0.0.1:8080). The address
+// is in the kernel's byte order, 32 bits at a time; the port is big-endian.
+func parseHexAddrPort(s string) (netip.AddrPort, error) {
+	a, p, ok := strings.Cut(s, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("bad address %q", s)
+	}
+	raw, err := hex.DecodeString(a)
+	if err != nil || (len(raw) != 4 && len(raw) != 16) {
+		return netip.AddrPort{}, fmt.Errorf("bad address %q", s)
+	}
+	port, err := strconv.ParseUint(p, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("bad port %q", s)
+	}
+	for i := 0; i < len(raw); i += 4 {
+		binary.BigEndian.PutUint32(raw[i:], binary.LittleEndian.Uint32(raw[i:]))
+	}
+	addr, _ := netip.AddrFromSlice(raw)
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// SocketFDs maps socket inodes to the file descriptors pid holds them on,
+// by reading /proc/<pid>/fd. Use "self" for the current process.
+func SocketFDs(proc, pid string) (map[uint64]int, error) {
+	dir := filepath.Join(proc, pid, "fd")
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	out := map[uint64]int{}
+	for _, e := range entries {
+		link, err := os.Readlink(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue // closed since we listed the directory
+		}
+		ino, ok := strings.CutPrefix(link, "socket:[")
+		if !ok {
+			continue
+		}
+		inode, err := strconv.ParseUint(strings.TrimSuffix(ino, "]"), 10, 64)
+		if err != nil {
+			continue
+		}
+		fd, _ := strconv.Atoi(e.Name())
+		out[inode] = fd
+	}
+	return out, nil
+}
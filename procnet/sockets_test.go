@@ -0,0 +1,110 @@
+package procnet
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSocketsFixture(t *testing.T) {
+	got, err := ParseSockets(open(t, "tcp"), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Socket{
+		{Proto: "tcp", Local: netip.MustParseAddrPort("0.0.0.0:8080"), Remote: netip.MustParseAddrPort("0.0.0.0:0"), State: "LISTEN", UID: 65532, Inode: 41237},
+		{Proto: "tcp", Local: netip.MustParseAddrPort("10.244.2.3:8080"), Remote: netip.MustParseAddrPort("10.244.1.5:40122"), State: "ESTABLISHED", UID: 65532, Inode: 41902},
+		{Proto: "tcp", Local: netip.MustParseAddrPort("10.244.2.3:47218"), Remote: netip.MustParseAddrPort("10.96.0.1:443"), State: "ESTABLISHED", UID: 65532, Inode: 41311},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%+v\nwant\n%+v", got, want)
+	}
+	if !got[0].Listening() || got[1].Listening() {
+		t.Error("only the first socket is listening")
+	}
+}
+
+// line fills in the columns ParseSockets doesn't read.
+func line(local, remote, st, queues string) string {
+	return "0: " + local + " " + remote + " " + st + " " + queues + " 00:00000000 00000000 1000 0 4242 1 0000000000000000 20 4 30 10 -1"
+}
+
+func TestParseSockets(t *testing.T) {
+	tests := []struct {
+		name  string
+		proto string
+		in    string
+		want  Socket
+	}{
+		{
+			// a full accept queue: three connections nobody accepted
+			name: "accept queue", proto: "tcp",
+			in:   line("0100007F:1F90", "00000000:0000", "0A", "00000000:00000003"),
+			want: Socket{Local: netip.MustParseAddrPort("127.0.0.1:8080"), Remote: netip.MustParseAddrPort("0.0.0.0:0"), State: "LISTEN", RxQueue: 3},
+		},
+		{
+			name: "send queue", proto: "tcp",
+			in:   line("0300F40A:1F90", "0501F40A:9CBA", "01", "0000FFFF:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("10.244.0.3:8080"), Remote: netip.MustParseAddrPort("10.244.1.5:40122"), State: "ESTABLISHED", TxQueue: 0xffff},
+		},
+		{
+			name: "tcp6 loopback", proto: "tcp6",
+			in:   line("00000000000000000000000001000000:1F90", "00000000000000000000000000000000:0000", "0A", "00000000:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("[::1]:8080"), Remote: netip.MustParseAddrPort("[::]:0"), State: "LISTEN"},
+		},
+		{
+			name: "tcp6", proto: "tcp6",
+			in:   line("100000FD010044020000000002000000:1F90", "100000FD000044020000000001000000:822A", "06", "00000000:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("[fd00:10:244:1::2]:8080"), Remote: netip.MustParseAddrPort("[fd00:10:244::1]:33322"), State: "TIME_WAIT"},
+		},
+		{
+			// an IPv4 client on a dual-stack listener
+			name: "tcp6 v4-mapped", proto: "tcp6",
+			in:   line("0000000000000000FFFF00000302F40A:1F90", "0000000000000000FFFF00000501F40A:9CBA", "01", "00000000:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("[::ffff:10.244.2.3]:8080"), Remote: netip.MustParseAddrPort("[::ffff:10.244.1.5]:40122"), State: "ESTABLISHED"},
+		},
+		{
+			name: "udp unconnected", proto: "udp",
+			in:   line("00000000:0035", "00000000:0000", "07", "00000000:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("0.0.0.0:53"), Remote: netip.MustParseAddrPort("0.0.0.0:0"), State: "UNCONN"},
+		},
+		{
+			name: "udp connected", proto: "udp",
+			in:   line("0300F40A:9525", "0A00600A:0035", "01", "00000000:00000000"),
+			want: Socket{Local: netip.MustParseAddrPort("10.244.0.3:38181"), Remote: netip.MustParseAddrPort("10.96.0.10:53"), State: "ESTABLISHED"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSockets(strings.NewReader(tt.in+"\n"), tt.proto)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.want.Proto, tt.want.UID, tt.want.Inode = tt.proto, 1000, 4242
+			if len(got) != 1 || !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSocketsErrors(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"too few fields", "0: 0100007F:1F90 00000000:0000 0A", "want at least 10 fields"},
+		{"no port", line("0100007F", "00000000:0000", "0A", "00000000:00000000"), "bad address"},
+		{"not hex", line("0100007G:1F90", "00000000:0000", "0A", "00000000:00000000"), "bad address"},
+		{"odd length", line("00007F:1F90", "00000000:0000", "0A", "00000000:00000000"), "bad address"},
+		{"bad port", line("0100007F:1F90", "00000000:XYZ", "0A", "00000000:00000000"), "bad port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSockets(strings.NewReader("  sl  local_address\n"+tt.in+"\n"), "tcp")
+			if err == nil || !strings.Contains(err.Error(), tt.want) || !strings.HasPrefix(err.Error(), "tcp line 2:") {
+				t.Errorf("err = %v, want tcp line 2 and %q", err, tt.want)
+			}
+		})
+	}
+}
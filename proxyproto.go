@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROXY protocol support, for when the pod sits behind an L4 load balancer
+// that would otherwise hide the client's address. The balancer prepends a
+// small header to every connection; we strip it and make RemoteAddr return
+// the client it describes. Spec:
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+//
+// Only peers in -proxy-trusted may set the address, and they must: a
+// trusted peer that sends no header is hung up on, as the spec requires.
+// Anyone else gets their bytes passed through untouched, so a client can't
+// spoof its address by sending a header of its own.
+
+var (
+	proxyProtocol = false
+	proxyTrusted  = ""
+)
+
+const (
+	proxyV1Prefix = "PROXY "
+	proxyV1MaxLen = 107 // including CRLF
+
+	proxyHeaderTimeout = 5 * time.Second
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Well-known v2 TLV types.
+const (
+	proxyTLVALPN      = 0x01
+	proxyTLVAuthority = 0x02
+	proxyTLVCRC32C    = 0x03
+	proxyTLVNoop      = 0x04
+	proxyTLVUniqueID  = 0x05
+	proxyTLVSSL       = 0x20
+	proxyTLVNetNS     = 0x30
+)
+
+// ProxyTLV is one type-length-value field from a v2 header.
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a parsed PROXY protocol header. Source and Destination are
+// nil for LOCAL connections (the balancer's own health checks) and for v1
+// UNKNOWN, in which case the real connection addresses stand.
+type ProxyHeader struct {
+	Version     int
+	Local       bool
+	Network     string
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []ProxyTLV
+}
+
+var errNotProxy = errors.New("no PROXY protocol header")
+
+// readProxyHeader reads a v1 or v2 header from br. It returns errNotProxy,
+// without consuming anything, when the stream doesn't start with one.
+func readProxyHeader(br *bufio.Reader) (*ProxyHeader, error) {
+	if sig, err := br.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(br)
+	}
+	if prefix, err := br.Peek(len(proxyV1Prefix)); err == nil && string(prefix) == proxyV1Prefix {
+		return readProxyV1(br)
+	}
+	return nil, errNotProxy
+}
+
+// readProxyV1 parses the text form, e.g.
+//
+//	PROXY TCP4 192.0.2.10 10.244.0.8 51234 8080\r\n
+func readProxyV1(br *bufio.Reader) (*ProxyHeader, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("proxy v1: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy v1: header not terminated by CRLF")
+	}
+
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return &ProxyHeader{Version: 1}, nil
+	}
+	if len(f) != 6 {
+		return nil, fmt.Errorf("proxy v1: want 6 fields, got %d", len(f))
+	}
+	if f[1] != "TCP4" && f[1] != "TCP6" {
+		return nil, fmt.Errorf("proxy v1: unknown protocol %q", f[1])
+	}
+	src, err := parseProxyV1Addr(f[1], f[2], f[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyV1Addr(f[1], f[3], f[5])
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyHeader{Version: 1, Network: "tcp", Source: src, Destination: dst}, nil
+}
+
+func parseProxyV1Addr(proto, ip, port string) (*net.TCPAddr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil, fmt.Errorf("proxy v1: %w", err)
+	}
+	if addr.Is4() != (proto == "TCP4") {
+		return nil, fmt.Errorf("proxy v1: %s address %s", proto, ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, fmt.Errorf("proxy v1: bad port %q", port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(p))), nil
+}
+
+// readProxyV2 parses the binary form: the 12-byte signature, a version and
+// command byte, an address family and transport byte, a big-endian length
+// and then the addresses followed by any TLVs.
+func readProxyV2(br *bufio.Reader) (*ProxyHeader, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, fmt.Errorf("proxy v2: %w", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("proxy v2: unsupported version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil {
+		return nil, fmt.Errorf("proxy v2: %w", err)
+	}
+
+	h := &ProxyHeader{Version: 2}
+	switch cmd := hdr[12] & 0x0f; cmd {
+	case 0x0:
+		h.Local = true
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("proxy v2: unknown command %d", cmd)
+	}
+
+	var (
+		addrLen int
+		family  = hdr[13] >> 4
+	)
+	switch hdr[13] & 0x0f {
+	case 0x1:
+		h.Network = "tcp"
+	case 0x2:
+		h.Network = "udp"
+	}
+	switch family {
+	case 0x1:
+		addrLen = 12
+	case 0x2:
+		addrLen = 36
+	case 0x3:
+		addrLen = 216
+		h.Network = "unix"
+	}
+	if len(body) < addrLen {
+		return nil, fmt.Errorf("proxy v2: %d bytes is too short for address family %d", len(body), family)
+	}
+
+	addrs := body[:addrLen]
+	switch family {
+	case 0x1, 0x2:
+		ipLen := addrLen/2 - 2
+		src, _ := netip.AddrFromSlice(addrs[:ipLen])
+		dst, _ := netip.AddrFromSlice(addrs[ipLen : 2*ipLen])
+		sport := binary.BigEndian.Uint16(addrs[2*ipLen:])
+		dport := binary.BigEndian.Uint16(addrs[2*ipLen+2:])
+		h.Source = proxyAddr(h.Network, netip.AddrPortFrom(src, sport))
+		h.Destination = proxyAddr(h.Network, netip.AddrPortFrom(dst, dport))
+	case 0x3:
+		h.Source = &net.UnixAddr{Net: "unix", Name: string(bytes.TrimRight(addrs[:108], "\x00"))}
+		h.Destination = &net.UnixAddr{Net: "unix", Name: string(bytes.TrimRight(addrs[108:], "\x00"))}
+	}
+	if h.Local || h.Network == "" {
+		h.Source, h.Destination = nil, nil
+	}
+
+	tlvs := body[addrLen:]
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return nil, errors.New("proxy v2: truncated TLV")
+		}
+		n := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return nil, errors.New("proxy v2: truncated TLV value")
+		}
+		h.TLVs = append(h.TLVs, ProxyTLV{Type: tlvs[0], Value: tlvs[3 : 3+n]})
+		if tlvs[0] == proxyTLVCRC32C {
+			if err := checkProxyCRC(hdr, body, len(body)-len(tlvs)+3, n); err != nil {
+				return nil, err
+			}
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+func proxyAddr(network string, ap netip.AddrPort) net.Addr {
+	if network == "udp" {
+		return net.UDPAddrFromAddrPort(ap)
+	}
+	return net.TCPAddrFromAddrPort(ap)
+}
+
+// checkProxyCRC verifies the CRC32C TLV whose value sits at body[off:],
+// which covers the whole header with the checksum itself zeroed.
+func checkProxyCRC(hdr, body []byte, off, n int) error {
+	if n != 4 {
+		return errors.New("proxy v2: CRC32C TLV must be 4 bytes")
+	}
+	sum := binary.BigEndian.Uint32(body[off:])
+	raw := append(append([]byte{}, hdr...), body...)
+	copy(raw[len(hdr)+off:], []byte{0, 0, 0, 0})
+	if got := crc32.Checksum(raw, crc32.MakeTable(crc32.Castagnoli)); got != sum {
+		return fmt.Errorf("proxy v2: CRC32C mismatch: header says %08x, computed %08x", sum, got)
+	}
+	return nil
+}
+
+// String names well-known TLV types for logs and debugging output.
+func (t ProxyTLV) String() string {
+	names := map[byte]string{
+		proxyTLVALPN:      "alpn",
+		proxyTLVAuthority: "authority",
+		proxyTLVCRC32C:    "crc32c",
+		proxyTLVNoop:      "noop",
+		proxyTLVUniqueID:  "unique_id",
+		proxyTLVSSL:       "ssl",
+		proxyTLVNetNS:     "netns",
+	}
+	name, ok := names[t.Type]
+	if !ok {
+		name = fmt.Sprintf("0x%02x", t.Type)
+	}
+	return fmt.Sprintf("%s=%q", name, t.Value)
+}
+
+// proxyListener wraps accepted connections in proxyConn.
+type proxyListener struct {
+	net.Listener
+	trusted []netip.Prefix
+}
+
+// newProxyListener parses a comma-separated CIDR list, which mustn't be
+// empty: trusting every peer would let any client pick its own address.
+func newProxyListener(ln net.Listener, trusted string) (net.Listener, error) {
+	pl := &proxyListener{Listener: ln}
+	for _, s := range strings.Split(trusted, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("-proxy-trusted: %w", err)
+		}
+		pl.trusted = append(pl.trusted, p.Masked())
+	}
+	if len(pl.trusted) == 0 {
+		return nil, errors.New("-proxy-protocol needs -proxy-trusted: the CIDRs of the load balancers allowed to send headers")
+	}
+	return pl, nil
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.isTrusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, br: bufio.NewReader(c)}, nil
+}
+
+func (l *proxyListener) isTrusted(a net.Addr) bool {
+	tcp, ok := a.(*net.TCPAddr)
+	if !ok {
+		// unix sockets have no address to trust; their clients are local
+		// and speak plain HTTP
+		return false
+	}
+	ip := tcp.AddrPort().Addr().Unmap()
+	for _, p := range l.trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reads the header the first time anyone asks for data or an
+// address. net/http calls RemoteAddr from the connection's own goroutine, so
+// a slow balancer only stalls its own connection, never Accept.
+type proxyConn struct {
+	net.Conn
+	br *bufio.Reader
+
+	once   sync.Once
+	header *ProxyHeader
+	err    error
+
+	// The read deadline the caller set, which reading the header mustn't
+	// lose, and the header's own while it's being read. The earlier wins.
+	mu             sync.Mutex
+	readDeadline   time.Time
+	headerDeadline time.Time
+}
+
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		c.setHeaderDeadline(time.Now().Add(proxyHeaderTimeout))
+		defer c.setHeaderDeadline(time.Time{})
+		c.header, c.err = readProxyHeader(c.br)
+		if c.err != nil {
+			// a missing or broken header from a balancer means we can't
+			// know who the client is
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) setHeaderDeadline(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.headerDeadline = t
+	c.applyReadDeadline()
+}
+
+// applyReadDeadline sets the earlier of the two deadlines; c.mu must be
+// held.
+func (c *proxyConn) applyReadDeadline() error {
+	d := c.readDeadline
+	if h := c.headerDeadline; !h.IsZero() && (d.IsZero() || h.Before(d)) {
+		d = h
+	}
+	return c.Conn.SetReadDeadline(d)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.applyReadDeadline()
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	if err := c.Conn.SetWriteDeadline(t); err != nil {
+		return err
+	}
+	return c.SetReadDeadline(t)
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.init(); c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init(); c.header != nil && c.header.Source != nil {
+		return c.header.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.init(); c.header != nil && c.header.Destination != nil {
+		return c.header.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// AddrFamily is the family of the client the header names, rather than the
+// balancer's. A LOCAL header, the balancer's own health check, keeps the
+// balancer's.
+func (c *proxyConn) AddrFamily() string {
+	if c.init(); c.header == nil || c.header.Source == nil {
+		return addrFamily(c.Conn)
+	}
+	ap, err := netip.ParseAddrPort(c.header.Source.String())
+	switch {
+	case err != nil:
+		return c.header.Source.Network()
+	case ap.Addr().Is4():
+		return "ipv4"
+	case ap.Addr().Is4In6():
+		return "ipv4-mapped"
+	}
+	return "ipv6"
+}
+
+// ProxyHeader returns the parsed header, or nil if the peer didn't send one.
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	c.init()
+	return c.header
+}
+
+func (c *proxyConn) NetConn() net.Conn { return c.Conn }
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 builds a v2 header: command 0 (LOCAL) or 1 (PROXY), family and
+// transport byte, then addresses and TLVs as body.
+func proxyV2(cmd, famProto byte, body []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, 0x20|cmd, famProto)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(body)))
+	return append(b, body...)
+}
+
+// tcp4Body is 192.0.2.10:51234 -> 10.244.0.8:8080.
+func tcp4Body() []byte {
+	b := []byte{192, 0, 2, 10, 10, 244, 0, 8}
+	b = binary.BigEndian.AppendUint16(b, 51234)
+	return binary.BigEndian.AppendUint16(b, 8080)
+}
+
+func withCRC(hdr []byte) []byte {
+	// the CRC TLV goes last, zeroed while summing
+	hdr = append(hdr, proxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], binary.BigEndian.Uint16(hdr[14:])+7)
+	sum := crc32.Checksum(hdr, crc32.MakeTable(crc32.Castagnoli))
+	binary.BigEndian.PutUint32(hdr[len(hdr)-4:], sum)
+	return hdr
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tlvs := append(tcp4Body(), proxyTLVAuthority, 0, 7)
+	tlvs = append(tlvs, "example"...)
+	tcp6 := make([]byte, 36)
+	tcp6[15], tcp6[31] = 1, 2 // ::1 -> ::2
+	binary.BigEndian.PutUint16(tcp6[32:], 40000)
+	binary.BigEndian.PutUint16(tcp6[34:], 443)
+	badCRC := withCRC(proxyV2(1, 0x11, tcp4Body()))
+	badCRC[len(badCRC)-1] ^= 0xff
+
+	tests := []struct {
+		name    string
+		in      []byte
+		source  string // "" for none
+		dest    string
+		local   bool
+		tlvs    int
+		wantErr string
+	}{
+		{name: "v1 tcp4", in: []byte("PROXY TCP4 192.0.2.10 10.244.0.8 51234 8080\r\n"), source: "192.0.2.10:51234", dest: "10.244.0.8:8080"},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 2001:db8::1 fd00::8 51234 8080\r\n"), source: "[2001:db8::1]:51234", dest: "[fd00::8]:8080"},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 family mismatch", in: []byte("PROXY TCP4 2001:db8::1 10.0.0.1 1 2\r\n"), wantErr: "TCP4 address"},
+		{name: "v1 leading zero port", in: []byte("PROXY TCP4 192.0.2.10 10.0.0.1 080 8080\r\n"), wantErr: "bad port"},
+		{name: "v1 truncated", in: []byte("PROXY TCP4 192.0.2.10 10.244"), wantErr: "EOF"},
+		{name: "v1 oversized", in: []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), wantErr: "not terminated"},
+		{name: "v1 no CRLF", in: []byte("PROXY TCP4 192.0.2.10 10.244.0.8 51234 8080\n"), wantErr: "not terminated"},
+		{name: "v2 tcp4", in: proxyV2(1, 0x11, tcp4Body()), source: "192.0.2.10:51234", dest: "10.244.0.8:8080"},
+		{name: "v2 tcp6", in: proxyV2(1, 0x21, tcp6), source: "[::1]:40000", dest: "[::2]:443"},
+		{name: "v2 tlvs", in: proxyV2(1, 0x11, tlvs), source: "192.0.2.10:51234", dest: "10.244.0.8:8080", tlvs: 1},
+		{name: "v2 crc", in: withCRC(proxyV2(1, 0x11, tcp4Body())), source: "192.0.2.10:51234", dest: "10.244.0.8:8080", tlvs: 1},
+		{name: "v2 bad crc", in: badCRC, wantErr: "CRC32C mismatch"},
+		// a balancer's health check: the connection's own addresses stand
+		{name: "v2 local", in: proxyV2(0, 0x11, tcp4Body()), local: true},
+		{name: "v2 local without addresses", in: proxyV2(0, 0x00, nil), local: true},
+		{name: "v2 unknown command", in: proxyV2(2, 0x11, tcp4Body()), wantErr: "unknown command"},
+		{name: "v2 truncated header", in: proxyV2(1, 0x11, nil)[:14], wantErr: "EOF"},
+		{name: "v2 truncated body", in: proxyV2(1, 0x11, tcp4Body())[:20], wantErr: "EOF"},
+		{name: "v2 short addresses", in: proxyV2(1, 0x11, tcp4Body()[:8]), wantErr: "too short"},
+		{name: "v2 truncated tlv", in: proxyV2(1, 0x11, append(tcp4Body(), proxyTLVNoop, 0, 9, 1)), wantErr: "truncated TLV value"},
+		{name: "v2 oversized", in: append(proxyV2(1, 0x11, nil)[:14], 0xff, 0xff), wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := readProxyHeader(bufio.NewReader(bytes.NewReader(tt.in)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.Local != tt.local {
+				t.Errorf("Local = %v, want %v", h.Local, tt.local)
+			}
+			if got := addrString(h.Source); got != tt.source {
+				t.Errorf("Source = %q, want %q", got, tt.source)
+			}
+			if got := addrString(h.Destination); got != tt.dest {
+				t.Errorf("Destination = %q, want %q", got, tt.dest)
+			}
+			if len(h.TLVs) != tt.tlvs {
+				t.Errorf("got %d TLVs, want %d", len(h.TLVs), tt.tlvs)
+			}
+		})
+	}
+}
+
+func addrString(a net.Addr) string {
+	if a == nil {
+		return ""
+	}
+	return a.String()
+}
+
+func TestReadProxyHeaderLeavesOtherStreamsAlone(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n\r\n"))
+	if _, err := readProxyHeader(br); !errors.Is(err, errNotProxy) {
+		t.Fatalf("err = %v, want errNotProxy", err)
+	}
+	line, _ := br.ReadString('\n')
+	if line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("consumed input: next line is %q", line)
+	}
+}
+
+func TestNewProxyListenerNeedsTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if _, err := newProxyListener(ln, " , "); err == nil {
+		t.Fatal("no trusted CIDRs: want an error")
+	}
+	if _, err := newProxyListener(ln, "10.0.0.0/33"); err == nil {
+		t.Fatal("bad CIDR: want an error")
+	}
+}
+
+// accept sends what over a loopback connection to a proxyListener that
+// trusts trusted, and returns the accepted side.
+func accept(t *testing.T, trusted, what string) net.Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	pl, err := newProxyListener(ln, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	if _, err := client.Write([]byte(what)); err != nil {
+		t.Fatal(err)
+	}
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestProxyListenerTrusted(t *testing.T) {
+	c := accept(t, "127.0.0.0/8", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\nhello\n")
+	if got := c.RemoteAddr().String(); got != "203.0.113.7:51234" {
+		t.Errorf("RemoteAddr = %s, want the header's source", got)
+	}
+	if got := c.LocalAddr().String(); got != "10.0.0.1:8080" {
+		t.Errorf("LocalAddr = %s, want the header's destination", got)
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("read %q, %v after the header; want hello", line, err)
+	}
+}
+
+func TestProxyListenerTrustedWithoutHeader(t *testing.T) {
+	c := accept(t, "127.0.0.0/8", "GET / HTTP/1.0\r\n\r\n")
+	if _, err := io.ReadAll(c); err == nil {
+		t.Fatal("read succeeded: a trusted peer without a header must be refused")
+	}
+}
+
+func TestProxyListenerUntrusted(t *testing.T) {
+	const spoof = "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\n"
+	c := accept(t, "10.0.0.0/8", spoof)
+	if got := c.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+		t.Errorf("RemoteAddr = %s: an untrusted peer set its own address", got)
+	}
+	buf := make([]byte, len(spoof))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != spoof {
+		t.Errorf("read %q, %v; want the header passed through untouched", buf, err)
+	}
+}
+
+// The header gets its own deadline, but the caller's comes back once it's
+// read: without it handleTCPEcho would never drop an idle client.
+func TestProxyConnKeepsCallerDeadline(t *testing.T) {
+	c := accept(t, "127.0.0.0/8", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\n")
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("err = %v, want the caller's deadline", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("read still blocked after the caller's deadline")
+	}
+}
+
+func TestProxyConnAddrFamily(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"v1 tcp6 through an IPv4 balancer", "PROXY TCP6 2001:db8::1 fd00::8 51234 8080\r\n", "ipv6"},
+		{"v1 tcp4", "PROXY TCP4 203.0.113.7 10.0.0.1 51234 8080\r\n", "ipv4"},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "ipv4"},
+		// the balancer's own health check
+		{"v2 local", string(proxyV2(0, 0x00, nil)), "ipv4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := accept(t, "127.0.0.0/8", tt.in)
+			if got := addrFamily(c); got != tt.want {
+				t.Errorf("addrFamily = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolRequestFamily(t *testing.T) {
+	oldProxy, oldTrusted := proxyProtocol, proxyTrusted
+	proxyProtocol, proxyTrusted = true, "127.0.0.0/8"
+	t.Cleanup(func() { proxyProtocol, proxyTrusted = oldProxy, oldTrusted })
+	ln, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, requestFamily(r), " ", r.RemoteAddr)
+	}))
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	fmt.Fprint(c, "PROXY TCP6 2001:db8::1 fd00::8 51234 8080\r\nGET / HTTP/1.1\r\nHost: x\r\nConnection: close\r\n\r\n")
+	body, _ := io.ReadAll(c)
+	if want := "\r\n\r\nipv6 [2001:db8::1]:51234"; !strings.HasSuffix(string(body), want) {
+		t.Errorf("response\n%s\nwant it to end in %q", body, want)
+	}
+}
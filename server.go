@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// http.ListenAndServe has no timeouts at all: a client that sends one header
+// byte a minute (slowloris) holds a connection, and a goroutine, forever.
+// These are the limits every server we stand up gets; each has a flag.
+var (
+	readHeaderTimeout = 5 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+	maxHeaderBytes    = 64 << 10
+	maxConns          = 1024
+)
+
+// noBody is the body limit for GET-only routes.
+const noBody = 0
+
+// newServer returns an http.Server with our timeouts that tracks its
+// connections in conns.
+func newServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           countRequests(h),
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		MaxHeaderBytes:    maxHeaderBytes,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connInfoKey{}, conns.add(addr, c))
+		},
+		ConnState: conns.setState,
+	}
+}
+
+// handle registers h on the default mux, refusing request bodies larger than
+// maxBody bytes with 413. A negative maxBody means no limit.
+func handle(pattern string, maxBody int64, h http.HandlerFunc) {
+	http.Handle(pattern, limitBody(maxBody, h))
+}
+
+func limitBody(maxBody int64, next http.Handler) http.Handler {
+	if maxBody < 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > maxBody {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// streaming lifts the server's read and write deadlines for a handler that
+// legitimately runs longer than a request should (gRPC streams, downloads).
+func streaming(w http.ResponseWriter) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+}
+
+// limitListener stops accepting once n connections are open, like
+// golang.org/x/net/netutil.LimitListener. Extra clients wait in the kernel's
+// accept queue instead of each costing us a goroutine and a buffer.
+type limitListener struct {
+	net.Listener
+	sem  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func newLimitListener(ln net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return ln
+	}
+	return &limitListener{Listener: ln, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
+	}
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+func (c *limitConn) NetConn() net.Conn { return c.Conn }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A slowloris client, sending a header line every 50ms, is hung up on once
+// -read-header-timeout is up rather than being waited on forever.
+func TestReadHeaderTimeout(t *testing.T) {
+	old := readHeaderTimeout
+	readHeaderTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { readHeaderTimeout = old })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, http.HandlerFunc(healthzHandler))
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	go func() {
+		if _, err := fmt.Fprint(c, "GET /healthz HTTP/1.1\r\nHost: x\r\n"); err != nil {
+			return
+		}
+		for i := 0; ; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := fmt.Fprintf(c, "X-Trickle-%d: 1\r\n", i); err != nil {
+				return
+			}
+		}
+	}()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	body, err := io.ReadAll(c)
+	elapsed := time.Since(start)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection still open after 5s of trickled headers")
+	}
+	if len(body) != 0 && !strings.HasPrefix(string(body), "HTTP/1.1 408") {
+		t.Errorf("got a response to an unfinished request:\n%s", body)
+	}
+	// the server can start its clock before Dial returns here; allow slack
+	if elapsed < readHeaderTimeout*3/4 {
+		t.Errorf("closed after %v, before the %v timeout", elapsed, readHeaderTimeout)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	old := maxHeaderBytes
+	maxHeaderBytes = 1 << 10
+	t.Cleanup(func() { maxHeaderBytes = old })
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, ln, http.HandlerFunc(healthzHandler))
+
+	tests := []struct {
+		name string
+		size int
+		want int
+	}{
+		{"small", 100, http.StatusOK},
+		// net/http allows 4KB of slack on top of MaxHeaderBytes
+		{"oversized", 16 << 10, http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+"/healthz", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Big", strings.Repeat("x", tt.size))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("%d byte header: %s, want %d", tt.size, resp.Status, tt.want)
+			}
+		})
+	}
+}
+
+// The listener holds connection N+1 in the accept queue until one of the
+// first N closes.
+func TestLimitListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newLimitListener(inner, 2)
+	accepted := make(chan net.Conn)
+	acceptErr := make(chan error, 1)
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	for range 3 {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	var held []net.Conn
+	for range 2 {
+		select {
+		case c := <-accepted:
+			held = append(held, c)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("accepted %d connections, want 2", len(held))
+		}
+	}
+	select {
+	case c := <-accepted:
+		c.Close()
+		t.Fatal("accepted a third connection with two open")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	held[0].Close()
+	// closing twice mustn't free a second slot
+	held[0].Close()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("third connection not accepted after one closed")
+	}
+	held[1].Close()
+
+	ln.Close()
+	select {
+	case err := <-acceptErr:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept after Close: %v, want net.ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Accept still blocked after Close")
+	}
+}
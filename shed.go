@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Load shedding. The server caps how many requests it works on at once and
+// answers the rest straight away with 503 and Retry-After, rather than
+// queueing them until everything times out. If it keeps shedding, /readyz
+// starts failing, the kubelet marks the pod NotReady, and the Service stops
+// sending it new traffic until it recovers.
+//
+// -concurrency picks how the cap is chosen:
+//
+//	off       no cap (the default)
+//	fixed     always -concurrency-limit
+//	aimd      additive increase while latency stays under -latency-target,
+//	          multiplicative decrease when it doesn't (like TCP congestion control)
+//	gradient  compares recent latency with its long-term average and shrinks
+//	          the cap as a queue builds (Netflix's concurrency-limits "gradient2")
+
+var (
+	concurrencyMode  = "off"
+	concurrencyLimit = 100
+	latencyTarget    = 50 * time.Millisecond
+	unreadyAfter     = 10 * time.Second
+)
+
+// shedRetryAfter is what we tell shed clients. A second is long enough for
+// the backlog to drain and short enough that nobody notices.
+const shedRetryAfter = 1
+
+// limitAlgorithm adjusts the cap after every request.
+type limitAlgorithm interface {
+	update(limit float64, latency time.Duration, inflight int) float64
+}
+
+type fixedLimit struct{}
+
+func (fixedLimit) update(limit float64, _ time.Duration, _ int) float64 { return limit }
+
+type aimdLimit struct {
+	target   time.Duration
+	backoff  float64
+	min, max float64
+}
+
+func (a aimdLimit) update(limit float64, latency time.Duration, inflight int) float64 {
+	switch {
+	case latency > a.target:
+		limit *= a.backoff
+	case float64(inflight)*2 >= limit:
+		// only grow when we're actually using the room we have
+		limit++
+	}
+	return math.Max(a.min, math.Min(a.max, limit))
+}
+
+type gradientLimit struct {
+	min, max float64
+
+	// long-term average latency moves slowly; short-term follows every sample
+	longRTT, shortRTT float64
+}
+
+func (g *gradientLimit) update(limit float64, latency time.Duration, inflight int) float64 {
+	rtt := float64(latency)
+	if g.longRTT == 0 {
+		g.longRTT, g.shortRTT = rtt, rtt
+	}
+	g.shortRTT += (rtt - g.shortRTT) * 0.1
+	g.longRTT += (rtt - g.longRTT) * 0.01
+
+	// Latency drifting above its long-term average means a queue is forming.
+	gradient := math.Max(0.5, math.Min(1, g.longRTT/g.shortRTT))
+	if float64(inflight) < limit/2 {
+		// app-limited: latency says nothing about the cap
+		return limit
+	}
+	queue := math.Sqrt(limit)
+	next := limit*gradient + queue
+	limit = limit*0.8 + next*0.2
+	return math.Max(g.min, math.Min(g.max, limit))
+}
+
+// shedder is the concurrency limiter.
+type shedder struct {
+	algo limitAlgorithm
+
+	mu            sync.Mutex
+	limit         float64
+	inflight      int
+	shed          int64
+	overloadStart time.Time
+	lastShed      time.Time
+}
+
+func newShedder(mode string, limit int, target time.Duration) (*shedder, error) {
+	s := &shedder{limit: float64(limit)}
+	switch mode {
+	case "off":
+		return nil, nil
+	case "fixed":
+		s.algo = fixedLimit{}
+	case "aimd":
+		s.algo = aimdLimit{target: target, backoff: 0.9, min: 1, max: float64(limit)}
+	case "gradient":
+		s.algo = &gradientLimit{min: 1, max: float64(limit)}
+	default:
+		return nil, fmt.Errorf("unknown -concurrency %q", mode)
+	}
+	if limit <= 0 {
+		return nil, fmt.Errorf("-concurrency-limit must be positive, got %d", limit)
+	}
+	return s, nil
+}
+
+// acquire reports whether there's room for one more request.
+func (s *shedder) acquire(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if float64(s.inflight) >= math.Floor(s.limit) {
+		s.shed++
+		if s.overloadStart.IsZero() || now.Sub(s.lastShed) > unreadyAfter {
+			s.overloadStart = now
+		}
+		s.lastShed = now
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+func (s *shedder) release(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limit = s.algo.update(s.limit, latency, s.inflight)
+	s.inflight--
+}
+
+// overloaded reports whether we've been shedding for at least -unready-after
+// without a break of the same length.
+func (s *shedder) overloaded(now time.Time) bool {
+	if s == nil || unreadyAfter <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.overloadStart.IsZero() || now.Sub(s.lastShed) > unreadyAfter {
+		return false
+	}
+	return now.Sub(s.overloadStart) >= unreadyAfter
+}
+
+// LoadStats is the body of /readyz.
+type LoadStats struct {
+	Ready    bool   `json:"ready"`
+	Mode     string `json:"mode"`
+	Limit    int    `json:"limit,omitempty"`
+	InFlight int    `json:"in_flight"`
+	Shed     int64  `json:"shed_total"`
+}
+
+func (s *shedder) stats(now time.Time) LoadStats {
+	st := LoadStats{Ready: !s.overloaded(now), Mode: concurrencyMode}
+	if s == nil {
+		return st
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st.Limit, st.InFlight, st.Shed = int(s.limit), s.inflight, s.shed
+	return st
+}
+
+// load is the server's shedder; nil when -concurrency is off.
+var load *shedder
+
+// probePaths are never shed. A liveness probe that gets a 503 restarts the
+// container, which is the last thing an overloaded pod needs.
+var probePaths = map[string]bool{
+	"/healthz":                         true,
+	"/readyz":                          true,
+	"/" + grpcHealthService + "/Check": true,
+	"/" + grpcHealthService + "/Watch": true,
+}
+
+func shedLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if load == nil || probePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		if !load.acquire(start) {
+			w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfter))
+			if isGRPC(r) {
+				w.Header().Set("Content-Type", "application/grpc")
+				w.Header().Set("Grpc-Status", strconv.Itoa(grpcUnavailable))
+				w.Header().Set("Grpc-Message", "server overloaded")
+				return
+			}
+			http.Error(w, "server overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer func() { load.release(time.Since(start)) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// healthzHandler is for liveness: if we can answer, we're alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler is for readiness: 503 while overloaded.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	st := load.stats(time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	if !st.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// slowHandler answers like "/" after sleeping for ?d= (default 100ms), so
+// you can push the server into overload with a load generator:
+//
+//	hey -z 30s -c 200 'http://localhost:8080/slow?d=200ms'
+func slowHandler(w http.ResponseWriter, r *http.Request) {
+	d := 100 * time.Millisecond
+	if v := r.URL.Query().Get("d"); v != "" {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil || d < 0 || d > time.Minute {
+			http.Error(w, "d must be a duration up to 1m", http.StatusBadRequest)
+			return
+		}
+	}
+	// the server's write deadline started with the request; the sleep is
+	// on purpose, so don't let it use up the time there is to answer
+	if writeTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + writeTimeout))
+	}
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+		return
+	}
+	jsonHandler(w, r)
+}
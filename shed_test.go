@@ -0,0 +1,215 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withLoad installs a shedder for the length of the test.
+func withLoad(t *testing.T, mode string, limit int) *shedder {
+	t.Helper()
+	s, err := newShedder(mode, limit, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := load
+	load = s
+	t.Cleanup(func() { load = old })
+	return s
+}
+
+func TestShedLoad(t *testing.T) {
+	s := withLoad(t, "fixed", 1)
+	started, finish := make(chan struct{}), make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/work", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+	})
+	mux.HandleFunc("/healthz", healthzHandler)
+	ts := httptest.NewServer(shedLoad(mux))
+	defer ts.Close()
+
+	done := make(chan *http.Response)
+	go func() {
+		resp, err := http.Get(ts.URL + "/work")
+		if err != nil {
+			t.Error(err)
+		}
+		done <- resp
+	}()
+	<-started
+
+	// the one slot is taken: the next request is shed straight away
+	resp, err := http.Get(ts.URL + "/work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("second request: %s, want 503", resp.Status)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+
+	// probes never are
+	resp, err = http.Get(ts.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz while full: %s, want 200", resp.Status)
+	}
+
+	close(finish)
+	if resp := <-done; resp != nil && resp.StatusCode != http.StatusOK {
+		t.Errorf("first request: %s, want 200", resp.Status)
+	}
+	if st := s.stats(time.Now()); st.Shed != 1 || st.InFlight != 0 {
+		t.Errorf("stats = %+v, want 1 shed and none in flight", st)
+	}
+}
+
+func TestShedderOverloaded(t *testing.T) {
+	s := withLoad(t, "fixed", 1)
+	t0 := time.Now()
+	if !s.acquire(t0) {
+		t.Fatal("first acquire shed")
+	}
+	s.acquire(t0)
+	if s.overloaded(t0.Add(unreadyAfter / 2)) {
+		t.Error("overloaded after shedding for half of -unready-after")
+	}
+	// still shedding a whole -unready-after later
+	s.acquire(t0.Add(unreadyAfter))
+	if !s.overloaded(t0.Add(unreadyAfter)) {
+		t.Error("not overloaded after shedding for -unready-after")
+	}
+	if st := s.stats(t0.Add(unreadyAfter)); st.Ready {
+		t.Error("/readyz says ready while overloaded")
+	}
+	// a quiet spell as long as -unready-after clears it
+	if s.overloaded(t0.Add(3 * unreadyAfter)) {
+		t.Error("still overloaded after shedding stopped")
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	h := limitBody(10, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			var tooBig *http.MaxBytesError
+			if errors.As(err, &tooBig) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	tests := []struct {
+		name string
+		body io.Reader
+		want int
+	}{
+		{"small", strings.NewReader("hello"), http.StatusOK},
+		// Content-Length says too much: refused before reading
+		{"oversized", strings.NewReader(strings.Repeat("x", 100)), http.StatusRequestEntityTooLarge},
+		// chunked, so only reading finds out
+		{"oversized chunked", io.MultiReader(strings.NewReader(strings.Repeat("x", 100))), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.Post(ts.URL, "text/plain", tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("%s, want %d", resp.Status, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitBodyNoBody(t *testing.T) {
+	ts := httptest.NewServer(limitBody(noBody, http.HandlerFunc(healthzHandler)))
+	defer ts.Close()
+	resp, err := http.Post(ts.URL, "text/plain", strings.NewReader("unexpected"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("body on a GET-only route: %s, want 413", resp.Status)
+	}
+}
+
+func TestSlowHandler(t *testing.T) {
+	old := writeTimeout
+	writeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = old })
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(slowHandler))
+	ts.Config.WriteTimeout = writeTimeout
+	ts.Start()
+	defer ts.Close()
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", http.StatusOK},
+		// sleeping past the write timeout still gets an answer
+		{"?d=400ms", http.StatusOK},
+		{"?d=2m", http.StatusBadRequest},
+		{"?d=-1s", http.StatusBadRequest},
+		{"?d=soon", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			resp, err := http.Get(ts.URL + "/slow" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("%s, want %d", resp.Status, tt.want)
+			}
+			if tt.want == http.StatusOK && !strings.Contains(string(body), `"hostname"`) {
+				t.Errorf("body %q isn't a Response", body)
+			}
+		})
+	}
+}
+
+// A client that stops reading mustn't hold a slow request's slot forever:
+// the request's context ends when it goes away.
+func TestSlowHandlerClientGone(t *testing.T) {
+	s := withLoad(t, "fixed", 1)
+	ts := httptest.NewServer(shedLoad(http.HandlerFunc(slowHandler)))
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := client.Get(ts.URL + "/slow?d=30s"); err == nil {
+		t.Fatal("want the client to time out")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.stats(time.Now()).InFlight != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot still held after the client left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/montybeatnik/learn-k8s/docker"
+	"github.com/montybeatnik/learn-k8s/kube"
+)
+
+// Topology is a kind cluster as docker and the API server see it together.
+type Topology struct {
+	Networks []TopoNetwork `json:"networks,omitempty"`
+	Nodes    []TopoNode    `json:"nodes"`
+	// Containers are the inspected containers that aren't nodes, such as
+	// the app run with `docker run`.
+	Containers []docker.Container `json:"containers,omitempty"`
+	// Unscheduled pods have no node yet; Elsewhere are on nodes we know
+	// nothing about.
+	Unscheduled []kube.Pod `json:"unscheduled,omitempty"`
+	Elsewhere   []kube.Pod `json:"elsewhere,omitempty"`
+}
+
+// TopoNetwork is a docker network the nodes are attached to.
+type TopoNetwork struct {
+	Name    string       `json:"name"`
+	Subnet  netip.Prefix `json:"subnet"`
+	Gateway string       `json:"gateway,omitempty"`
+}
+
+// TopoNode is one Kubernetes node and the container it runs in.
+type TopoNode struct {
+	Name    string `json:"name"`
+	Cluster string `json:"cluster,omitempty"`
+	Role    string `json:"role,omitempty"`
+	// Registered is false for a kind container with no Node object: -nodes
+	// wasn't given, or the node never joined.
+	Registered bool   `json:"registered"`
+	Ready      bool   `json:"ready"`
+	InternalIP string `json:"internal_ip,omitempty"`
+	PodCIDR    string `json:"pod_cidr,omitempty"`
+
+	Container string               `json:"container,omitempty"`
+	Image     string               `json:"image,omitempty"`
+	Networks  []docker.Network     `json:"networks,omitempty"`
+	Ports     []docker.PortMapping `json:"ports,omitempty"`
+
+	Pods []kube.Pod `json:"pods,omitempty"`
+	// HostNetworkPods share the node's IP (kube-proxy, calico-node, the
+	// control plane); they're only listed with -host-network.
+	HostNetworkPods int `json:"host_network_pods"`
+}
+
+// topologyCmd stitches saved `docker inspect`, `kubectl get nodes -o json`
+// and `kubectl get pods -o json` output into one picture of a kind cluster:
+//
+//	docker inspect $(docker ps -q --filter label=io.x-k8s.kind.cluster) > docker.json
+//	kubectl get nodes -o json > nodes.json
+//	kubectl get pods -A -o json > pods.json
+//	learn-k8s topology -docker docker.json -nodes nodes.json -pods pods.json
+//	learn-k8s topology -docker docker.json -nodes nodes.json -pods pods.json -o dot | dot -Tsvg > kind.svg
+func topologyCmd(args []string) error {
+	fs := flag.NewFlagSet("topology", flag.ExitOnError)
+	dockerFile := fs.String("docker", "", "`docker inspect` output for the node containers")
+	nodesFile := fs.String("nodes", "", "`kubectl get nodes -o json` (or -o wide) output")
+	podsFile := fs.String("pods", "", "`kubectl get pods -A -o json` output")
+	namespace := fs.String("namespace", "", "only show pods in this namespace")
+	hostNetwork := fs.Bool("host-network", false, "also list hostNetwork pods, which share their node's IP")
+	output := fs.String("o", "text", "output format: text, json or dot")
+	fs.Parse(args)
+
+	if *dockerFile == "" && *nodesFile == "" {
+		return fmt.Errorf("need at least one of -docker and -nodes")
+	}
+	var (
+		containers []docker.Container
+		nodes      []kube.Node
+		pods       []kube.Pod
+	)
+	if *dockerFile != "" {
+		in, err := readInput(*dockerFile)
+		if err != nil {
+			return err
+		}
+		if containers, err = docker.ParseInspect(bytes.NewReader(in)); err != nil {
+			return fmt.Errorf("%s: %w", *dockerFile, err)
+		}
+	}
+	if *nodesFile != "" {
+		in, err := readInput(*nodesFile)
+		if err != nil {
+			return err
+		}
+		if nodes, err = kube.ParseNodes(bytes.NewReader(in)); err != nil {
+			return fmt.Errorf("%s: %w", *nodesFile, err)
+		}
+	}
+	if *podsFile != "" {
+		in, err := readInput(*podsFile)
+		if err != nil {
+			return err
+		}
+		if pods, err = kube.ParsePods(bytes.NewReader(in)); err != nil {
+			return fmt.Errorf("%s: %w", *podsFile, err)
+		}
+	}
+	if *namespace != "" {
+		var keep []kube.Pod
+		for _, p := range pods {
+			if p.Namespace == *namespace {
+				keep = append(keep, p)
+			}
+		}
+		pods = keep
+	}
+
+	topo := buildTopology(containers, nodes, pods, *hostNetwork)
+	switch *output {
+	case "text":
+		return printTopology(os.Stdout, topo)
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(topo)
+	case "dot":
+		return writeTopologyDOT(os.Stdout, topo)
+	}
+	return fmt.Errorf("unknown -o %q: want text, json or dot", *output)
+}
+
+// buildTopology matches nodes to containers, by name (kind names the
+// container after the node) and failing that by IP, then files each pod
+// under its node.
+func buildTopology(containers []docker.Container, nodes []kube.Node, pods []kube.Pod, hostNetwork bool) Topology {
+	var topo Topology
+	used := map[string]bool{}
+	byName := map[string]int{}
+	for _, n := range nodes {
+		tn := TopoNode{Name: n.Name, Registered: true, Ready: n.Ready, Role: n.Roles, InternalIP: n.InternalIP, PodCIDR: n.PodCIDR}
+		for _, c := range containers {
+			if used[c.Name] || (c.Name != n.Name && (n.InternalIP == "" || !c.HasIP(n.InternalIP))) {
+				continue
+			}
+			used[c.Name] = true
+			fillFromContainer(&tn, c)
+			break
+		}
+		byName[tn.Name] = len(topo.Nodes)
+		topo.Nodes = append(topo.Nodes, tn)
+	}
+	// kind node containers that no Node matched (no -nodes, or a node that
+	// never joined)
+	for _, c := range containers {
+		if used[c.Name] {
+			continue
+		}
+		if c.KindCluster() == "" {
+			topo.Containers = append(topo.Containers, c)
+			continue
+		}
+		tn := TopoNode{Name: c.Name}
+		fillFromContainer(&tn, c)
+		byName[tn.Name] = len(topo.Nodes)
+		topo.Nodes = append(topo.Nodes, tn)
+	}
+	sort.Slice(topo.Nodes, func(i, j int) bool { return topo.Nodes[i].Name < topo.Nodes[j].Name })
+	for i, n := range topo.Nodes {
+		byName[n.Name] = i
+	}
+
+	for _, p := range pods {
+		i, ok := byName[p.Node]
+		switch {
+		case p.Node == "":
+			topo.Unscheduled = append(topo.Unscheduled, p)
+		case !ok:
+			topo.Elsewhere = append(topo.Elsewhere, p)
+		case p.HostNetwork && !hostNetwork:
+			topo.Nodes[i].HostNetworkPods++
+		default:
+			topo.Nodes[i].Pods = append(topo.Nodes[i].Pods, p)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, n := range topo.Nodes {
+		for _, nw := range n.Networks {
+			if seen[nw.Name] || !nw.IP.IsValid() {
+				continue
+			}
+			seen[nw.Name] = true
+			topo.Networks = append(topo.Networks, TopoNetwork{Name: nw.Name, Subnet: nw.IP.Masked(), Gateway: nw.Gateway})
+		}
+	}
+	return topo
+}
+
+func fillFromContainer(tn *TopoNode, c docker.Container) {
+	tn.Container = c.ID
+	if len(tn.Container) > 12 {
+		tn.Container = tn.Container[:12]
+	}
+	tn.Image, _, _ = strings.Cut(c.Image, "@")
+	tn.Networks, tn.Ports = c.Networks, c.Ports
+	tn.Cluster = c.KindCluster()
+	if tn.Role == "" {
+		tn.Role = c.KindRole()
+	}
+	if tn.InternalIP == "" && len(c.Networks) > 0 {
+		tn.InternalIP = c.Networks[0].IP.Addr().String()
+	}
+}
+
+func printTopology(w io.Writer, topo Topology) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, nw := range topo.Networks {
+		fmt.Fprintf(tw, "docker network %s\t%s\tgateway %s\n", nw.Name, nw.Subnet, nw.Gateway)
+	}
+	for i, n := range topo.Nodes {
+		if i > 0 || len(topo.Networks) > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", n.Name, orDash(n.Role), nodeStatus(n))
+		if n.Container != "" {
+			fmt.Fprintf(tw, "  container\t%s\t%s\n", n.Container, n.Image)
+		}
+		for _, nw := range n.Networks {
+			addrs := nw.IP.String()
+			if nw.IPv6.IsValid() {
+				addrs += ", " + nw.IPv6.String()
+			}
+			fmt.Fprintf(tw, "  network %s\t%s\t%s\n", nw.Name, addrs, nw.MAC)
+		}
+		if n.PodCIDR != "" {
+			fmt.Fprintf(tw, "  podCIDR\t%s\t\n", n.PodCIDR)
+		}
+		for _, p := range n.Ports {
+			fmt.Fprintf(tw, "  port\t%s\t%s\n", p, portHint(p))
+		}
+		for _, p := range n.Pods {
+			fmt.Fprintf(tw, "  pod\t%s/%s\t%s\n", p.Namespace, p.Name, podAddr(p))
+		}
+		if n.HostNetworkPods > 0 {
+			fmt.Fprintf(tw, "  \t+ %d hostNetwork pods on %s\t\n", n.HostNetworkPods, n.InternalIP)
+		}
+	}
+	for _, group := range []struct {
+		title string
+		pods  []kube.Pod
+	}{{"not scheduled", topo.Unscheduled}, {"on unknown nodes", topo.Elsewhere}} {
+		if len(group.pods) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\npods %s\t\t\n", group.title)
+		for _, p := range group.pods {
+			fmt.Fprintf(tw, "  pod\t%s/%s\t%s %s\n", p.Namespace, p.Name, p.Node, podAddr(p))
+		}
+	}
+	if len(topo.Containers) > 0 {
+		fmt.Fprintf(tw, "\nother containers\t\t\n")
+		for _, c := range topo.Containers {
+			var addrs []string
+			for _, nw := range c.Networks {
+				addrs = append(addrs, nw.Name+" "+nw.IP.Addr().String())
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", c.Name, strings.Join(addrs, ", "), c.Image)
+			for _, p := range c.Ports {
+				fmt.Fprintf(tw, "  \tport %s\t\n", p)
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+func nodeStatus(n TopoNode) string {
+	switch {
+	case !n.Registered:
+		return "no Node object " + n.InternalIP
+	case n.Ready:
+		return "Ready " + n.InternalIP
+	}
+	return "NotReady " + n.InternalIP
+}
+
+// portHint explains the well-known ports kind publishes.
+func portHint(p docker.PortMapping) string {
+	switch {
+	case p.ContainerPort == 6443:
+		return "API server (kubectl talks to this)"
+	case p.ContainerPort >= 30000 && p.ContainerPort <= 32767:
+		return fmt.Sprintf("NodePort range: localhost:%d reaches any NodePort Service on %d", p.HostPort, p.ContainerPort)
+	}
+	return ""
+}
+
+func podAddr(p kube.Pod) string {
+	ip := orDash(p.IP())
+	var ports []string
+	for _, cp := range p.Ports {
+		ports = append(ports, fmt.Sprintf("%d/%s", cp.Port, strings.ToLower(cp.Protocol)))
+	}
+	if len(ports) > 0 {
+		ip += " " + strings.Join(ports, ",")
+	}
+	if p.HostNetwork {
+		ip += " (hostNetwork)"
+	}
+	if p.Phase != "" && p.Phase != "Running" {
+		ip += " " + p.Phase
+	}
+	return ip
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// writeTopologyDOT draws the host, the docker network and a box per node
+// holding its pods. Published ports are edges from the host.
+func writeTopologyDOT(w io.Writer, topo Topology) error {
+	var b strings.Builder
+	b.WriteString("digraph topology {\n")
+	b.WriteString("  rankdir=LR;\n")
+	b.WriteString("  node [shape=box, fontname=\"Helvetica\", fontsize=10];\n")
+	b.WriteString("  edge [fontname=\"Helvetica\", fontsize=9];\n")
+	b.WriteString("  host [label=\"your machine\\n(docker host)\", shape=house];\n")
+
+	for _, nw := range topo.Networks {
+		fmt.Fprintf(&b, "  subgraph %s {\n", dotID("cluster_net_"+nw.Name))
+		fmt.Fprintf(&b, "    label=%s;\n    style=dashed;\n", dotID(fmt.Sprintf("docker network %s\n%s", nw.Name, nw.Subnet)))
+		for _, n := range topo.Nodes {
+			if !onNetwork(n, nw.Name) {
+				continue
+			}
+			writeNodeDOT(&b, n, "    ")
+		}
+		b.WriteString("  }\n")
+	}
+	for _, n := range topo.Nodes {
+		if len(n.Networks) == 0 {
+			writeNodeDOT(&b, n, "  ")
+		}
+	}
+	for _, n := range topo.Nodes {
+		for _, p := range n.Ports {
+			fmt.Fprintf(&b, "  host -> %s [label=%s];\n", dotID("node "+n.Name), dotID(p.String()))
+		}
+	}
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeNodeDOT(b *strings.Builder, n TopoNode, indent string) {
+	fmt.Fprintf(b, "%ssubgraph %s {\n", indent, dotID("cluster_node_"+n.Name))
+	fmt.Fprintf(b, "%s  label=%s;\n", indent, dotID(n.Name+"\n"+orDash(n.Role)))
+	fmt.Fprintf(b, "%s  %s [label=%s, shape=component];\n", indent, dotID("node "+n.Name), dotID("eth0 "+n.InternalIP))
+	for _, p := range n.Pods {
+		fmt.Fprintf(b, "%s  %s [label=%s, shape=ellipse];\n", indent, dotID("pod "+p.Namespace+"/"+p.Name), dotID(p.Name+"\n"+podAddr(p)))
+	}
+	if n.HostNetworkPods > 0 {
+		fmt.Fprintf(b, "%s  %s [label=%s, shape=note];\n", indent, dotID("hostnet "+n.Name), dotID(fmt.Sprintf("%d hostNetwork pods", n.HostNetworkPods)))
+	}
+	fmt.Fprintf(b, "%s}\n", indent)
+}
+
+func onNetwork(n TopoNode, name string) bool {
+	for _, nw := range n.Networks {
+		if nw.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// dotID quotes s as a Graphviz ID.
+func dotID(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	return `"` + r.Replace(s) + `"`
+}
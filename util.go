@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// orEmpty turns a nil slice into an empty one, so it encodes as [] rather
+// than null.
+func orEmpty[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
+
+// printCounts prints how many answers each pod gave, by hostname: what the
+// clients show to make load balancing visible.
+func printCounts(w io.Writer, counts map[string]int) {
+	for _, hn := range sortedKeys(counts) {
+		fmt.Fprintf(w, "%-40s %d\n", hn, counts[hn])
+	}
+}